@@ -0,0 +1,85 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"sync"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+type (
+	// _Alias is a topic registered using DB.RegisterAlias and the topic parsed by contract.
+	_Alias struct {
+		topic  []byte
+		parsed map[uint32]*message.Topic // The parsed topics have the contract added.
+	}
+
+	// _Aliases is the alias table of the DB. It is kept in memory only.
+	_Aliases struct {
+		sync.RWMutex
+		m map[uint16]*_Alias
+	}
+)
+
+func newAliases() *_Aliases {
+	return &_Aliases{m: make(map[uint16]*_Alias)}
+}
+
+// topic returns the topic of the alias.
+func (a *_Aliases) topic(alias uint16) ([]byte, bool) {
+	a.RLock()
+	defer a.RUnlock()
+	al, ok := a.m[alias]
+	if !ok {
+		return nil, false
+	}
+	return al.topic, true
+}
+
+// aliasTopic returns the topic of the alias parsed for the contract, and the expiry time set
+// by the ttl option of the topic. The topic is parsed once for the contract.
+func (db *DB) aliasTopic(alias uint16, contract uint32) (*message.Topic, uint32, error) {
+	a := db.internal.aliases
+	a.RLock()
+	al, ok := a.m[alias]
+	var t *message.Topic
+	if ok {
+		t = al.parsed[contract]
+	}
+	a.RUnlock()
+	if !ok {
+		return nil, 0, errAliasNotFound
+	}
+	if t == nil {
+		var err error
+		if t, _, err = db.parseTopic(contract, al.topic); err != nil {
+			return nil, 0, err
+		}
+		t.AddContract(contract)
+		a.Lock()
+		al.parsed[contract] = t
+		a.Unlock()
+	}
+	var expiresAt uint32
+	if ttl, ok := t.TTL(); ok {
+		expiresAt = ttl
+	}
+	// the parsed topic is shared by puts so a copy is returned for the encryption policy to be set.
+	tc := *t
+	return &tc, expiresAt, nil
+}
@@ -0,0 +1,336 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/unit-io/unitdb/fs"
+	"github.com/unit-io/unitdb/message"
+)
+
+// Backup stream is a sequence of frames written after the backup signature. Each frame
+// is a file descriptor and size followed by the file contents. The stream ends with a
+// frame of typeEnd.
+const (
+	backupVersion = 1
+	// incrementalBackupVersion 2 records if messages of the backup are stored with checksums
+	// following the version. Incremental backups of version 1 have messages without checksums.
+	incrementalBackupVersion = 2
+	typeEnd                  = _FileType(0xff)
+
+	backupFrameSize = 11 // file type, file num and file size.
+
+	// backupChecksum is set in the flags of the incremental backup if messages are stored with checksums.
+	backupChecksum = 0x01
+)
+
+var (
+	backupSignature            = [7]byte{'u', 'n', 'i', 't', 'b', 'a', 'k'}
+	incrementalBackupSignature = [7]byte{'u', 'n', 'i', 't', 'i', 'n', 'c'}
+)
+
+// backupFileTypes are files written to the backup in the order these are restored.
+var backupFileTypes = []_FileType{typeInfo, typeTimeWindow, typeIndex, typeData, typeLease, typeFilter}
+
+// backup writes DB files to w. The caller must hold the sync lock so DB files are not
+// written while being copied.
+func (db *DB) backup(w io.Writer) error {
+	hdr := make([]byte, len(backupSignature)+1)
+	copy(hdr, backupSignature[:])
+	hdr[len(backupSignature)] = backupVersion
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	for _, fileType := range backupFileTypes {
+		f, err := db.fs.getFile(_FileDesc{fileType: fileType})
+		if err != nil {
+			return err
+		}
+		stat, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if err := writeBackupFrame(w, f.fd, stat.Size()); err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, io.NewSectionReader(f, 0, stat.Size())); err != nil {
+			return err
+		}
+	}
+	return writeBackupFrame(w, _FileDesc{fileType: typeEnd}, 0)
+}
+
+func writeBackupFrame(w io.Writer, fd _FileDesc, size int64) error {
+	frame := make([]byte, backupFrameSize)
+	frame[0] = byte(fd.fileType)
+	binary.LittleEndian.PutUint16(frame[1:3], uint16(fd.num))
+	binary.LittleEndian.PutUint64(frame[3:11], uint64(size))
+	_, err := w.Write(frame)
+	return err
+}
+
+// Restore reconstructs a DB in the path from a backup stream written by DB.Backup.
+// The path must not contain a DB.
+func Restore(r io.Reader, path string) error {
+	if err := ensureDirs(fs.OS, path); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filePath(path, _FileDesc{fileType: typeInfo})); err == nil {
+		return errBackupTargetExist
+	}
+	hdr := make([]byte, len(backupSignature)+1)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return errBackupCorrupted
+	}
+	if string(hdr[:len(backupSignature)]) != string(backupSignature[:]) || hdr[len(backupSignature)] != backupVersion {
+		return errBackupCorrupted
+	}
+	frame := make([]byte, backupFrameSize)
+	for {
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return errBackupCorrupted
+		}
+		fd := _FileDesc{fileType: _FileType(frame[0]), num: int16(binary.LittleEndian.Uint16(frame[1:3]))}
+		size := int64(binary.LittleEndian.Uint64(frame[3:11]))
+		if fd.fileType == typeEnd {
+			return nil
+		}
+		if !isBackupFileType(fd.fileType) {
+			return errBackupCorrupted
+		}
+		if err := restoreFile(r, filePath(path, fd), size); err != nil {
+			return err
+		}
+	}
+}
+
+func isBackupFileType(fileType _FileType) bool {
+	for _, t := range backupFileTypes {
+		if t == fileType {
+			return true
+		}
+	}
+	return false
+}
+
+func restoreFile(r io.Reader, name string, size int64) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(0666))
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, size))
+	if err == nil && n != size {
+		err = errBackupCorrupted
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// backupSince writes entries with sequence greater than since to w and returns the
+// sequence of the DB at the time of the backup. Each entry is written in the format the
+// entry is put into the mem cache, so the restore replays entries as these are put.
+// The header records if messages are stored with checksums.
+// The caller must hold the sync lock so DB files are not written while being read.
+func (db *DB) backupSince(w io.Writer, since uint64) (uint64, error) {
+	upperSeq := db.seq()
+	hdr := make([]byte, len(incrementalBackupSignature)+18)
+	copy(hdr, incrementalBackupSignature[:])
+	hdr[len(incrementalBackupSignature)] = incrementalBackupVersion
+	if db.internal.dbInfo.checksum == 1 {
+		hdr[len(incrementalBackupSignature)+1] = backupChecksum
+	}
+	binary.LittleEndian.PutUint64(hdr[len(incrementalBackupSignature)+2:], since)
+	binary.LittleEndian.PutUint64(hdr[len(incrementalBackupSignature)+10:], upperSeq)
+	if _, err := w.Write(hdr); err != nil {
+		return 0, err
+	}
+
+	type backupEntry struct {
+		topicHash uint64
+		we        _WinEntry
+	}
+	var entries []backupEntry
+	for _, topic := range db.internal.trie.topics() {
+		for _, we := range db.internal.timeWindow.lookup(db.fs, topic.hash, topic.offset, 0, 0, math.MaxInt32) {
+			if we.seq() > since && we.seq() <= upperSeq {
+				entries = append(entries, backupEntry{topicHash: topic.hash, we: we})
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].we.seq() < entries[j].we.seq()
+	})
+
+	size := make([]byte, 4)
+	for _, be := range entries {
+		e, err := db.readEntry(_Query{seq: be.we.seq()})
+		if err == errMsgIDDeleted {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		raw, err := db.internal.reader.readRaw(e)
+		if err != nil {
+			return 0, err
+		}
+		m := _Entry{seq: e.seq, topicSize: e.topicSize, valueSize: e.valueSize, expiresAt: be.we.expiryTime(), topicHash: be.topicHash}
+		hdr, err := m.MarshalBinary()
+		if err != nil {
+			return 0, err
+		}
+		binary.LittleEndian.PutUint32(size, uint32(len(hdr)+len(raw)))
+		if _, err := w.Write(size); err != nil {
+			return 0, err
+		}
+		if _, err := w.Write(hdr); err != nil {
+			return 0, err
+		}
+		if _, err := w.Write(raw); err != nil {
+			return 0, err
+		}
+	}
+	binary.LittleEndian.PutUint32(size, 0)
+	if _, err := w.Write(size); err != nil {
+		return 0, err
+	}
+	return upperSeq, nil
+}
+
+// restoreIncremental puts entries from an incremental backup into the mem cache the same way
+// entries are put to the DB, and returns the sequence of the DB at the time of the backup.
+// Checksums of messages are added or removed if the backup and the DB differ in storing these.
+func (db *DB) restoreIncremental(r io.Reader) (uint64, error) {
+	hdr := make([]byte, len(incrementalBackupSignature)+1)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, errBackupCorrupted
+	}
+	if string(hdr[:len(incrementalBackupSignature)]) != string(incrementalBackupSignature[:]) {
+		return 0, errBackupCorrupted
+	}
+	var flags byte
+	switch hdr[len(incrementalBackupSignature)] {
+	case backupVersion:
+	case incrementalBackupVersion:
+		hdr = hdr[:1]
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return 0, errBackupCorrupted
+		}
+		flags = hdr[0]
+	default:
+		return 0, errBackupCorrupted
+	}
+	hdr = make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, errBackupCorrupted
+	}
+	upperSeq := binary.LittleEndian.Uint64(hdr[8:])
+	checksum := flags&backupChecksum != 0
+
+	size := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, size); err != nil {
+			return 0, errBackupCorrupted
+		}
+		n := binary.LittleEndian.Uint32(size)
+		if n == 0 {
+			break
+		}
+		if n < entrySize+idSize {
+			return 0, errBackupCorrupted
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return 0, errBackupCorrupted
+		}
+		var m _Entry
+		if err := m.UnmarshalBinary(data[:entrySize]); err != nil {
+			return 0, err
+		}
+		if uint32(len(data)) < entrySize+idSize+uint32(m.topicSize)+m.valueSize {
+			return 0, errBackupCorrupted
+		}
+		if checksum != (db.internal.dbInfo.checksum == 1) {
+			var err error
+			if data, err = convertChecksum(&m, data, checksum); err != nil {
+				return 0, err
+			}
+		}
+		if err := db.replayEntry(m, data); err != nil {
+			return 0, err
+		}
+	}
+	db.advanceSeq(upperSeq)
+	return upperSeq, nil
+}
+
+// convertChecksum removes the checksum of the message of the entry read from a backup if the backup
+// stores checksums, or adds the checksum otherwise. It returns the entry with the value size updated.
+func convertChecksum(m *_Entry, data []byte, checksum bool) ([]byte, error) {
+	end := entrySize + idSize + uint32(m.topicSize) + m.valueSize
+	data = data[:end]
+	if checksum {
+		if m.valueSize < checksumSize || !validChecksum(data[entrySize:]) {
+			return nil, errBackupCorrupted
+		}
+		data = data[:end-checksumSize]
+		m.valueSize -= checksumSize
+	} else {
+		data = append(data, make([]byte, checksumSize)...)
+		m.valueSize += checksumSize
+		putChecksum(data[entrySize:])
+	}
+	entryData, err := m.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	copy(data, entryData)
+	return data, nil
+}
+
+// replayEntry puts the entry from a backup into the mem cache, time window and trie. Entries that
+// exist in the DB are skipped.
+func (db *DB) replayEntry(m _Entry, data []byte) error {
+	if ok, err := db.has(m.seq, binary.LittleEndian.Uint32(data[entrySize+4:entrySize+8])); err != nil || ok {
+		return err
+	}
+	timeID, err := db.internal.mem.Put(m.seq, data)
+	if err != nil {
+		return err
+	}
+	if ok := db.internal.timeWindow.add(timeID, m.topicHash, newWinEntry(m.seq, m.expiresAt)); !ok {
+		return errForbidden
+	}
+	if m.topicSize != 0 {
+		t := new(message.Topic)
+		t.Unmarshal(data[entrySize+idSize : entrySize+idSize+uint32(m.topicSize)])
+		db.internal.trie.initEncryption(m.topicHash, t.Encryption)
+		db.internal.trie.add(newTopic(m.topicHash, 0), t.Parts, t.Depth, t.Topic)
+	}
+	db.internal.meter.Puts.Inc(1)
+	return nil
+}
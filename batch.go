@@ -17,8 +17,10 @@
 package unitdb
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
+	"sync/atomic"
 
 	"github.com/unit-io/bpool"
 	"github.com/unit-io/unitdb/memdb"
@@ -47,9 +49,16 @@ type (
 		opts    *_Options
 		managed bool
 
+		// ctx is set by BatchContext; puts and writes fail once it is done.
+		ctx context.Context
+
 		index  []_BatchIndex
 		buffer *bpool.Buffer
 		size   int64
+		// reserved are sequences set using Entry.WithSeq, released once the batch is written or aborted.
+		reserved []uint64
+		// truncates is the number of times the DB was truncated when the batch was started.
+		truncates uint64
 
 		// commitComplete is used to signal if batch commit is complete and batch is fully written to DB.
 		commitComplete chan struct{}
@@ -68,20 +77,22 @@ func (b *Batch) Put(topic, payload []byte) error {
 // It is safe to modify the contents of the argument after Put returns but not
 // before.
 func (b *Batch) PutEntry(e *Entry) error {
-	switch {
-	case len(e.Topic) == 0:
-		return errTopicEmpty
-	case len(e.Topic) > maxTopicLength:
-		return errTopicTooLarge
-	case len(e.Payload) == 0:
-		return errValueEmpty
-	case len(e.Payload) > maxValueLength:
-		return errValueTooLarge
+	if err := b.canceled(); err != nil {
+		return err
+	}
+	if err := b.db.validateEntry(e); err != nil {
+		return err
 	}
 	e.Encryption = e.Encryption || b.opts.batchOptions.encryption
+	if e.compression == CompressionDefault {
+		e.compression = b.opts.batchOptions.compression
+	}
 	if err := b.db.setEntry(e); err != nil {
 		return err
 	}
+	if e.entry.reserved {
+		b.reserved = append(b.reserved, e.entry.seq)
+	}
 
 	var scratch [4]byte
 	binary.LittleEndian.PutUint32(scratch[0:4], uint32(len(e.entry.cache)+4))
@@ -112,6 +123,9 @@ func (b *Batch) Delete(id, topic []byte) error {
 // It is safe to modify the contents of the argument after Delete returns but
 // not before.
 func (b *Batch) DeleteEntry(e *Entry) error {
+	if err := b.canceled(); err != nil {
+		return err
+	}
 	switch {
 	case b.db.opts.flags.immutable:
 		return errImmutable
@@ -192,12 +206,32 @@ func (b *Batch) writeInternal(fn func(i int, e _Entry, data []byte) error) error
 
 // Write starts writing entries into DB. It returns an error if batch write fails.
 func (b *Batch) Write() error {
+	b.db.internal.truncate.RLock()
+	defer b.db.internal.truncate.RUnlock()
+	return b.write()
+}
+
+// write writes entries into DB. Sequences of the entries are taken before the batch is written,
+// so the batch is not written if the DB was truncated since the batch was started. The caller
+// must hold the truncate lock.
+func (b *Batch) write() error {
+	if atomic.LoadUint64(&b.db.internal.truncates) != b.truncates {
+		return errBatchTruncated
+	}
 	if b.len() == 0 {
 		return nil
 	}
+	if err := b.canceled(); err != nil {
+		return err
+	}
+	if err := b.db.waitLog(); err != nil {
+		return err
+	}
 
 	topics := make(map[uint64]*message.Topic)
 	timeID := b.mem.TimeID()
+	var written []_Entry
+	var contracts []uint32
 
 	b.writeInternal(func(i int, e _Entry, data []byte) error {
 		if e.topicSize != 0 {
@@ -208,7 +242,7 @@ func (b *Batch) Write() error {
 				t.Unmarshal(rawTopic)
 				topics[e.topicHash] = t
 			}
-			b.db.internal.trie.add(newTopic(e.topicHash, 0), t.Parts, t.Depth)
+			b.db.internal.trie.add(newTopic(e.topicHash, 0), t.Parts, t.Depth, t.Topic)
 		}
 		if err := b.mem.Put(e.seq, data); err != nil {
 			return err
@@ -216,10 +250,17 @@ func (b *Batch) Write() error {
 		if ok := b.db.internal.timeWindow.add(timeID, e.topicHash, newWinEntry(e.seq, e.expiresAt)); !ok {
 			return errForbidden
 		}
+		written = append(written, e)
+		// the contract is the prefix of the message ID following the epoch.
+		contracts = append(contracts, binary.LittleEndian.Uint32(data[entrySize+4:entrySize+8]))
 		return nil
 	})
 
 	b.mem.Write()
+	for i, w := range written {
+		b.db.retain(w.topicHash, contracts[i], w.seq, w.valueSize)
+		b.db.notify(w.topicHash, w.seq, w.expiresAt)
+	}
 	b.reset()
 
 	return nil
@@ -237,23 +278,42 @@ func (b *Batch) Commit() error {
 		b.Abort()
 	}()
 
+	// Entries written are committed before the DB can be truncated.
+	b.db.internal.truncate.RLock()
 	// Write if any pending entries in batch.
-	if err := b.Write(); err != nil {
+	if err := b.write(); err != nil {
+		b.db.internal.truncate.RUnlock()
 		return err
 	}
 
 	// Commit batch to database.
-	if err := b.mem.Commit(); err != nil {
+	err := b.mem.Commit()
+	b.db.internal.truncate.RUnlock()
+	if err != nil {
 		return err
 	}
 
+	if b.opts.batchOptions.sync {
+		return b.db.Sync()
+	}
+
 	return nil
 }
 
+// canceled returns the context error if the batch context is done.
+func (b *Batch) canceled() error {
+	if b.ctx == nil {
+		return nil
+	}
+	return b.ctx.Err()
+}
+
 func (b *Batch) reset() {
 	b.index = b.index[:0]
 	b.size = 0
 	b.buffer.Reset()
+	b.db.internal.reserved.release(b.reserved...)
+	b.reserved = b.reserved[:0]
 }
 
 //Abort abort is a batch cleanup operation on batch complete.
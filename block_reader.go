@@ -16,15 +16,26 @@
 
 package unitdb
 
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// checksumSize is the size of the checksum stored after the value of each message of a DB created with checksums.
+const checksumSize = 4
+
 type _BlockReader struct {
 	indexBlock          _IndexBlock
 	fs                  *_FileSet
 	indexFile, dataFile *_File
 	offset              int64
+
+	// checksum is set if messages are stored with a checksum, and verify if the checksum is verified on read.
+	checksum, verify bool
 }
 
-func newBlockReader(fs *_FileSet) *_BlockReader {
-	r := &_BlockReader{fs: fs}
+func newBlockReader(fs *_FileSet, checksum, verify bool) *_BlockReader {
+	r := &_BlockReader{fs: fs, checksum: checksum, verify: checksum && verify}
 
 	indexFile, err := fs.getFile(_FileDesc{fileType: typeIndex})
 	if err != nil {
@@ -78,20 +89,100 @@ func (r *_BlockReader) readEntry(seq uint64) (_IndexEntry, error) {
 	return b.entries[entryIdx], nil
 }
 
-func (r *_BlockReader) readMessage(e _IndexEntry) ([]byte, []byte, error) {
-	if e.cache != nil {
-		return e.cache[:idSize], e.cache[e.topicSize+idSize:], nil
+// readMessage reads the message ID and value of the entry. A message that is not cached is read
+// into the buffer if the buffer is not nil.
+func (r *_BlockReader) readMessage(e _IndexEntry, buf *_DecodeBuffer) ([]byte, []byte, error) {
+	var message []byte
+	var err error
+	if buf != nil {
+		message, err = r.readRawInto(e, buf)
+	} else {
+		message, err = r.readRaw(e)
 	}
-	message, err := r.dataFile.slice(e.msgOffset, e.msgOffset+int64(e.mSize()))
 	if err != nil {
 		return nil, nil, err
 	}
+	if r.checksum {
+		if message, err = r.trimChecksum(e, message); err != nil {
+			return nil, nil, err
+		}
+	}
 	return message[:idSize], message[e.topicSize+idSize:], nil
 }
 
+// trimChecksum verifies the checksum of the message read for the entry if checksums are verified,
+// and returns the message without the checksum.
+func (r *_BlockReader) trimChecksum(e _IndexEntry, message []byte) ([]byte, error) {
+	n := len(message) - checksumSize
+	if n < idSize+int(e.topicSize) {
+		return nil, errCorrupted
+	}
+	if r.verify && !validChecksum(message) {
+		return nil, errCorrupted
+	}
+	return message[:n], nil
+}
+
+// readRaw reads the message ID, topic and value of the entry as these are stored.
+func (r *_BlockReader) readRaw(e _IndexEntry) ([]byte, error) {
+	if e.cache != nil {
+		return e.cache[:e.mSize()], nil
+	}
+	return r.dataFile.slice(e.msgOffset, e.msgOffset+int64(e.mSize()))
+}
+
+// readRawInto reads the message ID, topic and value of the entry into the buffer, growing the buffer if needed.
+func (r *_BlockReader) readRawInto(e _IndexEntry, buf *_DecodeBuffer) ([]byte, error) {
+	if e.cache != nil {
+		return e.cache[:e.mSize()], nil
+	}
+	n := int(e.mSize())
+	if cap(buf.raw) < n {
+		buf.raw = make([]byte, n)
+	}
+	buf.raw = buf.raw[:n]
+	if _, err := r.dataFile.ReadAt(buf.raw, e.msgOffset); err != nil {
+		return nil, err
+	}
+	return buf.raw, nil
+}
+
+// readID reads the message ID prefix of the entry without reading the topic or value.
+func (r *_BlockReader) readID(e _IndexEntry) ([]byte, error) {
+	if e.cache != nil {
+		return e.cache[:idSize], nil
+	}
+	return r.dataFile.slice(e.msgOffset, e.msgOffset+int64(idSize))
+}
+
 func (r *_BlockReader) readTopic(e _IndexEntry) ([]byte, error) {
+	if r.verify {
+		message, err := r.readRaw(e)
+		if err != nil {
+			return nil, err
+		}
+		if message, err = r.trimChecksum(e, message); err != nil {
+			return nil, err
+		}
+		return message[idSize : e.topicSize+idSize], nil
+	}
 	if e.cache != nil {
 		return e.cache[idSize : e.topicSize+idSize], nil
 	}
 	return r.dataFile.slice(e.msgOffset+int64(idSize), e.msgOffset+int64(e.topicSize)+int64(idSize))
 }
+
+// putChecksum writes the checksum of the message ID, topic and value into the last bytes of the message.
+func putChecksum(message []byte) {
+	n := len(message) - checksumSize
+	binary.LittleEndian.PutUint32(message[n:], crc32.ChecksumIEEE(message[:n]))
+}
+
+// validChecksum reports whether the checksum in the last bytes of the message matches the message ID, topic and value.
+func validChecksum(message []byte) bool {
+	n := len(message) - checksumSize
+	if n < 0 {
+		return false
+	}
+	return binary.LittleEndian.Uint32(message[n:]) == crc32.ChecksumIEEE(message[:n])
+}
@@ -18,6 +18,7 @@ package unitdb
 
 import (
 	"fmt"
+	"io"
 	"sort"
 
 	"github.com/unit-io/bpool"
@@ -102,9 +103,14 @@ func (w *_BlockWriter) del(seq uint64) (_IndexEntry, error) {
 		return delEntry, nil // no entry in db to delete
 	}
 	delEntry = b.entries[entryIdx]
-	delEntry.msgOffset = -1
-	b.entries[entryIdx] = delEntry
-	b.dirty = true
+	if delEntry.msgOffset == -1 {
+		return _IndexEntry{}, nil // entry is already deleted
+	}
+	b.entries[entryIdx].msgOffset = -1
+	// Write index block so the entry is deleted from the index file.
+	if _, err := w.indexFile.WriteAt(b.marshalBinary(), blockOffset(bIdx)); err != nil {
+		return _IndexEntry{}, err
+	}
 	// b.entryIdx--
 
 	// i := entryIdx
@@ -117,33 +123,35 @@ func (w *_BlockWriter) del(seq uint64) (_IndexEntry, error) {
 	return delEntry, nil
 }
 
-func (w *_BlockWriter) append(e _IndexEntry) (err error) {
-	var b _IndexBlock
-	var ok bool
-	if e.seq == 0 {
+// indexBlock returns the index block the entry of the sequence is appended to.
+func (w *_BlockWriter) indexBlock(seq uint64) (b _IndexBlock, bIdx int32, err error) {
+	if seq == 0 {
 		panic("unable to append zero sequence")
 	}
-	bIdx := blockIndex(e.seq)
-	b, ok = w.indexBlocks[bIdx]
+	bIdx = blockIndex(seq)
+	b, ok := w.indexBlocks[bIdx]
 	if !ok {
 		if bIdx < w.blockIdx {
 			r := _BlockReader{indexFile: w.indexFile, offset: blockOffset(bIdx)}
 			b, err = r.readIndexBlock()
 			if err != nil {
-				return err
+				return b, bIdx, err
 			}
 			b.leased = true
 		}
 	}
-	entryIdx := 0
 	for i := 0; i < int(b.entryIdx); i++ {
-		if b.entries[i].seq == e.seq { //record exist in db
-			entryIdx = -1
-			break
+		if b.entries[i].seq == seq { //record exist in db
+			return b, bIdx, errEntryExist
 		}
 	}
-	if entryIdx == -1 {
-		return errEntryExist
+	return b, bIdx, nil
+}
+
+func (w *_BlockWriter) append(e _IndexEntry) (err error) {
+	b, bIdx, err := w.indexBlock(e.seq)
+	if err != nil {
+		return err
 	}
 
 	if len(e.cache) == 0 {
@@ -153,12 +161,13 @@ func (w *_BlockWriter) append(e _IndexEntry) (err error) {
 	dataLen := len(e.cache)
 	off := w.lease.allocate(uint32(dataLen))
 	if off != -1 {
+		// The lease is freed on abort even if the write fails.
+		w.dataLeases[off] = uint32(dataLen)
 		buf := make([]byte, dataLen)
 		copy(buf, e.cache)
 		if _, err = w.dataFile.WriteAt(buf, off); err != nil {
 			return err
 		}
-		w.dataLeases[off] = uint32(dataLen)
 	} else {
 		off = w.offset
 		offset, err := w.buffer.Extend(int64(dataLen))
@@ -172,6 +181,56 @@ func (w *_BlockWriter) append(e _IndexEntry) (err error) {
 	}
 	e.msgOffset = off
 
+	return w.appendIndex(b, bIdx, e)
+}
+
+// appendFrom appends the entry reading its message from r into the data file in chunks, so a
+// large message is not buffered in memory. The message is written past the buffered entries
+// so these are written to the data file first.
+func (w *_BlockWriter) appendFrom(e _IndexEntry, r io.Reader) error {
+	b, bIdx, err := w.indexBlock(e.seq)
+	if err != nil {
+		return err
+	}
+
+	dataLen := e.mSize()
+	off := w.lease.allocate(dataLen)
+	if off != -1 {
+		w.dataLeases[off] = dataLen
+	} else {
+		if _, err := w.dataFile.write(w.buffer.Bytes()); err != nil {
+			return err
+		}
+		w.buffer.Reset()
+		if off, err = w.dataFile.extend(dataLen); err != nil {
+			return err
+		}
+		w.offset = off + int64(dataLen)
+	}
+	buf := make([]byte, streamChunkSize)
+	for n := int64(0); n < int64(dataLen); {
+		chunk := buf
+		if rem := int64(dataLen) - n; rem < int64(len(chunk)) {
+			chunk = chunk[:rem]
+		}
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if _, err := w.dataFile.WriteAt(chunk, off+n); err != nil {
+			return err
+		}
+		n += int64(len(chunk))
+	}
+	e.msgOffset = off
+
+	return w.appendIndex(b, bIdx, e)
+}
+
+// appendIndex appends the entry written to the data file to the index block.
+func (w *_BlockWriter) appendIndex(b _IndexBlock, bIdx int32, e _IndexEntry) error {
 	if b.leased {
 		w.indexLeases[e.seq] = struct{}{}
 	}
@@ -301,17 +360,43 @@ func (w *_BlockWriter) rollback() error {
 		w.lease.freeBlock(off, size)
 	}
 
-	// roll back index leases
+	// roll back index leases, removing the entries appended to the index blocks written before
+	// so the entries are appended again on retry.
+	blocks := make(map[int32]struct{})
 	for seq := range w.indexLeases {
-		if _, err := w.del(seq); err != nil {
+		blocks[blockIndex(seq)] = struct{}{}
+	}
+	for bIdx := range blocks {
+		r := _BlockReader{indexFile: w.indexFile, offset: blockOffset(bIdx)}
+		b, err := r.readIndexBlock()
+		if err != nil {
+			return err
+		}
+		n := 0
+		for i := 0; i < int(b.entryIdx); i++ {
+			if _, ok := w.indexLeases[b.entries[i].seq]; ok {
+				continue
+			}
+			b.entries[n] = b.entries[i]
+			n++
+		}
+		for i := n; i < int(b.entryIdx); i++ {
+			b.entries[i] = _IndexEntry{}
+		}
+		b.entryIdx = uint16(n)
+		if _, err := w.indexFile.WriteAt(b.marshalBinary(), blockOffset(bIdx)); err != nil {
 			return err
 		}
+		delete(w.indexBlocks, bIdx)
 	}
 	return nil
 }
 
 func (w *_BlockWriter) reset() error {
 	w.buffer.Reset()
+	// Leases of the written entries are no longer rolled back.
+	w.indexLeases = make(map[uint64]struct{})
+	w.dataLeases = make(map[int64]uint32)
 
 	w.indexOffset = w.indexFile.currSize()
 	w.blockIdx = int32(w.indexOffset / int64(blockSize))
@@ -0,0 +1,280 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+const (
+	// streamChunkSize is the size of the chunks a payload read from a reader is written in.
+	streamChunkSize = 64 << 10
+	// bulkLoadCount is the number of messages BulkLoad writes to the DB files at a time.
+	bulkLoadCount = 1 << 16
+	// bulkLoadSize is the size of the data BulkLoad buffers before it is written to the DB files.
+	bulkLoadSize = 64 << 20
+)
+
+// _LoadedEntry is an entry of the chunk BulkLoad is writing. The entry is retained and
+// subscribers are notified once the chunk is written.
+type _LoadedEntry struct {
+	topicHash uint64
+	contract  uint32
+	seq       uint64
+	valueSize uint32
+	expiresAt uint32
+}
+
+// messageReader returns the reader of the message of the entry put using DB.PutReader. The
+// message holds the message ID and topic packed by setEntry followed by the payload read from
+// the reader of the entry, and the checksum of these if the DB is written with checksums.
+func (db *DB) messageReader(e *Entry) io.Reader {
+	r := io.MultiReader(bytes.NewReader(e.entry.cache[entrySize:]), io.LimitReader(e.reader, e.readerSize))
+	if db.internal.dbInfo.checksum != 1 {
+		return r
+	}
+	h := crc32.NewIEEE()
+	return io.MultiReader(io.TeeReader(r, h), &_ChecksumReader{h: h})
+}
+
+// _ChecksumReader reads the checksum of the data written to the hash once the data has been read.
+type _ChecksumReader struct {
+	h   hash.Hash32
+	buf []byte
+}
+
+func (r *_ChecksumReader) Read(p []byte) (int, error) {
+	if r.buf == nil {
+		r.buf = make([]byte, checksumSize)
+		binary.LittleEndian.PutUint32(r.buf, r.h.Sum32())
+	}
+	if len(r.buf) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// bulkLoad writes entries received from the channel to the window, index and data files in chunks
+// without writing them to the mem DB and the write ahead log. The DB info is written once all entries
+// are written. The caller must hold the sync lock.
+func (db *DB) bulkLoad(entries <-chan *Entry) error {
+	// Entries put before the load are synced first, so the first window block of a topic holds
+	// the entry the topic is packed with, as the trie is loaded from it on open.
+	if db.internal.syncHandle.startSync() {
+		err := db.internal.syncHandle.Sync()
+		db.internal.syncHandle.finish()
+		if err != nil {
+			return err
+		}
+	}
+
+	rawWindow := db.internal.bufPool.Get()
+	rawBlock := db.internal.bufPool.Get()
+	defer func() {
+		db.internal.bufPool.Put(rawWindow)
+		db.internal.bufPool.Put(rawBlock)
+	}()
+
+	var windowWriter *_WindowWriter
+	var blockWriter *_BlockWriter
+	var upperSeq uint64
+	var inBytes int64
+	var loaded []_LoadedEntry
+	var newTopics []uint64
+	// reserved are sequences set using Entry.WithSeq, released once the load returns.
+	var reserved []uint64
+	defer func() {
+		db.internal.reserved.release(reserved...)
+	}()
+	winEntries := make(map[uint64]_WindowEntries)
+	topicOffs := make(map[uint64]int64)
+
+	// abort rolls back the chunk of entries appended to the writers, the topics it added
+	// to the trie and the sequences it took, so the entries can be loaded again.
+	abort := func() {
+		windowWriter.abort()
+		blockWriter.abort()
+		for h, off := range topicOffs {
+			db.internal.trie.setOffset(_Topic{hash: h, offset: off})
+		}
+		for _, h := range newTopics {
+			db.internal.trie.remove(h)
+		}
+		seqs := make(map[uint64]struct{}, len(loaded))
+		for _, e := range loaded {
+			seqs[e.seq] = struct{}{}
+		}
+		for seq := upperSeq; ; seq-- {
+			if _, ok := seqs[seq]; !ok || !db.releaseSeq(seq) {
+				break
+			}
+		}
+	}
+
+	// write writes the chunk of entries appended to the writers, and rolls it back on error.
+	write := func() (err error) {
+		if upperSeq == 0 {
+			return nil
+		}
+		defer func() {
+			if err != nil {
+				abort()
+			}
+			windowWriter, blockWriter = nil, nil
+			upperSeq, inBytes = 0, 0
+			loaded, newTopics = nil, nil
+			winEntries = make(map[uint64]_WindowEntries)
+			topicOffs = make(map[uint64]int64)
+		}()
+		if _, err := blockWriter.extend(upperSeq); err != nil {
+			return err
+		}
+		for h, wEntries := range winEntries {
+			topicOff, ok := db.internal.trie.getOffset(h)
+			if !ok {
+				return errors.New("db.BulkLoad: unable to get topic offset from trie")
+			}
+			wOff, err := windowWriter.append(h, topicOff, wEntries)
+			if err != nil {
+				return err
+			}
+			if ok := db.internal.trie.setOffset(_Topic{hash: h, offset: wOff}); !ok {
+				return errors.New("db.BulkLoad: unable to set topic offset in trie")
+			}
+			topicOffs[h] = topicOff
+		}
+		if err := windowWriter.write(); err != nil {
+			return err
+		}
+		if err := blockWriter.write(); err != nil {
+			return err
+		}
+		for _, e := range loaded {
+			db.internal.filter.Append(e.seq)
+			db.retain(e.topicHash, e.contract, e.seq, e.valueSize)
+			db.notify(e.topicHash, e.seq, e.expiresAt)
+		}
+		count := int64(len(loaded))
+		db.incount(uint64(count))
+		db.internal.meter.Puts.Inc(count)
+		db.internal.meter.InMsgs.Inc(count)
+		db.internal.meter.InBytes.Inc(inBytes)
+		return nil
+	}
+
+	// load appends the entry to the writers of the current chunk.
+	load := func(e *Entry) (err error) {
+		if windowWriter == nil {
+			rawWindow.Reset()
+			rawBlock.Reset()
+			if windowWriter, err = newWindowWriter(db.fs, rawWindow); err != nil {
+				return err
+			}
+			if blockWriter, err = newBlockWriter(db.fs, db.internal.freeList, rawBlock); err != nil {
+				return err
+			}
+		}
+		if err := db.validateEntry(e); err != nil {
+			return err
+		}
+		if err := db.setEntry(e); err != nil {
+			return err
+		}
+		if e.entry.reserved {
+			reserved = append(reserved, e.entry.seq)
+		}
+		mu := db.internal.writeMutex.getMutex(e.entry.topicHash)
+		mu.RLock()
+		defer mu.RUnlock()
+		ie := _IndexEntry{
+			seq:       e.entry.seq,
+			topicSize: e.entry.topicSize,
+			valueSize: e.entry.valueSize,
+
+			cache: e.entry.cache[entrySize:],
+		}
+		if e.reader != nil {
+			err = blockWriter.appendFrom(ie, db.messageReader(e))
+		} else {
+			err = blockWriter.append(ie)
+		}
+		if err != nil {
+			if e.ID == nil && e.seq == 0 {
+				db.releaseSeq(e.entry.seq)
+			}
+			return err
+		}
+		if e.entry.topicSize != 0 {
+			t := new(message.Topic)
+			t.Unmarshal(e.entry.cache[entrySize+idSize : entrySize+idSize+e.entry.topicSize])
+			if db.internal.trie.add(newTopic(e.entry.topicHash, 0), t.Parts, t.Depth, t.Topic) {
+				newTopics = append(newTopics, e.entry.topicHash)
+			}
+		}
+		winEntries[e.entry.topicHash] = append(winEntries[e.entry.topicHash], newWinEntry(e.entry.seq, e.entry.expiresAt))
+		loaded = append(loaded, _LoadedEntry{topicHash: e.entry.topicHash, contract: e.Contract, seq: e.entry.seq, valueSize: e.entry.valueSize, expiresAt: e.entry.expiresAt})
+		if e.entry.seq > upperSeq {
+			upperSeq = e.entry.seq
+		}
+		inBytes += int64(e.entry.valueSize)
+
+		// the packed entry is copied by the block writer.
+		e.reset()
+		return nil
+	}
+
+	var err error
+loop:
+	for {
+		select {
+		case <-db.internal.closeC:
+			err = errClosed
+			break loop
+		case e, ok := <-entries:
+			if !ok {
+				break loop
+			}
+			if err = load(e); err != nil {
+				break loop
+			}
+			if len(loaded) >= bulkLoadCount || rawBlock.Size() >= bulkLoadSize {
+				if err = write(); err != nil {
+					break loop
+				}
+			}
+		}
+	}
+	if err == nil {
+		err = write()
+	} else if windowWriter != nil {
+		abort()
+	}
+	// Chunks written before an error are kept, so the DB info is written in either case.
+	if err := db.sync(); err != nil {
+		return err
+	}
+	return err
+}
@@ -0,0 +1,307 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"os"
+	"path"
+	"sort"
+	"sync/atomic"
+
+	"github.com/unit-io/unitdb/fs"
+)
+
+// CompactStats provides space reclaimed by DB.Compact.
+type CompactStats struct {
+	// ReclaimedBytes is the reduction in size of the data and window files.
+	ReclaimedBytes int64
+	// DroppedEntries is the number of expired entries dropped from the DB.
+	DroppedEntries int
+}
+
+// compactSuffix is the suffix of the compacted files written by Compact before these replace the DB files.
+const compactSuffix = ".compact"
+
+// compactTypes are the types of the DB files Compact rewrites.
+var compactTypes = []_FileType{typeTimeWindow, typeIndex, typeData}
+
+// compactMarker returns the path of the file marking that the compacted files are written and synced,
+// so these replace the DB files even if Compact is interrupted while the files are renamed.
+func compactMarker(dirName string) string {
+	return path.Join(dirName, prefix+compactSuffix)
+}
+
+// finishCompact replaces the DB files with the compacted files if the compacted files were complete
+// when Compact was interrupted, otherwise the compacted files are removed and the DB files are kept.
+func finishCompact(fsys fs.FileSystem, dirName string) error {
+	_, err := fsys.Stat(compactMarker(dirName))
+	complete := err == nil
+	for _, fileType := range compactTypes {
+		name := filePath(dirName, _FileDesc{fileType: fileType})
+		if _, err := fsys.Stat(name + compactSuffix); err != nil {
+			continue
+		}
+		if !complete {
+			if err := fsys.Remove(name + compactSuffix); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := fsys.Rename(name+compactSuffix, name); err != nil {
+			return err
+		}
+	}
+	if !complete {
+		return nil
+	}
+	return fsys.Remove(compactMarker(dirName))
+}
+
+// createCompactFile creates the file the compacted file of the file type is written to.
+func (db *DB) createCompactFile(fileType _FileType) (*_File, error) {
+	fd := _FileDesc{fileType: fileType}
+	fi, err := db.fs.fsys.OpenFile(filePath(db.fs.path, fd)+compactSuffix, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(0666))
+	if err != nil {
+		return nil, err
+	}
+	return &_File{File: fi, fd: fd}, nil
+}
+
+// compact writes live entries to the start of a new data file dropping free blocks and expired
+// entries, along with the index file of the moved entries and a window file with entries of live
+// messages. The first entry of a topic is kept even if it has expired as the topic is stored along
+// with it. The new files are synced and then renamed over the DB files, so the DB files are left
+// intact if Compact fails. The caller must hold the sync lock.
+func (db *DB) compact() (stats CompactStats, err error) {
+	// Queries read entries without the sync lock so they are held off while the files are replaced.
+	for _, mu := range db.internal.mutex.internal {
+		mu.Lock()
+		defer mu.Unlock()
+	}
+
+	winFile, err := db.fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		return stats, err
+	}
+	indexFile, err := db.fs.getFile(_FileDesc{fileType: typeIndex})
+	if err != nil {
+		return stats, err
+	}
+	dataFile, err := db.fs.getFile(_FileDesc{fileType: typeData})
+	if err != nil {
+		return stats, err
+	}
+	winSize := winFile.currSize()
+	dataSize := dataFile.currSize()
+
+	// Read window entries of all topics.
+	topics := make(map[uint64]_WindowEntries)
+	expired := make(map[uint64]struct{})
+	wr := _WindowReader{winFile: winFile}
+	for wIdx := int32(0); wIdx < int32(winSize/int64(blockSize)); wIdx++ {
+		wr.offset = winBlockOffset(wIdx)
+		b, err := wr.readWindowBlock()
+		if err != nil {
+			return stats, err
+		}
+		for _, we := range b.entries[:b.entryIdx] {
+			if we.sequence == 0 {
+				continue
+			}
+			if we.isExpired() {
+				expired[we.sequence] = struct{}{}
+			}
+			topics[b.topicHash] = append(topics[b.topicHash], we)
+		}
+	}
+
+	// Drop expired entries from index blocks and collect live entries.
+	type _Slot struct {
+		bIdx int32
+		i    int
+	}
+	nBlocks := int32((indexFile.currSize() + int64(blockSize) - 1) / int64(blockSize))
+	blocks := make([]_IndexBlock, nBlocks)
+	live := make(map[uint64]struct{})
+	var slots []_Slot
+	br := _BlockReader{indexFile: indexFile}
+	for bIdx := int32(0); bIdx < nBlocks; bIdx++ {
+		br.offset = blockOffset(bIdx)
+		b, err := br.readIndexBlock()
+		if err != nil {
+			return stats, err
+		}
+		blocks[bIdx] = b
+		for i := 0; i < int(b.entryIdx) && i < entriesPerIndexBlock; i++ {
+			e := b.entries[i]
+			if e.seq == 0 || e.msgOffset == -1 {
+				continue
+			}
+			if _, ok := expired[e.seq]; ok && e.topicSize == 0 {
+				blocks[bIdx].entries[i].msgOffset = -1
+				stats.DroppedEntries++
+				continue
+			}
+			live[e.seq] = struct{}{}
+			slots = append(slots, _Slot{bIdx: bIdx, i: i})
+		}
+	}
+
+	// The compacted files are removed if Compact fails before these are complete. Once complete,
+	// these replace the DB files the next time the DB is opened if Compact fails to rename them.
+	var newFiles []*_File
+	var complete bool
+	defer func() {
+		for _, f := range newFiles {
+			f.Close()
+		}
+		if err != nil && !complete {
+			finishCompact(db.fs.fsys, db.fs.path)
+		}
+	}()
+	newFile := func(fileType _FileType) (*_File, error) {
+		f, err := db.createCompactFile(fileType)
+		if err == nil {
+			newFiles = append(newFiles, f)
+		}
+		return f, err
+	}
+
+	// Write live entries to the new data file in the order of the offsets.
+	newData, err := newFile(typeData)
+	if err != nil {
+		return stats, err
+	}
+	sort.Slice(slots, func(i, j int) bool {
+		return blocks[slots[i].bIdx].entries[slots[i].i].msgOffset < blocks[slots[j].bIdx].entries[slots[j].i].msgOffset
+	})
+	for _, s := range slots {
+		e := &blocks[s.bIdx].entries[s.i]
+		data, err := dataFile.slice(e.msgOffset, e.msgOffset+int64(e.mSize()))
+		if err != nil {
+			return stats, err
+		}
+		e.msgOffset = newData.size
+		if _, err := newData.write(data); err != nil {
+			return stats, err
+		}
+	}
+
+	// Write index blocks with offsets of the moved entries to the new index file.
+	newIndex, err := newFile(typeIndex)
+	if err != nil {
+		return stats, err
+	}
+	for _, b := range blocks {
+		if _, err := newIndex.write(b.marshalBinary()); err != nil {
+			return stats, err
+		}
+	}
+
+	// Write window entries of live messages to the new window file in the order topics were first written.
+	hashes := make([]uint64, 0, len(topics))
+	for h, wEntries := range topics {
+		var n int
+		for _, we := range wEntries {
+			if _, ok := live[we.sequence]; ok {
+				wEntries[n] = we
+				n++
+			}
+		}
+		sort.Slice(wEntries[:n], func(i, j int) bool {
+			return wEntries[i].sequence < wEntries[j].sequence
+		})
+		topics[h] = wEntries[:n]
+		hashes = append(hashes, h)
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		ti, tj := topics[hashes[i]], topics[hashes[j]]
+		if len(ti) == 0 || len(tj) == 0 {
+			return len(ti) > len(tj)
+		}
+		return ti[0].sequence < tj[0].sequence
+	})
+	newWin, err := newFile(typeTimeWindow)
+	if err != nil {
+		return stats, err
+	}
+	buf := db.internal.bufPool.Get()
+	defer db.internal.bufPool.Put(buf)
+	w := &_WindowWriter{windowIdx: -1, winBlocks: make(map[int32]_WinBlock), winLeases: make(map[int32][]uint64), fs: db.fs, buffer: buf, winFile: newWin}
+	offsets := make(map[uint64]int64, len(hashes))
+	for _, h := range hashes {
+		if len(topics[h]) == 0 {
+			offsets[h] = 0
+			continue
+		}
+		if offsets[h], err = w.append(h, 0, topics[h]); err != nil {
+			return stats, err
+		}
+	}
+	if err := w.write(); err != nil {
+		return stats, err
+	}
+
+	for _, f := range newFiles {
+		if err := f.Sync(); err != nil {
+			return stats, err
+		}
+	}
+	// Free blocks of the data file are dropped before the data file is replaced, so a free block
+	// is never reused once the data file is replaced. Space of the free blocks is lost if the DB
+	// files are kept.
+	db.internal.freeList.reset()
+	if err := db.internal.freeList.write(); err != nil {
+		return stats, err
+	}
+	if err := db.fs.sync(); err != nil {
+		return stats, err
+	}
+	marker, err := db.fs.fsys.OpenFile(compactMarker(db.fs.path), os.O_CREATE|os.O_RDWR, os.FileMode(0666))
+	if err != nil {
+		return stats, err
+	}
+	err = marker.Sync()
+	if err1 := marker.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return stats, err
+	}
+	complete = true
+	if err := finishCompact(db.fs.fsys, db.fs.path); err != nil {
+		return stats, err
+	}
+	for _, fileType := range compactTypes {
+		if err := db.fs.reopen(_FileDesc{fileType: fileType}); err != nil {
+			return stats, err
+		}
+	}
+	for h, off := range offsets {
+		db.internal.trie.setOffset(_Topic{hash: h, offset: off})
+	}
+
+	atomic.StoreUint64(&db.internal.dbInfo.count, uint64(len(live)))
+	if err := db.writeInfo(); err != nil {
+		return stats, err
+	}
+	if err := db.fs.sync(); err != nil {
+		return stats, err
+	}
+	stats.ReclaimedBytes = dataSize - dataFile.currSize() + winSize - winFile.currSize()
+	return stats, nil
+}
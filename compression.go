@@ -0,0 +1,165 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the codec used to compress message payloads.
+type Compression uint8
+
+const (
+	// CompressionDefault uses the compression of the DB or the batch, which defaults to snappy.
+	CompressionDefault Compression = iota
+	// CompressionSnappy compresses payloads using snappy.
+	CompressionSnappy
+	// CompressionNone stores payloads uncompressed.
+	CompressionNone
+	// CompressionZstd compresses payloads using zstd.
+	CompressionZstd
+)
+
+// Codec encodes and decodes message payloads.
+type Codec interface {
+	Encode(src []byte) ([]byte, error)
+	Decode(src []byte) ([]byte, error)
+}
+
+var codecs = struct {
+	sync.RWMutex
+	m map[Compression]Codec
+}{m: map[Compression]Codec{
+	CompressionSnappy: snappyCodec{},
+	CompressionNone:   noneCodec{},
+	CompressionZstd:   zstdCodec{},
+}}
+
+// RegisterCodec registers the codec used for the compression. It replaces the codec
+// registered earlier for the compression. Compressions above 8 cannot be stored with
+// messages, puts using them return an error.
+func RegisterCodec(c Compression, codec Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.m[c] = codec
+}
+
+func getCodec(c Compression) (Codec, error) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	codec, ok := codecs.m[c]
+	if !ok {
+		return nil, errCodecNotFound
+	}
+	return codec, nil
+}
+
+// codecID returns id of the compression stored in the low three bits of the high nibble of the
+// encryption key id of the message ID. Snappy has id zero as messages written before codecs were stored use snappy.
+func (c Compression) codecID() uint8 {
+	if c == CompressionDefault {
+		return 0
+	}
+	return uint8(c) - 1
+}
+
+func compressionOf(codecID uint8) Compression {
+	return Compression(codecID + 1)
+}
+
+// maxDecodeBufferSize is the size above which buffers are not put back to the decode pool,
+// so a few large messages do not keep large buffers alive.
+const maxDecodeBufferSize = 1 << 20
+
+// _DecodeBuffer holds scratch space to read a message from the data file and decrypt it before
+// the value is decoded into the payload. sync.Pool keeps buffers per processor, so concurrent
+// reads on different shards do not contend for buffers.
+type _DecodeBuffer struct {
+	raw, plain []byte
+}
+
+func (db *DB) getDecodeBuffer() *_DecodeBuffer {
+	if buf, ok := db.internal.decodePool.Get().(*_DecodeBuffer); ok {
+		return buf
+	}
+	return &_DecodeBuffer{}
+}
+
+func (db *DB) putDecodeBuffer(buf *_DecodeBuffer) {
+	if cap(buf.raw) > maxDecodeBufferSize || cap(buf.plain) > maxDecodeBufferSize {
+		return
+	}
+	db.internal.decodePool.Put(buf)
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) Encode(src []byte) ([]byte, error) {
+	return snappy.Encode(nil, src), nil
+}
+
+func (snappyCodec) Decode(src []byte) ([]byte, error) {
+	return snappy.Decode(nil, src)
+}
+
+// zstd encoder and decoder are created on first use and shared, as EncodeAll and DecodeAll
+// are safe for concurrent use.
+var zstdCoders struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+func zstdInit() error {
+	zstdCoders.once.Do(func() {
+		if zstdCoders.encoder, zstdCoders.err = zstd.NewWriter(nil); zstdCoders.err != nil {
+			return
+		}
+		zstdCoders.decoder, zstdCoders.err = zstd.NewReader(nil)
+	})
+	return zstdCoders.err
+}
+
+type zstdCodec struct{}
+
+func (zstdCodec) Encode(src []byte) ([]byte, error) {
+	if err := zstdInit(); err != nil {
+		return nil, err
+	}
+	return zstdCoders.encoder.EncodeAll(src, nil), nil
+}
+
+func (zstdCodec) Decode(src []byte) ([]byte, error) {
+	if err := zstdInit(); err != nil {
+		return nil, err
+	}
+	return zstdCoders.decoder.DecodeAll(src, nil)
+}
+
+type noneCodec struct{}
+
+func (noneCodec) Encode(src []byte) ([]byte, error) {
+	return append([]byte(nil), src...), nil
+}
+
+func (noneCodec) Decode(src []byte) ([]byte, error) {
+	return src, nil
+}
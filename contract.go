@@ -0,0 +1,321 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+
+	"github.com/unit-io/unitdb/hash"
+	"github.com/unit-io/unitdb/message"
+)
+
+const (
+	// contractSize is the size of a contract and its revoked flag in the info file.
+	contractSize = 5
+	// policySize is the size of a topic hash and its encryption policy in the info file.
+	policySize = 9
+)
+
+// _Contracts is the set of contracts created using DB.NewContract and contracts revoked using
+// DB.RevokeContract. It is stored in the info file following the DB info.
+type _Contracts struct {
+	sync.RWMutex
+	revoked map[uint32]bool // revoked is the revoked flag by contract.
+}
+
+func newContracts() *_Contracts {
+	return &_Contracts{revoked: make(map[uint32]bool)}
+}
+
+// contractOf derives the contract of the seed. A seed hashing to zero or the master contract is
+// hashed again with a counter appended so every seed has a contract.
+func contractOf(seed []byte) uint32 {
+	b := append([]byte(nil), seed...)
+	for i := byte(0); ; i++ {
+		if contract := hash.New(b); contract != 0 && contract != message.MasterContract {
+			return contract
+		}
+		b = append(b[:len(seed)], i)
+	}
+}
+
+// MarshalBinary serializes contracts into binary data.
+func (c *_Contracts) MarshalBinary() ([]byte, error) {
+	contracts := make([]uint32, 0, len(c.revoked))
+	for contract := range c.revoked {
+		contracts = append(contracts, contract)
+	}
+	sort.Slice(contracts, func(i, j int) bool { return contracts[i] < contracts[j] })
+	buf := make([]byte, 4+contractSize*len(contracts))
+	binary.LittleEndian.PutUint32(buf[:4], uint32(len(contracts)))
+	off := 4
+	for _, contract := range contracts {
+		binary.LittleEndian.PutUint32(buf[off:off+4], contract)
+		if c.revoked[contract] {
+			buf[off+4] = 1
+		}
+		off += contractSize
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary de-serializes contracts from binary data.
+func (c *_Contracts) UnmarshalBinary(data []byte) error {
+	if len(data) < 4 {
+		return errCorrupted
+	}
+	n := int(binary.LittleEndian.Uint32(data[:4]))
+	if len(data) < 4+contractSize*n {
+		return errCorrupted
+	}
+	off := 4
+	for i := 0; i < n; i++ {
+		c.revoked[binary.LittleEndian.Uint32(data[off:off+4])] = data[off+4] == 1
+		off += contractSize
+	}
+	return nil
+}
+
+// _Policies is the encryption policy set using DB.SetTopicEncryption by topic hash. Policies are
+// stored in the info file following the retention caps and byte limits.
+type _Policies map[uint64]uint8
+
+// MarshalBinary serializes encryption policies into binary data.
+func (p _Policies) MarshalBinary() ([]byte, error) {
+	topics := make([]uint64, 0, len(p))
+	for topicHash := range p {
+		topics = append(topics, topicHash)
+	}
+	sort.Slice(topics, func(i, j int) bool { return topics[i] < topics[j] })
+	buf := make([]byte, 4+policySize*len(topics))
+	binary.LittleEndian.PutUint32(buf[:4], uint32(len(topics)))
+	off := 4
+	for _, topicHash := range topics {
+		binary.LittleEndian.PutUint64(buf[off:off+8], topicHash)
+		buf[off+8] = p[topicHash]
+		off += policySize
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary de-serializes encryption policies from binary data.
+func (p _Policies) UnmarshalBinary(data []byte) error {
+	if len(data) < 4 {
+		return errCorrupted
+	}
+	n := int(binary.LittleEndian.Uint32(data[:4]))
+	if len(data) < 4+policySize*n {
+		return errCorrupted
+	}
+	off := 4
+	for i := 0; i < n; i++ {
+		p[binary.LittleEndian.Uint64(data[off:off+8])] = data[off+8]
+		off += policySize
+	}
+	return nil
+}
+
+// _StoredTopics is the marshaled topic by topic hash of topics of which the first entry, the topic is
+// stored along with, is evicted by a retention cap. Topics are stored in the info file following the
+// encryption policies so the topic is loaded once its first entry is deleted.
+type _StoredTopics map[uint64][]byte
+
+// MarshalBinary serializes stored topics into binary data.
+func (t _StoredTopics) MarshalBinary() ([]byte, error) {
+	topics := make([]uint64, 0, len(t))
+	size := 4
+	for topicHash, rawTopic := range t {
+		topics = append(topics, topicHash)
+		size += 10 + len(rawTopic)
+	}
+	sort.Slice(topics, func(i, j int) bool { return topics[i] < topics[j] })
+	buf := make([]byte, size)
+	binary.LittleEndian.PutUint32(buf[:4], uint32(len(topics)))
+	off := 4
+	for _, topicHash := range topics {
+		binary.LittleEndian.PutUint64(buf[off:off+8], topicHash)
+		binary.LittleEndian.PutUint16(buf[off+8:off+10], uint16(len(t[topicHash])))
+		off += 10
+		off += copy(buf[off:], t[topicHash])
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary de-serializes stored topics from binary data.
+func (t _StoredTopics) UnmarshalBinary(data []byte) error {
+	if len(data) < 4 {
+		return errCorrupted
+	}
+	n := int(binary.LittleEndian.Uint32(data[:4]))
+	off := 4
+	for i := 0; i < n; i++ {
+		if len(data) < off+10 {
+			return errCorrupted
+		}
+		topicHash := binary.LittleEndian.Uint64(data[off : off+8])
+		size := int(binary.LittleEndian.Uint16(data[off+8 : off+10]))
+		off += 10
+		if len(data) < off+size {
+			return errCorrupted
+		}
+		t[topicHash] = append([]byte(nil), data[off:off+size]...)
+		off += size
+	}
+	return nil
+}
+
+// isRevoked reports whether the contract is revoked.
+func (c *_Contracts) isRevoked(contract uint32) bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.revoked[contract]
+}
+
+// readContracts reads contracts, the retention caps, encryption policies and stored topics from the info
+// file. DB files written before contracts were stored have no contracts following the DB info.
+func (db *DB) readContracts() error {
+	size := db.internal.info.currSize() - int64(fixed)
+	if size <= 0 {
+		return nil
+	}
+	db.internal.contracts.Lock()
+	defer db.internal.contracts.Unlock()
+	if err := db.internal.info.readUnmarshalableAt(db.internal.contracts, uint32(size), int64(fixed)); err != nil {
+		return err
+	}
+	off := int64(fixed) + 4 + int64(contractSize*len(db.internal.contracts.revoked))
+	err := db.readRetention(off)
+	if err != nil {
+		return err
+	}
+	for _, size := range []int64{retentionSize, byteLimitSize} {
+		if off, err = db.sectionEnd(off, size); err != nil {
+			return err
+		}
+	}
+	if err := db.readEncryption(off); err != nil {
+		return err
+	}
+	if off, err = db.sectionEnd(off, policySize); err != nil {
+		return err
+	}
+	if size := db.internal.info.currSize() - off; size > 0 {
+		return db.internal.info.readUnmarshalableAt(db.internal.storedTopics, uint32(size), off)
+	}
+	return nil
+}
+
+// sectionEnd returns the offset following the section of the info file at the offset, the section
+// being the count of records followed by records of the size.
+func (db *DB) sectionEnd(off, size int64) (int64, error) {
+	if db.internal.info.currSize() < off+4 {
+		return off, nil
+	}
+	buf := make([]byte, 4)
+	if _, err := db.internal.info.ReadAt(buf, off); err != nil {
+		return 0, err
+	}
+	return off + 4 + size*int64(binary.LittleEndian.Uint32(buf)), nil
+}
+
+// storedTopic returns the marshaled topic stored in the info file for the topic hash.
+func (db *DB) storedTopic(topicHash uint64) ([]byte, bool) {
+	db.internal.contracts.RLock()
+	defer db.internal.contracts.RUnlock()
+	rawTopic, ok := db.internal.storedTopics[topicHash]
+	return rawTopic, ok
+}
+
+// storeTopic stores the marshaled topic in the info file before the first entry of the topic
+// is deleted.
+func (db *DB) storeTopic(topicHash uint64, rawTopic []byte) error {
+	db.internal.contracts.Lock()
+	defer db.internal.contracts.Unlock()
+	if _, ok := db.internal.storedTopics[topicHash]; ok {
+		return nil
+	}
+	db.internal.storedTopics[topicHash] = append([]byte(nil), rawTopic...)
+	if err := db.writeContracts(); err != nil {
+		delete(db.internal.storedTopics, topicHash)
+		return err
+	}
+	return nil
+}
+
+// readEncryption reads encryption policies stored in the info file following the retention caps and
+// byte limits. Policies read from the info file take precedence over policies of stored topics.
+func (db *DB) readEncryption(off int64) error {
+	size := db.internal.info.currSize() - off
+	if size <= 0 {
+		return nil
+	}
+	policies := make(_Policies)
+	if err := db.internal.info.readUnmarshalableAt(policies, uint32(size), off); err != nil {
+		return err
+	}
+	for topicHash, policy := range policies {
+		db.internal.trie.setEncryption(topicHash, policy)
+	}
+	return nil
+}
+
+// writeContracts writes contracts, the retention caps, encryption policies and stored topics into the
+// info file following the DB info. The caller must hold the contracts lock.
+func (db *DB) writeContracts() error {
+	return db.writeContractsWith(db.internal.trie.encryptionPolicies())
+}
+
+// writeContractsWith writes the info file as writeContracts does using the encryption policies.
+// The caller must hold the contracts lock.
+func (db *DB) writeContractsWith(policies _Policies) error {
+	buf, err := db.internal.contracts.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	rbuf, err := db.internal.retention.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	pbuf, err := policies.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	tbuf, err := db.internal.storedTopics.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	buf = append(buf, rbuf...)
+	buf = append(buf, pbuf...)
+	buf = append(buf, tbuf...)
+	if _, err := db.internal.info.WriteAt(buf, int64(fixed)); err != nil {
+		return err
+	}
+	if err := db.internal.info.truncate(int64(fixed) + int64(len(buf))); err != nil {
+		return err
+	}
+	return db.internal.info.Sync()
+}
+
+// checkContract returns errForbidden if the contract is revoked.
+func (db *DB) checkContract(contract uint32) error {
+	if contract != message.MasterContract && db.internal.contracts.isRevoked(contract) {
+		return errForbidden
+	}
+	return nil
+}
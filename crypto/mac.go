@@ -100,11 +100,12 @@ func (m *MAC) Decrypt(dst, src []byte) ([]byte, error) {
 	}
 
 	nonce := append(m.salt, src[:MessageOffset]...)
+	// Append epoch to dst at the beginning so the message is opened
+	// into dst without copying.
+	dst = append(dst, src[:EpochSize]...)
 	dst, err := m.parent.Open(dst, nonce, src[MessageOffset:], nil)
 	if err != nil {
 		return dst, errors.New("Authentication failed.")
 	}
-	// Append epoch to dst at the beginning
-	dst = append(src[:EpochSize], dst...)
 	return dst, nil
 }
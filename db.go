@@ -18,8 +18,11 @@ package unitdb
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"math"
 	"math/rand"
 	"os"
 	"sort"
@@ -27,10 +30,10 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/golang/snappy"
 	"github.com/unit-io/bpool"
 	"github.com/unit-io/unitdb/crypto"
 	fltr "github.com/unit-io/unitdb/filter"
+	"github.com/unit-io/unitdb/fs"
 	"github.com/unit-io/unitdb/memdb"
 	"github.com/unit-io/unitdb/message"
 )
@@ -40,7 +43,7 @@ import (
 type DB struct {
 	opts *_Options
 
-	lock _LockFile
+	lock fs.LockFile
 	fs   *_FileSet
 
 	internal *_DB
@@ -48,6 +51,18 @@ type DB struct {
 
 // Open opens or creates a new DB.
 func Open(path string, opts ...Options) (*DB, error) {
+	return OpenContext(context.Background(), path, opts...)
+}
+
+// OpenContext opens or creates a new DB the same as Open, and stops opening the DB if ctx is canceled
+// while the log is recovered or topics are loaded from the window file, such as on a shutdown signal
+// while a DB with a large log is opened. The files opened are closed and the error of ctx is returned.
+// Entries already recovered from the log are written to the DB files or back to the log, so these
+// are recovered again the next time the DB is opened.
+func OpenContext(ctx context.Context, path string, opts ...Options) (*DB, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	options := &_Options{}
 	WithDefaultOptions().set(options)
 	WithDefaultFlags().set(options)
@@ -56,18 +71,84 @@ func Open(path string, opts ...Options) (*DB, error) {
 			opt.set(options)
 		}
 	}
+	shards := options.shards
+	switch {
+	case shards == 0:
+		shards = nShards
+	case shards < 0 || shards&(shards-1) != 0:
+		return nil, errShardsInvalid
+	}
 
-	lock, err := createLockFile(path)
-	if err != nil {
-		if err == os.ErrExist {
-			err = errLocked
+	// Check the codecs used to compress messages are registered.
+	for _, c := range []Compression{options.compression, options.batchOptions.compression} {
+		if c == CompressionDefault {
+			continue
+		}
+		if _, err := getCodec(c); err != nil {
+			return nil, err
+		}
+	}
+
+	// Create a MAC for each contract key.
+	contractMacs := make(map[uint32]*crypto.MAC, len(options.contractKeys))
+	for contract, key := range options.contractKeys {
+		mac, err := crypto.New(key)
+		if err != nil {
+			return nil, err
+		}
+		contractMacs[contract] = mac
+	}
+
+	// Create a MAC for each key of the key ring.
+	keyRing := make(map[uint8]*crypto.MAC, len(options.keyRing))
+	for keyID, key := range options.keyRing {
+		if keyID == 0 || keyID > maxKeyRingID {
+			return nil, errKeyIDInvalid
+		}
+		mac, err := crypto.New(key)
+		if err != nil {
+			return nil, err
+		}
+		keyRing[keyID] = mac
+	}
+	if _, ok := keyRing[options.currentKeyID]; options.currentKeyID != 0 && !ok {
+		return nil, errKeyNotFound
+	}
+
+	var lock fs.LockFile
+	if !options.flags.readOnly {
+		var err error
+		lock, err = createLockFile(options.fileSystem, path)
+		if err != nil {
+			if err == os.ErrExist {
+				err = errLocked
+			}
+			return nil, err
+		}
+	}
+
+	// The files opened are closed and the lock is released if the DB is not opened, so the DB
+	// can be opened again.
+	opened := &_FileSet{mu: new(sync.RWMutex)}
+	abort := func(err error) (*DB, error) {
+		opened.close()
+		if lock != nil {
+			lock.Unlock()
 		}
 		return nil, err
 	}
 
-	infoFile, err := newFile(path, 1, _FileDesc{fileType: typeInfo})
+	if !options.flags.readOnly {
+		// A DB.Compact interrupted once the compacted files are written is finished.
+		if err := finishCompact(options.fileSystem, path); err != nil {
+			return abort(err)
+		}
+	}
+
+	infoFile, err := newFile(options.fileSystem, path, 1, _FileDesc{fileType: typeInfo}, options.flags.readOnly)
+	opened.list = append(opened.list, infoFile)
 	if err != nil {
-		return nil, err
+		return abort(err)
 	}
 
 	timeOptions := &_TimeOptions{
@@ -75,20 +156,24 @@ func Open(path string, opts ...Options) (*DB, error) {
 		expDurationType:     time.Minute,
 		maxExpDurations:     maxExpDur,
 		backgroundKeyExpiry: options.flags.backgroundKeyExpiry,
+		shards:              shards,
 	}
-	winFile, err := newFile(path, 1, _FileDesc{fileType: typeTimeWindow})
+	winFile, err := newFile(options.fileSystem, path, 1, _FileDesc{fileType: typeTimeWindow}, options.flags.readOnly)
+	opened.list = append(opened.list, winFile)
 	if err != nil {
-		return nil, err
+		return abort(err)
 	}
 
-	indexFile, err := newFile(path, 1, _FileDesc{fileType: typeIndex})
+	indexFile, err := newFile(options.fileSystem, path, 1, _FileDesc{fileType: typeIndex}, options.flags.readOnly)
+	opened.list = append(opened.list, indexFile)
 	if err != nil {
-		return nil, err
+		return abort(err)
 	}
 
-	dataFile, err := newFile(path, 1, _FileDesc{fileType: typeData})
+	dataFile, err := newFile(options.fileSystem, path, 1, _FileDesc{fileType: typeData}, options.flags.readOnly)
+	opened.list = append(opened.list, dataFile)
 	if err != nil {
-		return nil, err
+		return abort(err)
 	}
 
 	dbInfo := _DBInfo{}
@@ -100,45 +185,70 @@ func Open(path string, opts ...Options) (*DB, error) {
 			},
 		}
 		if _, err = infoFile.extend(fixed); err != nil {
-			return nil, err
+			return abort(err)
 		}
 		if err := infoFile.writeMarshalableAt(dbInfo, 0); err != nil {
-			return nil, err
+			return abort(err)
 		}
 	}
 
 	if err := infoFile.readUnmarshalableAt(&dbInfo, fixed, 0); err != nil {
 		logger.Error().Err(err).Str("context", "db.readHeader")
-		return nil, err
+		return abort(err)
 	}
 	if !bytes.Equal(dbInfo.header.signature[:], signature[:]) {
-		return nil, errCorrupted
+		return abort(errCorrupted)
+	}
+	if dbInfo.header.version > version {
+		return abort(errVersionUnsupported)
+	}
+
+	// Checksums are stored with messages only if the DB is created with checksums.
+	if options.flags.checksum && dbInfo.checksum == 0 {
+		if options.flags.readOnly || dbInfo.sequence != 0 || dataFile.currSize() != 0 {
+			return abort(errChecksumUnsupported)
+		}
+		dbInfo.checksum = 1
+		if err := infoFile.writeMarshalableAt(dbInfo, 0); err != nil {
+			return abort(err)
+		}
 	}
 
-	leaseFile, err := newFile(path, 1, _FileDesc{fileType: typeLease})
+	leaseFile, err := newFile(options.fileSystem, path, 1, _FileDesc{fileType: typeLease}, options.flags.readOnly)
+	opened.list = append(opened.list, leaseFile)
 	if err != nil {
-		return nil, err
+		return abort(err)
 	}
-	lease := newLease(leaseFile, options.freeBlockSize)
+	lease := newLease(leaseFile, options.freeBlockSize, shards)
 
-	filterFile, err := newFile(path, 1, _FileDesc{fileType: typeFilter})
+	filterFile, err := newFile(options.fileSystem, path, 1, _FileDesc{fileType: typeFilter}, options.flags.readOnly)
+	opened.list = append(opened.list, filterFile)
 	if err != nil {
-		return nil, err
+		return abort(err)
 	}
 
-	fileset := &_FileSet{mu: new(sync.RWMutex), list: []_FileSet{infoFile, winFile, indexFile, dataFile, leaseFile, filterFile}}
+	fileset := &_FileSet{mu: new(sync.RWMutex), list: []_FileSet{infoFile, winFile, indexFile, dataFile, leaseFile, filterFile}, fsys: options.fileSystem, path: path}
 	internal := &_DB{
-		mutex: newMutex(),
-		start: time.Now(),
-		meter: NewMeter(),
+		mutex:      newMutex(),
+		writeMutex: newMutex(),
+		dedup:      newDedup(options.dedupWindow),
+		start:      time.Now(),
+		meter:      NewMeter(),
 
 		dbInfo: dbInfo,
 
 		bufPool: bpool.NewBufferPool(options.bufferSize, &bpool.Options{MaxElapsedTime: 10 * time.Second}),
 
-		info:     infoFile,
-		filter:   Filter{file: filterFile, filterBlock: fltr.NewFilterGenerator()},
-		freeList: lease,
+		info:      infoFile,
+		contracts: newContracts(),
+		aliases:   newAliases(),
+		retention: newRetention(),
+		loaded:    newLoaded(),
+		reserved:  newReserved(),
+		filter:    Filter{file: filterFile, filterBlock: fltr.NewSizedFilterGenerator(options.filterSize())},
+		freeList:  lease,
+
+		storedTopics: make(_StoredTopics),
 
 		timeWindow: newTimeWindowBucket(timeOptions),
 
@@ -146,31 +256,73 @@ func Open(path string, opts ...Options) (*DB, error) {
 		trie: newTrie(),
 
 		// Block reader
-		reader: newBlockReader(fileset),
+		reader: newBlockReader(fileset, dbInfo.checksum == 1, options.flags.checksum),
 
 		// Sync Handler
-		syncLockC: make(chan struct{}, 1),
+		syncLockC:     make(chan struct{}, 1),
+		syncInterval:  int64(options.syncDurationType * time.Duration(options.maxSyncDurations)),
+		syncIntervalC: make(chan struct{}, 1),
 
 		// Close
 		closeC: make(chan struct{}),
 	}
 
-	// Create a new MAC from the key.
-	if internal.mac, err = crypto.New(options.encryptionKey); err != nil {
-		return nil, err
+	// Create a new MAC from the key unless a cipher is set.
+	if options.cipher != nil {
+		internal.mac = options.cipher
+	} else if internal.mac, err = crypto.New(options.encryptionKey); err != nil {
+		return abort(err)
 	}
 
+	internal.contractMacs = contractMacs
+
+	internal.keyRing = keyRing
+
 	// set encryption flag to encrypt messages.
 	if options.flags.encryption {
 		internal.dbInfo.encryption = 1
 	}
 
-	// Create a blockcache.
-	memdb, err := memdb.Open(memdb.WithLogFilePath(path), memdb.WithMemdbSize(options.memdbSize))
+	// Create a blockcache. The log file of read-only DB is kept in memory so the log of the
+	// DB that writes files is not recovered and nothing is written to the file system.
+	memdbOpts := []memdb.Options{memdb.WithMemdbSize(options.memdbSize), memdb.WithFileSystem(options.fileSystem), memdb.WithShards(shards)}
+	if options.flags.sectorAlign {
+		memdbOpts = append(memdbOpts, memdb.WithSectorAlign())
+	}
+	if options.flags.lenientRecovery {
+		memdbOpts = append(memdbOpts, memdb.WithLenientRecovery())
+	}
+	if options.groupCommitInterval > 0 {
+		memdbOpts = append(memdbOpts, memdb.WithGroupCommit(options.groupCommitInterval, options.groupCommitCount))
+	}
+	if options.tinyBatchSize > 0 {
+		memdbOpts = append(memdbOpts, memdb.WithTinyBatchSize(options.tinyBatchSize))
+	}
+	if options.filterMessages != 0 {
+		memdbOpts = append(memdbOpts, memdb.WithFilterSize(fltr.Size(options.filterMessages/uint64(shards), options.filterFPRate)))
+	}
+	progress := &_Progress{fn: options.onRecoverProgress, winBlocks: int(winFile.currSize() / int64(blockSize))}
+	if progress.fn != nil {
+		memdbOpts = append(memdbOpts, memdb.WithRecoverProgress(func(done, total int) {
+			progress.logs = total
+			progress.report(done)
+		}))
+	}
+	if options.flags.readOnly {
+		memdbOpts = append(memdbOpts, memdb.WithFileSystem(fs.NewMem()), memdb.WithLogReset(), memdb.WithoutTinyBatchLoop())
+	}
+	logPath := path
+	if options.walPath != "" {
+		logPath = options.walPath
+	}
+	memdb, err := memdb.OpenContext(ctx, append(memdbOpts, memdb.WithLogFilePath(logPath))...)
 	if err != nil {
-		return nil, err
+		return abort(err)
 	}
 	internal.mem = memdb
+	for _, e := range memdb.RecoveryErrors() {
+		logger.Error().Err(e.Err).Str("context", "db.recoverLog").Int64("offset", e.Offset).Msg("log skipped")
+	}
 
 	internal.filter.blockCache = internal.mem
 
@@ -183,23 +335,55 @@ func Open(path string, opts ...Options) (*DB, error) {
 		internal: internal,
 	}
 
-	if err := db.loadTrie(); err != nil {
+	// Contracts are read first as topics of which the first entry is evicted are stored with these.
+	if err := db.readContracts(); err != nil {
+		logger.Error().Err(err).Str("context", "db.readContracts")
+		return nil, db.abortOpen(err)
+	}
+
+	if err := db.loadTrie(ctx, progress); err != nil {
+		if ctx.Err() != nil {
+			return nil, db.abortOpen(err)
+		}
 		logger.Error().Err(err).Str("context", "db.loadTrie")
 	}
 
 	// Read freeList.
 	if err := db.internal.freeList.read(); err != nil {
 		logger.Error().Err(err).Str("context", "db.readHeader")
-		return nil, err
+		return nil, db.abortOpen(err)
+	}
+
+	db.internal.syncHandle = _SyncHandle{DB: db}
+	if db.opts.flags.readOnly {
+		return db, nil
+	}
+
+	// Reconcile db info with the index file.
+	if err := db.recoverInfo(); err != nil {
+		logger.Error().Err(err).Str("context", "db.recoverInfo")
+		return nil, db.abortOpen(err)
 	}
 
-	if err := db.recoverLog(); err != nil {
+	if err := db.recoverLog(ctx, progress); err != nil {
+		if ctx.Err() != nil {
+			return nil, db.abortOpen(err)
+		}
 		// if unable to recover db then close db.
 		panic(fmt.Sprintf("Unable to recover db on sync error %v. Closing db...", err))
 	}
 
-	db.internal.syncHandle = _SyncHandle{DB: db}
-	db.startSyncer(options.syncDurationType * time.Duration(options.maxSyncDurations))
+	if db.opts.flags.rebuildFilter && !db.opts.flags.readOnly {
+		n, err := db.rebuildFilter()
+		if err != nil {
+			logger.Error().Err(err).Str("context", "db.rebuildFilter")
+			return nil, db.abortOpen(err)
+		}
+		db.internal.filterRebuilt = n
+		logger.Info().Str("context", "db.rebuildFilter").Int64("entries", n).Msg("filter rebuilt")
+	}
+
+	db.startSyncer()
 
 	if db.opts.flags.backgroundKeyExpiry {
 		db.startExpirer(time.Minute, maxExpDur)
@@ -219,259 +403,1315 @@ func (db *DB) Close() error {
 
 // Get return items matching the query paramater.
 func (db *DB) Get(q *Query) (items [][]byte, err error) {
-	if err := db.ok(); err != nil {
-		return nil, err
+	err = db.get(q, func(m Message) error {
+		items = append(items, m.Payload)
+		return nil
+	})
+	return items, err
+}
+
+// GetMessages returns messages matching the query with their ID, sequence, topic and expiry time,
+// so a payload can be correlated with its message without querying again.
+func (db *DB) GetMessages(q *Query) (msgs []Message, err error) {
+	err = db.get(q, func(m Message) error {
+		msgs = append(msgs, m)
+		return nil
+	})
+	return msgs, err
+}
+
+// Range returns messages of the topic with sequence between fromSeq and toSeq inclusive in sequence
+// order, such as to catch up a replica deterministically. Unlike Get, the last duration and limit
+// of the topic are not used to select messages.
+func (db *DB) Range(topic []byte, fromSeq, toSeq uint64) ([]Message, error) {
+	if fromSeq > toSeq {
+		return nil, errBadRequest
 	}
-	switch {
-	case len(q.Topic) == 0:
-		return nil, errTopicEmpty
-	case len(q.Topic) > maxTopicLength:
-		return nil, errTopicTooLarge
+	q := NewQuery(topic).WithOrder(Ascending)
+	q.internal.seqRange = true
+	q.internal.fromSeq, q.internal.toSeq = fromSeq, toSeq
+	return db.GetMessages(q)
+}
+
+// Subscribe streams messages matching the query and then delivers messages put to topics matching
+// the query as they are written, such as to tail a topic like a message queue consumer. The query
+// limit applies to the messages streamed first. Messages put by a batch are delivered once the batch
+// is written. The returned func cancels the subscription. The channel is closed once the subscription
+// is canceled, the DB is closed or reading a message fails. Messages are queued for a slow reader so
+// the subscription does not block writes, and the subscription is canceled once 65536 messages
+// are queued. Use Query.WithAckTimeout to redeliver messages not acknowledged while the subscription is open.
+func (db *DB) Subscribe(q *Query) (<-chan Message, func(), error) {
+	if err := db.parseQuery(q); err != nil {
+		return nil, nil, err
 	}
-	// // CPU profiling by default
-	// defer profile.Start().Stop()
-	q.internal.opts = &_QueryOptions{defaultQueryLimit: db.opts.queryOptions.defaultQueryLimit, maxQueryLimit: db.opts.queryOptions.maxQueryLimit}
-	if err := q.parse(); err != nil {
-		return nil, err
+	sub := &_Subscriber{
+		q:       q,
+		ch:      make(chan Message),
+		matches: make(map[uint64]bool),
+		notifyC: make(chan struct{}, 1),
+		doneC:   make(chan struct{}),
+
+		ackTimeout: q.internal.ackTimeout,
+		inFlight:   make(map[uint64]_InFlight),
 	}
-	mu := db.internal.mutex.getMutex(q.internal.prefix)
-	mu.RLock()
-	defer mu.RUnlock()
-	db.lookup(q)
-	if len(q.internal.winEntries) == 0 {
-		return
+	// the subscriber is registered before existing messages are looked up so no message put in between is missed.
+	db.internal.subscribers.subscribe(sub)
+	if err := db.prepareQuery(q); err != nil {
+		db.internal.subscribers.unsubscribe(sub)
+		return nil, nil, err
 	}
-	sort.Slice(q.internal.winEntries[:], func(i, j int) bool {
-		return q.internal.winEntries[i].seq > q.internal.winEntries[j].seq
-	})
-	start := 0
-	limit := q.Limit
-	if len(q.internal.winEntries) < int(q.Limit) {
-		limit = len(q.internal.winEntries)
+	if err := db.ok(); err != nil {
+		db.internal.subscribers.unsubscribe(sub)
+		return nil, nil, err
 	}
+	db.internal.closeW.Add(1)
+	go db.deliver(sub)
+	return sub.ch, func() { db.internal.subscribers.unsubscribe(sub) }, nil
+}
 
-	for {
-		invalidCount := 0
-		for _, query := range q.internal.winEntries[start:limit] {
-			err = func() error {
-				if query.seq == 0 {
-					return nil
-				}
-				s, err := db.readEntry(query)
-				if err != nil {
-					if err == errMsgIDDeleted {
-						invalidCount++
-						return nil
-					}
-					logger.Error().Err(err).Str("context", "db.readEntry")
-					return err
-				}
-				id, val, err := db.internal.reader.readMessage(s)
-				if err != nil {
-					logger.Error().Err(err).Str("context", "data.readMessage")
-					return err
-				}
-				msgID := message.ID(id)
-				if !msgID.EvalPrefix(q.Contract, q.internal.cutoff) {
-					invalidCount++
-					return nil
-				}
-
-				// last bit of ID is an encryption flag.
-				if uint8(id[idSize-1]) == 1 {
-					val, err = db.internal.mac.Decrypt(nil, val)
-					if err != nil {
-						logger.Error().Err(err).Str("context", "mac.decrypt")
-						return err
-					}
-				}
-				var buffer []byte
-				val, err = snappy.Decode(buffer, val)
-				if err != nil {
-					logger.Error().Err(err).Str("context", "snappy.Decode")
-					return err
-				}
-				items = append(items, val)
-				db.internal.meter.OutBytes.Inc(int64(s.valueSize))
-				return nil
-			}()
-			if err != nil {
-				return items, err
-			}
-		}
-
-		if invalidCount == 0 || len(items) == int(q.Limit) || len(q.internal.winEntries) == limit {
-			break
-		}
+// Items returns an iterator over live messages of all topics and contracts of the DB in sequence
+// order, such as to export the DB. Expired messages are skipped.
+func (db *DB) Items() *ItemIterator {
+	return db.newItemIterator()
+}
 
-		if len(q.internal.winEntries) <= int(q.Limit+invalidCount) {
-			start = limit
-			limit = len(q.internal.winEntries)
-		} else {
-			start = limit
-			limit = limit + invalidCount
-		}
+// GetContext is like Get but stops the query once ctx is done. The context is checked between
+// topics looked up for the query and between messages read, and its error is returned.
+func (db *DB) GetContext(ctx context.Context, q *Query) (items [][]byte, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	db.internal.meter.Gets.Inc(int64(len(items)))
-	db.internal.meter.OutMsgs.Inc(int64(len(items)))
-	return items, nil
+	q.internal.ctx = ctx
+	defer func() {
+		q.internal.ctx = nil
+	}()
+	err = db.get(q, func(m Message) error {
+		items = append(items, m.Payload)
+		return nil
+	})
+	return items, err
 }
 
-// NewContract generates a new Contract.
-func (db *DB) NewContract() (uint32, error) {
-	raw := make([]byte, 4)
-	rand.Read(raw)
+// GetBatch returns items matching each of the queries. The result is aligned index-for-index
+// with the queries. Topics for all queries are looked up in a single pass over the trie.
+func (db *DB) GetBatch(queries []*Query) ([][][]byte, error) {
+	return db.getBatch(queries)
+}
 
-	contract := uint32(binary.LittleEndian.Uint32(raw[:4]))
-	return contract, nil
+// GetFunc calls fn for each message matching the query as it is read from the DB,
+// without building a result set in memory. If fn returns an error the read stops
+// and GetFunc returns the error.
+func (db *DB) GetFunc(q *Query, fn func(Message) error) error {
+	return db.get(q, fn)
 }
 
-// NewID generates new ID that is later used to put entry or delete entry.
-func (db *DB) NewID() []byte {
-	db.internal.meter.Leases.Inc(1)
-	return message.NewID(db.nextSeq())
+// GetStream returns a channel that yields messages matching the query as they are read from the DB,
+// and a function to stop the stream. The channel is closed once all messages are read, on an error
+// reading a message, or once the stream is stopped. Read locks are not held while waiting on the
+// caller to receive a message, and the stream stops if the DB is closed.
+func (db *DB) GetStream(q *Query) (<-chan Message, func(), error) {
+	if err := db.prepareQuery(q); err != nil {
+		return nil, nil, err
+	}
+	msgs := make(chan Message)
+	stopC := make(chan struct{})
+	var stopOnce sync.Once
+	db.internal.closeW.Add(1)
+	go func() {
+		defer func() {
+			close(msgs)
+			db.internal.closeW.Done()
+		}()
+		if err := db.readQuery(q, func(m Message) error {
+			select {
+			case <-db.internal.closeC:
+				return errClosed
+			case <-stopC:
+				return errClosed
+			case msgs <- m:
+				return nil
+			}
+		}); err != nil && err != errClosed {
+			logger.Error().Err(err).Str("context", "db.GetStream").Msg("Error reading query")
+		}
+	}()
+	return msgs, func() { stopOnce.Do(func() { close(stopC) }) }, nil
 }
 
-// Put puts entry into DB. It uses default Contract to put entry into DB.
-// It is safe to modify the contents of the argument after Put returns but not
-// before.
-func (db *DB) Put(topic, payload []byte) error {
-	return db.PutEntry(NewEntry(topic, payload))
+// NewContract generates a new Contract.
+func (db *DB) NewContract() (uint32, error) {
+	db.internal.contracts.Lock()
+	defer db.internal.contracts.Unlock()
+	raw := make([]byte, 4)
+	for {
+		rand.Read(raw)
+		contract := uint32(binary.LittleEndian.Uint32(raw[:4]))
+		if _, ok := db.internal.contracts.revoked[contract]; ok || contract == message.MasterContract {
+			continue
+		}
+		if err := db.addContract(contract); err != nil {
+			return 0, err
+		}
+		return contract, nil
+	}
 }
 
-// PutEntry puts entry into the DB, if Contract is not specified then it uses master Contract.
-// It is safe to modify the contents of the argument after PutEntry returns but not
-// before.
-func (db *DB) PutEntry(e *Entry) error {
+// RegisterAlias registers the alias of the topic so entries put using Entry.WithAlias reference
+// the topic by the alias, such as to mirror MQTT topic aliases. The topic of an alias is parsed once
+// for each contract instead of on every put. Registering an alias again replaces its topic. Aliases
+// are kept in memory so these must be registered again after the DB is reopened.
+func (db *DB) RegisterAlias(alias uint16, topic []byte) error {
 	if err := db.ok(); err != nil {
 		return err
 	}
-
 	switch {
-	case len(e.Topic) == 0:
+	case alias == 0:
+		return errBadRequest
+	case len(topic) == 0:
 		return errTopicEmpty
-	case len(e.Topic) > maxTopicLength:
+	case len(topic) > maxTopicLength:
 		return errTopicTooLarge
-	case len(e.Payload) == 0:
-		return errValueEmpty
-	case len(e.Payload) > maxValueLength:
-		return errValueTooLarge
-	}
-
-	if err := db.setEntry(e); err != nil {
-		return err
 	}
-
-	timeID, err := db.internal.mem.Put(e.entry.seq, e.entry.cache)
+	t, _, err := db.parseTopic(message.MasterContract, topic)
 	if err != nil {
 		return err
 	}
+	t.AddContract(message.MasterContract)
+	al := &_Alias{topic: append([]byte(nil), topic...), parsed: map[uint32]*message.Topic{message.MasterContract: t}}
+	db.internal.aliases.Lock()
+	defer db.internal.aliases.Unlock()
+	db.internal.aliases.m[alias] = al
+	return nil
+}
 
-	if ok := db.internal.timeWindow.add(timeID, e.entry.topicHash, newWinEntry(e.entry.seq, e.entry.expiresAt)); !ok {
-		return errForbidden
-	}
-
-	if e.entry.topicSize != 0 {
-		t := new(message.Topic)
-		rawTopic := e.entry.cache[entrySize+idSize : entrySize+idSize+e.entry.topicSize]
-		t.Unmarshal(rawTopic)
-		db.internal.trie.add(newTopic(e.entry.topicHash, 0), t.Parts, t.Depth)
+// SetTopicRetention caps the number of messages kept for the topic. Once the topic holds more than
+// maxMessages messages, each put to the topic evicts the oldest message, and evicted messages are
+// deleted on the next sync. The cap applies to the topic under any contract. The cap is stored in the
+// DB info so it applies after the DB is reopened. Set maxMessages to 0 to remove the cap.
+func (db *DB) SetTopicRetention(topic []byte, maxMessages int) error {
+	if maxMessages < 0 || int64(maxMessages) > math.MaxUint32 {
+		return errBadRequest
 	}
-
-	db.internal.meter.Puts.Inc(1)
-
-	// reset message entry.
-	e.reset()
-	return nil
+	return db.setRetention(topic, func(r *_Retention, topicHash uint64) {
+		if maxMessages == 0 {
+			delete(r.caps, topicHash)
+			return
+		}
+		r.caps[topicHash] = maxMessages
+	})
 }
 
-// Delete sets entry for deletion.
-// It is safe to modify the contents of the argument after Delete returns but not
-// before.
-func (db *DB) Delete(id, topic []byte) error {
-	return db.DeleteEntry(NewEntry(topic, nil).WithID(id))
+// SetTopicByteLimit caps the size of the values kept for the topic, such as for devices with small
+// disks. Once values of the topic add up to more than maxBytes, each put to the topic evicts the
+// oldest messages, and evicted messages are deleted on the next sync the same as SetTopicRetention.
+// The newest message is kept even if its value alone is larger than maxBytes. The limit is stored
+// in the DB info so it applies after the DB is reopened. Set maxBytes to 0 to remove the limit.
+func (db *DB) SetTopicByteLimit(topic []byte, maxBytes int64) error {
+	if maxBytes < 0 {
+		return errBadRequest
+	}
+	return db.setRetention(topic, func(r *_Retention, topicHash uint64) {
+		if maxBytes == 0 {
+			delete(r.limits, topicHash)
+			return
+		}
+		r.limits[topicHash] = maxBytes
+	})
 }
 
-// DeleteEntry deletes an entry from DB. you must provide an ID to delete an entry.
-// It is safe to modify the contents of the argument after Delete returns but
-// not before.
-func (db *DB) DeleteEntry(e *Entry) error {
+// setRetention sets the retention caps of the topic using fn, stores the caps in the DB info
+// and deletes the entries of the topic beyond the caps.
+func (db *DB) setRetention(topic []byte, fn func(r *_Retention, topicHash uint64)) error {
 	switch {
+	case db.opts.flags.readOnly:
+		return errForbidden
 	case db.opts.flags.immutable:
 		return errImmutable
-	case len(e.ID) == 0:
-		return errMsgIDEmpty
-	case len(e.Topic) == 0:
+	case len(topic) == 0:
 		return errTopicEmpty
-	case len(e.Topic) > maxTopicLength:
+	case len(topic) > maxTopicLength:
 		return errTopicTooLarge
 	}
-	id := message.ID(e.ID)
-	topic, _, err := db.parseTopic(e.Contract, e.Topic)
-	if err != nil {
+	if err := db.ok(); err != nil {
 		return err
 	}
-	if e.Contract == 0 {
-		e.Contract = message.MasterContract
+	t, _, err := db.parseTopic(message.MasterContract, topic)
+	if err != nil {
+		return err
 	}
-	topic.AddContract(e.Contract)
+	t.AddContract(message.MasterContract)
+	topicHash := t.GetHash(message.MasterContract)
 
-	if err := db.delete(topic.GetHash(e.Contract), message.ID(id).Sequence()); err != nil {
+	if err := db.applyRetention(topicHash, fn); err != nil {
 		return err
 	}
 
-	return nil
+	db.internal.syncLockC <- struct{}{}
+	defer func() {
+		<-db.internal.syncLockC
+	}()
+	return db.deleteEvicted()
 }
 
-// Batch executes a function within the context of a read-write managed transaction.
-// If no error is returned from the function then the transaction is written.
-// If an error is returned then the entire transaction is rolled back.
-// Any error that is returned from the function or returned from the write is
-// returned from the Batch() method.
-//
-// Attempting to manually commit or rollback within the function will cause a panic.
-func (db *DB) Batch(fn func(*Batch, <-chan struct{}) error) error {
-	b := db.batch()
-
-	b.setManaged()
+// applyRetention sets the retention caps of the topic using fn and stores the caps in the DB
+// info. The caps are rolled back if the entries of the topic cannot be tracked or the caps
+// cannot be stored, and the topic is tracked again on the next put.
+func (db *DB) applyRetention(topicHash uint64, fn func(r *_Retention, topicHash uint64)) error {
+	db.internal.contracts.Lock()
+	defer db.internal.contracts.Unlock()
+	r := db.internal.retention
+	r.Lock()
+	max, hasMax := r.caps[topicHash]
+	limit, hasLimit := r.limits[topicHash]
+	evicted := len(r.evicted)
+	rollback := func() {
+		delete(r.caps, topicHash)
+		delete(r.limits, topicHash)
+		if hasMax {
+			r.caps[topicHash] = max
+		}
+		if hasLimit {
+			r.limits[topicHash] = limit
+		}
+		r.forget(topicHash, evicted)
+	}
+	fn(r, topicHash)
+	if r.capped(topicHash) {
+		if err := db.track(topicHash); err != nil {
+			rollback()
+			r.Unlock()
+			return err
+		}
+	} else {
+		r.untrack(topicHash)
+	}
+	r.retrack(topicHash)
+	r.Unlock()
 
-	// If an error is returned from the function then rollback and return error.
-	if err := fn(b, b.commitComplete); err != nil {
-		b.Abort()
-		close(b.commitComplete)
+	if err := db.writeContracts(); err != nil {
+		r.Lock()
+		rollback()
+		r.Unlock()
 		return err
 	}
-	b.unsetManaged()
-	return b.Commit()
+	return nil
 }
 
-// Sync syncs entries into DB. Sync happens synchronously.
-// Sync write window entries into summary file and write index, and data to respective index and data files.
-// In case of any error during sync operation recovery is performed on log file (write ahead log).
-func (db *DB) Sync() error {
-	// start := time.Now()
-	if ok := db.internal.syncHandle.status(); ok {
-		// sync is in-progress.
+// NewContractFrom derives the contract from the seed, such as a tenant name, so separate DBs
+// map the seed to the same contract. The contract is recorded as NewContract does, and the same
+// contract is returned for the seed again. It returns errForbidden if the contract is revoked.
+func (db *DB) NewContractFrom(seed []byte) (uint32, error) {
+	if len(seed) == 0 {
+		return 0, errBadRequest
+	}
+	contract := contractOf(seed)
+	db.internal.contracts.Lock()
+	defer db.internal.contracts.Unlock()
+	revoked, ok := db.internal.contracts.revoked[contract]
+	switch {
+	case revoked:
+		return 0, errForbidden
+	case ok:
+		return contract, nil
+	}
+	if err := db.addContract(contract); err != nil {
+		return 0, err
+	}
+	return contract, nil
+}
+
+// addContract records the contract. The caller must hold the contracts lock.
+func (db *DB) addContract(contract uint32) error {
+	// Contracts are not recorded by a read-only DB as it does not write DB files.
+	if db.opts.flags.readOnly {
 		return nil
 	}
+	db.internal.contracts.revoked[contract] = false
+	if err := db.writeContracts(); err != nil {
+		delete(db.internal.contracts.revoked, contract)
+		return err
+	}
+	return nil
+}
 
-	// Sync happens synchronously.
-	db.internal.syncLockC <- struct{}{}
-	db.internal.closeW.Add(1)
-	defer func() {
-		db.internal.closeW.Done()
-		<-db.internal.syncLockC
-	}()
+// Contracts returns contracts created using NewContract that are not revoked.
+func (db *DB) Contracts() ([]uint32, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	db.internal.contracts.RLock()
+	defer db.internal.contracts.RUnlock()
+	contracts := make([]uint32, 0, len(db.internal.contracts.revoked))
+	for contract, revoked := range db.internal.contracts.revoked {
+		if !revoked {
+			contracts = append(contracts, contract)
+		}
+	}
+	sort.Slice(contracts, func(i, j int) bool { return contracts[i] < contracts[j] })
+	return contracts, nil
+}
 
-	if ok := db.internal.syncHandle.startSync(); !ok {
+// RevokeContract revokes the contract so puts, deletes and queries using the contract return
+// errForbidden. Messages of the contract are kept in the DB but can no longer be read. The master
+// contract cannot be revoked.
+func (db *DB) RevokeContract(contract uint32) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if db.opts.flags.readOnly || contract == message.MasterContract || contract == 0 {
+		return errForbidden
+	}
+	db.internal.contracts.Lock()
+	defer db.internal.contracts.Unlock()
+	revoked, ok := db.internal.contracts.revoked[contract]
+	if revoked {
 		return nil
 	}
-	defer func() {
+	db.internal.contracts.revoked[contract] = true
+	if err := db.writeContracts(); err != nil {
+		if ok {
+			db.internal.contracts.revoked[contract] = false
+		} else {
+			delete(db.internal.contracts.revoked, contract)
+		}
+		return err
+	}
+	return nil
+}
+
+// NewID generates new ID that is later used to put entry or delete entry.
+func (db *DB) NewID() []byte {
+	db.internal.meter.Leases.Inc(1)
+	return message.NewID(db.nextSeq())
+}
+
+// Put puts entry into DB. It uses default Contract to put entry into DB.
+// It is safe to modify the contents of the argument after Put returns but not
+// before.
+func (db *DB) Put(topic, payload []byte) error {
+	return db.PutEntry(NewEntry(topic, payload))
+}
+
+// PutEntry puts entry into the DB, if Contract is not specified then it uses master Contract.
+// The ID and payload of the entry are reset once it is put, use PutWithResult to get the ID
+// assigned to the message.
+// It is safe to modify the contents of the argument after PutEntry returns but not
+// before.
+func (db *DB) PutEntry(e *Entry) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if db.opts.flags.readOnly {
+		return errForbidden
+	}
+	if err := db.validateEntry(e); err != nil {
+		return err
+	}
+	if e.dedupKey != nil {
+		_, _, err := db.putDedup(e)
+		return err
+	}
+	return db.putEntry(e)
+}
+
+// PutWithResult puts entry into the DB as PutEntry does and returns the ID and sequence of the
+// message, such as to reference the message in a reply or to delete it later. The ID has the
+// contract of the entry and can be used with DB.Delete.
+// It is safe to modify the contents of the argument after PutWithResult returns but not
+// before.
+func (db *DB) PutWithResult(e *Entry) (message.ID, uint64, error) {
+	if err := db.ok(); err != nil {
+		return nil, 0, err
+	}
+	if db.opts.flags.readOnly {
+		return nil, 0, errForbidden
+	}
+	if err := db.validateEntry(e); err != nil {
+		return nil, 0, err
+	}
+	if e.dedupKey != nil {
+		return db.putDedup(e)
+	}
+	return db.putResult(e)
+}
+
+// putResult puts the validated entry into the DB and returns the ID and sequence of the message.
+func (db *DB) putResult(e *Entry) (message.ID, uint64, error) {
+	// The sequence is taken and the entry written before the DB can be truncated.
+	db.internal.truncate.RLock()
+	defer db.internal.truncate.RUnlock()
+	if err := db.setEntry(e); err != nil {
+		return nil, 0, err
+	}
+	id, seq := e.messageID(), e.entry.seq
+	mu := db.internal.writeMutex.getMutex(e.entry.topicHash)
+	mu.RLock()
+	defer mu.RUnlock()
+	if err := db.writeEntry(e); err != nil {
+		return nil, 0, err
+	}
+	return id, seq, nil
+}
+
+// PutEntries puts entries into the DB. The topic of entries having the same topic and Contract is parsed
+// once. No entry is put if any of the entries is invalid. PutEntries is not atomic: entries are put one by
+// one, so entries put before a failed entry are kept and may be committed apart from later entries. Use
+// DB.Batch to put entries atomically.
+// It is safe to modify the contents of the arguments after PutEntries returns but not
+// before.
+func (db *DB) PutEntries(entries []*Entry) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if db.opts.flags.readOnly {
+		return errForbidden
+	}
+	for _, e := range entries {
+		if err := db.validateEntry(e); err != nil {
+			return err
+		}
+	}
+
+	type _TopicKey struct {
+		contract uint32
+		topic    string
+	}
+	parsed := make(map[_TopicKey]_Entry)
+	for _, e := range entries {
+		if e.Contract == 0 {
+			e.Contract = message.MasterContract
+		}
+		key := _TopicKey{contract: e.Contract, topic: string(e.Topic)}
+		if p, ok := parsed[key]; ok && !e.entry.parsed {
+			e.entry.topicHash = p.topicHash
+			e.entry.topicExpiresAt = p.topicExpiresAt
+			e.entry.parsed = true
+		}
+		if err := db.putEntry(e); err != nil {
+			return err
+		}
+		parsed[key] = e.entry
+	}
+	return nil
+}
+
+func (db *DB) validateEntry(e *Entry) error {
+	if e.alias != 0 {
+		topic, ok := db.internal.aliases.topic(e.alias)
+		if !ok {
+			return errAliasNotFound
+		}
+		e.Topic = topic
+	}
+	size := int64(len(e.Payload))
+	if e.reader != nil {
+		size = e.readerSize
+	}
+	switch {
+	case len(e.Topic) == 0:
+		return errTopicEmpty
+	case len(e.Topic) > maxTopicLength:
+		return errTopicTooLarge
+	case size <= 0:
+		return errValueEmpty
+	case size > db.opts.maxValueSize:
+		return errValueTooLarge
+	}
+	return nil
+}
+
+// putEntry puts the validated entry into the DB.
+func (db *DB) putEntry(e *Entry) error {
+	_, _, err := db.putResult(e)
+	return err
+}
+
+// Merge puts the entry for the topic with the payload returned from fn. The fn is called with
+// the payload of the most recent message of the topic, or nil if the topic has no messages, and
+// the payload of the entry. Merge holds the write lock of the topic from reading the latest payload
+// until the merged entry is put, so concurrent Put and Merge calls to the topic do not interleave.
+// Entries written by a Batch are not serialized with Merge.
+// It is safe to modify the contents of the argument after Merge returns but not
+// before.
+func (db *DB) Merge(e *Entry, fn func(old, new []byte) []byte) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if db.opts.flags.readOnly {
+		return errForbidden
+	}
+	if err := db.validateEntry(e); err != nil {
+		return err
+	}
+	t, err := db.parseEntryTopic(e)
+	if err != nil {
+		return err
+	}
+	mu := db.internal.writeMutex.getMutex(t.GetHash(e.Contract))
+	mu.Lock()
+	defer mu.Unlock()
+
+	var old []byte
+	msgs, err := db.Get(NewQuery(e.Topic).WithContract(e.Contract).WithLimit(1))
+	if err != nil {
+		return err
+	}
+	if len(msgs) > 0 {
+		old = msgs[0]
+	}
+	e.Payload = fn(old, e.Payload)
+	if err := db.validateEntry(e); err != nil {
+		return err
+	}
+	if err := db.setEntry(e); err != nil {
+		return err
+	}
+	return db.writeEntry(e)
+}
+
+// PutIf puts the entry only if the sequence of the most recent live message of the topic equals
+// expectedLast, and returns the sequence of the entry put. Use zero expectedLast for a topic with
+// no live messages. It returns errWriteConflict if the topic has changed, so writers can coordinate
+// on a topic by chaining the returned sequence. The check and the put are done under the write lock
+// of the topic, as in Merge.
+// It is safe to modify the contents of the argument after PutIf returns but not
+// before.
+func (db *DB) PutIf(e *Entry, expectedLast uint64) (uint64, error) {
+	if err := db.ok(); err != nil {
+		return 0, err
+	}
+	if db.opts.flags.readOnly {
+		return 0, errForbidden
+	}
+	if err := db.validateEntry(e); err != nil {
+		return 0, err
+	}
+	t, err := db.parseEntryTopic(e)
+	if err != nil {
+		return 0, err
+	}
+	mu := db.internal.writeMutex.getMutex(t.GetHash(e.Contract))
+	mu.Lock()
+	defer mu.Unlock()
+
+	_, last, err := db.bounds(t, e.Contract)
+	if err != nil {
+		return 0, err
+	}
+	if last != expectedLast {
+		return 0, errWriteConflict
+	}
+	if err := db.setEntry(e); err != nil {
+		return 0, err
+	}
+	seq := e.entry.seq
+	if err := db.writeEntry(e); err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// writeEntry writes the entry packed by setEntry into the mem DB.
+func (db *DB) writeEntry(e *Entry) error {
+	if e.entry.reserved {
+		defer db.internal.reserved.release(e.entry.seq)
+	}
+	if err := db.waitLog(); err != nil {
+		return err
+	}
+	timeID, err := db.internal.mem.Put(e.entry.seq, e.entry.cache)
+	if err != nil {
+		if e.ID == nil && e.seq == 0 {
+			db.releaseSeq(e.entry.seq)
+		}
+		return err
+	}
+
+	if ok := db.internal.timeWindow.add(timeID, e.entry.topicHash, newWinEntry(e.entry.seq, e.entry.expiresAt)); !ok {
+		return errForbidden
+	}
+
+	if e.entry.topicSize != 0 {
+		t := new(message.Topic)
+		rawTopic := e.entry.cache[entrySize+idSize : entrySize+idSize+e.entry.topicSize]
+		t.Unmarshal(rawTopic)
+		db.internal.trie.add(newTopic(e.entry.topicHash, 0), t.Parts, t.Depth, t.Topic)
+	}
+	db.retain(e.entry.topicHash, e.Contract, e.entry.seq, e.entry.valueSize)
+	db.notify(e.entry.topicHash, e.entry.seq, e.entry.expiresAt)
+
+	db.internal.meter.Puts.Inc(1)
+
+	// reset message entry.
+	e.reset()
+	return nil
+}
+
+// Delete sets entry for deletion.
+// It is safe to modify the contents of the argument after Delete returns but not
+// before.
+func (db *DB) Delete(id, topic []byte) error {
+	return db.DeleteEntry(NewEntry(topic, nil).WithID(id))
+}
+
+// DeleteEntry deletes an entry from DB. you must provide an ID to delete an entry.
+// It returns an error if the message ID does not exist in DB or the message
+// was not stored for the entry Contract.
+// It is safe to modify the contents of the argument after Delete returns but
+// not before.
+func (db *DB) DeleteEntry(e *Entry) error {
+	switch {
+	case db.opts.flags.readOnly:
+		return errForbidden
+	case db.opts.flags.immutable:
+		return errImmutable
+	case len(e.ID) == 0:
+		return errMsgIDEmpty
+	case len(e.Topic) == 0:
+		return errTopicEmpty
+	case len(e.Topic) > maxTopicLength:
+		return errTopicTooLarge
+	}
+	if e.Contract == 0 {
+		e.Contract = message.MasterContract
+	}
+	if err := db.checkContract(e.Contract); err != nil {
+		return err
+	}
+	topic, _, err := db.parseTopic(e.Contract, e.Topic)
+	if err != nil {
+		return err
+	}
+	topic.AddContract(e.Contract)
+	seq := message.ID(e.ID).Sequence()
+	if err := db.validateID(seq, e.Contract); err != nil {
+		return err
+	}
+
+	// Delete happens synchronously with sync so the index block is not overwritten by the sync.
+	db.internal.syncLockC <- struct{}{}
+	defer func() {
+		<-db.internal.syncLockC
+	}()
+	if err := db.delete(topic.GetHash(e.Contract), seq); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Has reports whether a message with the entry ID exists in the DB. The value is neither read nor
+// decoded, only the stored message ID prefix is matched with the entry Contract so an ID put under
+// another contract is reported as not found.
+func (db *DB) Has(e *Entry) (bool, error) {
+	if err := db.ok(); err != nil {
+		return false, err
+	}
+	if len(e.ID) == 0 {
+		return false, errMsgIDEmpty
+	}
+	if e.Contract == 0 {
+		e.Contract = message.MasterContract
+	}
+	if err := db.checkContract(e.Contract); err != nil {
+		return false, err
+	}
+	return db.has(message.ID(e.ID).Sequence(), e.Contract)
+}
+
+// Bounds returns sequences of the oldest and the most recent live messages of the topic, so a consumer
+// can resume reading the topic from a known sequence. Deleted and expired messages are skipped. It returns
+// zero first and last sequences if the topic has no live messages, as no message is put with sequence zero.
+func (db *DB) Bounds(topic []byte) (first, last uint64, err error) {
+	switch {
+	case len(topic) == 0:
+		return 0, 0, errTopicEmpty
+	case len(topic) > maxTopicLength:
+		return 0, 0, errTopicTooLarge
+	}
+	if err := db.ok(); err != nil {
+		return 0, 0, err
+	}
+	t, _, err := db.parseTopic(message.MasterContract, topic)
+	if err != nil {
+		return 0, 0, err
+	}
+	t.AddContract(message.MasterContract)
+	return db.bounds(t, message.MasterContract)
+}
+
+// Topics returns topics under the prefix. Wildcards in the prefix match topics the same way
+// as in DeleteTopic, and an empty prefix returns all topics. Only topics of the master contract
+// are returned, and topics put before topic strings were stored in the DB are not listed.
+func (db *DB) Topics(prefix []byte) ([][]byte, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	if len(prefix) > maxTopicLength {
+		return nil, errTopicTooLarge
+	}
+	if !bytes.HasSuffix(prefix, []byte(message.TopicGenericSymbol)) {
+		prefix = append(append([]byte{}, prefix...), message.TopicGenericSymbol...)
+	}
+	t, _, err := db.parseTopic(message.MasterContract, prefix)
+	if err != nil {
+		return nil, err
+	}
+	t.AddContract(message.MasterContract)
+	return db.internal.trie.names(t.Parts, t.Depth), nil
+}
+
+// ForEachTopic calls fn for each topic with the number of live messages of the topic and sequences of
+// the oldest and the most recent live messages, in sorted order of topics. Topics are listed the same
+// way as in Topics, and messages of a topic are counted only when the topic is visited. Iteration stops
+// at the first error returned by fn, and ForEachTopic returns that error.
+func (db *DB) ForEachTopic(fn func(topic []byte, count uint64, first, last uint64) error) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	t, _, err := db.parseTopic(message.MasterContract, []byte(message.TopicGenericSymbol))
+	if err != nil {
+		return err
+	}
+	t.AddContract(message.MasterContract)
+	for _, name := range db.internal.trie.names(t.Parts, t.Depth) {
+		if err := db.ok(); err != nil {
+			return err
+		}
+		topic, _, err := db.parseTopic(message.MasterContract, name)
+		if err != nil {
+			return err
+		}
+		topic.AddContract(message.MasterContract)
+		count, first, last, err := db.summary(topic, message.MasterContract)
+		if err != nil {
+			return err
+		}
+		if err := fn(name, count, first, last); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteTopic deletes a topic and all its messages from DB. If topic is a wildcard topic
+// then all topics matching the wildcard topic are deleted. DeleteTopic is not allowed on immutable DB.
+func (db *DB) DeleteTopic(topic []byte) error {
+	switch {
+	case db.opts.flags.readOnly:
+		return errForbidden
+	case db.opts.flags.immutable:
+		return errImmutable
+	case len(topic) == 0:
+		return errTopicEmpty
+	case len(topic) > maxTopicLength:
+		return errTopicTooLarge
+	}
+	if err := db.ok(); err != nil {
+		return err
+	}
+	t, _, err := db.parseTopic(message.MasterContract, topic)
+	if err != nil {
+		return err
+	}
+	t.AddContract(message.MasterContract)
+
+	topics := map[uint64]struct{}{t.GetHash(message.MasterContract): {}}
+	if t.TopicType == message.TopicWildcard {
+		for _, top := range db.internal.trie.match(t.Parts, t.Depth) {
+			topics[top.hash] = struct{}{}
+		}
+	}
+
+	db.internal.syncLockC <- struct{}{}
+	defer func() {
+		<-db.internal.syncLockC
+	}()
+
+	return db.deleteTopics(topics)
+}
+
+// Batch executes a function within the context of a read-write managed transaction.
+// If no error is returned from the function then the transaction is written.
+// If an error is returned then the entire transaction is rolled back.
+// Any error that is returned from the function or returned from the write is
+// returned from the Batch() method.
+//
+// Attempting to manually commit or rollback within the function will cause a panic.
+func (db *DB) Batch(fn func(*Batch, <-chan struct{}) error) error {
+	if db.opts.flags.readOnly {
+		return errForbidden
+	}
+	b := db.batch()
+
+	b.setManaged()
+
+	// If an error is returned from the function then rollback and return error.
+	if err := fn(b, b.commitComplete); err != nil {
+		b.unsetManaged()
+		b.Abort()
+		close(b.commitComplete)
+		return err
+	}
+	b.unsetManaged()
+	return b.Commit()
+}
+
+// BatchContext executes a function within the context of a managed batch like Batch,
+// but the batch is aborted if ctx is done before the function returns. Once ctx is done
+// puts and deletes on the batch return the context error so a long batch stops early,
+// and the buffered entries are discarded without being written to the write ahead log.
+// Entries already written by calling Batch.Write from the function are not rolled back.
+func (db *DB) BatchContext(ctx context.Context, fn func(*Batch) error) error {
+	if db.opts.flags.readOnly {
+		return errForbidden
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b := db.batch()
+	b.ctx = ctx
+
+	b.setManaged()
+
+	err := fn(b)
+	if err == nil {
+		err = ctx.Err()
+	}
+	b.unsetManaged()
+	if err != nil {
+		b.Abort()
+		close(b.commitComplete)
+		return err
+	}
+	return b.Commit()
+}
+
+// Flush commits the pending tiny batch to the write ahead log without waiting for the tiny batch
+// interval, and returns once the log is written. Unlike Sync, entries are not written to the DB
+// files and files are not synced to disk.
+func (db *DB) Flush() error {
+	if db.opts.flags.readOnly {
+		return nil
+	}
+	if err := db.ok(); err != nil {
+		return err
+	}
+	return db.internal.mem.Flush()
+}
+
+// SetSyncInterval sets the interval between background syncs, such as to sync more often
+// during quiet periods and less often under load. The interval set using WithMaxSyncDuration
+// applies until it is changed. A non-positive interval is ignored.
+func (db *DB) SetSyncInterval(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	atomic.StoreInt64(&db.internal.syncInterval, int64(d))
+	select {
+	case db.internal.syncIntervalC <- struct{}{}:
+	default:
+	}
+}
+
+// Sync syncs entries into DB. Sync happens synchronously.
+// Sync commits the pending tiny batch to the write ahead log, write window entries into summary file
+// and write index, and data to respective index and data files. The DB files and the DB info are synced
+// to disk before Sync returns, so all entries put before Sync is called are durable.
+// In case of any error during sync operation recovery is performed on log file (write ahead log).
+//
+// Sync blocks concurrent writers only while the pending tiny batch is written to the write ahead log.
+// Entries put while files are synced are written on the next Sync. Concurrent calls to Sync wait
+// for the sync in-progress to finish.
+func (db *DB) Sync() error {
+	if db.opts.flags.readOnly {
+		return nil
+	}
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if err := db.internal.mem.Flush(); err != nil {
+		return err
+	}
+
+	// Sync happens synchronously.
+	db.internal.syncLockC <- struct{}{}
+	db.internal.closeW.Add(1)
+	defer func() {
+		db.internal.closeW.Done()
+		<-db.internal.syncLockC
+	}()
+
+	if err := db.deleteEvicted(); err != nil {
+		return err
+	}
+	if ok := db.internal.syncHandle.startSync(); !ok {
+		return nil
+	}
+	defer func() {
 		db.internal.syncHandle.finish()
 	}()
 	return db.internal.syncHandle.Sync()
 }
 
+// BulkLoad puts entries received from the channel until the channel is closed, such as to import
+// an existing dataset. Entries put before BulkLoad are synced first, then entries are written directly
+// to the DB files in large sequential writes instead of the write ahead log, and the DB info is written
+// once all entries are written. BulkLoad is not crash safe: if the process crashes during the load, the
+// DB is to be discarded and loaded again. Writes to the DB files by Sync and other maintenance are held
+// off until BulkLoad returns. Entries received after an invalid entry are not put, and BulkLoad returns
+// the error of the invalid entry.
+func (db *DB) BulkLoad(entries <-chan *Entry) error {
+	if db.opts.flags.readOnly {
+		return errForbidden
+	}
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if err := db.internal.mem.Flush(); err != nil {
+		return err
+	}
+
+	db.internal.syncLockC <- struct{}{}
+	db.internal.closeW.Add(1)
+	defer func() {
+		db.internal.closeW.Done()
+		<-db.internal.syncLockC
+	}()
+	return db.bulkLoad(entries)
+}
+
+// PutReader puts the entry reading size bytes of its payload from r. The payload is written to
+// the data file in chunks as it is read, so a large payload is not held in memory. It is stored
+// uncompressed and cannot be encrypted. The message is written to the DB files directly, as
+// DB.BulkLoad does, and syncs are held off while the payload is read.
+func (db *DB) PutReader(e *Entry, r io.Reader, size int64) error {
+	e.reader, e.readerSize = r, size
+	defer func() {
+		e.reader, e.readerSize = nil, 0
+	}()
+	entries := make(chan *Entry, 1)
+	entries <- e
+	close(entries)
+	return db.BulkLoad(entries)
+}
+
+// Backup writes a consistent snapshot of the DB to w. Entries put before Backup is called are
+// synced to the DB files, and syncs are held off while the files are copied so writes continue
+// into the mem cache. Use Restore to reconstruct the DB from the backup.
+func (db *DB) Backup(w io.Writer) error {
+	if err := db.Sync(); err != nil {
+		return err
+	}
+	if err := db.ok(); err != nil {
+		return err
+	}
+	db.internal.syncLockC <- struct{}{}
+	db.internal.closeW.Add(1)
+	defer func() {
+		db.internal.closeW.Done()
+		<-db.internal.syncLockC
+	}()
+	return db.backup(w)
+}
+
+// BackupSince writes entries put after the sequence since to w and returns the sequence
+// of the DB at the time of the backup. Pass the returned sequence to the next BackupSince
+// to chain incremental backups on top of a full backup written by Backup. Entries deleted
+// after the previous backup are not removed on restore.
+func (db *DB) BackupSince(w io.Writer, since uint64) (uint64, error) {
+	if err := db.Sync(); err != nil {
+		return 0, err
+	}
+	if err := db.ok(); err != nil {
+		return 0, err
+	}
+	db.internal.syncLockC <- struct{}{}
+	db.internal.closeW.Add(1)
+	defer func() {
+		db.internal.closeW.Done()
+		<-db.internal.syncLockC
+	}()
+	return db.backupSince(w, since)
+}
+
+// RestoreIncremental puts entries from an incremental backup written by BackupSince to the DB
+// and syncs the DB. Incremental backups are restored in order on top of the DB restored from
+// the full backup. Checksums of messages are added or removed if the backup and the DB differ in
+// storing these. It returns the sequence of the DB at the time of the incremental backup.
+func (db *DB) RestoreIncremental(r io.Reader) (uint64, error) {
+	if err := db.ok(); err != nil {
+		return 0, err
+	}
+	if db.opts.flags.readOnly {
+		return 0, errForbidden
+	}
+	seq, err := db.restoreIncremental(r)
+	if err != nil {
+		return 0, err
+	}
+	return seq, db.Sync()
+}
+
+// Compact reclaims space of deleted and expired entries. Entries put before Compact is called are
+// synced to the DB files, and live entries are written to the start of a new data file along with
+// new index and window files. The new files are synced and then replace the DB files, so the DB is
+// left intact if Compact fails or the process crashes, and a Compact interrupted while the files are
+// replaced is finished when the DB is opened. Writes are held off in the mem cache and queries wait
+// until Compact returns.
+func (db *DB) Compact() (CompactStats, error) {
+	if db.opts.flags.readOnly {
+		return CompactStats{}, errForbidden
+	}
+	if err := db.Sync(); err != nil {
+		return CompactStats{}, err
+	}
+	if err := db.ok(); err != nil {
+		return CompactStats{}, err
+	}
+	db.internal.syncLockC <- struct{}{}
+	db.internal.closeW.Add(1)
+	defer func() {
+		db.internal.closeW.Done()
+		<-db.internal.syncLockC
+	}()
+	return db.compact()
+}
+
+// Truncate drops all messages and topics from the DB and resets the sequence, keeping the DB open.
+// Entries put but not yet synced are dropped along with the write ahead log. Contracts, retention
+// caps and encryption policies are kept. Writes and queries wait until Truncate returns, and a batch
+// started before Truncate fails to write. Truncate is not allowed on immutable DB.
+func (db *DB) Truncate() error {
+	switch {
+	case db.opts.flags.readOnly:
+		return errForbidden
+	case db.opts.flags.immutable:
+		return errImmutable
+	}
+	if err := db.ok(); err != nil {
+		return err
+	}
+	db.internal.syncLockC <- struct{}{}
+	db.internal.closeW.Add(1)
+	defer func() {
+		db.internal.closeW.Done()
+		<-db.internal.syncLockC
+	}()
+	return db.truncate()
+}
+
+// DefragLease coalesces adjacent free blocks of the lease file so larger values can reuse the freed
+// space. Free blocks are otherwise only coalesced when the DB is closed. The lease file is rewritten
+// with the merged free blocks.
+func (db *DB) DefragLease() (LeaseStats, error) {
+	if db.opts.flags.readOnly {
+		return LeaseStats{}, errForbidden
+	}
+	if err := db.ok(); err != nil {
+		return LeaseStats{}, err
+	}
+	db.internal.syncLockC <- struct{}{}
+	db.internal.closeW.Add(1)
+	defer func() {
+		db.internal.closeW.Done()
+		<-db.internal.syncLockC
+	}()
+	var stats LeaseStats
+	stats.FragmentsBefore, stats.FragmentsAfter = db.internal.freeList.defrag()
+	stats.FreeBytes = atomic.LoadInt64(&db.internal.freeList.size)
+	if err := db.internal.freeList.write(); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// Verify cross-checks the DB files for inconsistencies, such as after a crash. It reports index slots
+// that no window entry refers to, window entries without an index slot, index slots pointing outside
+// of the data file and index slots missing from the filter. Messages of a DB created WithChecksum
+// are checked against their checksums. Entries put since the last Sync are not written to the DB
+// files and are not verified. Verify does not change the DB files.
+func (db *DB) Verify() ([]Inconsistency, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	db.internal.syncLockC <- struct{}{}
+	db.internal.closeW.Add(1)
+	defer func() {
+		db.internal.closeW.Done()
+		<-db.internal.syncLockC
+	}()
+	return db.verify()
+}
+
+// SetTopicEncryption sets whether messages of the topic are always encrypted or never encrypted.
+// The topic policy takes precedence over encryption of the DB, the batch and the entry, and it applies
+// to the topic under any contract. Wildcard topics are not accepted. The policy is stored in the info
+// file so it is kept when the DB is reopened.
+func (db *DB) SetTopicEncryption(topic []byte, on bool) error {
+	if db.opts.flags.readOnly {
+		return errForbidden
+	}
+	if err := db.ok(); err != nil {
+		return err
+	}
+	t, _, err := db.parseTopic(message.MasterContract, topic)
+	if err != nil {
+		return err
+	}
+	if t.TopicType == message.TopicWildcard {
+		return errBadRequest
+	}
+	t.AddContract(message.MasterContract)
+	policy := message.EncryptionOff
+	if on {
+		policy = message.EncryptionOn
+	}
+	topicHash := t.GetHash(message.MasterContract)
+
+	db.internal.contracts.Lock()
+	defer db.internal.contracts.Unlock()
+	policies := db.internal.trie.encryptionPolicies()
+	policies[topicHash] = policy
+	if err := db.writeContractsWith(policies); err != nil {
+		return err
+	}
+	db.internal.trie.setEncryption(topicHash, policy)
+	return nil
+}
+
+// ReEncrypt rewrites messages encrypted using the DB encryption key or other keys of the key ring so they
+// are encrypted using the key with the key id. Old keys can be dropped from the key ring once ReEncrypt
+// returns. Messages are rewritten in place a chunk of index blocks at a time, and reads and syncs are held
+// off only while a chunk is rewritten; run it in a goroutine to rotate keys in the background.
+func (db *DB) ReEncrypt(keyID uint8) error {
+	if db.opts.flags.readOnly {
+		return errForbidden
+	}
+	if _, ok := db.internal.keyRing[keyID]; !ok {
+		return errKeyNotFound
+	}
+	if err := db.Sync(); err != nil {
+		return err
+	}
+	for start := int32(0); ; start += reEncryptBlocks {
+		done, err := db.reEncryptChunk(keyID, start)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// reEncryptChunk rewrites messages of a chunk of index blocks holding the sync lock.
+func (db *DB) reEncryptChunk(keyID uint8, start int32) (bool, error) {
+	if err := db.ok(); err != nil {
+		return false, err
+	}
+	db.internal.syncLockC <- struct{}{}
+	db.internal.closeW.Add(1)
+	defer func() {
+		db.internal.closeW.Done()
+		<-db.internal.syncLockC
+	}()
+	return db.reEncrypt(keyID, start)
+}
+
+// Refresh reads the DB files written by another DB and makes newly synced entries visible to
+// the DB opened in read-only mode. Refresh is a no-op if DB is not opened in read-only mode.
+// DB files are read using ReadAt so there is no mapping to extend when files grow.
+func (db *DB) Refresh() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if !db.opts.flags.readOnly {
+		return nil
+	}
+
+	db.internal.syncLockC <- struct{}{}
+	defer func() {
+		<-db.internal.syncLockC
+	}()
+
+	var dbInfo _DBInfo
+	if err := db.internal.info.readUnmarshalableAt(&dbInfo, fixed, 0); err != nil {
+		logger.Error().Err(err).Str("context", "db.Refresh")
+		return err
+	}
+	atomic.StoreUint64(&db.internal.dbInfo.sequence, dbInfo.sequence)
+	atomic.StoreUint64(&db.internal.dbInfo.count, dbInfo.count)
+	if err := db.readContracts(); err != nil {
+		logger.Error().Err(err).Str("context", "db.Refresh")
+		return err
+	}
+
+	return db.refreshTrie()
+}
+
+// StorageBreakdown provides bytes used by each component of the DB storage.
+type StorageBreakdown struct {
+	// LiveData is the size of IDs and payloads of live entries in the data file.
+	LiveData int64
+	// Free is the size of free blocks in the data file reused for new entries.
+	Free int64
+	// Topics is the size of topics stored along with live entries in the data file.
+	Topics int64
+	// Index is the size of index, window, filter, lease and info files.
+	Index int64
+	// WAL is the size of the write ahead log.
+	WAL int64
+	// Total is the total size of the DB files and the write ahead log.
+	Total int64
+}
+
+// StorageBreakdown returns bytes used by live data, free space, topics, index and the write ahead log.
+// It reads index blocks of the DB but does not read payloads from the data file. Entries not yet synced
+// to the DB files are only accounted in the size of the write ahead log.
+func (db *DB) StorageBreakdown() (StorageBreakdown, error) {
+	if err := db.ok(); err != nil {
+		return StorageBreakdown{}, err
+	}
+	return db.storageBreakdown()
+}
+
+// DiskUsage provides bytes used on disk by each of the DB files.
+type DiskUsage struct {
+	// Index is the size of the index file.
+	Index int64
+	// Data is the size of the data file.
+	Data int64
+	// Window is the size of the time window file.
+	Window int64
+	// Lease is the size of the lease file holding free blocks of the data file.
+	Lease int64
+	// Filter is the size of the filter file.
+	Filter int64
+	// Info is the size of the info file holding the DB header and contracts.
+	Info int64
+	// Log is the size of the write ahead log.
+	Log int64
+	// Total is the total size of the DB files and the write ahead log.
+	Total int64
+}
+
+// DiskUsage returns the size of each of the DB files and the write ahead log, such as to monitor
+// which of the files grows.
+func (db *DB) DiskUsage() (DiskUsage, error) {
+	if err := db.ok(); err != nil {
+		return DiskUsage{}, err
+	}
+	u := DiskUsage{
+		Index:  db.fs.sizeOf(typeIndex),
+		Data:   db.fs.sizeOf(typeData),
+		Window: db.fs.sizeOf(typeTimeWindow),
+		Lease:  db.fs.sizeOf(typeLease),
+		Filter: db.fs.sizeOf(typeFilter),
+		Info:   db.fs.sizeOf(typeInfo),
+		Log:    db.internal.mem.LogSize(),
+	}
+	u.Total = u.Index + u.Data + u.Window + u.Lease + u.Filter + u.Info + u.Log
+	return u, nil
+}
+
 // FileSize returns the total size of the disk storage used by the DB.
 func (db *DB) FileSize() (int64, error) {
 	return db.fs.size()
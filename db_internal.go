@@ -17,6 +17,9 @@
 package unitdb
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"io"
 	"math"
@@ -25,7 +28,6 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/golang/snappy"
 	"github.com/unit-io/bpool"
 	"github.com/unit-io/unitdb/crypto"
 	"github.com/unit-io/unitdb/memdb"
@@ -36,7 +38,7 @@ const (
 	entriesPerIndexBlock  = 255 // (4096 i.e blocksize - 14 fixed/16 i.e entry size)
 	entriesPerWindowBlock = 335 // ((4096 i.e. blocksize - 26 fixed)/12 i.e. window entry size)
 	nBlocks               = 100000
-	nShards               = 27
+	nShards               = 32
 	nPoolSize             = 27
 	lockPostfix           = ".lock"
 	idSize                = 9 // message ID prefix with additional encryption bit.
@@ -66,17 +68,52 @@ const (
 	maxSeq = math.MaxUint64
 )
 
+// Key ids are stored in the low nibble of the last byte of the message ID to select the encryption key
+// on read. The high nibble stores the compression codec id.
+const (
+	keyNone     uint8 = iota // message is not encrypted.
+	keyDB                    // message is encrypted using DB encryption key.
+	keyContract              // message is encrypted using encryption key of the message contract.
+	// key ids after keyContract select the key of the key ring, such as keyContract+1 for the key with id 1.
+)
+
+// maxKeyRingID is the maximum id of a key in the key ring as key ids are stored in a nibble.
+const maxKeyRingID = 0x0f - keyContract
+
+// flagMultiPart is set in the high bit of the last byte of the message ID if the payload is stored
+// in parts, so codec ids use the remaining three bits of the high nibble.
+const (
+	flagMultiPart uint8 = 0x80
+	maxCodecID    uint8 = 0x07
+)
+
 type (
 	_DB struct {
 		mutex _Mutex
+		// writeMutex serializes Merge with other writes to the topic.
+		writeMutex _Mutex
+		// truncate holds off puts taking a sequence while the DB is truncated, and truncates counts
+		// Truncate calls so batches taking sequences before the DB is truncated are not written.
+		truncate  sync.RWMutex
+		truncates uint64
+		// dedup skips puts of dedup keys seen within the dedup window.
+		dedup *_Dedup
 
 		// The db start time.
 		start time.Time
 		// The metrics to measure timeseries on message events.
 		meter *Meter
 
-		dbInfo _DBInfo
-		mac    *crypto.MAC
+		dbInfo       _DBInfo
+		mac          Cipher
+		contractMacs map[uint32]*crypto.MAC
+		keyRing      map[uint8]*crypto.MAC
+		contracts    *_Contracts
+		aliases      *_Aliases
+		retention    *_Retention
+		loaded       *_Loaded
+		reserved     *_Reserved
+		storedTopics _StoredTopics
 
 		mem      *memdb.DB
 		bufPool  *bpool.BufferPool
@@ -84,6 +121,9 @@ type (
 		filter   Filter
 		freeList *_Lease
 
+		// decodePool holds scratch buffers to read and decrypt messages before these are decoded.
+		decodePool sync.Pool
+
 		timeWindow *_TimeWindowBucket
 
 		// Trie
@@ -92,16 +132,26 @@ type (
 		// Block reader
 		reader *_BlockReader
 
+		// filterRebuilt is the number of entries added to the filter rebuilt on open.
+		filterRebuilt int64
+
+		// subscribers are notified of entries put to the DB.
+		subscribers _Subscribers
+
 		// sync handler
 		syncLockC  chan struct{}
 		syncWrites bool
 		syncHandle _SyncHandle
 
+		// syncInterval is the interval of background sync, and syncIntervalC signals the
+		// syncer once it is changed.
+		syncInterval  int64
+		syncIntervalC chan struct{}
+
 		// Close.
 		closeW sync.WaitGroup
 		closeC chan struct{}
 		closed uint32
-		closer io.Closer
 	}
 )
 
@@ -112,6 +162,7 @@ func (db *DB) writeInfo() error {
 			version:   version,
 		},
 		encryption: db.internal.dbInfo.encryption,
+		checksum:   db.internal.dbInfo.checksum,
 		sequence:   atomic.LoadUint64(&db.internal.dbInfo.sequence),
 		count:      atomic.LoadUint64(&db.internal.dbInfo.count),
 	}
@@ -139,64 +190,200 @@ func (db *DB) close() error {
 	// close memdb.
 	db.internal.mem.Close()
 
-	if err := db.writeInfo(); err != nil {
-		return err
-	}
-	db.internal.freeList.defrag()
-	if err := db.internal.freeList.write(); err != nil {
-		return err
+	if !db.opts.flags.readOnly {
+		if err := db.writeInfo(); err != nil {
+			return err
+		}
+		db.internal.freeList.defrag()
+		if err := db.internal.freeList.write(); err != nil {
+			return err
+		}
 	}
 	if err := db.fs.close(); err != nil {
 		return err
 	}
-	if err := db.lock.unlock(); err != nil {
-		return err
-	}
-
-	var err error
-	if db.internal.closer != nil {
-		if err1 := db.internal.closer.Close(); err1 != nil {
-			err = err1
+	if db.lock != nil {
+		if err := db.lock.Unlock(); err != nil {
+			return err
 		}
-		db.internal.closer = nil
 	}
 
 	db.internal.meter.UnregisterAll()
 
+	return nil
+}
+
+// abortOpen closes the DB opened partially once opening the DB fails or is canceled and returns err. Entries
+// recovered into the mem DB are written to the log before it is closed. The DB info and the free list
+// are not written as these are not fully read or recovered.
+func (db *DB) abortOpen(err error) error {
+	db.setClosed()
+	close(db.internal.closeC)
+	if !db.opts.flags.readOnly {
+		db.internal.mem.Flush()
+	}
+	db.internal.mem.Close()
+	db.fs.close()
+	if db.lock != nil {
+		db.lock.Unlock()
+	}
+	db.internal.meter.UnregisterAll()
 	return err
 }
 
-// loadTopicHash loads topic and offset from window file.
-func (db *DB) loadTrie() error {
+// loadTopicHash loads topic and offset from window file. It stops loading topics if ctx is canceled.
+func (db *DB) loadTrie(ctx context.Context, progress *_Progress) error {
 	r := newWindowReader(db.fs)
 	err := r.foreachWindowBlock(func(startSeq, topicHash uint64, off int64) (bool, error) {
+		if err := ctx.Err(); err != nil {
+			return true, err
+		}
+		progress.report(progress.logs + int(off/int64(blockSize)) + 1)
 		// fmt.Println("db.loadTrie: topicHash, seq ", topicHash, startSeq)
-		e, err := db.internal.reader.readEntry(startSeq)
+		t, err := db.readFirstTopic(topicHash, startSeq)
 		if err != nil {
 			return true, err
 		}
-		if e.topicSize == 0 {
+		if t == nil {
 			// fmt.Println("db.loadTrie: topic not found topicHash, seq ", topicHash, startSeq)
 			return false, nil
 		}
-		rawtopic, err := db.internal.reader.readTopic(e)
-		if err != nil {
-			return true, err
-		}
-		t := new(message.Topic)
-		err = t.Unmarshal(rawtopic)
-		if err != nil {
-			return true, err
-		}
-		if ok := db.internal.trie.add(newTopic(topicHash, off), t.Parts, t.Depth); !ok {
+		db.internal.trie.initEncryption(topicHash, t.Encryption)
+		if ok := db.internal.trie.add(newTopic(topicHash, off), t.Parts, t.Depth, t.Topic); !ok {
 			logger.Info().Str("context", "db.loadTrie: topic exist in the trie")
 			return false, nil
 		}
 		return false, nil
 	})
+	if err == nil {
+		progress.report(progress.logs + progress.winBlocks)
+	}
 	return err
 }
 
+// readFirstTopic reads the topic stored along with the first entry of the topic, or the topic stored
+// in the info file once the first entry is evicted. It returns nil if the topic is not found.
+func (db *DB) readFirstTopic(topicHash, seq uint64) (*message.Topic, error) {
+	var rawTopic []byte
+	e, err := db.internal.reader.readEntry(seq)
+	switch {
+	case err == errMsgIDDeleted || (err == nil && e.topicSize == 0):
+		var ok bool
+		if rawTopic, ok = db.storedTopic(topicHash); !ok {
+			return nil, nil
+		}
+	case err != nil:
+		return nil, err
+	default:
+		if rawTopic, err = db.internal.reader.readTopic(e); err != nil {
+			return nil, err
+		}
+	}
+	t := new(message.Topic)
+	if err := t.Unmarshal(rawTopic); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// storageBreakdown sums entry sizes from index blocks and sizes of DB files.
+func (db *DB) storageBreakdown() (StorageBreakdown, error) {
+	db.internal.syncLockC <- struct{}{}
+	defer func() {
+		<-db.internal.syncLockC
+	}()
+
+	var s StorageBreakdown
+	indexFile, err := db.fs.getFile(_FileDesc{fileType: typeIndex})
+	if err != nil {
+		return s, err
+	}
+	dataFile, err := db.fs.getFile(_FileDesc{fileType: typeData})
+	if err != nil {
+		return s, err
+	}
+	nBlocks := int32((indexFile.currSize() + int64(blockSize) - 1) / int64(blockSize))
+	r := _BlockReader{indexFile: indexFile}
+	for bIdx := int32(0); bIdx < nBlocks; bIdx++ {
+		r.offset = blockOffset(bIdx)
+		b, err := r.readIndexBlock()
+		if err != nil {
+			return s, err
+		}
+		for i := 0; i < int(b.entryIdx) && i < entriesPerIndexBlock; i++ {
+			e := b.entries[i]
+			if e.seq == 0 || e.msgOffset == -1 {
+				continue
+			}
+			s.LiveData += int64(idSize) + int64(e.valueSize)
+			s.Topics += int64(e.topicSize)
+		}
+	}
+	s.Free = atomic.LoadInt64(&db.internal.freeList.size)
+
+	total, err := db.fs.size()
+	if err != nil {
+		return s, err
+	}
+	s.Index = total - dataFile.currSize()
+	s.WAL = db.internal.mem.LogSize()
+	s.Total = total + s.WAL
+
+	return s, nil
+}
+
+// refreshTrie reads winBlocks written by another DB and sets last offset of each topic into trie.
+// Topics not yet in the trie are added using the first entry of the topic.
+func (db *DB) refreshTrie() error {
+	type _TopicBlock struct {
+		startSeq uint64
+		off      int64
+	}
+	topics := make(map[uint64]_TopicBlock)
+	r := newWindowReader(db.fs)
+	for windowIdx := int32(0); windowIdx <= r.windowIdx; windowIdx++ {
+		r.offset = winBlockOffset(windowIdx)
+		b, err := r.readWindowBlock()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		if b.entryIdx == 0 {
+			continue
+		}
+		t := topics[b.topicHash]
+		if b.next == 0 {
+			t.startSeq = b.entries[0].sequence
+		}
+		if r.offset > t.off {
+			t.off = r.offset
+		}
+		topics[b.topicHash] = t
+	}
+
+	for topicHash, tb := range topics {
+		if _, ok := db.internal.trie.getOffset(topicHash); ok {
+			db.internal.trie.setOffset(_Topic{hash: topicHash, offset: tb.off})
+			continue
+		}
+		if tb.startSeq == 0 {
+			continue
+		}
+		t, err := db.readFirstTopic(topicHash, tb.startSeq)
+		if err != nil {
+			return err
+		}
+		if t == nil {
+			continue
+		}
+		db.internal.trie.initEncryption(topicHash, t.Encryption)
+		db.internal.trie.add(newTopic(topicHash, tb.off), t.Parts, t.Depth, t.Topic)
+	}
+	return nil
+}
+
 func (db *DB) readEntry(q _Query) (_IndexEntry, error) {
 	data, _ := db.internal.mem.Get(q.seq)
 	if data != nil {
@@ -212,32 +399,399 @@ func (db *DB) readEntry(q _Query) (_IndexEntry, error) {
 		return e, nil
 	}
 
-	return db.internal.reader.readEntry(q.seq)
+	e, err := db.internal.reader.readEntry(q.seq)
+	if err == errEntryInvalid || err == io.EOF {
+		// entry is neither in mem cache nor persisted, i.e. it was deleted before sync.
+		return _IndexEntry{}, errMsgIDDeleted
+	}
+	return e, err
+}
+
+// get reads messages matching the query in the query order and calls fn for each message.
+func (db *DB) get(q *Query, fn func(Message) error) error {
+	if err := db.prepareQuery(q); err != nil {
+		return err
+	}
+	return db.readQuery(q, fn)
+}
+
+// prepareQuery validates and parses the query and then lookups window entries matching the query
+// sorted in the query order.
+func (db *DB) prepareQuery(q *Query) error {
+	if err := db.parseQuery(q); err != nil {
+		return err
+	}
+	mu := db.internal.mutex.getMutex(q.internal.prefix)
+	mu.RLock()
+	defer mu.RUnlock()
+	return db.lookup(q)
+}
+
+// parseQuery validates and parses the query.
+func (db *DB) parseQuery(q *Query) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	switch {
+	case len(q.Topic) == 0:
+		return errTopicEmpty
+	case len(q.Topic) > maxTopicLength:
+		return errTopicTooLarge
+	}
+	// // CPU profiling by default
+	// defer profile.Start().Stop()
+	q.internal.opts = &_QueryOptions{defaultQueryLimit: db.opts.queryOptions.defaultQueryLimit, maxQueryLimit: db.opts.queryOptions.maxQueryLimit}
+	if err := q.parse(); err != nil {
+		return err
+	}
+	if err := db.checkContract(q.Contract); err != nil {
+		return err
+	}
+	q.internal.next = 0
+	q.internal.sources = nil
+	return nil
+}
+
+// getBatch prepares all queries using a single pass over the trie and reads messages
+// for each query. Queries sharing a mutex are looked up under one read lock.
+func (db *DB) getBatch(qs []*Query) ([][][]byte, error) {
+	for _, q := range qs {
+		if err := db.parseQuery(q); err != nil {
+			return nil, err
+		}
+	}
+	topics := db.internal.trie.lookupBatch(qs)
+	locks := make(map[*sync.RWMutex][]int)
+	for i, q := range qs {
+		mu := db.internal.mutex.getMutex(q.internal.prefix)
+		locks[mu] = append(locks[mu], i)
+	}
+	for mu, idx := range locks {
+		mu.RLock()
+		for _, i := range idx {
+			db.lookupTopics(qs[i], topics[i])
+		}
+		mu.RUnlock()
+	}
+	items := make([][][]byte, len(qs))
+	for i, q := range qs {
+		if err := db.readQuery(q, func(m Message) error {
+			items[i] = append(items[i], m.Payload)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// readQuery reads messages for window entries of a prepared query and calls fn for each message.
+// Deleted entries or entries not matching the query contract do not count towards the query limit.
+// The read lock is held only while reading a message so fn is free to block.
+func (db *DB) readQuery(q *Query, fn func(Message) error) error {
+	mu := db.internal.mutex.getMutex(q.internal.prefix)
+	var count int
+	var size int64
+	defer func() {
+		q.internal.count = count
+		db.internal.meter.Gets.Inc(int64(count))
+		if !q.internal.countOnly {
+			db.internal.meter.OutMsgs.Inc(int64(count))
+		}
+	}()
+	for _, query := range q.internal.winEntries {
+		if !q.internal.countOnly && count == q.Limit {
+			break
+		}
+		if err := q.internal.canceled(); err != nil {
+			return err
+		}
+		if query.seq == 0 {
+			continue
+		}
+		if q.internal.countOnly {
+			mu.RLock()
+			ok, err := db.countMessage(q, query)
+			mu.RUnlock()
+			if err != nil {
+				return err
+			}
+			if ok {
+				count++
+				q.internal.next = query.seq
+			}
+			continue
+		}
+		mu.RLock()
+		m, err := db.readMessage(q, query)
+		mu.RUnlock()
+		if err != nil {
+			if err == errMsgIDDeleted || err == errMsgIDPrefixMismatch {
+				continue
+			}
+			return err
+		}
+		if q.internal.limitBytes != 0 {
+			size += int64(len(m.Payload))
+			if count != 0 && size > q.internal.limitBytes {
+				break
+			}
+		}
+		if err := fn(m); err != nil {
+			return err
+		}
+		if q.internal.source {
+			q.internal.sources = append(q.internal.sources, m.FromCache)
+		}
+		count++
+		q.internal.next = query.seq
+	}
+
+	return nil
+}
+
+// countMessage reports whether the message matches the query, reading its ID but not its payload.
+func (db *DB) countMessage(q *Query, query _Query) (bool, error) {
+	s, err := db.readEntry(query)
+	if err == errMsgIDDeleted {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	id, err := db.internal.reader.readID(s)
+	if err != nil {
+		return false, err
+	}
+	msgID := message.ID(id)
+	return msgID.EvalPrefix(q.Contract, q.internal.cutoff) && msgID.EvalTime(q.internal.cutoff, q.internal.end), nil
+}
+
+// readMessage reads message from mem cache or from the DB files and decodes its payload.
+func (db *DB) readMessage(q *Query, query _Query) (Message, error) {
+	s, err := db.readEntry(query)
+	if err == errMsgIDDeleted && db.opts.loader != nil {
+		return db.load(q, query)
+	}
+	if err != nil {
+		if err != errMsgIDDeleted {
+			logger.Error().Err(err).Str("context", "db.readEntry")
+		}
+		return Message{}, err
+	}
+	buf := db.getDecodeBuffer()
+	id, val, err := db.internal.reader.readMessage(s, buf)
+	if err != nil {
+		db.putDecodeBuffer(buf)
+		logger.Error().Err(err).Str("context", "data.readMessage")
+		return Message{}, err
+	}
+	msgID := message.ID(id)
+	if !msgID.EvalPrefix(q.Contract, q.internal.cutoff) || !msgID.EvalTime(q.internal.cutoff, q.internal.end) {
+		db.putDecodeBuffer(buf)
+		return Message{}, errMsgIDPrefixMismatch
+	}
+	return db.decodeMessage(query, s, id, val, q.Contract, buf)
+}
+
+// decodeMessage decrypts and decompresses the value of the entry read for the query into a message.
+// The buffer the message is read into is put back to the pool once the payload no longer refers to it.
+func (db *DB) decodeMessage(query _Query, s _IndexEntry, id, val []byte, contract uint32, buf *_DecodeBuffer) (Message, error) {
+	msgID := message.ID(id)
+
+	// last byte of ID is the encryption key id and the compression codec id.
+	if keyID := uint8(id[idSize-1]) & 0x0f; keyID != keyNone {
+		mac, err := db.cipher(keyID, contract)
+		if err != nil {
+			logger.Error().Err(err).Str("context", "db.cipher")
+			return Message{}, err
+		}
+		// decrypt into the buffer only using the MAC of the DB as it decrypts into dst.
+		var dst []byte
+		_, pooled := mac.(*crypto.MAC)
+		if pooled && buf != nil {
+			dst = buf.plain[:0]
+		}
+		val, err = mac.Decrypt(dst, val)
+		if err != nil {
+			logger.Error().Err(err).Str("context", "mac.decrypt")
+			return Message{}, err
+		}
+		if pooled && buf != nil {
+			buf.plain = val
+		}
+	}
+	codec, err := getCodec(compressionOf(uint8(id[idSize-1]) >> 4 & maxCodecID))
+	if err != nil {
+		logger.Error().Err(err).Str("context", "db.getCodec")
+		return Message{}, err
+	}
+	val, err = codec.Decode(val)
+	if err != nil {
+		logger.Error().Err(err).Str("context", "codec.Decode")
+		return Message{}, err
+	}
+	// snappy decodes into a new payload, other codecs may return the value read into the buffer.
+	if _, ok := codec.(snappyCodec); ok && buf != nil {
+		db.putDecodeBuffer(buf)
+	}
+	var parts [][]byte
+	if uint8(id[idSize-1])&flagMultiPart != 0 {
+		if parts, err = splitParts(val); err != nil {
+			logger.Error().Err(err).Str("context", "db.splitParts")
+			return Message{}, err
+		}
+		val = bytes.Join(parts, nil)
+	}
+	db.internal.meter.OutBytes.Inc(int64(s.valueSize))
+
+	// message ID is stored without sequence.
+	mID := make([]byte, msgID.Size())
+	copy(mID, msgID.Prefix())
+	binary.LittleEndian.PutUint64(mID[8:], s.seq)
+
+	return Message{ID: mID, Seq: s.seq, Topic: db.topicName(query.topicHash), Payload: val, Parts: parts, ExpiresAt: expiryTime(query.expiresAt), FromCache: s.cache != nil}, nil
+}
+
+// topicName returns a copy of the topic string of the topic.
+func (db *DB) topicName(topicHash uint64) []byte {
+	name := db.internal.trie.name(topicHash)
+	if name == nil {
+		return nil
+	}
+	return append([]byte{}, name...)
+}
+
+// expiryTime returns the expiry time of an entry, or zero time if the entry does not expire.
+func expiryTime(expiresAt uint32) time.Time {
+	if expiresAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(expiresAt), 0)
 }
 
 // lookups are performed in following order
 // ilookup lookups in memory entries from timeWindow
 // lookup lookups persisted entries from timeWindow file.
 func (db *DB) lookup(q *Query) error {
-	topics := db.internal.trie.lookup(q.internal.parts, q.internal.depth, q.internal.topicType)
+	var topics _Topics
+	if q.internal.regex != nil {
+		topics = db.internal.trie.regex(q.internal.parts, q.internal.regex)
+	} else {
+		topics = db.internal.trie.lookup(q.internal.parts, q.internal.depth, q.internal.topicType)
+	}
+	return db.lookupTopics(q, topics)
+}
+
+// lookupTopics lookups window entries of the topics matching the query sorted in the query order.
+func (db *DB) lookupTopics(q *Query, topics _Topics) error {
+	if len(q.internal.exclusions) != 0 {
+		topics = db.internal.trie.exclude(topics, q.internal.exclusions)
+	}
+	topics = append(_Topics(nil), topics...)
 	sort.Slice(topics[:], func(i, j int) bool {
 		return topics[i].offset > topics[j].offset
 	})
+	// oldest entries are at the end of window blocks chain so all entries are
+	// looked up when results are requested in ascending order.
+	// The cursor bounds entries strictly before it in descending order and strictly after it in ascending order.
+	lookupLimit := q.Limit
+	before := q.internal.cursor
+	if q.internal.countOnly || q.internal.end != 0 {
+		// entries newer than the time range are skipped on read so they must not count towards the lookup limit.
+		lookupLimit = math.MaxInt32
+	}
+	if q.internal.order == Ascending {
+		lookupLimit = math.MaxInt32
+		before = 0
+	}
+	if q.internal.seqRange {
+		// before wraps to zero for the largest sequence and leaves the range open.
+		before = q.internal.toSeq + 1
+	}
+	q.internal.winEntries = q.internal.winEntries[:0]
 	for _, topic := range topics {
-		if len(q.internal.winEntries) > q.Limit {
+		if len(q.internal.winEntries) > lookupLimit {
 			break
 		}
-		limit := q.Limit - len(q.internal.winEntries)
-		wEntries := db.internal.timeWindow.lookup(db.fs, topic.hash, topic.offset, q.internal.cutoff, limit)
+		if err := q.internal.canceled(); err != nil {
+			return err
+		}
+		limit := lookupLimit - len(q.internal.winEntries)
+		wEntries := db.internal.timeWindow.lookup(db.fs, topic.hash, topic.offset, q.internal.cutoff, before, limit)
 		for _, we := range wEntries {
-			q.internal.winEntries = append(q.internal.winEntries, _Query{topicHash: topic.hash, seq: we.seq()})
+			if q.internal.order == Ascending && q.internal.cursor != 0 && we.seq() <= q.internal.cursor {
+				continue
+			}
+			if q.internal.seqRange && we.seq() < q.internal.fromSeq {
+				continue
+			}
+			q.internal.winEntries = append(q.internal.winEntries, _Query{topicHash: topic.hash, seq: we.seq(), expiresAt: we.expiryTime()})
 		}
 		// fmt.Println("db.lookup: topicHash, count ", topic.hash, len(wEntries))
 	}
+	sort.Slice(q.internal.winEntries[:], func(i, j int) bool {
+		if q.internal.order == Ascending {
+			return q.internal.winEntries[i].seq < q.internal.winEntries[j].seq
+		}
+		return q.internal.winEntries[i].seq > q.internal.winEntries[j].seq
+	})
 
 	return nil
 }
 
+// cipher returns the cipher to decrypt a message for the key id and contract.
+func (db *DB) cipher(keyID uint8, contract uint32) (Cipher, error) {
+	switch keyID {
+	case keyDB:
+		return db.internal.mac, nil
+	case keyContract:
+		if mac, ok := db.internal.contractMacs[contract]; ok {
+			return mac, nil
+		}
+	default:
+		if mac, ok := db.internal.keyRing[keyID-keyContract]; ok {
+			return mac, nil
+		}
+	}
+	return nil, errKeyNotFound
+}
+
+// encrypt reports whether the message of the entry is to be encrypted. The encryption policy of
+// the topic takes precedence over encryption of the DB and the entry.
+func (db *DB) encrypt(e *Entry) bool {
+	switch db.topicEncryption(e) {
+	case message.EncryptionOn:
+		return true
+	case message.EncryptionOff:
+		return false
+	}
+	return db.internal.dbInfo.encryption == 1 || e.Encryption
+}
+
+// topicEncryption returns the encryption policy of the topic of the entry. Policies are set on the
+// topic under the master contract, so the topic of an entry of another contract is parsed again
+// under the master contract unless its own hash has a policy.
+func (db *DB) topicEncryption(e *Entry) uint8 {
+	policy := db.internal.trie.getEncryption(e.entry.topicHash)
+	if policy != message.EncryptionDefault || e.Contract == message.MasterContract || !db.internal.trie.hasEncryption() {
+		return policy
+	}
+	topic := e.Topic
+	if e.alias != 0 {
+		var ok bool
+		if topic, ok = db.internal.aliases.topic(e.alias); !ok {
+			return policy
+		}
+	}
+	t, _, err := db.parseTopic(message.MasterContract, topic)
+	if err != nil {
+		return policy
+	}
+	t.AddContract(message.MasterContract)
+	return db.internal.trie.getEncryption(t.GetHash(message.MasterContract))
+}
+
 func (db *DB) parseTopic(contract uint32, topic []byte) (*message.Topic, uint32, error) {
 	t := new(message.Topic)
 
@@ -255,35 +809,87 @@ func (db *DB) parseTopic(contract uint32, topic []byte) (*message.Topic, uint32,
 	return t, 0, nil
 }
 
-func (db *DB) setEntry(e *Entry) error {
+// parseEntryTopic parses the topic of the entry for the entry Contract, setting the master
+// contract if the entry has none.
+func (db *DB) parseEntryTopic(e *Entry) (*message.Topic, error) {
+	if e.Contract == 0 {
+		e.Contract = message.MasterContract
+	}
+	t, _, err := db.parseTopic(e.Contract, e.Topic)
+	if err != nil {
+		return nil, err
+	}
+	t.AddContract(e.Contract)
+	return t, nil
+}
+
+func (db *DB) setEntry(e *Entry) (err error) {
 	var id message.ID
-	var eBit uint8
+	var keyID uint8
 	var seq uint64
 	var rawTopic []byte
+	if err := db.checkContract(e.Contract); err != nil {
+		return err
+	}
+	if int64(len(e.Payload)) > db.opts.maxValueSize {
+		return errValueTooLarge
+	}
 	if !e.entry.parsed {
 		if e.Contract == 0 {
 			e.Contract = message.MasterContract
 		}
-		t, ttl, err := db.parseTopic(e.Contract, e.Topic)
-		if err != nil {
-			return err
-		}
-		if e.ExpiresAt == 0 && ttl > 0 {
-			e.ExpiresAt = ttl
+		var t *message.Topic
+		var ttl uint32
+		var err error
+		if e.alias != 0 {
+			if t, ttl, err = db.aliasTopic(e.alias, e.Contract); err != nil {
+				return err
+			}
+		} else {
+			if t, ttl, err = db.parseTopic(e.Contract, e.Topic); err != nil {
+				return err
+			}
+			t.AddContract(e.Contract)
 		}
-		t.AddContract(e.Contract)
+		e.entry.topicExpiresAt = ttl
 		e.entry.topicHash = t.GetHash(e.Contract)
 		// topic is packed if it is new topic entry
 		if _, ok := db.internal.trie.getOffset(e.entry.topicHash); !ok {
+			t.Encryption = db.internal.trie.getEncryption(e.entry.topicHash)
 			rawTopic = t.Marshal()
 			e.entry.topicSize = uint16(len(rawTopic))
 		}
 		e.entry.parsed = true
 	}
-	if e.ID != nil {
+	expiresAt, err := e.expiryTime()
+	if err != nil {
+		return err
+	}
+	// a payload read from a reader is written as is and cannot be encrypted.
+	if e.reader != nil {
+		if _, ok := db.internal.contractMacs[e.Contract]; ok || db.encrypt(e) {
+			return errStreamEncrypted
+		}
+	}
+	switch {
+	case e.ID != nil:
 		id = message.ID(e.ID)
 		seq = id.Sequence()
-	} else {
+		db.advanceSeq(seq)
+	case e.seq != 0:
+		seq = e.seq
+		// a message is not overwritten as its data block would leak and reads would return either message.
+		if err := db.reserveSeq(seq); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				db.internal.reserved.release(seq)
+			}
+		}()
+		e.entry.reserved = true
+		id = message.NewID(seq)
+	default:
 		seq = db.nextSeq()
 		id = message.NewID(seq)
 	}
@@ -293,31 +899,194 @@ func (db *DB) setEntry(e *Entry) error {
 
 	id.SetContract(e.Contract)
 	e.entry.seq = seq
-	e.entry.expiresAt = e.ExpiresAt
-	val := snappy.Encode(nil, e.Payload)
-	if db.internal.dbInfo.encryption == 1 || e.Encryption {
-		eBit = 1
-		val = db.internal.mac.Encrypt(nil, val)
+	e.entry.expiresAt = expiresAt
+	compression := e.compression
+	if compression == CompressionDefault {
+		compression = db.opts.compression
+	}
+	if compression == CompressionDefault {
+		compression = CompressionSnappy
+	}
+	// a payload read from a reader is stored uncompressed as it is written in chunks.
+	if e.reader != nil {
+		compression = CompressionNone
+	}
+	if compression.codecID() > maxCodecID {
+		return errCodecNotFound
+	}
+	codec, err := getCodec(compression)
+	if err != nil {
+		return err
+	}
+	val, err := codec.Encode(e.Payload)
+	if err != nil {
+		return err
+	}
+	if mac, ok := db.internal.contractMacs[e.Contract]; ok {
+		keyID = keyContract
+		val = mac.Encrypt(nil, val)
+	} else if db.encrypt(e) {
+		keyID = keyDB
+		mac := db.internal.mac
+		if current := db.opts.currentKeyID; current != 0 {
+			keyID = keyContract + current
+			mac = db.internal.keyRing[current]
+		}
+		val = mac.Encrypt(nil, val)
 	}
 	e.entry.valueSize = uint32(len(val))
+	if e.reader != nil {
+		e.entry.valueSize = uint32(e.readerSize)
+	}
+	if db.internal.dbInfo.checksum == 1 {
+		e.entry.valueSize += checksumSize
+	}
 	mLen := entrySize + idSize + uint32(e.entry.topicSize) + uint32(e.entry.valueSize)
-	e.entry.cache = make([]byte, mLen)
+	// only the message ID and topic are packed if the payload is read from a reader.
+	if e.reader != nil {
+		mLen = entrySize + idSize + uint32(e.entry.topicSize)
+	}
+	// all bytes of the pooled buffer are written below.
+	e.entry.cache = getCache(int(mLen))
 	entryData, err := e.entry.MarshalBinary()
 	if err != nil {
 		return err
 	}
 	copy(e.entry.cache, entryData)
 	copy(e.entry.cache[entrySize:], id.Prefix())
-	e.entry.cache[entrySize+idSize-1] = byte(eBit)
+	e.entry.cache[entrySize+idSize-1] = compression.codecID()<<4 | keyID
+	if e.multiPart {
+		e.entry.cache[entrySize+idSize-1] |= flagMultiPart
+	}
 	// topic data is added on first entry for the topic.
 	if e.entry.topicSize != 0 {
 		copy(e.entry.cache[entrySize+idSize:], rawTopic)
 		// fmt.Println("db.setEntry: topicHash, seq ", e.entry.topicHash, e.entry.seq)
 	}
 	copy(e.entry.cache[entrySize+idSize+uint32(e.entry.topicSize):], val)
+	if db.internal.dbInfo.checksum == 1 && e.reader == nil {
+		putChecksum(e.entry.cache[entrySize:])
+	}
+	return nil
+}
+
+// validateID checks the message exist in DB and the message ID prefix matches the contract.
+func (db *DB) validateID(seq uint64, contract uint32) error {
+	id, err := db.liveID(seq)
+	switch {
+	case err != nil:
+		return err
+	case id == nil:
+		return errMsgIDDoesNotExist
+	case !message.ID(id).EvalPrefix(contract, 0):
+		return errMsgIDPrefixMismatch
+	}
 	return nil
 }
 
+// has checks the message exist in DB and the message ID prefix matches the contract.
+func (db *DB) has(seq uint64, contract uint32) (bool, error) {
+	switch err := db.validateID(seq, contract); err {
+	case nil:
+		return true, nil
+	case errMsgIDDoesNotExist, errMsgIDPrefixMismatch:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// exists reports whether a live message of any contract has the sequence.
+func (db *DB) exists(seq uint64) (bool, error) {
+	id, err := db.liveID(seq)
+	return id != nil, err
+}
+
+// liveID returns the ID of the live message having the sequence, or nil if there is no such message.
+func (db *DB) liveID(seq uint64) ([]byte, error) {
+	if seq == 0 {
+		return nil, nil
+	}
+	if data, _ := db.internal.mem.Get(seq); data == nil && !db.internal.filter.Test(seq) {
+		return nil, nil
+	}
+	e, err := db.readEntry(_Query{seq: seq})
+	switch {
+	case err == errMsgIDDeleted:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	return db.internal.reader.readID(e)
+}
+
+// topicSeqs returns sequences of window entries of the topic for the contract in sorted order.
+func (db *DB) topicSeqs(t *message.Topic, contract uint32) []uint64 {
+	topicHash := t.GetHash(contract)
+	off, ok := db.internal.trie.getOffset(topicHash)
+	if !ok {
+		return nil
+	}
+	mu := db.internal.mutex.getMutex(message.Prefix(t.Parts))
+	mu.RLock()
+	wEntries := db.internal.timeWindow.lookup(db.fs, topicHash, off, 0, 0, math.MaxInt32)
+	mu.RUnlock()
+	seqs := make([]uint64, 0, len(wEntries))
+	for _, we := range wEntries {
+		seqs = append(seqs, we.seq())
+	}
+	sort.Slice(seqs, func(i, j int) bool {
+		return seqs[i] < seqs[j]
+	})
+	return seqs
+}
+
+// summary returns the number of live messages of the topic for the contract, and sequences of
+// the oldest and the most recent live messages.
+func (db *DB) summary(t *message.Topic, contract uint32) (count, first, last uint64, err error) {
+	for _, seq := range db.topicSeqs(t, contract) {
+		ok, err := db.has(seq, contract)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		if !ok {
+			continue
+		}
+		if first == 0 {
+			first = seq
+		}
+		last = seq
+		count++
+	}
+	return count, first, last, nil
+}
+
+// bounds returns sequences of the oldest and the most recent live messages of the topic for the contract.
+func (db *DB) bounds(t *message.Topic, contract uint32) (first, last uint64, err error) {
+	seqs := db.topicSeqs(t, contract)
+	for _, seq := range seqs {
+		ok, err := db.has(seq, contract)
+		if err != nil {
+			return 0, 0, err
+		}
+		if ok {
+			first = seq
+			break
+		}
+	}
+	for i := len(seqs) - 1; i >= 0 && first != 0; i-- {
+		ok, err := db.has(seqs[i], contract)
+		if err != nil {
+			return 0, 0, err
+		}
+		if ok {
+			last = seqs[i]
+			break
+		}
+	}
+	return first, last, nil
+}
+
 // delete deletes the given key from the DB.
 func (db *DB) delete(topicHash, seq uint64) error {
 	if db.opts.flags.immutable {
@@ -340,6 +1109,10 @@ func (db *DB) delete(topicHash, seq uint64) error {
 	if err != nil {
 		return err
 	}
+	if e.seq == 0 {
+		// entry not found in the index file.
+		return nil
+	}
 	db.internal.freeList.freeBlock(e.msgOffset, e.mSize())
 	db.decount(1)
 	if db.internal.syncWrites {
@@ -348,12 +1121,58 @@ func (db *DB) delete(topicHash, seq uint64) error {
 	return nil
 }
 
+// deleteTopics deletes all entries of the topics, clears their winBlocks and removes the topics from trie.
+// The window file is read once for all topics.
+func (db *DB) deleteTopics(topics map[uint64]struct{}) error {
+	seqs := make(map[uint64]uint64)
+	for topicHash := range topics {
+		for _, we := range db.internal.timeWindow.ilookup(topicHash, 0, math.MaxInt32) {
+			seqs[we.seq()] = topicHash
+		}
+	}
+
+	winFile, err := db.fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		return err
+	}
+	nBlocks := int32(winFile.currSize() / int64(blockSize))
+	r := _WindowReader{winFile: winFile}
+	empty := _WinBlock{}
+	for wIdx := int32(0); wIdx < nBlocks; wIdx++ {
+		r.offset = winBlockOffset(wIdx)
+		b, err := r.readWindowBlock()
+		if err != nil {
+			return err
+		}
+		if _, ok := topics[b.topicHash]; !ok || b.entryIdx == 0 {
+			continue
+		}
+		for _, we := range b.entries[:b.entryIdx] {
+			seqs[we.seq()] = b.topicHash
+		}
+		if _, err := winFile.WriteAt(empty.marshalBinary(), r.offset); err != nil {
+			return err
+		}
+	}
+
+	for seq, topicHash := range seqs {
+		if err := db.delete(topicHash, seq); err != nil && err != errMsgIDDeleted {
+			return err
+		}
+	}
+	for topicHash := range topics {
+		db.internal.trie.remove(topicHash)
+	}
+
+	return nil
+}
+
 // batch starts a new batch.
 func (db *DB) batch() *Batch {
 	opts := &_Options{}
 	WithDefaultBatchOptions().set(opts)
 	opts.batchOptions.encryption = db.internal.dbInfo.encryption == 1
-	b := &Batch{opts: opts, db: db, buffer: db.internal.bufPool.Get()}
+	b := &Batch{opts: opts, db: db, buffer: db.internal.bufPool.Get(), truncates: atomic.LoadUint64(&db.internal.truncates)}
 	b.mem = db.internal.mem.NewBatch()
 	b.commitComplete = make(chan struct{})
 
@@ -369,6 +1188,63 @@ func (db *DB) nextSeq() uint64 {
 	return atomic.AddUint64(&db.internal.dbInfo.sequence, 1)
 }
 
+// advanceSeq advances sequence of the DB to seq unless the sequence is already past it.
+func (db *DB) advanceSeq(seq uint64) {
+	for curr := db.seq(); curr < seq; curr = db.seq() {
+		if atomic.CompareAndSwapUint64(&db.internal.dbInfo.sequence, curr, seq) {
+			return
+		}
+	}
+}
+
+// _Reserved is the set of sequences set using Entry.WithSeq of entries not yet written.
+type _Reserved struct {
+	sync.Mutex
+	seqs map[uint64]struct{}
+}
+
+func newReserved() *_Reserved {
+	return &_Reserved{seqs: make(map[uint64]struct{})}
+}
+
+// release releases the sequence once the entry is written or fails to write.
+func (r *_Reserved) release(seqs ...uint64) {
+	r.Lock()
+	defer r.Unlock()
+	for _, seq := range seqs {
+		delete(r.seqs, seq)
+	}
+}
+
+// reserveSeq reserves the sequence set using Entry.WithSeq and advances the sequence of the DB
+// past it. It returns errEntryExist if the DB has a live message with the sequence or the sequence
+// is reserved by an entry not yet written. The check and the reservation are done under one lock so
+// concurrent puts of the sequence do not both pass the check.
+func (db *DB) reserveSeq(seq uint64) error {
+	r := db.internal.reserved
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.seqs[seq]; ok {
+		return errEntryExist
+	}
+	ok, err := db.exists(seq)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return errEntryExist
+	}
+	r.seqs[seq] = struct{}{}
+	db.advanceSeq(seq)
+	return nil
+}
+
+// releaseSeq releases the sequence taken for an entry that failed to write unless a later
+// sequence has been taken since.
+func (db *DB) releaseSeq(seq uint64) bool {
+	return atomic.CompareAndSwapUint64(&db.internal.dbInfo.sequence, seq, seq-1)
+}
+
 func (db *DB) incount(count uint64) uint64 {
 	return atomic.AddUint64(&db.internal.dbInfo.count, count)
 }
@@ -394,3 +1270,18 @@ func (db *DB) ok() error {
 	}
 	return nil
 }
+
+// waitLog waits for logs in the write ahead log to be applied to the DB files once the size of
+// pending logs reaches the WithMaxPendingLogSize limit.
+func (db *DB) waitLog() error {
+	if db.opts.maxPendingLogSize <= 0 {
+		return nil
+	}
+	if db.internal.mem.WaitLogApplied(db.opts.maxPendingLogSize, db.opts.pendingLogTimeout) {
+		return nil
+	}
+	if err := db.ok(); err != nil {
+		return err
+	}
+	return errFull
+}
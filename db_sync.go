@@ -19,9 +19,11 @@ package unitdb
 import (
 	"errors"
 	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/unit-io/bpool"
+	"github.com/unit-io/unitdb/message"
 )
 
 type (
@@ -117,13 +119,11 @@ func (db *_SyncHandle) abort() error {
 		return err
 	}
 
-	db.decount(uint64(db.syncInfo.count))
-
 	return nil
 }
 
-func (db *DB) startSyncer(interval time.Duration) {
-	syncTicker := time.NewTicker(interval)
+func (db *DB) startSyncer() {
+	syncTicker := time.NewTicker(time.Duration(atomic.LoadInt64(&db.internal.syncInterval)))
 	go func() {
 		defer func() {
 			syncTicker.Stop()
@@ -132,6 +132,9 @@ func (db *DB) startSyncer(interval time.Duration) {
 			select {
 			case <-db.internal.closeC:
 				return
+			case <-db.internal.syncIntervalC:
+				syncTicker.Stop()
+				syncTicker = time.NewTicker(time.Duration(atomic.LoadInt64(&db.internal.syncInterval)))
 			case <-syncTicker.C:
 				if err := db.Sync(); err != nil {
 					logger.Error().Err(err).Str("context", "startSyncer").Msg("Error syncing to db")
@@ -162,7 +165,7 @@ func (db *DB) sync() error {
 		return err
 	}
 	if err := db.fs.sync(); err != nil {
-		return nil
+		return err
 	}
 
 	return nil
@@ -190,6 +193,7 @@ func (db *_SyncHandle) sync(recovery bool) error {
 
 	db.incount(uint64(db.syncInfo.count))
 	if err := db.DB.sync(); err != nil {
+		db.decount(uint64(db.syncInfo.count))
 		return err
 	}
 	if recovery {
@@ -210,8 +214,18 @@ func (db *_SyncHandle) Sync() error {
 	// defer profile.Start().Stop()
 	var err1 error
 	timeRelease := db.internal.timeWindow.release()
-	err := db.internal.mem.ForEachBlock(func(timeID int64, seqs []uint64) (bool, error) {
+	err := db.internal.mem.ForEachBlock(func(timeID int64, seqs []uint64) (stop bool, err error) {
 		winEntries := make(map[uint64]_WindowEntries)
+		// Topic offsets are restored if the block fails to sync so the trie does not
+		// point to window blocks that are rolled back.
+		topicOffs := make(map[uint64]int64)
+		defer func() {
+			if err != nil {
+				for h, off := range topicOffs {
+					db.internal.trie.setOffset(_Topic{hash: h, offset: off})
+				}
+			}
+		}()
 		sort.Slice(seqs[:], func(i, j int) bool {
 			return seqs[i] < seqs[j]
 		})
@@ -232,6 +246,13 @@ func (db *_SyncHandle) Sync() error {
 				err1 = err
 				continue
 			}
+			// An entry put while its topic is deleted by DeleteTopic is not packed with the topic,
+			// so it is dropped along with the topic.
+			if m.topicSize == 0 {
+				if _, ok := db.internal.trie.getOffset(m.topicHash); !ok {
+					continue
+				}
+			}
 			e := _IndexEntry{
 				seq:       m.seq,
 				topicSize: m.topicSize,
@@ -245,6 +266,21 @@ func (db *_SyncHandle) Sync() error {
 				}
 				return true, err
 			}
+			// The topic of an entry recovered from the log is not added to the trie on put.
+			if m.topicSize != 0 {
+				if _, ok := db.internal.trie.getOffset(m.topicHash); !ok {
+					rawtopic, err := db.internal.reader.readTopic(e)
+					if err != nil {
+						return true, err
+					}
+					t := new(message.Topic)
+					if err := t.Unmarshal(rawtopic); err != nil {
+						return true, err
+					}
+					db.internal.trie.initEncryption(m.topicHash, t.Encryption)
+					db.internal.trie.add(newTopic(m.topicHash, 0), t.Parts, t.Depth, t.Topic)
+				}
+			}
 
 			we := newWinEntry(seq, m.expiresAt)
 			if _, ok := winEntries[m.topicHash]; ok {
@@ -269,6 +305,7 @@ func (db *_SyncHandle) Sync() error {
 			if ok := db.internal.trie.setOffset(_Topic{hash: h, offset: wOff}); !ok {
 				return true, errors.New("db:Sync: timeWindow sync error: unable to set topic offset in trie")
 			}
+			topicOffs[h] = topicOff
 		}
 		if err1 != nil {
 			return true, err1
@@ -291,32 +328,71 @@ func (db *_SyncHandle) Sync() error {
 	if err != nil || err1 != nil {
 		db.syncInfo.syncComplete = false
 		db.abort()
+		// Entries of the blocks that failed to sync are kept in the mem DB and are synced
+		// on the next sync, such as once space is freed on a full disk.
+		if err == nil {
+			err = err1
+		}
+		return err
 	}
 
 	return db.sync(false)
 }
 
 // expireEntries run expirer to delete entries from db if ttl was set on entries and that has expired.
+// The expire callback is called for deleted entries once the sync lock is released.
 func (db *DB) expireEntries() error {
+	expired, err := db.expire()
+	if db.opts.onExpire != nil {
+		for _, we := range expired {
+			db.opts.onExpire(we.topicHash, we.seq())
+		}
+	}
+	return err
+}
+
+// expire deletes expired entries from db and returns the deleted entries.
+func (db *DB) expire() ([]_ExpiryEntry, error) {
 	// sync happens synchronously.
 	db.internal.syncLockC <- struct{}{}
 	defer func() {
 		<-db.internal.syncLockC
 	}()
+	var expired []_ExpiryEntry
+	w, err := newBlockWriter(db.fs, db.internal.freeList, nil)
+	if err != nil {
+		return expired, err
+	}
 	expiredEntries := db.internal.timeWindow.expiryWindowBucket.getExpiredEntries(db.opts.queryOptions.defaultQueryLimit)
 	for _, expiredEntry := range expiredEntries {
-		we := expiredEntry.(_WinEntry)
+		we := expiredEntry.(_ExpiryEntry)
 		/// Test filter block if message hash presence.
 		if !db.internal.filter.Test(we.seq()) {
 			continue
 		}
 		e, err := db.internal.reader.readEntry(we.seq())
+		if err == errMsgIDDeleted {
+			// entry was already expired or dropped by compaction.
+			continue
+		}
 		if err != nil {
-			return err
+			return expired, err
+		}
+		// The first entry of a topic is kept as the topic is stored along with it.
+		if e.topicSize != 0 {
+			continue
+		}
+		// Entry is deleted from the index so its space is not freed again if it expires again.
+		if e, err = w.del(we.seq()); err != nil {
+			return expired, err
+		}
+		if e.seq == 0 {
+			continue
 		}
 		db.internal.freeList.free(e.seq, e.msgOffset, e.mSize())
 		db.decount(1)
+		expired = append(expired, we)
 	}
 
-	return nil
+	return expired, nil
 }
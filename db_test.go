@@ -17,11 +17,28 @@
 package unitdb
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/unit-io/unitdb/filter"
+	"github.com/unit-io/unitdb/fs"
+	"github.com/unit-io/unitdb/message"
 )
 
 var (
@@ -62,7 +79,7 @@ func TestSimple(t *testing.T) {
 
 	verifyMsgsAndClose := func() {
 		if count := db.Count(); count != uint64(n) {
-			if err := db.recoverLog(); err != nil {
+			if err := db.recoverLog(context.Background(), nil); err != nil {
 				t.Fatal(err)
 			}
 		}
@@ -92,7 +109,7 @@ func TestSimple(t *testing.T) {
 	var ids [][]byte
 
 	entry := NewEntry(topic, nil)
-	entry.WithContract(contract).WithTTL([]byte("1m"))
+	entry.WithContract(contract).WithTTL(time.Minute)
 	for i = 0; i < n; i++ {
 		messageID := db.NewID()
 		entry.WithID(messageID)
@@ -153,7 +170,7 @@ func TestBatch(t *testing.T) {
 
 	verifyMsgsAndClose := func() {
 		if count := db.Count(); count != uint64(n) {
-			if err := db.recoverLog(); err != nil {
+			if err := db.recoverLog(context.Background(), nil); err != nil {
 				t.Fatal(err)
 			}
 		}
@@ -239,6 +256,60 @@ func TestExpiry(t *testing.T) {
 	db.expireEntries()
 }
 
+func TestOnExpire(t *testing.T) {
+	cleanup()
+	expired := make(map[uint64]uint64)
+	onExpire := func(topicHash, seq uint64) {
+		expired[seq] = topicHash
+	}
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16), WithMutable(), WithBackgroundKeyExpiry(), WithOnExpire(onExpire))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.onexpire")
+	if err := db.Put(topic, []byte("msg.live")); err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := uint32(time.Now().Add(-1 * time.Hour).Unix())
+	seqs := make(map[uint64]bool)
+	for i := 0; i < 10; i++ {
+		id := db.NewID()
+		entry := &Entry{Topic: topic, Payload: []byte(fmt.Sprintf("msg.%2d", i)), ExpiresAt: expiresAt}
+		if err := db.PutEntry(entry.WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		seqs[message.ID(id).Sequence()] = true
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// Expired entries are added to the expiry window when queried.
+	if _, err := db.Get(NewQuery(topic)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.expireEntries(); err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != len(seqs) {
+		t.Fatalf("expected %d expired entries; got %d", len(seqs), len(expired))
+	}
+	var topicHash uint64
+	for seq, h := range expired {
+		if !seqs[seq] {
+			t.Fatalf("unexpected expired entry %d", seq)
+		}
+		if topicHash != 0 && h != topicHash {
+			t.Fatalf("expected topic hash %d; got %d", topicHash, h)
+		}
+		topicHash = h
+	}
+	if topicHash == 0 {
+		t.Fatal("expected topic hash of expired entries")
+	}
+}
+
 func TestLeasing(t *testing.T) {
 	cleanup()
 	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<4), WithMutable(), WithBackgroundKeyExpiry())
@@ -316,3 +387,4832 @@ func TestWildcardTopics(t *testing.T) {
 		}
 	}
 }
+
+func TestQueryOrder(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.order")
+	var n = 20
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+		// persist first half of the messages so both in memory and persisted entries are looked up.
+		if i == n/2 {
+			if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var asc, desc [][]byte
+	for i := 0; i < 5; i++ {
+		asc = append(asc, []byte(fmt.Sprintf("msg.%2d", i)))
+		desc = append(desc, []byte(fmt.Sprintf("msg.%2d", n-i-1)))
+	}
+	if v, err := db.Get(NewQuery(topic).WithOrder(Ascending).WithLimit(5)); err != nil || !reflect.DeepEqual(asc, v) {
+		t.Fatalf("expected %v; got %v, %v", asc, v, err)
+	}
+	if v, err := db.Get(NewQuery(topic).WithOrder(Descending).WithLimit(5)); err != nil || !reflect.DeepEqual(desc, v) {
+		t.Fatalf("expected %v; got %v, %v", desc, v, err)
+	}
+}
+
+func TestQueryTimeRange(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.range")
+	before := [][]byte{[]byte("msg.1"), []byte("msg.0")}
+	after := [][]byte{[]byte("msg.3"), []byte("msg.2")}
+	for _, msg := range [][]byte{before[1], before[0]} {
+		if err := db.Put(topic, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// message IDs are in seconds resolution.
+	time.Sleep(time.Second)
+	mid := time.Now()
+	time.Sleep(time.Second)
+	for _, msg := range [][]byte{after[1], after[0]} {
+		if err := db.Put(topic, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if v, err := db.Get(NewQuery(topic).WithTimeRange(time.Time{}, mid).WithLimit(1)); err != nil || !reflect.DeepEqual(before[:1], v) {
+		t.Fatalf("expected %v; got %v, %v", before[:1], v, err)
+	}
+	if v, err := db.Get(NewQuery(topic).WithTimeRange(time.Time{}, mid)); err != nil || !reflect.DeepEqual(before, v) {
+		t.Fatalf("expected %v; got %v, %v", before, v, err)
+	}
+	if v, err := db.Get(NewQuery(topic).WithTimeRange(mid, time.Time{})); err != nil || !reflect.DeepEqual(after, v) {
+		t.Fatalf("expected %v; got %v, %v", after, v, err)
+	}
+	if v, err := db.Get(NewQuery(topic).WithTimeRange(mid, mid)); err != nil || len(v) != 0 {
+		t.Fatalf("expected no messages; got %v, %v", v, err)
+	}
+}
+
+func TestQueryCursor(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var n = 20
+	for _, order := range []Order{Ascending, Descending} {
+		topic := []byte(fmt.Sprintf("unit.cursor%d", order))
+		var vals [][]byte
+		for i := 0; i < n; i++ {
+			val := []byte(fmt.Sprintf("msg.%2d", i))
+			if err := db.Put(topic, val); err != nil {
+				t.Fatal(err)
+			}
+			vals = append(vals, val)
+			if i == n/2 {
+				if err := db.Sync(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		var got [][]byte
+		var cursor uint64
+		for {
+			q := NewQuery(topic).WithOrder(order).WithCursor(cursor).WithLimit(3)
+			v, err := db.Get(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(v) == 0 {
+				break
+			}
+			got = append(got, v...)
+			cursor = q.Cursor()
+		}
+		if len(got) != n {
+			t.Fatalf("expected %d messages; got %d", n, len(got))
+		}
+		for i := range got {
+			expected := vals[i]
+			if order == Descending {
+				expected = vals[n-i-1]
+			}
+			if !reflect.DeepEqual(expected, got[i]) {
+				t.Fatalf("expected %s; got %s", expected, got[i])
+			}
+		}
+	}
+}
+
+func TestContractKeys(t *testing.T) {
+	cleanup()
+	contract1, contract2 := uint32(1), uint32(2)
+	key1, key2 := []byte("a8KnT2sbQm4xYw7zLp0c3VfRh6JdE9uG"), []byte("Xk2pW9sLm4QzT7vB1nC6yHd3Rj8fGa0E")
+	// the DB is not opened with an invalid contract key, and the DB is not left locked.
+	if _, err := Open(dbPath, WithContractKey(contract1, key1[:16])); err == nil {
+		t.Fatal("expected an error for the invalid contract key")
+	}
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16), WithContractKey(contract1, key1), WithContractKey(contract2, key2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.contract")
+	for _, contract := range []uint32{contract1, contract2} {
+		val := []byte(fmt.Sprintf("msg.%d", contract))
+		if err := db.PutEntry(NewEntry(topic, val).WithContract(contract)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	for _, contract := range []uint32{contract1, contract2} {
+		val := []byte(fmt.Sprintf("msg.%d", contract))
+		v, err := db.Get(NewQuery(topic).WithContract(contract))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(v) != 1 || !reflect.DeepEqual(val, v[0]) {
+			t.Fatalf("expected %s; got %s", val, v)
+		}
+	}
+
+	// messages are not readable without the contract key.
+	delete(db.internal.contractMacs, contract2)
+	if _, err := db.Get(NewQuery(topic).WithContract(contract2)); err != errKeyNotFound {
+		t.Fatalf("expected %v; got %v", errKeyNotFound, err)
+	}
+}
+
+func TestGetFunc(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<20), WithLogSize(1<<20), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.stream")
+	// payload compresses well so decoded payloads are much larger than the cached entries.
+	payload := bytes.Repeat([]byte("a"), 1<<14)
+	var n = 500
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var count int
+	var m runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&m)
+	heapAlloc := m.HeapAlloc
+	if err := db.GetFunc(NewQuery(topic).WithLimit(n), func(msg Message) error {
+		if !bytes.Equal(payload, msg.Payload) {
+			return errors.New("payload mismatch")
+		}
+		count++
+		if count == n {
+			runtime.GC()
+			runtime.ReadMemStats(&m)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if count != n {
+		t.Fatalf("expected %d messages; got %d", n, count)
+	}
+	// messages read are not held in memory.
+	if m.HeapAlloc > heapAlloc && m.HeapAlloc-heapAlloc > uint64(n*len(payload)/2) {
+		t.Fatalf("heap grew by %d bytes reading %d bytes", m.HeapAlloc-heapAlloc, n*len(payload))
+	}
+
+	// read stops on error.
+	errStop := errors.New("stop")
+	count = 0
+	if err := db.GetFunc(NewQuery(topic).WithLimit(10), func(msg Message) error {
+		count++
+		return errStop
+	}); err != errStop || count != 1 {
+		t.Fatalf("expected %v after 1 message; got %v after %d messages", errStop, err, count)
+	}
+}
+
+func TestGetBatch(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topics := [][]byte{[]byte("unit.batch.a"), []byte("unit.batch.b")}
+	for i, topic := range topics {
+		for j := 0; j <= i; j++ {
+			if err := db.Put(topic, []byte(fmt.Sprintf("msg.%d", j))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	queries := []*Query{
+		NewQuery(topics[1]).WithLimit(10),
+		NewQuery([]byte("unit.batch.c")).WithLimit(10),
+		NewQuery(topics[0]).WithLimit(10),
+		NewQuery(topics[1]).WithLimit(1),
+	}
+	results, err := db.GetBatch(queries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(queries) {
+		t.Fatalf("expected %d results; got %d", len(queries), len(results))
+	}
+	for i, want := range []int{2, 0, 1, 1} {
+		if len(results[i]) != want {
+			t.Fatalf("query %d: expected %d items; got %d", i, want, len(results[i]))
+		}
+	}
+	if _, err := db.GetBatch([]*Query{NewQuery(topics[0]), NewQuery(nil)}); err != errTopicEmpty {
+		t.Fatalf("expected error %v; got %v", errTopicEmpty, err)
+	}
+}
+
+func TestGetStream(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topic := []byte("unit.stream")
+	var n = 50
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msgs, stop, err := db.GetStream(NewQuery(topic).WithLimit(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	var i int
+	for msg := range msgs {
+		if val := []byte(fmt.Sprintf("msg.%2d", n-i-1)); !bytes.Equal(val, msg.Payload) {
+			t.Fatalf("expected %s; got %s", val, msg.Payload)
+		}
+		i++
+	}
+	if i != n {
+		t.Fatalf("expected %d messages; got %d", n, i)
+	}
+
+	// stream is stopped if caller stops it before reading all messages.
+	msgs, stop, err = db.GetStream(NewQuery(topic).WithLimit(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-msgs
+	stop()
+	stop()
+	for range msgs {
+	}
+
+	// stream is stopped on close if caller stops reading.
+	msgs, _, err = db.GetStream(NewQuery(topic).WithLimit(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-msgs
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for range msgs {
+	}
+}
+
+func TestRecoverInfo(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit.recover")
+	var n = 300
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// wait for tiny batch to write entries to the log.
+	time.Sleep(100 * time.Millisecond)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate info file lagging the index file.
+	f, err := os.OpenFile(filePath(dbPath, _FileDesc{fileType: typeInfo}), os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inf := _DBInfo{header: _Header{signature: signature, version: version}, sequence: 10, count: 10}
+	buf, _ := inf.MarshalBinary()
+	if _, err := f.WriteAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if seq := db.seq(); seq != uint64(n) {
+		t.Fatalf("expected seq %d; got %d", n, seq)
+	}
+	if count := db.Count(); count != uint64(n) {
+		t.Fatalf("expected count %d; got %d", n, count)
+	}
+	if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", n))); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get(NewQuery(topic).WithLimit(n + 1)); err != nil || len(v) != n+1 {
+		t.Fatalf("expected %d messages; got %d, %v", n+1, len(v), err)
+	}
+}
+
+func TestEntryTTL(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// entry ttl takes precedence over topic ttl.
+	e := NewEntry([]byte("unit.ttl?ttl=1h"), []byte("msg")).WithTTL(time.Minute)
+	if err := db.setEntry(e); err != nil {
+		t.Fatal(err)
+	}
+	if expiresAt := int64(e.entry.expiresAt); expiresAt > time.Now().Add(time.Minute).Unix() {
+		t.Fatalf("expected expiry within a minute; got %d", expiresAt-time.Now().Unix())
+	}
+
+	e = NewEntry([]byte("unit.ttl?ttl=1h"), []byte("msg"))
+	if err := db.setEntry(e); err != nil {
+		t.Fatal(err)
+	}
+	if expiresAt := int64(e.entry.expiresAt); expiresAt <= time.Now().Add(time.Minute).Unix() {
+		t.Fatalf("expected expiry of topic ttl; got %d", expiresAt-time.Now().Unix())
+	}
+
+	if err := db.PutEntry(NewEntry([]byte("unit.ttl"), []byte("msg")).WithTTL(200 * 365 * 24 * time.Hour)); err != errTtlTooLarge {
+		t.Fatalf("expected %v; got %v", errTtlTooLarge, err)
+	}
+}
+
+func TestDeleteEntry(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit.delete")
+	id := db.NewID()
+	if err := db.PutEntry(NewEntry(topic, []byte("msg")).WithID(id).WithContract(contract)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteEntry(NewEntry(topic, nil).WithID(id)); err != errMsgIDPrefixMismatch {
+		t.Fatalf("expected %v; got %v", errMsgIDPrefixMismatch, err)
+	}
+	if err := db.DeleteEntry(NewEntry(topic, nil).WithID(db.NewID()).WithContract(contract)); err != errMsgIDDoesNotExist {
+		t.Fatalf("expected %v; got %v", errMsgIDDoesNotExist, err)
+	}
+	if err := db.DeleteEntry(NewEntry(topic, nil).WithID(id).WithContract(contract)); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get(NewQuery(topic).WithContract(contract)); err != nil || len(v) != 0 {
+		t.Fatalf("expected no messages; got %d, %v", len(v), err)
+	}
+}
+
+func TestHas(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit.has")
+	id := db.NewID()
+	if err := db.PutEntry(NewEntry(topic, []byte("msg")).WithID(id).WithContract(contract)); err != nil {
+		t.Fatal(err)
+	}
+	for _, synced := range []bool{false, true} {
+		if synced {
+			if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if ok, err := db.Has(NewEntry(topic, nil).WithID(id).WithContract(contract)); err != nil || !ok {
+			t.Fatalf("synced %v: expected entry to exist; got %v, %v", synced, ok, err)
+		}
+		if ok, err := db.Has(NewEntry(topic, nil).WithID(id)); err != nil || ok {
+			t.Fatalf("synced %v: expected foreign entry not to exist; got %v, %v", synced, ok, err)
+		}
+	}
+	if ok, err := db.Has(NewEntry(topic, nil).WithID(db.NewID()).WithContract(contract)); err != nil || ok {
+		t.Fatalf("expected entry not to exist; got %v, %v", ok, err)
+	}
+	if err := db.DeleteEntry(NewEntry(topic, nil).WithID(id).WithContract(contract)); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := db.Has(NewEntry(topic, nil).WithID(id).WithContract(contract)); err != nil || ok {
+		t.Fatalf("expected deleted entry not to exist; got %v, %v", ok, err)
+	}
+	if _, err := db.Has(NewEntry(topic, nil)); err != errMsgIDEmpty {
+		t.Fatalf("expected %v; got %v", errMsgIDEmpty, err)
+	}
+}
+
+type reverseCodec struct{}
+
+func (reverseCodec) Encode(src []byte) ([]byte, error) {
+	dst := make([]byte, len(src))
+	for i, b := range src {
+		dst[len(src)-1-i] = b
+	}
+	return dst, nil
+}
+
+func (c reverseCodec) Decode(src []byte) ([]byte, error) {
+	return c.Encode(src)
+}
+
+func TestCompression(t *testing.T) {
+	cleanup()
+	compressionReverse := CompressionZstd + 1
+	if _, err := Open(dbPath, WithCompression(compressionReverse)); err != errCodecNotFound {
+		t.Fatalf("expected %v; got %v", errCodecNotFound, err)
+	}
+	// the DB is not left locked by the open that is rejected.
+	if db, err := Open(dbPath); err != nil {
+		t.Fatal(err)
+	} else if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	RegisterCodec(compressionReverse, reverseCodec{})
+	defer func() {
+		codecs.Lock()
+		delete(codecs.m, compressionReverse)
+		codecs.Unlock()
+	}()
+
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16), WithMutable(), WithCompression(CompressionNone))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.compression")
+	var want [][]byte
+	for _, c := range []Compression{CompressionDefault, CompressionSnappy, CompressionNone, CompressionZstd, compressionReverse} {
+		payload := []byte(fmt.Sprintf("msg.%d.%s", c, strings.Repeat("a", 32)))
+		if err := db.PutEntry(NewEntry(topic, payload).WithCompression(c)); err != nil {
+			t.Fatal(err)
+		}
+		want = append([][]byte{payload}, want...)
+	}
+	batchTopic := []byte("unit.compression.batch")
+	batchPayload := []byte("msg.batch." + strings.Repeat("b", 32))
+	err = db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		b.SetOptions(WithBatchCompression(CompressionZstd))
+		return b.Put(batchTopic, batchPayload)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, synced := range []bool{false, true} {
+		if synced {
+			if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := db.Get(NewQuery(topic).WithLimit(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("synced %v: expected %q; got %q", synced, want, got)
+		}
+		got, err = db.Get(NewQuery(batchTopic))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, [][]byte{batchPayload}) {
+			t.Fatalf("synced %v: expected %q; got %q", synced, batchPayload, got)
+		}
+	}
+}
+
+func TestNoCompression(t *testing.T) {
+	for _, dbCompression := range []bool{false, true} {
+		cleanup()
+		opts := []Options{WithBufferSize(1 << 16), WithMemdbSize(1 << 16), WithLogSize(1 << 16), WithFreeBlockSize(1 << 16), WithMutable()}
+		if dbCompression {
+			opts = append(opts, WithNoCompression())
+		}
+		db, err := Open(dbPath, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		topic := []byte("unit.nocompression")
+		payload := bytes.Repeat([]byte("z"), 64)
+		e := NewEntry(topic, payload)
+		if !dbCompression {
+			e.WithNoCompression()
+		}
+		if err := db.PutEntry(e); err != nil {
+			t.Fatal(err)
+		}
+		if int(e.entry.valueSize) != len(payload) {
+			t.Fatalf("expected payload of %d bytes to be stored verbatim; got %d bytes", len(payload), e.entry.valueSize)
+		}
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		got, err := db.Get(NewQuery(topic))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, [][]byte{payload}) {
+			t.Fatalf("expected %q; got %q", payload, got)
+		}
+		db.Close()
+	}
+}
+
+type xorCipher struct {
+	encrypted, decrypted int
+}
+
+func (c *xorCipher) Encrypt(dst, src []byte) []byte {
+	c.encrypted++
+	for _, b := range src {
+		dst = append(dst, b^0x5a)
+	}
+	return dst
+}
+
+func (c *xorCipher) Decrypt(dst, src []byte) ([]byte, error) {
+	c.decrypted++
+	for _, b := range src {
+		dst = append(dst, b^0x5a)
+	}
+	return dst, nil
+}
+
+func TestCipher(t *testing.T) {
+	cleanup()
+	c := &xorCipher{}
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16), WithMutable(), WithEncryption(), WithCipher(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.cipher")
+	payload := []byte("msg.cipher")
+	if err := db.PutEntry(NewEntry(topic, payload).WithNoCompression()); err != nil {
+		t.Fatal(err)
+	}
+	if c.encrypted != 1 {
+		t.Fatalf("expected message to be encrypted using cipher; got %d encryptions", c.encrypted)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.Get(NewQuery(topic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, [][]byte{payload}) {
+		t.Fatalf("expected %q; got %q", payload, got)
+	}
+	if c.decrypted == 0 {
+		t.Fatal("expected message to be decrypted using cipher")
+	}
+}
+
+func TestReEncrypt(t *testing.T) {
+	cleanup()
+	key1 := []byte("4tq9GbyGQxcSuR1s2ArYKzJVkjwmMpXR")
+	key2 := []byte("zUq7dYk2mL5vT9pW3xR8cF1bN6hJ0sEa")
+	opts := []Options{WithBufferSize(1 << 16), WithMemdbSize(1 << 16), WithLogSize(1 << 16), WithFreeBlockSize(1 << 16), WithMutable(), WithEncryption()}
+	sessions := []struct {
+		topic     []byte
+		opts      []Options
+		bulk      int
+		reEncrypt error
+	}{
+		{[]byte("unit.rotate.db"), nil, 0, errKeyNotFound},
+		// Messages of more index blocks than ReEncrypt rewrites at a time.
+		{[]byte("unit.rotate.key1"), []Options{WithKeyRing(1, map[uint8][]byte{1: key1})}, 2 * reEncryptBlocks * entriesPerIndexBlock, errKeyNotFound},
+		{[]byte("unit.rotate.key2"), []Options{WithKeyRing(2, map[uint8][]byte{1: key1, 2: key2})}, 0, nil},
+	}
+	payload := []byte("msg.rotate")
+	bulk := []byte("unit.rotate.bulk")
+	for _, s := range sessions {
+		db, err := Open(dbPath, append(opts, s.opts...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put(s.topic, payload); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < s.bulk; i++ {
+			if err := db.Put(bulk, payload); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		for _, prev := range sessions {
+			if got, err := db.Get(NewQuery(prev.topic)); err != nil || !reflect.DeepEqual(got, [][]byte{payload}) {
+				t.Fatalf("topic %s: expected %q; got %q, %v", prev.topic, payload, got, err)
+			}
+			if bytes.Equal(prev.topic, s.topic) {
+				break
+			}
+		}
+		if err := db.ReEncrypt(2); err != s.reEncrypt {
+			t.Fatalf("expected %v; got %v", s.reEncrypt, err)
+		}
+		db.Close()
+	}
+
+	// Messages are readable using the current key only after re-encryption.
+	db, err := Open(dbPath, append(opts, WithEncryptionKey(key1), WithKeyRing(2, map[uint8][]byte{2: key2}))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, s := range sessions {
+		if got, err := db.Get(NewQuery(s.topic)); err != nil || !reflect.DeepEqual(got, [][]byte{payload}) {
+			t.Fatalf("topic %s: expected %q; got %q, %v", s.topic, payload, got, err)
+		}
+	}
+	n := sessions[1].bulk
+	if got, err := db.Get(NewQuery(bulk).WithLimit(n)); err != nil || len(got) != n {
+		t.Fatalf("topic %s: expected %d messages; got %d, %v", bulk, n, len(got), err)
+	}
+	if _, err := Open(dbPath+"-keyring", WithKeyRing(14, map[uint8][]byte{14: key1})); err != errKeyIDInvalid {
+		t.Fatalf("expected %v; got %v", errKeyIDInvalid, err)
+	}
+	if _, err := Open(dbPath+"-keyring", WithKeyRing(2, map[uint8][]byte{1: key1})); err != errKeyNotFound {
+		t.Fatalf("expected %v; got %v", errKeyNotFound, err)
+	}
+	// the DB is not left locked by the opens that are rejected.
+	if db, err := Open(dbPath + "-keyring"); err != nil {
+		t.Fatal(err)
+	} else if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(dbPath + "-keyring")
+}
+
+func TestTopicEncryption(t *testing.T) {
+	cleanup()
+	opts := []Options{WithBufferSize(1 << 16), WithMemdbSize(1 << 16), WithLogSize(1 << 16), WithFreeBlockSize(1 << 16), WithMutable()}
+	db, err := Open(dbPath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pii := []byte("unit.pii")
+	plain := []byte("unit.plain")
+	payload := []byte("msg.policy")
+	encrypted := func(e *Entry) bool {
+		if err := db.PutEntry(e); err != nil {
+			t.Fatal(err)
+		}
+		return int(e.entry.valueSize) != len(payload)
+	}
+	if err := db.SetTopicEncryption([]byte("unit.*"), true); err != errBadRequest {
+		t.Fatalf("expected %v setting policy of wildcard topic; got %v", errBadRequest, err)
+	}
+	if err := db.SetTopicEncryption(pii, true); err != nil {
+		t.Fatal(err)
+	}
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := db.NewID()
+	if !encrypted(NewEntry(pii, payload).WithID(first).WithNoCompression()) {
+		t.Fatal("expected message of the topic to be encrypted")
+	}
+	if !encrypted(NewEntry(pii, payload).WithContract(contract).WithNoCompression()) {
+		t.Fatal("expected message of the topic under the contract to be encrypted")
+	}
+	if !encrypted(NewEntry(pii, payload).WithNoCompression()) {
+		t.Fatal("expected message of the topic to be encrypted")
+	}
+	if encrypted(NewEntry(plain, payload).WithNoCompression()) {
+		t.Fatal("expected message of the topic not to be encrypted")
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// Policy of a topic already stored is kept after the first entry of the topic is deleted.
+	if err := db.SetTopicEncryption(plain, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteEntry(NewEntry(pii, nil).WithID(first)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.Get(NewQuery(pii)); err != nil || !reflect.DeepEqual(got, [][]byte{payload}) {
+		t.Fatalf("expected %q; got %q, %v", payload, got, err)
+	}
+	db.Close()
+
+	db, err = Open(dbPath, append(opts, WithEncryption())...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if encrypted(NewEntry(plain, payload).WithNoCompression().WithEncryption()) {
+		t.Fatal("expected topic policy to take precedence over encryption of the DB and the entry")
+	}
+	if !encrypted(NewEntry(pii, payload).WithNoCompression()) {
+		t.Fatal("expected message of the topic to be encrypted after reopen")
+	}
+	if encrypted(NewEntry(plain, payload).WithContract(contract).WithNoCompression()) {
+		t.Fatal("expected message of the topic under the contract not to be encrypted after reopen")
+	}
+	db.Close()
+	if err := db.SetTopicEncryption(pii, false); err == nil {
+		t.Fatal("expected error setting policy of closed DB")
+	}
+}
+
+func TestRevokeContract(t *testing.T) {
+	cleanup()
+	opts := []Options{WithBufferSize(1 << 16), WithMemdbSize(1 << 16), WithLogSize(1 << 16), WithFreeBlockSize(1 << 16), WithMutable()}
+	db, err := Open(dbPath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contracts []uint32
+	for i := 0; i < 3; i++ {
+		contract, err := db.NewContract()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contracts = append(contracts, contract)
+	}
+	topic := []byte("unit.tenant")
+	revoked := contracts[1]
+	id := db.NewID()
+	if err := db.PutEntry(NewEntry(topic, []byte("msg.tenant")).WithID(id).WithContract(revoked)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RevokeContract(revoked); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RevokeContract(message.MasterContract); err != errForbidden {
+		t.Fatalf("expected %v revoking master contract; got %v", errForbidden, err)
+	}
+	db.Close()
+
+	db, err = Open(dbPath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	got, err := db.Contracts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint32{contracts[0], contracts[2]}
+	sort.Slice(want, func(i, j int) bool { return want[i] < want[j] })
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected contracts %v; got %v", want, got)
+	}
+	if err := db.PutEntry(NewEntry(topic, []byte("msg.tenant")).WithContract(revoked)); err != errForbidden {
+		t.Fatalf("expected %v on put; got %v", errForbidden, err)
+	}
+	if _, err := db.Get(NewQuery(topic).WithContract(revoked)); err != errForbidden {
+		t.Fatalf("expected %v on get; got %v", errForbidden, err)
+	}
+	if err := db.DeleteEntry(NewEntry(topic, nil).WithID(id).WithContract(revoked)); err != errForbidden {
+		t.Fatalf("expected %v on delete; got %v", errForbidden, err)
+	}
+	if err := db.PutEntry(NewEntry(topic, []byte("msg.tenant")).WithContract(contracts[0])); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPutEntries(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	topics := [][]byte{[]byte("unit.bulk1"), []byte("unit.bulk2"), []byte("unit.bulk3?ttl=1h")}
+	want := make(map[string][][]byte)
+	var entries []*Entry
+	for i := 0; i < 30; i++ {
+		topic := topics[i%len(topics)]
+		payload := []byte(fmt.Sprintf("msg.%2d", i))
+		entries = append(entries, NewEntry(topic, payload).WithContract(contract))
+		want[string(topic)] = append([][]byte{payload}, want[string(topic)]...)
+	}
+	if err := db.PutEntries([]*Entry{NewEntry(topics[0], []byte("msg")), NewEntry(topics[1], nil)}); err != errValueEmpty {
+		t.Fatalf("expected %v; got %v", errValueEmpty, err)
+	}
+	if err := db.PutEntries(entries); err != nil {
+		t.Fatal(err)
+	}
+	for _, synced := range []bool{false, true} {
+		if synced {
+			if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, topic := range topics {
+			got, err := db.Get(NewQuery(topic).WithContract(contract).WithLimit(100))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want[string(topic)]) {
+				t.Fatalf("synced %v, topic %s: expected %q; got %q", synced, topic, want[string(topic)], got)
+			}
+		}
+	}
+	if got, err := db.Get(NewQuery(topics[0]).WithLimit(100)); err != nil || len(got) != 0 {
+		t.Fatalf("expected no messages put for invalid entries; got %q, %v", got, err)
+	}
+}
+
+func TestMaxValueSize(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16), WithMutable(), WithMaxValueSize(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.maxvalue")
+	if err := db.Put(topic, make([]byte, 64)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(topic, make([]byte, 65)); err != errValueTooLarge {
+		t.Fatalf("expected %v; got %v", errValueTooLarge, err)
+	}
+	err = db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		return b.Put(topic, make([]byte, 65))
+	})
+	if err != errValueTooLarge {
+		t.Fatalf("expected %v on batch put; got %v", errValueTooLarge, err)
+	}
+	if db.opts.maxValueSize != 64 {
+		t.Fatalf("expected max value size 64; got %d", db.opts.maxValueSize)
+	}
+	opts := &_Options{}
+	WithMaxValueSize(1 << 40).set(opts)
+	if opts.maxValueSize != maxValueLength {
+		t.Fatalf("expected max value size to be limited to %d; got %d", maxValueLength, opts.maxValueSize)
+	}
+}
+
+func TestLoader(t *testing.T) {
+	cleanup()
+	topic := []byte("unit.loader")
+	tiered := []byte("msg.tiered")
+	var db *DB
+	var calls int
+	loader := func(topicHash, seq uint64) ([]byte, error) {
+		calls++
+		// The message being loaded is not loaded again if the loader reads the DB.
+		if _, err := db.Get(NewQuery(topic)); err != nil {
+			return nil, err
+		}
+		return tiered, nil
+	}
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16), WithMutable(), WithLoader(loader, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var ids [][]byte
+	for i := 0; i < 3; i++ {
+		id := db.NewID()
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("msg.%d", i))).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(ids[1], topic); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]byte{[]byte("msg.2"), tiered, []byte("msg.0")}
+	for i := 0; i < 2; i++ {
+		got, err := db.Get(NewQuery(topic))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected %q; got %q", want, got)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected loaded message to be cached; got %d loader calls", calls)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	put := func(topic []byte, n int) {
+		for i := 0; i < n; i++ {
+			if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	topic1 := []byte("unit.refresh1")
+	topic2 := []byte("unit.refresh2")
+	put(topic1, 3)
+
+	replica, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16), WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+
+	// Read-only DBs do not lock DB files so many replicas can be opened.
+	replica2, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16), WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica2.Close()
+
+	writes := map[string]func() error{
+		"Put":        func() error { return replica.Put(topic1, []byte("msg")) },
+		"PutEntries": func() error { return replica.PutEntries([]*Entry{NewEntry(topic1, []byte("msg"))}) },
+		"Delete":     func() error { return replica.Delete(replica.NewID(), topic1) },
+		"DeleteTopic": func() error {
+			return replica.DeleteTopic(topic1)
+		},
+		"Batch": func() error {
+			return replica.Batch(func(b *Batch, completed <-chan struct{}) error { return nil })
+		},
+		"Compact": func() error {
+			_, err := replica.Compact()
+			return err
+		},
+		"SetTopicEncryption": func() error { return replica.SetTopicEncryption(topic1, true) },
+		"RevokeContract":     func() error { return replica.RevokeContract(1) },
+	}
+	for name, write := range writes {
+		if err := write(); err != errForbidden {
+			t.Fatalf("%s: expected %v; got %v", name, errForbidden, err)
+		}
+	}
+	if v, err := replica.Get(NewQuery(topic1).WithLimit(10)); err != nil || len(v) != 3 {
+		t.Fatalf("expected 3 messages; got %d, %v", len(v), err)
+	}
+
+	put(topic2, 2)
+	if v, err := replica.Get(NewQuery(topic2).WithLimit(10)); err != nil || len(v) != 0 {
+		t.Fatalf("expected no messages before refresh; got %d, %v", len(v), err)
+	}
+	if err := replica.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := replica.Get(NewQuery(topic2).WithLimit(10)); err != nil || len(v) != 2 {
+		t.Fatalf("expected 2 messages; got %d, %v", len(v), err)
+	}
+
+	put(topic2, 3)
+	if err := replica.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := replica.Get(NewQuery(topic2).WithLimit(10)); err != nil || len(v) != 5 {
+		t.Fatalf("expected 5 messages; got %d, %v", len(v), err)
+	}
+	if v, err := replica.Get(NewQuery(topic1).WithLimit(10)); err != nil || len(v) != 3 {
+		t.Fatalf("expected 3 messages; got %d, %v", len(v), err)
+	}
+}
+
+func TestSyncDurability(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.sync")
+	for i := 0; i < 10; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Copy DB files without the write ahead log to simulate a crash after Sync.
+	crashPath := dbPath + ".crash"
+	defer os.RemoveAll(crashPath)
+	if err := copyDBFiles(dbPath, crashPath); err != nil {
+		t.Fatal(err)
+	}
+
+	crashDB, err := Open(crashPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer crashDB.Close()
+	if v, err := crashDB.Get(NewQuery(topic).WithLimit(10)); err != nil || len(v) != 10 {
+		t.Fatalf("expected 10 messages; got %d, %v", len(v), err)
+	}
+}
+
+func TestSyncAppend(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// the first topic synced has its window block at offset zero, and entries of later syncs are appended to it.
+	topic := []byte("unit.sync.append")
+	for i := 0; i < 15; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+		if i == 9 || i == 14 {
+			if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if v, err := db.Get(NewQuery(topic).WithLimit(100)); err != nil || len(v) != 15 {
+		t.Fatalf("expected 15 messages; got %d, %v", len(v), err)
+	}
+}
+
+// copyDBFiles copies DB files without the write ahead log and the lock file.
+func copyDBFiles(src, dst string) error {
+	os.RemoveAll(dst)
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0777)
+		}
+		if strings.Contains(info.Name(), ".log") || strings.HasSuffix(info.Name(), ".lock") {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(dst, rel), data, 0666)
+	})
+}
+
+func TestBatchSync(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.batchsync")
+	err = db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		b.SetOptions(WithBatchSync())
+		for i := 0; i < 10; i++ {
+			if err := b.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crashPath := dbPath + ".crash"
+	defer os.RemoveAll(crashPath)
+	if err := copyDBFiles(dbPath, crashPath); err != nil {
+		t.Fatal(err)
+	}
+	crashDB, err := Open(crashPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer crashDB.Close()
+	if v, err := crashDB.Get(NewQuery(topic).WithLimit(10)); err != nil || len(v) != 10 {
+		t.Fatalf("expected 10 messages; got %d, %v", len(v), err)
+	}
+}
+
+func TestStorageBreakdown(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.storage")
+	payload := []byte("msg for storage breakdown")
+	n := 10
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := db.StorageBreakdown()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.LiveData <= int64(n*idSize) {
+		t.Fatalf("expected live data of %d entries; got %d", n, s.LiveData)
+	}
+	if s.Topics == 0 || s.Index == 0 || s.WAL == 0 {
+		t.Fatalf("expected non zero topics, index and WAL size; got %+v", s)
+	}
+	if s.Total < s.LiveData+s.Topics+s.Index+s.WAL {
+		t.Fatalf("expected total to include all components; got %+v", s)
+	}
+}
+
+func TestDeleteTopic(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topics := [][]byte{[]byte("teams.alpha.ch1"), []byte("teams.alpha.ch2"), []byte("teams.beta.ch1")}
+	for _, topic := range topics {
+		for i := 0; i < 5; i++ {
+			if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// Entries not yet synced are deleted along with the synced entries.
+	if err := db.Put(topics[0], []byte("msg")); err != nil {
+		t.Fatal(err)
+	}
+	if count := db.Count(); count != 15 {
+		t.Fatalf("expected count 15; got %d", count)
+	}
+
+	if err := db.DeleteTopic([]byte("teams.alpha.*")); err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range topics[:2] {
+		if v, err := db.Get(NewQuery(topic).WithLimit(10)); err != nil || len(v) != 0 {
+			t.Fatalf("expected no messages for deleted topic %s; got %d, %v", topic, len(v), err)
+		}
+	}
+	if v, err := db.Get(NewQuery(topics[2]).WithLimit(10)); err != nil || len(v) != 5 {
+		t.Fatalf("expected 5 messages; got %d, %v", len(v), err)
+	}
+	if count := db.Count(); count != 5 {
+		t.Fatalf("expected count 5; got %d", count)
+	}
+
+	// An entry put while its topic is deleted is dropped on sync.
+	if err := db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		if err := b.Put(topics[2], []byte("msg")); err != nil {
+			return err
+		}
+		return db.DeleteTopic(topics[2])
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get(NewQuery(topics[2]).WithLimit(10)); err != nil || len(v) != 0 {
+		t.Fatalf("expected no messages for deleted topic %s; got %d, %v", topics[2], len(v), err)
+	}
+	if count := db.Count(); count != 0 {
+		t.Fatalf("expected count 0; got %d", count)
+	}
+
+	immutable, err := Open(dbPath+".immutable", WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbPath + ".immutable")
+	defer immutable.Close()
+	if err := immutable.DeleteTopic(topics[2]); err != errImmutable {
+		t.Fatalf("expected %v; got %v", errImmutable, err)
+	}
+}
+
+func TestTopics(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, topic := range []string{"teams.alpha.ch1", "teams.alpha.ch2?ttl=1h", "teams.beta.ch1", "teams.beta...", "unit"} {
+		if err := db.Put([]byte(topic), []byte("msg")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.PutEntry(NewEntry([]byte("teams.alpha.ch3"), []byte("msg")).WithContract(3376327)); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"", []string{"teams.alpha.ch1", "teams.alpha.ch2", "teams.beta...", "teams.beta.ch1", "unit"}},
+		{"teams.alpha", []string{"teams.alpha.ch1", "teams.alpha.ch2"}},
+		{"teams.*.ch1", []string{"teams.alpha.ch1", "teams.beta.ch1"}},
+		{"teams.gamma", nil},
+	}
+	check := func() {
+		for _, tt := range tests {
+			topics, err := db.Topics([]byte(tt.prefix))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, topic := range topics {
+				got = append(got, string(topic))
+			}
+			if !reflect.DeepEqual(tt.want, got) {
+				t.Fatalf("prefix %q: expected %v; got %v", tt.prefix, tt.want, got)
+			}
+		}
+	}
+	check()
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// topics are loaded from the DB on open.
+	db, err = Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check()
+}
+
+func TestBackup(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topic := []byte("unit.backup")
+	var n = 50
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := db.Backup(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want, err := db.Get(NewQuery(topic).WithLimit(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "unitdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := Restore(bytes.NewReader(buf.Bytes()[:buf.Len()/2]), dir); err != errBackupCorrupted {
+		t.Fatalf("expected %v; got %v", errBackupCorrupted, err)
+	}
+	os.RemoveAll(dir)
+	if err := Restore(bytes.NewReader(buf.Bytes()), dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := Restore(bytes.NewReader(buf.Bytes()), dir); err != errBackupTargetExist {
+		t.Fatalf("expected %v; got %v", errBackupTargetExist, err)
+	}
+	db, err = Open(dir, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if v, err := db.Get(NewQuery(topic).WithLimit(n)); err != nil || len(v) != n || !reflect.DeepEqual(want, v) {
+		t.Fatalf("expected %d messages; got %d, %v", n, len(v), err)
+	}
+}
+
+func TestBackupSince(t *testing.T) {
+	cleanup()
+	opts := []Options{WithBufferSize(1 << 16), WithMemdbSize(1 << 16), WithLogSize(1 << 16), WithFreeBlockSize(1 << 16)}
+	db, err := Open(dbPath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topic := []byte("unit.backup")
+	var n = 20
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var full bytes.Buffer
+	if err := db.Backup(&full); err != nil {
+		t.Fatal(err)
+	}
+	var incs []bytes.Buffer
+	since, err := db.BackupSince(ioutil.Discard, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tp := range [][]byte{topic, []byte("unit.backup.inc")} {
+		for i := 0; i < n; i++ {
+			if err := db.Put(tp, []byte(fmt.Sprintf("msg.%2d", n+i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var buf bytes.Buffer
+		if since, err = db.BackupSince(&buf, since); err != nil {
+			t.Fatal(err)
+		}
+		incs = append(incs, buf)
+	}
+	want, err := db.Get(NewQuery([]byte("unit.backup...")).WithLimit(3 * n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "unitdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := Restore(&full, dir); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dir, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, inc := range incs {
+		seq, err := db.RestoreIncremental(bytes.NewReader(inc.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// entries already restored are skipped.
+		if _, err := db.RestoreIncremental(bytes.NewReader(inc.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+		if db.seq() < seq {
+			t.Fatalf("expected sequence at least %d; got %d", seq, db.seq())
+		}
+	}
+	if v, err := db.Get(NewQuery([]byte("unit.backup...")).WithLimit(3 * n)); err != nil || !reflect.DeepEqual(want, v) {
+		t.Fatalf("expected %d messages; got %d, %v", len(want), len(v), err)
+	}
+	if v, err := db.Get(NewQuery([]byte("unit.backup.inc")).WithLimit(3 * n)); err != nil || len(v) != n {
+		t.Fatalf("expected %d messages; got %d, %v", n, len(v), err)
+	}
+	if _, err := db.RestoreIncremental(bytes.NewReader(incs[0].Bytes()[:10])); err != errBackupCorrupted {
+		t.Fatalf("expected %v; got %v", errBackupCorrupted, err)
+	}
+}
+
+func TestBackupSinceChecksum(t *testing.T) {
+	topic := []byte("unit.backup.checksum")
+	// messages are restored to a DB storing checksums from a DB without checksums, and the other way around.
+	for _, checksum := range []bool{true, false} {
+		var srcOpts, dstOpts []Options
+		if checksum {
+			srcOpts = append(srcOpts, WithChecksum())
+		} else {
+			dstOpts = append(dstOpts, WithChecksum())
+		}
+		src, err := Open(dbPath, append(srcOpts, WithFileSystem(fs.NewMem()))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if err := src.Put(topic, []byte(fmt.Sprintf("msg.%d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := src.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if _, err := src.BackupSince(&buf, 0); err != nil {
+			t.Fatal(err)
+		}
+		want, err := src.Get(NewQuery(topic).WithLimit(100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := src.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		mem := fs.NewMem()
+		dst, err := Open(dbPath, append(dstOpts, WithFileSystem(mem))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dst.RestoreIncremental(bytes.NewReader(buf.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+		if err := dst.Close(); err != nil {
+			t.Fatal(err)
+		}
+		dst, err = Open(dbPath, append(dstOpts, WithFileSystem(mem))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, err := dst.Get(NewQuery(topic).WithLimit(100)); err != nil || !reflect.DeepEqual(want, v) {
+			t.Fatalf("expected %q; got %q, %v", want, v, err)
+		}
+		if err := dst.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	cleanup()
+	opts := []Options{WithBufferSize(1 << 16), WithMemdbSize(1 << 16), WithLogSize(1 << 16), WithFreeBlockSize(1 << 16), WithMutable()}
+	db, err := Open(dbPath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topic := []byte("unit.compact")
+	ttlTopic := []byte("unit.compact.ttl")
+	var n = 50
+	var ids [][]byte
+	for i := 0; i < n; i++ {
+		if err := db.PutEntry(NewEntry(ttlTopic, bytes.Repeat([]byte("a"), 1<<10)).WithTTL(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		id := db.NewID()
+		ids = append(ids, id)
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("msg.%2d", i))).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < n; i += 2 {
+		if err := db.DeleteEntry(NewEntry(topic, nil).WithID(ids[i])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := db.Get(NewQuery(topic).WithLimit(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataFile, err := db.fs.getFile(_FileDesc{fileType: typeData})
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := dataFile.currSize()
+	time.Sleep(2 * time.Second)
+
+	stats, err := db.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first entry of the topic stores the topic so it is not dropped.
+	if stats.DroppedEntries != n-1 {
+		t.Fatalf("expected %d dropped entries; got %d", n-1, stats.DroppedEntries)
+	}
+	if stats.ReclaimedBytes <= 0 || dataFile.currSize() >= size {
+		t.Fatalf("expected data file to shrink from %d; got %d, %d bytes reclaimed", size, dataFile.currSize(), stats.ReclaimedBytes)
+	}
+	// data file only holds live entries.
+	s, err := db.StorageBreakdown()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Free != 0 || s.LiveData+s.Topics != dataFile.currSize() {
+		t.Fatalf("expected data file size %d; got %d, free %d", s.LiveData+s.Topics, dataFile.currSize(), s.Free)
+	}
+	if count := db.Count(); count != uint64(n/2+1) {
+		t.Fatalf("expected count %d; got %d", n/2+1, count)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if v, err := db.Get(NewQuery(topic).WithLimit(n)); err != nil || !reflect.DeepEqual(want, v) {
+		t.Fatalf("expected %d messages; got %d, %v", len(want), len(v), err)
+	}
+	if v, err := db.Get(NewQuery(ttlTopic).WithLimit(n)); err != nil || len(v) != 0 {
+		t.Fatalf("expected no messages; got %d, %v", len(v), err)
+	}
+	if err := db.Put(topic, []byte("msg.new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get(NewQuery(topic).WithLimit(n)); err != nil || len(v) != len(want)+1 || string(v[0]) != "msg.new" {
+		t.Fatalf("expected %d messages; got %d, %v", len(want)+1, len(v), err)
+	}
+}
+
+func TestCompactInterrupted(t *testing.T) {
+	cleanup()
+	opts := []Options{WithBufferSize(1 << 16), WithMemdbSize(1 << 16), WithLogSize(1 << 16), WithFreeBlockSize(1 << 16), WithMutable()}
+	db, err := Open(dbPath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit.compact")
+	var n = 10
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// compacted files written before Compact was interrupted are removed.
+	dataPath := filePath(dbPath, _FileDesc{fileType: typeData})
+	if err := os.WriteFile(dataPath+compactSuffix, []byte("partial"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get(NewQuery(topic).WithLimit(n)); err != nil || len(v) != n {
+		t.Fatalf("expected %d messages; got %d, %v", n, len(v), err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dataPath + compactSuffix); !os.IsNotExist(err) {
+		t.Fatalf("expected compacted data file to be removed; got %v", err)
+	}
+
+	// complete compacted files replace the DB files if Compact was interrupted while these are renamed.
+	for _, fileType := range compactTypes {
+		name := filePath(dbPath, _FileDesc{fileType: fileType})
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name+compactSuffix, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(dataPath, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(compactMarker(dbPath), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if v, err := db.Get(NewQuery(topic).WithLimit(n)); err != nil || len(v) != n {
+		t.Fatalf("expected %d messages; got %d, %v", n, len(v), err)
+	}
+	if _, err := os.Stat(compactMarker(dbPath)); !os.IsNotExist(err) {
+		t.Fatalf("expected compact marker to be removed; got %v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.stats")
+	for i := 0; i < 10; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(NewQuery(topic).WithLimit(10)); err != nil {
+		t.Fatal(err)
+	}
+
+	s := db.Stats()
+	if s.Sequence != 10 || s.Count != 10 {
+		t.Fatalf("expected sequence and count 10; got %d, %d", s.Sequence, s.Count)
+	}
+	if s.Puts != 10 || s.Gets != 10 || s.OutMsgs != 10 {
+		t.Fatalf("expected 10 puts, gets and out messages; got %+v", s)
+	}
+	if s.BlockIdx != 0 || s.WindowIdx != 0 || s.WALSize == 0 {
+		t.Fatalf("expected single index and window block and non zero WAL size; got %+v", s)
+	}
+}
+
+func TestFileSystem(t *testing.T) {
+	cleanup()
+	mem := fs.NewMem()
+	opts := []Options{WithFileSystem(mem), WithBufferSize(1 << 16), WithMemdbSize(1 << 16), WithLogSize(1 << 16), WithFreeBlockSize(1 << 16)}
+	db, err := Open(dbPath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dbPath, opts...); err != errLocked {
+		t.Fatalf("expected %v; got %v", errLocked, err)
+	}
+	topic := []byte("unit.mem")
+	var want [][]byte
+	for i := 0; i < 10; i++ {
+		payload := []byte(fmt.Sprintf("msg.%2d", i))
+		if err := db.Put(topic, payload); err != nil {
+			t.Fatal(err)
+		}
+		want = append([][]byte{payload}, want...)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dbPath); !os.IsNotExist(err) {
+		t.Fatalf("expected no DB files on disk; got %v", err)
+	}
+	if _, err := mem.Stat(filePath(dbPath, _FileDesc{fileType: typeData})); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	got, err := db.Get(NewQuery(topic).WithLimit(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %q; got %q", want, got)
+	}
+}
+
+func TestQueryRegex(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, topic := range []string{"sensor.1.temp", "sensor.22.temp", "sensor.3.humidity", "sensor.4.temperature", "sensor.x.temp", "other.5.temp"} {
+		if err := db.Put([]byte(topic), []byte(topic)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := [][]byte{[]byte("sensor.1.temp"), []byte("sensor.22.temp")}
+	for _, synced := range []bool{false, true} {
+		if synced {
+			if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := db.Get(NewQuery([]byte("sensor")).WithRegex(`sensor\.\d+\.temp`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Slice(got, func(i, j int) bool { return bytes.Compare(got[i], got[j]) < 0 })
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("synced %v: expected %q; got %q", synced, want, got)
+		}
+	}
+	items, err := db.GetBatch([]*Query{NewQuery([]byte("sensor")).WithRegex(`.*\.humidity`), NewQuery([]byte("sensor.1.temp"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items[0]) != 1 || string(items[0][0]) != "sensor.3.humidity" || len(items[1]) != 1 {
+		t.Fatalf("unexpected batch result %q", items)
+	}
+	if _, err := db.Get(NewQuery([]byte("sensor")).WithRegex(`sensor\.(`)); err != errRegexInvalid {
+		t.Fatalf("expected %v; got %v", errRegexInvalid, err)
+	}
+}
+
+func TestQueryWithout(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, topic := range []string{"teams.alpha", "teams.alpha.ch1", "teams.alpha.ch1.u1", "teams.alpha.secret", "teams.*"} {
+		if err := db.Put([]byte(topic), []byte(topic)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	get := func(q *Query) []string {
+		items, err := db.Get(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, item := range items {
+			got = append(got, string(item))
+		}
+		sort.Strings(got)
+		return got
+	}
+	if got, want := get(NewQuery([]byte("teams.alpha")).WithRegex(`.*`).Without([]byte("teams.alpha.secret"))), []string{"teams.alpha", "teams.alpha.ch1", "teams.alpha.ch1.u1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %q; got %q", want, got)
+	}
+	if got, want := get(NewQuery([]byte("teams.alpha")).WithRegex(`.*`).Without([]byte("teams.alpha.ch1..."), []byte("teams.alpha"))), []string{"teams.alpha.secret"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %q; got %q", want, got)
+	}
+	if got, want := get(NewQuery([]byte("teams.alpha"))), []string{"teams.*", "teams.alpha"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %q; got %q", want, got)
+	}
+	if got, want := get(NewQuery([]byte("teams.alpha")).Without([]byte("teams.alpha"))), []string{"teams.*"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %q; got %q", want, got)
+	}
+}
+
+func TestBounds(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	put := func(topic []byte, n int) (ids []message.ID) {
+		for i := 0; i < n; i++ {
+			id := db.NewID()
+			if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("msg.%2d", i))).WithID(id)); err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, message.ID(id))
+		}
+		return ids
+	}
+	bounds := func(topic []byte, first, last uint64) {
+		t.Helper()
+		f, l, err := db.Bounds(topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f != first || l != last {
+			t.Fatalf("topic %s: expected %d, %d; got %d, %d", topic, first, last, f, l)
+		}
+	}
+
+	topic := []byte("unit.bounds")
+	bounds(topic, 0, 0)
+	ids := put(topic, 10)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []message.ID{ids[1], ids[9]} {
+		if err := db.Delete(id, topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bounds(topic, ids[0].Sequence(), ids[8].Sequence())
+
+	// Entries not yet synced are looked up from the mem cache.
+	topic = []byte("unit.bounds.unsynced")
+	ids = put(topic, 5)
+	bounds(topic, ids[0].Sequence(), ids[4].Sequence())
+
+	if _, _, err := db.Bounds(nil); err != errTopicEmpty {
+		t.Fatalf("expected %v; got %v", errTopicEmpty, err)
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	cleanup()
+	opts := []Options{WithBufferSize(1 << 16), WithMemdbSize(1 << 16), WithLogSize(1 << 16), WithFreeBlockSize(1 << 16), WithGroupCommit(10*time.Millisecond, 4)}
+	db, err := Open(dbPath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topics := [][]byte{[]byte("unit.group1"), []byte("unit.group2"), []byte("unit.group3"), []byte("unit.group4")}
+	errs := make(chan error, len(topics))
+	for _, topic := range topics {
+		go func(topic []byte) {
+			errs <- db.Batch(func(b *Batch, completed <-chan struct{}) error {
+				for i := 0; i < 10; i++ {
+					if err := b.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}(topic)
+	}
+	for range topics {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, topic := range topics {
+		items, err := db.Get(NewQuery(topic).WithLimit(100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 10 {
+			t.Fatalf("topic %s: expected 10 messages; got %d", topic, len(items))
+		}
+	}
+}
+
+// doneAfterCtx is a context that is done after its Done channel is checked n times.
+type doneAfterCtx struct {
+	context.Context
+	n    int
+	done chan struct{}
+}
+
+func (c *doneAfterCtx) Done() <-chan struct{} {
+	if c.n--; c.n < 0 {
+		return c.done
+	}
+	return nil
+}
+
+func (c *doneAfterCtx) Err() error {
+	if c.n < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestGetContext(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.context")
+	for i := 0; i < 20; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	want, err := db.Get(NewQuery(topic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.GetContext(context.Background(), NewQuery(topic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %q; got %q", want, got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := db.GetContext(ctx, NewQuery(topic)); err != context.Canceled {
+		t.Fatalf("expected %v; got %v", context.Canceled, err)
+	}
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if _, err := db.GetContext(ctx, NewQuery(topic)); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v; got %v", context.DeadlineExceeded, err)
+	}
+
+	// The query stops between messages once the context is done.
+	done := make(chan struct{})
+	close(done)
+	got, err = db.GetContext(&doneAfterCtx{Context: context.Background(), n: 5, done: done}, NewQuery(topic))
+	if err != context.Canceled {
+		t.Fatalf("expected %v; got %v", context.Canceled, err)
+	}
+	if len(got) == 0 || len(got) >= len(want) {
+		t.Fatalf("expected query to stop after some messages; got %d messages", len(got))
+	}
+}
+
+func TestBatchContext(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Entries put before the context is canceled are discarded.
+	canceled := []byte("unit.batch.canceled")
+	ctx, cancel := context.WithCancel(context.Background())
+	err = db.BatchContext(ctx, func(b *Batch) error {
+		for i := 0; i < 10; i++ {
+			if err := b.Put(canceled, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cancel()
+		if err := b.Put(canceled, []byte("msg.late")); err != context.Canceled {
+			t.Fatalf("expected %v; got %v", context.Canceled, err)
+		}
+		return nil
+	})
+	if err != context.Canceled {
+		t.Fatalf("expected %v; got %v", context.Canceled, err)
+	}
+	if err := db.BatchContext(ctx, func(b *Batch) error {
+		t.Fatal("batch function called with canceled context")
+		return nil
+	}); err != context.Canceled {
+		t.Fatalf("expected %v; got %v", context.Canceled, err)
+	}
+
+	// The DB accepts writes after a canceled batch.
+	committed := []byte("unit.batch.committed")
+	err = db.BatchContext(context.Background(), func(b *Batch) error {
+		for i := 0; i < 10; i++ {
+			if err := b.Put(committed, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if msgs, err := db.Get(NewQuery(canceled)); err != nil || len(msgs) != 0 {
+		t.Fatalf("expected no messages from canceled batch; got %d, %v", len(msgs), err)
+	}
+	if msgs, err := db.Get(NewQuery(committed)); err != nil || len(msgs) != 10 {
+		t.Fatalf("expected 10 messages from committed batch; got %d, %v", len(msgs), err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.counter")
+	add := func(old, new []byte) []byte {
+		var n uint64
+		if old != nil {
+			n, _ = strconv.ParseUint(string(old), 10, 64)
+		}
+		d, _ := strconv.ParseUint(string(new), 10, 64)
+		return []byte(strconv.FormatUint(n+d, 10))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if err := db.Merge(NewEntry(topic, []byte("2")), add); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	msgs, err := db.Get(NewQuery(topic).WithLimit(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || string(msgs[0]) != "200" {
+		t.Fatalf("expected counter 200; got %q", msgs)
+	}
+
+	if err := db.Merge(NewEntry(topic, []byte("1")), func(old, new []byte) []byte { return nil }); err != errValueEmpty {
+		t.Fatalf("expected %v; got %v", errValueEmpty, err)
+	}
+}
+
+func TestPutIf(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.putif")
+	seq, err := db.PutIf(NewEntry(topic, []byte("msg.1")), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.PutIf(NewEntry(topic, []byte("msg.2")), 0); err != errWriteConflict {
+		t.Fatalf("expected %v; got %v", errWriteConflict, err)
+	}
+	next, err := db.PutIf(NewEntry(topic, []byte("msg.2")), seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next <= seq {
+		t.Fatalf("expected sequence after %d; got %d", seq, next)
+	}
+	if _, last, err := db.Bounds(topic); err != nil || last != next {
+		t.Fatalf("expected last sequence %d; got %d, %v", next, last, err)
+	}
+
+	// A writer with a stale sequence gets a conflict and retries with the current one.
+	stale := next
+	if next, err = db.PutIf(NewEntry(topic, []byte("msg.3")), stale); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.PutIf(NewEntry(topic, []byte("msg.4")), stale); err != errWriteConflict {
+		t.Fatalf("expected %v; got %v", errWriteConflict, err)
+	}
+	_, last, err := db.Bounds(topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last != next {
+		t.Fatalf("expected last sequence %d; got %d", next, last)
+	}
+	if _, err := db.PutIf(NewEntry(topic, []byte("msg.4")), last); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, err := db.Get(NewQuery(topic).WithLimit(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 4 {
+		t.Fatalf("expected 4 messages; got %d", len(msgs))
+	}
+}
+
+func TestQueryCountOnly(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.count")
+	for i := 0; i < 150; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%3d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The count is not bounded by the default query limit.
+	q := NewQuery(topic).CountOnly()
+	items, err := db.Get(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 0 {
+		t.Fatalf("expected no messages from count only query; got %d", len(items))
+	}
+	if q.Count() != 150 {
+		t.Fatalf("expected count 150; got %d", q.Count())
+	}
+	q = NewQuery(append(topic, []byte("?last=1h")...)).CountOnly()
+	if _, err := db.Get(q); err != nil || q.Count() != 150 {
+		t.Fatalf("expected count 150; got %d, %v", q.Count(), err)
+	}
+
+	q = NewQuery(topic).WithLimit(10)
+	if _, err := db.Get(q); err != nil || q.Count() != 10 {
+		t.Fatalf("expected count 10; got %d, %v", q.Count(), err)
+	}
+
+	if _, err := db.Get(NewQuery(topic).CountOnly().WithLimit(10)); err != errBadRequest {
+		t.Fatalf("expected %v; got %v", errBadRequest, err)
+	}
+	if _, err := db.Get(NewQuery(append(topic, []byte("?last=10")...)).CountOnly()); err != errBadRequest {
+		t.Fatalf("expected %v; got %v", errBadRequest, err)
+	}
+}
+
+func TestShards(t *testing.T) {
+	cleanup()
+	if _, err := Open(dbPath, WithShards(24)); err != errShardsInvalid {
+		t.Fatalf("expected %v; got %v", errShardsInvalid, err)
+	}
+	if nShards&(nShards-1) != 0 {
+		t.Fatalf("expected the default number of shards to be a power of two; got %d", nShards)
+	}
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16), WithShards(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit.shards")
+	var want [][]byte
+	for i := 0; i < 50; i++ {
+		payload := []byte(fmt.Sprintf("msg.%2d", i))
+		want = append([][]byte{payload}, want...)
+		if err := db.Put(topic, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.Get(NewQuery(topic)); err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %q; got %q, %v", want, got, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Shards are not stored so the DB can be reopened with another number of shards.
+	db, err = Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16), WithShards(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got, err := db.Get(NewQuery(topic)); err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %q; got %q, %v", want, got, err)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.flush")
+	logSize := db.internal.mem.LogSize()
+	for i := 0; i < 10; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if size := db.internal.mem.LogSize(); size <= logSize {
+		t.Fatal("expected entries written to the write ahead log")
+	}
+	if msgs, err := db.Get(NewQuery(topic)); err != nil || len(msgs) != 10 {
+		t.Fatalf("expected 10 messages; got %d, %v", len(msgs), err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQuerySource(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topic := []byte("unit.source")
+	for i := 0; i < 5; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q := NewQuery(topic).WithSource()
+	msgs, err := db.Get(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(q.Sources()) != len(msgs) || len(msgs) != 5 {
+		t.Fatalf("expected 5 sources; got %d for %d messages", len(q.Sources()), len(msgs))
+	}
+	for i, fromCache := range q.Sources() {
+		if !fromCache {
+			t.Fatalf("expected message %d read from mem cache", i)
+		}
+	}
+	if q := NewQuery(topic); q.Sources() != nil {
+		t.Fatalf("expected no sources without WithSource; got %v", q.Sources())
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Messages are read from the DB files once the DB is reopened.
+	db, err = Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.GetFunc(NewQuery(topic), func(m Message) error {
+		if m.FromCache {
+			t.Fatalf("expected message %d read from DB files", m.Seq)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q = NewQuery(topic).WithSource()
+	if _, err := db.Get(q); err != nil || len(q.Sources()) != 5 {
+		t.Fatalf("expected 5 sources; got %d, %v", len(q.Sources()), err)
+	}
+	for i, fromCache := range q.Sources() {
+		if fromCache {
+			t.Fatalf("expected message %d read from DB files", i)
+		}
+	}
+}
+
+func TestGetMessages(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.messages")
+	id := db.NewID()
+	if err := db.PutEntry(NewEntry(topic, []byte("msg.ttl")).WithID(id).WithTTL(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(topic, []byte("msg.latest")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, err := db.GetMessages(NewQuery(topic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages; got %d", len(msgs))
+	}
+	for _, m := range msgs {
+		if !bytes.Equal(m.Topic, topic) {
+			t.Fatalf("expected topic %q; got %q", topic, m.Topic)
+		}
+	}
+	latest, ttl := msgs[0], msgs[1]
+	if string(latest.Payload) != "msg.latest" || !latest.ExpiresAt.IsZero() {
+		t.Fatalf("expected latest message without expiry; got %q expiring at %v", latest.Payload, latest.ExpiresAt)
+	}
+	if string(ttl.Payload) != "msg.ttl" || ttl.Seq != message.ID(id).Sequence() {
+		t.Fatalf("expected message with sequence %d; got %q with sequence %d", message.ID(id).Sequence(), ttl.Payload, ttl.Seq)
+	}
+	if d := time.Until(ttl.ExpiresAt); d <= 0 || d > time.Hour {
+		t.Fatalf("expected message to expire within an hour; got %v", ttl.ExpiresAt)
+	}
+	if !bytes.Equal(message.ID(ttl.ID).Prefix(), message.ID(id).Prefix()) {
+		t.Fatalf("expected message ID %v; got %v", id, ttl.ID)
+	}
+}
+
+func TestItems(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	topics := [][]byte{[]byte("unit.items.a"), []byte("unit.items.b")}
+	var deleted []byte
+	want := make(map[uint64]string)
+	for i := 0; i < 20; i++ {
+		e := NewEntry(topics[i%2], []byte(fmt.Sprintf("msg.%2d", i))).WithID(db.NewID())
+		if i%5 == 0 {
+			e.WithContract(contract)
+		}
+		id := e.ID
+		if err := db.PutEntry(e); err != nil {
+			t.Fatal(err)
+		}
+		if i == 7 {
+			deleted = id
+			continue
+		}
+		want[message.ID(id).Sequence()] = fmt.Sprintf("%s/msg.%2d", topics[i%2], i)
+	}
+	if err := db.Delete(deleted, topics[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	it := db.Items()
+	var last uint64
+	got := make(map[uint64]string)
+	if it.Valid() {
+		t.Fatal("expected iterator not at a message before Next")
+	}
+	for it.Next() {
+		m := it.Item()
+		if !it.Valid() || !bytes.Equal(it.Key(), m.ID) || !bytes.Equal(it.Value(), m.Payload) {
+			t.Fatalf("expected iterator at message %d", m.Seq)
+		}
+		if m.Seq <= last {
+			t.Fatalf("expected sequence after %d; got %d", last, m.Seq)
+		}
+		last = m.Seq
+		got[m.Seq] = fmt.Sprintf("%s/%s", m.Topic, m.Payload)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if it.Valid() {
+		t.Fatal("expected iterator not at a message after the last message")
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v; got %v", want, got)
+	}
+}
+
+func TestOpenFormat(t *testing.T) {
+	cleanup()
+	mem := fs.NewMem()
+	db, err := Open(dbPath, WithFileSystem(mem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit1.test")
+	for i := 0; i < 10; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	infoPath := filePath(dbPath, _FileDesc{fileType: typeInfo})
+	patch := func(off int64, b []byte) {
+		f, err := mem.OpenFile(infoPath, os.O_RDWR, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteAt(b, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A file of version 1 without the encryption and checksum bytes is opened and its messages are read.
+	patch(7, []byte{1, 0, 0, 0, 0})
+	patch(28, []byte{0})
+	db, err = Open(dbPath, WithFileSystem(mem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := db.Get(NewQuery(topic).WithLimit(20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 10 {
+		t.Fatalf("expected 10 messages; got %d", len(items))
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file of a newer format version is not opened.
+	patch(7, []byte{version + 1, 0, 0, 0})
+	if _, err := Open(dbPath, WithFileSystem(mem)); err != errVersionUnsupported {
+		t.Fatalf("expected %v; got %v", errVersionUnsupported, err)
+	}
+
+	// A file without the signature is not opened.
+	patch(0, []byte("foreign"))
+	if _, err := Open(dbPath, WithFileSystem(mem), WithReadOnly()); err != errCorrupted {
+		t.Fatalf("expected %v; got %v", errCorrupted, err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	cleanup()
+	open := func() (*fs.Mem, []uint64) {
+		mem := fs.NewMem()
+		db, err := Open(dbPath, WithFileSystem(mem))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var seqs []uint64
+		for i := 0; i < 10; i++ {
+			id := db.NewID()
+			seqs = append(seqs, message.ID(id).Sequence())
+			if err := db.PutEntry(NewEntry([]byte("unit.verify"), []byte(fmt.Sprintf("msg.%2d", i))).WithID(id)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		found, err := db.Verify()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != 0 {
+			t.Fatalf("expected no inconsistencies; got %v", found)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return mem, seqs
+	}
+	truncate := func(mem *fs.Mem, fd _FileDesc) {
+		f, err := mem.OpenFile(filePath(dbPath, fd), os.O_RDWR, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if err := f.Truncate(0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	verify := func(mem *fs.Mem, seqs []uint64, kind InconsistencyKind) {
+		db, err := Open(dbPath, WithFileSystem(mem), WithReadOnly())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		found, err := db.Verify()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != len(seqs) {
+			t.Fatalf("expected %d inconsistencies; got %v", len(seqs), found)
+		}
+		for i, inc := range found {
+			if inc.Kind != kind || inc.Seq != seqs[i] {
+				t.Fatalf("expected inconsistency %d of message %d; got %v", kind, seqs[i], inc)
+			}
+		}
+	}
+
+	mem, seqs := open()
+	truncate(mem, _FileDesc{fileType: typeData, num: 0})
+	verify(mem, seqs, DataOutOfRange)
+
+	mem, seqs = open()
+	truncate(mem, _FileDesc{fileType: typeTimeWindow, num: 0})
+	verify(mem, seqs, OrphanedSlot)
+
+	mem, seqs = open()
+	truncate(mem, _FileDesc{fileType: typeIndex, num: 0})
+	verify(mem, seqs, DanglingWindowEntry)
+}
+
+func TestRebuildFilter(t *testing.T) {
+	cleanup()
+	mem := fs.NewMem()
+	db, err := Open(dbPath, WithFileSystem(mem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []*Entry
+	for i := 0; i < 10; i++ {
+		entries = append(entries, NewEntry([]byte("unit.filter"), []byte(fmt.Sprintf("msg.%2d", i))).WithID(db.NewID()))
+	}
+	for _, e := range entries {
+		id := e.ID
+		if err := db.PutEntry(e); err != nil {
+			t.Fatal(err)
+		}
+		e.ID = id
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the filter with a filter that has lost all entries.
+	f, err := mem.OpenFile(filePath(dbPath, _FileDesc{fileType: typeFilter}), os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(filter.NewFilterGenerator().Finish(), 0); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// The filter is not rebuilt by a read-only DB.
+	db, err = Open(dbPath, WithFileSystem(mem), WithReadOnly(), WithRebuildFilter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := db.Stats().FilterRebuilt; n != 0 {
+		t.Fatalf("expected filter not rebuilt by a read-only DB; got %d entries", n)
+	}
+	if ok, err := db.Has(entries[0]); err != nil || ok {
+		t.Fatalf("expected entry missing from the lost filter; got %v, %v", ok, err)
+	}
+	db.Close()
+
+	db, err = Open(dbPath, WithFileSystem(mem), WithRebuildFilter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if n := db.Stats().FilterRebuilt; n != int64(len(entries)) {
+		t.Fatalf("expected %d entries added to the filter; got %d", len(entries), n)
+	}
+	for _, e := range entries {
+		if ok, err := db.Has(e); err != nil || !ok {
+			t.Fatalf("expected entry in the rebuilt filter; got %v, %v", ok, err)
+		}
+	}
+}
+
+func TestMultiPart(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.parts")
+	parts := [][]byte{[]byte("part1."), []byte(""), []byte("part3")}
+	e := NewEntry(topic, nil).WithPayloads(parts)
+	if err := db.PutEntry(e); err != nil {
+		t.Fatal(err)
+	}
+	// the entry is reset on put so it is reused for a single part message.
+	if err := db.PutEntry(e.WithPayload([]byte("single"))); err != nil {
+		t.Fatal(err)
+	}
+	batchTopic := []byte("unit.parts.batch")
+	if err := db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		return b.PutEntry(NewEntry(batchTopic, nil).WithPayloads(parts))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, err := db.GetMessages(NewQuery(topic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages; got %d", len(msgs))
+	}
+	if string(msgs[0].Payload) != "single" || msgs[0].Parts != nil {
+		t.Fatalf("expected single part message; got %q with %d parts", msgs[0].Payload, len(msgs[0].Parts))
+	}
+	if !reflect.DeepEqual(msgs[1].Parts, parts) {
+		t.Fatalf("expected parts %q; got %q", parts, msgs[1].Parts)
+	}
+	for _, topic := range [][]byte{topic, batchTopic} {
+		vals, err := db.Get(NewQuery(topic).WithOrder(Ascending).WithLimit(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(vals) != 1 || string(vals[0]) != "part1.part3" {
+			t.Fatalf("expected joined parts for topic %s; got %q", topic, vals)
+		}
+	}
+	if err := db.PutEntry(NewEntry(topic, nil).WithPayloads(nil)); err != errValueEmpty {
+		t.Fatalf("expected error %v; got %v", errValueEmpty, err)
+	}
+
+	// A payload set using WithPayload replaces the parts.
+	plainTopic := []byte("unit.multipart.plain")
+	if err := db.PutEntry(NewEntry(plainTopic, nil).WithPayloads(parts).WithPayload([]byte("part1"))); err != nil {
+		t.Fatal(err)
+	}
+	if msgs, err := db.GetMessages(NewQuery(plainTopic)); err != nil || len(msgs) != 1 || string(msgs[0].Payload) != "part1" || msgs[0].Parts != nil {
+		t.Fatalf("expected single part message %q; got %v, %v", "part1", msgs, err)
+	}
+	// Codec ids share the last byte of the message ID with the multi-part flag.
+	c := compressionOf(maxCodecID + 1)
+	RegisterCodec(c, noneCodec{})
+	if err := db.PutEntry(NewEntry(plainTopic, []byte("msg")).WithCompression(c)); err != errCodecNotFound {
+		t.Fatalf("expected error %v; got %v", errCodecNotFound, err)
+	}
+}
+
+func TestRange(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.range")
+	var seqs []uint64
+	for i := 0; i < 10; i++ {
+		id := db.NewID()
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("msg.%d", i))).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, message.ID(id).Sequence())
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// last duration and limit of the topic do not apply to the range.
+	msgs, err := db.Range([]byte("unit.range?last=1ms&limit=1"), seqs[3], seqs[6])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 4 {
+		t.Fatalf("expected 4 messages; got %d", len(msgs))
+	}
+	for i, m := range msgs {
+		if m.Seq != seqs[3+i] || string(m.Payload) != fmt.Sprintf("msg.%d", 3+i) {
+			t.Fatalf("expected message %d with sequence %d; got %q with sequence %d", 3+i, seqs[3+i], m.Payload, m.Seq)
+		}
+	}
+	msgs, err = db.Range(topic, 0, math.MaxUint64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 10 {
+		t.Fatalf("expected 10 messages; got %d", len(msgs))
+	}
+	if _, err := db.Range(topic, seqs[6], seqs[3]); err != errBadRequest {
+		t.Fatalf("expected error %v; got %v", errBadRequest, err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.subscribe")
+	if err := db.Put(topic, []byte("msg.0")); err != nil {
+		t.Fatal(err)
+	}
+	msgs, cancel, err := db.Subscribe(NewQuery(topic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv := func(want string) {
+		select {
+		case m, ok := <-msgs:
+			if !ok || string(m.Payload) != want {
+				t.Fatalf("expected message %q; got %q", want, m.Payload)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected message %q; got none", want)
+		}
+	}
+	recv("msg.0")
+
+	if err := db.Put([]byte("unit.other"), []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i <= 3; i++ {
+		recv(fmt.Sprintf("msg.%d", i))
+	}
+
+	// the subscriber is notified once the batch is written.
+	batchTopic := []byte("unit.subscribe.batch")
+	batchMsgs, batchCancel, err := db.Subscribe(NewQuery(batchTopic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer batchCancel()
+	if err := db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		return b.Put(batchTopic, []byte("batch.msg"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-batchMsgs:
+		if string(m.Payload) != "batch.msg" || !bytes.Equal(m.Topic, batchTopic) {
+			t.Fatalf("expected batch message; got %q for topic %q", m.Payload, m.Topic)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected batch message; got none")
+	}
+
+	cancel()
+	if err := db.Put(topic, []byte("msg.4")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m, ok := <-msgs:
+		if ok {
+			t.Fatalf("expected channel closed after cancel; got %q", m.Payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected channel closed after cancel")
+	}
+
+	// a subscriber not reading its channel is canceled once too many messages are queued.
+	defer func(n int) { maxPendingMessages = n }(maxPendingMessages)
+	maxPendingMessages = 16
+	slowTopic := []byte("unit.subscribe.slow")
+	slowMsgs, slowCancel, err := db.Subscribe(NewQuery(slowTopic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slowCancel()
+	// messages taken by the subscriber before it blocks on its channel are not queued, so more
+	// messages are put than the subscriber can take.
+	for i := 0; i < 4*maxPendingMessages; i++ {
+		if err := db.Put(slowTopic, []byte("slow")); err != nil {
+			t.Fatal(err)
+		}
+		// puts are notified once the tiny batch is committed.
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	timeout := time.After(5 * time.Second)
+	for n := 0; ; n++ {
+		select {
+		case _, ok := <-slowMsgs:
+			if ok {
+				continue
+			}
+			if n == 4*maxPendingMessages {
+				t.Fatalf("expected slow subscription canceled; got %d messages", n)
+			}
+		case <-timeout:
+			t.Fatal("expected slow subscription canceled")
+		}
+		break
+	}
+
+	db.Close()
+	if _, _, err := db.Subscribe(NewQuery(topic)); err == nil {
+		t.Fatal("expected error subscribing to a closed DB")
+	}
+}
+
+func TestSubscribeAck(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.subscribe.ack")
+	msgs, cancel, err := db.Subscribe(NewQuery(topic).WithAckTimeout(100 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	recv := func(want string) Message {
+		select {
+		case m := <-msgs:
+			if string(m.Payload) != want {
+				t.Fatalf("expected message %q; got %q", want, m.Payload)
+			}
+			return m
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected message %q; got none", want)
+		}
+		return Message{}
+	}
+	for _, payload := range []string{"msg.1", "msg.2"} {
+		if err := db.Put(topic, []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recv("msg.1").Ack()
+	m := recv("msg.2")
+	m.Nack()
+	// nacked message is redelivered without waiting for the ack timeout.
+	start := time.Now()
+	recv("msg.2")
+	if d := time.Since(start); d >= 100*time.Millisecond {
+		t.Fatalf("expected nacked message redelivered before ack timeout; got after %v", d)
+	}
+	// unacknowledged message is redelivered after the ack timeout.
+	recv("msg.2").Ack()
+	select {
+	case m := <-msgs:
+		t.Fatalf("expected no redelivery of acknowledged messages; got %q", m.Payload)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestPutWithResult(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.result")
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, seq, err := db.PutWithResult(NewEntry(topic, []byte("msg")).WithContract(contract))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Sequence() != seq {
+		t.Fatalf("expected ID with sequence %d; got %d", seq, id.Sequence())
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := db.GetMessages(NewQuery(topic).WithContract(contract))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Seq != seq || !bytes.Equal(msgs[0].ID, id) {
+		t.Fatalf("expected message with ID %v; got %v", id, msgs)
+	}
+	if err := db.DeleteEntry(NewEntry(topic, nil).WithID(id).WithContract(contract)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	vals, err := db.Get(NewQuery(topic).WithContract(contract))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vals) != 0 {
+		t.Fatalf("expected message deleted; got %q", vals)
+	}
+}
+
+func TestPutWithSeq(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.seq")
+	seq := db.seq() + 100
+	if err := db.PutEntry(NewEntry(topic, []byte("replicated")).WithSeq(seq)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutEntry(NewEntry(topic, []byte("replayed")).WithSeq(seq)); err != errEntryExist {
+		t.Fatalf("expected error %v; got %v", errEntryExist, err)
+	}
+	id, next, err := db.PutWithResult(NewEntry(topic, []byte("local")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next <= seq {
+		t.Fatalf("expected sequence after %d; got %d", seq, next)
+	}
+	// the sequence of the DB is advanced past the sequence of the entry ID.
+	if err := db.PutEntry(NewEntry(topic, []byte("with.id")).WithID(message.NewID(next + 100))); err != nil {
+		t.Fatal(err)
+	}
+	if db.seq() != next+100 {
+		t.Fatalf("expected DB sequence %d; got %d", next+100, db.seq())
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutEntry(NewEntry(topic, []byte("replayed")).WithSeq(seq)); err != errEntryExist {
+		t.Fatalf("expected error %v after sync; got %v", errEntryExist, err)
+	}
+
+	msgs, err := db.GetMessages(NewQuery(topic).WithOrder(Ascending))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 messages; got %d", len(msgs))
+	}
+	if msgs[0].Seq != seq || string(msgs[0].Payload) != "replicated" {
+		t.Fatalf("expected replicated message with sequence %d; got %q with sequence %d", seq, msgs[0].Payload, msgs[0].Seq)
+	}
+	if !bytes.Equal(msgs[1].ID, id) {
+		t.Fatalf("expected message ID %v; got %v", id, msgs[1].ID)
+	}
+
+	// concurrent puts of a sequence write one message.
+	concurrentTopic := []byte("unit.seq.concurrent")
+	seq = db.seq() + 100
+	var wg sync.WaitGroup
+	var written int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := db.PutEntry(NewEntry(concurrentTopic, []byte("replicated")).WithSeq(seq)); err == nil {
+				atomic.AddInt32(&written, 1)
+			} else if err != errEntryExist {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if written != 1 {
+		t.Fatalf("expected one message written for the sequence; got %d", written)
+	}
+
+	// the sequence of an entry put by a batch is reserved until the batch is written.
+	seq = db.seq() + 100
+	if err := db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		if err := b.PutEntry(NewEntry(concurrentTopic, []byte("batch")).WithSeq(seq)); err != nil {
+			return err
+		}
+		if err := db.PutEntry(NewEntry(concurrentTopic, []byte("replayed")).WithSeq(seq)); err != errEntryExist {
+			t.Errorf("expected error %v; got %v", errEntryExist, err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutEntry(NewEntry(concurrentTopic, []byte("replayed")).WithSeq(seq)); err != errEntryExist {
+		t.Fatalf("expected error %v after batch; got %v", errEntryExist, err)
+	}
+}
+
+func TestDedupKey(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16), WithDedupWindow(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.dedup")
+	id, seq, err := db.PutWithResult(NewEntry(topic, []byte("msg")).WithDedupKey([]byte("producer.1")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// retries of the put are skipped and return the message put first.
+	if err := db.PutEntry(NewEntry(topic, []byte("msg.retry")).WithDedupKey([]byte("producer.1"))); err != nil {
+		t.Fatal(err)
+	}
+	retryID, retrySeq, err := db.PutWithResult(NewEntry(topic, []byte("msg.retry")).WithDedupKey([]byte("producer.1")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retrySeq != seq || !bytes.Equal(retryID, id) {
+		t.Fatalf("expected sequence %d of the message put first; got %d", seq, retrySeq)
+	}
+	if err := db.PutEntry(NewEntry(topic, []byte("msg.other")).WithDedupKey([]byte("producer.2"))); err != nil {
+		t.Fatal(err)
+	}
+	// the dedup key is scoped to the contract.
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, contractSeq, err := db.PutWithResult(NewEntry(topic, []byte("msg.contract")).WithContract(contract).WithDedupKey([]byte("producer.1"))); err != nil || contractSeq == seq {
+		t.Fatalf("expected message put for the contract; got sequence %d, error %v", contractSeq, err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	vals, err := db.Get(NewQuery(topic).WithOrder(Ascending))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, [][]byte{[]byte("msg"), []byte("msg.other")}) {
+		t.Fatalf("expected messages without retries; got %q", vals)
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	d := newDedup(time.Minute)
+	now := time.Now()
+	d.add("key", _DedupEntry{seq: 1, seen: now})
+	if e, ok := d.get("key", now.Add(time.Second)); !ok || e.seq != 1 {
+		t.Fatalf("expected key within the window; got %v, %v", e, ok)
+	}
+	if _, ok := d.get("key", now.Add(time.Minute)); ok {
+		t.Fatal("expected key past the window to be forgotten")
+	}
+	// keys past the window are purged on add.
+	d.add("other", _DedupEntry{seq: 2, seen: now.Add(2 * time.Minute)})
+	if _, ok := d.keys["key"]; ok {
+		t.Fatal("expected key past the window to be purged")
+	}
+}
+
+func TestFilterSize(t *testing.T) {
+	bits, hashes := filter.Size(1000000, 0.01)
+	if bits < 9500000 || bits > 9700000 || bits%64 != 0 || hashes != 7 {
+		t.Fatalf("expected about 9.6 bits a key and 7 hashes; got %d bits, %d hashes", bits, hashes)
+	}
+	// the default size is written without a header so filter files of earlier versions are read.
+	if n := len(filter.NewSizedFilterGenerator(0, 0).Finish()); n != 7*8+160000/8 {
+		t.Fatalf("expected default filter block of %d bytes; got %d", 7*8+160000/8, n)
+	}
+	g := filter.NewSizedFilterGenerator(filter.Size(100, 0.001))
+	for h := uint64(1); h <= 100; h++ {
+		g.Append(h)
+	}
+	b := filter.NewFilterBlock(g.Finish())
+	for h := uint64(1); h <= 100; h++ {
+		if !b.Test(h) {
+			t.Fatalf("expected key %d in the filter", h)
+		}
+	}
+
+	cleanup()
+	mem := fs.NewMem()
+	db, err := Open(dbPath, WithFileSystem(mem), WithFilterSize(1<<20, 0.001))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []*Entry
+	for i := 0; i < 10; i++ {
+		e := NewEntry([]byte("unit.filter.size"), []byte(fmt.Sprintf("msg.%d", i))).WithID(db.NewID())
+		id := e.ID
+		if err := db.PutEntry(e); err != nil {
+			t.Fatal(err)
+		}
+		e.ID = id
+		entries = append(entries, e)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the filter is read back using the size written with the filter.
+	db, err = Open(dbPath, WithFileSystem(mem), WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, e := range entries {
+		if ok, err := db.Has(e); err != nil || !ok {
+			t.Fatalf("expected entry in the filter; got %v, %v", ok, err)
+		}
+	}
+}
+
+func TestNewContractFrom(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithFileSystem(fs.NewMem()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	contract, err := db.NewContractFrom([]byte("tenant.alpha"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contract == 0 || contract == message.MasterContract {
+		t.Fatalf("expected contract other than the master contract; got %d", contract)
+	}
+	// separate DBs derive the same contract for the seed.
+	other, err := Open("other", WithFileSystem(fs.NewMem()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if c, err := other.NewContractFrom([]byte("tenant.alpha")); err != nil || c != contract {
+		t.Fatalf("expected contract %d; got %d, %v", contract, c, err)
+	}
+	if c, err := db.NewContractFrom([]byte("tenant.alpha")); err != nil || c != contract {
+		t.Fatalf("expected contract %d again; got %d, %v", contract, c, err)
+	}
+	if c, err := db.NewContractFrom([]byte("tenant.beta")); err != nil || c == contract {
+		t.Fatalf("expected contract of another seed; got %d, %v", c, err)
+	}
+	contracts, err := db.Contracts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contracts) != 2 {
+		t.Fatalf("expected 2 contracts; got %v", contracts)
+	}
+
+	if err := db.RevokeContract(contract); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.NewContractFrom([]byte("tenant.alpha")); err != errForbidden {
+		t.Fatalf("expected error %v for revoked contract; got %v", errForbidden, err)
+	}
+	if _, err := db.NewContractFrom(nil); err != errBadRequest {
+		t.Fatalf("expected error %v; got %v", errBadRequest, err)
+	}
+}
+
+func TestTopicAlias(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.alias.ch1")
+	if err := db.RegisterAlias(1, topic); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RegisterAlias(2, []byte("unit.alias.ttl?ttl=1h")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RegisterAlias(0, topic); err != errBadRequest {
+		t.Fatalf("expected error %v; got %v", errBadRequest, err)
+	}
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := db.PutEntry(NewEntry(nil, []byte(fmt.Sprintf("msg.%d", i))).WithAlias(1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.PutEntry(NewEntry(nil, []byte("msg.contract")).WithAlias(1).WithContract(contract)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutEntry(NewEntry(nil, []byte("msg.ttl")).WithAlias(2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutEntry(NewEntry(nil, []byte("msg")).WithAlias(3)); err != errAliasNotFound {
+		t.Fatalf("expected error %v; got %v", errAliasNotFound, err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	vals, err := db.Get(NewQuery(topic).WithOrder(Ascending))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, [][]byte{[]byte("msg.0"), []byte("msg.1"), []byte("msg.2")}) {
+		t.Fatalf("expected messages put using the alias; got %q", vals)
+	}
+	vals, err = db.Get(NewQuery(topic).WithContract(contract))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vals) != 1 || string(vals[0]) != "msg.contract" {
+		t.Fatalf("expected message of the contract; got %q", vals)
+	}
+	msgs, err := db.GetMessages(NewQuery([]byte("unit.alias.ttl")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].ExpiresAt.IsZero() {
+		t.Fatalf("expected message expiring by the ttl of the alias topic; got %v", msgs)
+	}
+}
+
+func TestTopicRetention(t *testing.T) {
+	cleanup()
+	mem := fs.NewMem()
+	db, err := Open(dbPath, WithFileSystem(mem), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topic := []byte("unit.retention.ch1")
+	put := func(db *DB, from, to int) {
+		for i := from; i < to; i++ {
+			if err := db.Put(topic, []byte(fmt.Sprintf("msg.%d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(db *DB, want ...int) {
+		t.Helper()
+		items, err := db.Get(NewQuery(append(topic, []byte("?last=1h")...)).WithLimit(100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, item := range items {
+			got = append(got, string(item))
+		}
+		sort.Strings(got)
+		var w []string
+		for _, i := range want {
+			w = append(w, fmt.Sprintf("msg.%d", i))
+		}
+		sort.Strings(w)
+		if !reflect.DeepEqual(got, w) {
+			t.Fatalf("expected %v; got %v", w, got)
+		}
+	}
+
+	put(db, 0, 10)
+	if err := db.SetTopicRetention(topic, -1); err != errBadRequest {
+		t.Fatalf("expected errBadRequest; got %v", err)
+	}
+	if err := db.SetTopicRetention(topic, 3); err != nil {
+		t.Fatal(err)
+	}
+	expect(db, 7, 8, 9)
+	put(db, 10, 15)
+	expect(db, 12, 13, 14)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the cap is read back from the DB info, and the topic of which the first message is evicted.
+	db, err = Open(dbPath, WithFileSystem(mem), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(db, 12, 13, 14)
+	put(db, 15, 17)
+	expect(db, 14, 15, 16)
+
+	// the cap applies to the topic under any contract.
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("contract.%d", i))).WithContract(contract)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	items, err := db.Get(NewQuery(append(topic, []byte("?last=1h")...)).WithContract(contract).WithLimit(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 3 {
+		t.Fatalf("expected 3 messages under the contract; got %d", len(items))
+	}
+	expect(db, 14, 15, 16)
+
+	if err := db.SetTopicRetention(topic, 0); err != nil {
+		t.Fatal(err)
+	}
+	put(db, 17, 19)
+	expect(db, 14, 15, 16, 17, 18)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath, WithFileSystem(mem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.SetTopicRetention(topic, 3); err != errImmutable {
+		t.Fatalf("expected errImmutable; got %v", err)
+	}
+}
+
+func TestTopicByteLimit(t *testing.T) {
+	cleanup()
+	mem := fs.NewMem()
+	db, err := Open(dbPath, WithFileSystem(mem), WithMutable(), WithCompression(CompressionNone))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topic := []byte("unit.retention.bytes")
+	put := func(db *DB, payloads ...string) {
+		for _, payload := range payloads {
+			if err := db.Put(topic, []byte(payload)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(db *DB, want ...string) {
+		t.Helper()
+		items, err := db.Get(NewQuery(append(topic, []byte("?last=1h")...)).WithLimit(100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, item := range items {
+			got = append(got, string(item))
+		}
+		sort.Strings(got)
+		sort.Strings(want)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected %v; got %v", want, got)
+		}
+	}
+	msg := func(i int) string { return fmt.Sprintf("msg.%06d", i) }
+
+	for i := 0; i < 10; i++ {
+		put(db, msg(i))
+	}
+	if err := db.SetTopicByteLimit(topic, -1); err != errBadRequest {
+		t.Fatalf("expected errBadRequest; got %v", err)
+	}
+	// values are stored uncompressed in 10 bytes so the three newest messages fit the limit.
+	if err := db.SetTopicByteLimit(topic, 35); err != nil {
+		t.Fatal(err)
+	}
+	expect(db, msg(7), msg(8), msg(9))
+	put(db, msg(10), msg(11))
+	expect(db, msg(9), msg(10), msg(11))
+	// the newest message is kept even if it is larger than the limit.
+	large := strings.Repeat("x", 50)
+	put(db, large)
+	expect(db, large)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the limit is read back from the DB info along with the retention cap.
+	db, err = Open(dbPath, WithFileSystem(mem), WithMutable(), WithCompression(CompressionNone))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.SetTopicRetention(topic, 2); err != nil {
+		t.Fatal(err)
+	}
+	put(db, msg(12), msg(13), msg(14))
+	expect(db, msg(13), msg(14))
+	if err := db.SetTopicRetention(topic, 0); err != nil {
+		t.Fatal(err)
+	}
+	put(db, msg(15), msg(16))
+	expect(db, msg(14), msg(15), msg(16))
+	if err := db.SetTopicByteLimit(topic, 0); err != nil {
+		t.Fatal(err)
+	}
+	put(db, msg(17), msg(18))
+	expect(db, msg(14), msg(15), msg(16), msg(17), msg(18))
+}
+
+func TestQueryLimitBytes(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithFileSystem(fs.NewMem()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.limit.bytes")
+	for i := 0; i < 10; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("%0100d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		q    *Query
+		want int
+	}{
+		{NewQuery(topic).WithLimit(10).WithLimitBytes(350), 3},
+		{NewQuery(topic).WithLimit(2).WithLimitBytes(350), 2},
+		{NewQuery(topic).WithLimit(10).WithLimitBytes(1000), 10},
+		// the first message is returned even if it is larger than the limit.
+		{NewQuery(topic).WithLimit(10).WithLimitBytes(50), 1},
+	}
+	for _, tt := range tests {
+		items, err := db.Get(tt.q)
+		if err != nil || len(items) != tt.want {
+			t.Fatalf("expected %d messages; got %d, %v", tt.want, len(items), err)
+		}
+	}
+	if _, err := db.Get(NewQuery(topic).WithLimitBytes(-1)); err != errBadRequest {
+		t.Fatalf("expected errBadRequest; got %v", err)
+	}
+	if _, err := db.Get(NewQuery(topic).CountOnly().WithLimitBytes(100)); err != errBadRequest {
+		t.Fatalf("expected errBadRequest; got %v", err)
+	}
+
+	// reading resumed from the cursor returns the next messages.
+	q := NewQuery(topic).WithLimit(10).WithLimitBytes(450)
+	items, err := db.Get(q)
+	if err != nil || len(items) != 4 {
+		t.Fatalf("expected 4 messages; got %d, %v", len(items), err)
+	}
+	items, err = db.Get(NewQuery(topic).WithLimit(10).WithLimitBytes(450).WithCursor(q.Cursor()))
+	if err != nil || len(items) != 4 || string(items[0]) != fmt.Sprintf("%0100d", 5) {
+		t.Fatalf("expected 4 messages from msg 5; got %d, %v", len(items), err)
+	}
+}
+
+// cancelAfter is a context canceled once its Err has been called n times.
+type cancelAfter struct {
+	context.Context
+	n int
+}
+
+func (c *cancelAfter) Err() error {
+	if c.n == 0 {
+		return context.Canceled
+	}
+	c.n--
+	return nil
+}
+
+func TestOpenContext(t *testing.T) {
+	cleanup()
+	mem := fs.NewMem()
+	db, err := Open(dbPath, WithFileSystem(mem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit.open.context")
+	for i := 0; i < 10; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := OpenContext(ctx, dbPath, WithFileSystem(mem)); err != context.Canceled {
+		t.Fatalf("expected context.Canceled; got %v", err)
+	}
+	// opening is canceled while the log is recovered or topics are loaded.
+	for n := 1; n < 3; n++ {
+		if _, err := OpenContext(&cancelAfter{Context: context.Background(), n: n}, dbPath, WithFileSystem(mem)); err != context.Canceled {
+			t.Fatalf("expected context.Canceled; got %v", err)
+		}
+	}
+
+	// the lock file is released so the DB is opened again.
+	db, err = OpenContext(context.Background(), dbPath, WithFileSystem(mem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if v, err := db.Get(NewQuery(topic).WithLimit(100)); err != nil || len(v) != 10 {
+		t.Fatalf("expected 10 messages; got %d, %v", len(v), err)
+	}
+}
+
+func TestOpenFailure(t *testing.T) {
+	cleanup()
+	fsys := fs.NewFaulty(fs.NewMem())
+	db, err := Open(dbPath, WithFileSystem(fsys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit.open.failure")
+	for i := 0; i < 10; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// opening fails reading the log or the DB files, and the lock file is released so the DB
+	// is opened again.
+	for _, suffix := range []string{".log", ".info", ".lease"} {
+		fsys.Match(func(name string) bool { return strings.HasSuffix(name, suffix) })
+		fsys.FailRead(1, nil)
+		if _, err := Open(dbPath, WithFileSystem(fsys)); !errors.Is(err, fs.ErrInjected) {
+			t.Fatalf("%s: expected %v; got %v", suffix, fs.ErrInjected, err)
+		}
+		fsys.Reset()
+		db, err = Open(dbPath, WithFileSystem(fsys))
+		if err != nil {
+			t.Fatalf("%s: %v", suffix, err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err = Open(dbPath, WithFileSystem(fsys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if v, err := db.Get(NewQuery(topic).WithLimit(100)); err != nil || len(v) != 10 {
+		t.Fatalf("expected 10 messages; got %d, %v", len(v), err)
+	}
+}
+
+func TestRecoverProgress(t *testing.T) {
+	cleanup()
+	mem := fs.NewMem()
+	// entries are not synced in the background so all entries put after Sync are read from the log.
+	db, err := Open(dbPath, WithFileSystem(mem), WithMaxSyncDuration(time.Hour, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit.recover.progress")
+	for i := 0; i < 10; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// entries written to the log but not synced are read from the log on open.
+	for i := 10; i < 300; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.internal.mem.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls [][2]int
+	db, err = Open(dbPath, WithFileSystem(mem), WithRecoverProgress(func(done, total int) {
+		calls = append(calls, [2]int{done, total})
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if len(calls) == 0 {
+		t.Fatal("expected progress to be reported")
+	}
+	last := calls[len(calls)-1]
+	if last[0] != last[1] || last[1] != 2*290+1 {
+		t.Fatalf("expected progress to reach the total of log entries read and synced and window blocks; got %v", last)
+	}
+	// the log entries recovered are reported as these are synced into the DB files.
+	if len(calls) < 2 || calls[len(calls)-2][0] <= last[1]/2+1 {
+		t.Fatalf("expected progress to be reported while log entries are synced; got %v", calls)
+	}
+	items, err := db.Get(NewQuery(append(topic, []byte("?last=1h")...)).WithLimit(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 300 {
+		t.Fatalf("expected 300 messages once the log is recovered; got %d", len(items))
+	}
+	for i := 1; i < len(calls); i++ {
+		if calls[i][0] <= calls[i-1][0] {
+			t.Fatalf("expected progress to advance; got %v", calls)
+		}
+	}
+}
+
+func TestRecoverTopic(t *testing.T) {
+	cleanup()
+	mem := fs.NewMem()
+	db, err := Open(dbPath, WithFileSystem(mem), WithMaxSyncDuration(time.Hour, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit.recover.topic")
+	for i := 0; i < 300; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// entries recovered from the log are put to many time blocks, and the topic is recovered
+	// from the time block of its first entry.
+	db, err = Open(dbPath, WithFileSystem(mem), WithTinyBatchSize(1<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	items, err := db.Get(NewQuery(append(topic, []byte("?last=1h")...)).WithLimit(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 300 {
+		t.Fatalf("expected 300 messages once the log is recovered; got %d", len(items))
+	}
+}
+
+func TestDefragLease(t *testing.T) {
+	cleanup()
+	mem := fs.NewMem()
+	db, err := Open(dbPath, WithFileSystem(mem), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.defrag.ch1")
+	for i := 0; i < 10; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// evicted messages free adjacent blocks of the data file.
+	if err := db.SetTopicRetention(topic, 1); err != nil {
+		t.Fatal(err)
+	}
+	free := atomic.LoadInt64(&db.internal.freeList.size)
+	stats, err := db.DefragLease()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.FragmentsBefore < 2 || stats.FragmentsAfter >= stats.FragmentsBefore {
+		t.Fatalf("expected fewer fragments after defrag; got %+v", stats)
+	}
+	if stats.FreeBytes != free {
+		t.Fatalf("expected free bytes %d; got %d", free, stats.FreeBytes)
+	}
+	stats, err = db.DefragLease()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.FragmentsBefore != stats.FragmentsAfter {
+		t.Fatalf("expected no change on second defrag; got %+v", stats)
+	}
+}
+
+func TestLeaseStats(t *testing.T) {
+	cleanup()
+	mem := fs.NewMem()
+	db, err := Open(dbPath, WithFileSystem(mem), WithMutable(), WithFreeBlockSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.lease.ch1")
+	put := func(from, to int) {
+		for i := from; i < to; i++ {
+			if err := db.Put(topic, []byte(fmt.Sprintf("msg.%d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(0, 10)
+	s := db.Stats()
+	if s.FreeBlocks != 0 || s.LeaseReused != 0 || s.LeaseMissed != 10 || s.LeaseHitRate != 0 {
+		t.Fatalf("expected no free blocks and 10 missed leases; got %+v", s)
+	}
+	// evicted messages free adjacent blocks of the data file.
+	if err := db.SetTopicRetention(topic, 1); err != nil {
+		t.Fatal(err)
+	}
+	s = db.Stats()
+	if s.FreeBlocks != 9 || s.FreeBytes == 0 || s.LargestFreeRegion != s.FreeBytes {
+		t.Fatalf("expected 9 adjacent free blocks; got %+v", s)
+	}
+	if err := db.SetTopicRetention(topic, 0); err != nil {
+		t.Fatal(err)
+	}
+	put(10, 15)
+	s = db.Stats()
+	if s.LeaseReused+s.LeaseMissed != 15 {
+		t.Fatalf("expected 15 leases; got %+v", s)
+	}
+	if want := float64(s.LeaseReused) / 15; s.LeaseHitRate != want {
+		t.Fatalf("expected hit rate %f; got %f", want, s.LeaseHitRate)
+	}
+}
+
+func TestMaxPendingLogSize(t *testing.T) {
+	cleanup()
+	mem := fs.NewMem()
+	db, err := Open(dbPath, WithFileSystem(mem), WithMaxSyncDuration(time.Hour, 1), WithMaxPendingLogSize(1, 200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.pending.ch1")
+	if err := db.Put(topic, []byte("msg.0")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// the log written by Flush is not applied until the next sync.
+	if err := db.Put(topic, []byte("msg.1")); err != errFull {
+		t.Fatalf("expected errFull; got %v", err)
+	}
+	err = db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		return b.Put(topic, []byte("msg.1"))
+	})
+	if err != errFull {
+		t.Fatalf("expected errFull; got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- db.PutEntry(NewEntry(topic, []byte("msg.1")))
+	}()
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	cleanup()
+	mem := fs.NewMem()
+	db, err := Open(dbPath, WithFileSystem(mem), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topics := [][]byte{[]byte("unit.truncate.ch1"), []byte("unit.truncate.ch2")}
+	put := func(from, to int) {
+		for _, topic := range topics {
+			for i := from; i < to; i++ {
+				if err := db.Put(topic, []byte(fmt.Sprintf("msg.%d", i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	put(0, 10)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// entries not yet synced are dropped as well.
+	put(10, 13)
+	// a batch taking sequences before the DB is truncated is not written.
+	if err := db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		if err := b.Put(topics[0], []byte("msg.batch")); err != nil {
+			return err
+		}
+		return db.Truncate()
+	}); err != errBatchTruncated {
+		t.Fatalf("expected errBatchTruncated; got %v", err)
+	}
+	for _, topic := range topics {
+		if items, err := db.Get(NewQuery(append(topic, []byte("?last=1h")...)).WithLimit(100)); err != nil || len(items) != 0 {
+			t.Fatalf("expected no messages; got %d, %v", len(items), err)
+		}
+	}
+	if names, err := db.Topics(nil); err != nil || len(names) != 0 {
+		t.Fatalf("expected no topics; got %q, %v", names, err)
+	}
+	if s := db.Stats(); s.Sequence != 0 || s.Count != 0 {
+		t.Fatalf("expected sequence and count 0; got %d, %d", s.Sequence, s.Count)
+	}
+
+	put(0, 5)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath, WithFileSystem(mem), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if s := db.Stats(); s.Sequence != 10 || s.Count != 10 {
+		t.Fatalf("expected sequence and count 10; got %d, %d", s.Sequence, s.Count)
+	}
+	for _, topic := range topics {
+		if items, err := db.Get(NewQuery(append(topic, []byte("?last=1h")...)).WithLimit(100)); err != nil || len(items) != 5 {
+			t.Fatalf("expected 5 messages; got %d, %v", len(items), err)
+		}
+	}
+
+	// puts racing Truncate take unique sequences, taken either before or after the sequence is reset.
+	var wg sync.WaitGroup
+	for _, topic := range topics {
+		wg.Add(1)
+		go func(topic []byte) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if err := db.Put(topic, []byte(fmt.Sprintf("msg.%d", i))); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(topic)
+	}
+	if err := db.Truncate(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	seqs := make(map[uint64]bool)
+	for _, topic := range topics {
+		msgs, err := db.GetMessages(NewQuery(append(topic, []byte("?last=1h")...)).WithLimit(200))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range msgs {
+			if seqs[m.Seq] || m.Seq > db.Stats().Sequence {
+				t.Fatalf("expected unique sequence up to %d; got %d", db.Stats().Sequence, m.Seq)
+			}
+			seqs[m.Seq] = true
+		}
+	}
+	if s := db.Stats(); uint64(len(seqs)) != s.Sequence {
+		t.Fatalf("expected %d messages put since truncate; got %d", s.Sequence, len(seqs))
+	}
+}
+
+func TestReadOnlyFileSystem(t *testing.T) {
+	cleanup()
+	mem := fs.NewMem()
+	db, err := Open(dbPath, WithFileSystem(mem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit.readonly.ch1")
+	for i := 0; i < 10; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ro := fs.ReadOnly(mem)
+	// a DB that writes files cannot be opened on a read-only file system.
+	if _, err := Open(dbPath, WithFileSystem(ro)); err == nil {
+		t.Fatal("expected open to fail on read-only file system")
+	}
+	db, err = Open(dbPath, WithFileSystem(ro), WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := db.Get(NewQuery(append(topic, []byte("?last=1h")...)).WithLimit(100))
+	if err != nil || len(items) != 10 {
+		t.Fatalf("expected 10 messages; got %d, %v", len(items), err)
+	}
+	if err := db.Put(topic, []byte("msg")); err != errForbidden {
+		t.Fatalf("expected %v; got %v", errForbidden, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	cleanup()
+	mem := fs.NewMem()
+	db, err := Open(dbPath, WithFileSystem(mem), WithChecksum())
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit.checksum")
+	for i := 0; i < 3; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := db.Get(NewQuery(topic).WithLimit(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 messages; got %d", len(msgs))
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a DB written with checksums can be opened without verifying them.
+	db, err = Open(dbPath, WithFileSystem(mem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgs, err = db.Get(NewQuery(topic).WithLimit(10)); err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 3 || string(msgs[0]) != "msg. 2" {
+		t.Fatalf("expected 3 messages; got %q", msgs)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// flip a byte of the value of the last message written to the data file.
+	f, err := mem.OpenFile(filePath(dbPath, _FileDesc{fileType: typeData, num: 0}), os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	off := info.Size() - checksumSize - 1
+	if _, err := f.ReadAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err := f.WriteAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	db, err = Open(dbPath, WithFileSystem(mem), WithChecksum())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(NewQuery(topic).WithLimit(10)); err != errCorrupted {
+		t.Fatalf("expected %v; got %v", errCorrupted, err)
+	}
+	found, err := db.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Kind != ChecksumMismatch {
+		t.Fatalf("expected checksum mismatch; got %v", found)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// checksums cannot be enabled on a DB written without checksums.
+	mem = fs.NewMem()
+	db, err = Open(dbPath, WithFileSystem(mem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(topic, []byte("msg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dbPath, WithFileSystem(mem), WithChecksum()); err != errChecksumUnsupported {
+		t.Fatalf("expected %v; got %v", errChecksumUnsupported, err)
+	}
+
+	// the DB is opened again once the DB is not opened with checksums.
+	db, err = Open(dbPath, WithFileSystem(mem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	items, err := db.Get(NewQuery(topic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("expected 1 message; got %d", len(items))
+	}
+}
+
+func TestForEachTopic(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable(), WithFileSystem(fs.NewMem()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	counts := map[string]int{"unit.b": 3, "unit.a": 2, "unit.c": 1}
+	for topic, n := range counts {
+		for i := 0; i < n; i++ {
+			if err := db.Put([]byte(topic), []byte("msg")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	type summary struct {
+		topic              string
+		count, first, last uint64
+	}
+	var got []summary
+	if err := db.ForEachTopic(func(topic []byte, count uint64, first, last uint64) error {
+		got = append(got, summary{string(topic), count, first, last})
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(counts) {
+		t.Fatalf("expected %d topics; got %v", len(counts), got)
+	}
+	for i, s := range got {
+		if i > 0 && got[i-1].topic >= s.topic {
+			t.Fatalf("expected topics in sorted order; got %v", got)
+		}
+		if int(s.count) != counts[s.topic] {
+			t.Fatalf("topic %s: expected %d messages; got %d", s.topic, counts[s.topic], s.count)
+		}
+		first, last, err := db.Bounds([]byte(s.topic))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.first != first || s.last != last {
+			t.Fatalf("topic %s: expected bounds %d-%d; got %d-%d", s.topic, first, last, s.first, s.last)
+		}
+	}
+
+	errStop := fmt.Errorf("stop")
+	visited := 0
+	if err := db.ForEachTopic(func(topic []byte, count uint64, first, last uint64) error {
+		visited++
+		return errStop
+	}); err != errStop {
+		t.Fatalf("expected %v; got %v", errStop, err)
+	}
+	if visited != 1 {
+		t.Fatalf("expected iteration to stop after 1 topic; visited %d", visited)
+	}
+}
+
+func TestDecodeBufferReuse(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithFileSystem(fs.NewMem()), WithEncryption())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, c := range []Compression{CompressionSnappy, CompressionNone} {
+		topic := []byte(fmt.Sprintf("unit.decode.%d", c))
+		for i := 0; i < 10; i++ {
+			if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("msg.%2d", i))).WithCompression(c)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// payloads read earlier must not be overwritten by buffers reused for later reads.
+	var got [][][]byte
+	for _, c := range []Compression{CompressionSnappy, CompressionNone} {
+		topic := []byte(fmt.Sprintf("unit.decode.%d", c))
+		items, err := db.Get(NewQuery(topic).WithLimit(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, items)
+	}
+	for _, items := range got {
+		if len(items) != 10 {
+			t.Fatalf("expected 10 messages; got %d", len(items))
+		}
+		for i, item := range items {
+			if want := fmt.Sprintf("msg.%2d", 9-i); string(item) != want {
+				t.Fatalf("expected %s; got %s", want, item)
+			}
+		}
+	}
+}
+
+func TestCachePool(t *testing.T) {
+	for _, size := range []int{1, 64, 65, 1000, 1 << 16} {
+		buf := getCache(size)
+		if len(buf) != size || cap(buf) < size || cap(buf)&(cap(buf)-1) != 0 {
+			t.Fatalf("size %d: expected a power of two buffer; got len %d cap %d", size, len(buf), cap(buf))
+		}
+		putCache(buf)
+	}
+	if buf := getCache(1<<16 + 1); cap(buf) != 1<<16+1 {
+		t.Fatalf("expected unpooled buffer of size %d; got cap %d", 1<<16+1, cap(buf))
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	cleanup()
+	mem := fs.NewMem()
+	db, err := Open(dbPath, WithFileSystem(mem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topics := []string{"unit.bulk.a", "unit.bulk.b", "unit.bulk.c"}
+	n := 1000
+	entries := make(chan *Entry)
+	go func() {
+		defer close(entries)
+		for i := 0; i < n; i++ {
+			for _, topic := range topics {
+				entries <- NewEntry([]byte(topic), []byte(fmt.Sprintf("msg.%d", i)))
+			}
+		}
+	}()
+	if err := db.BulkLoad(entries); err != nil {
+		t.Fatal(err)
+	}
+	if count := db.Count(); count != uint64(n*len(topics)) {
+		t.Fatalf("expected %d messages; got %d", n*len(topics), count)
+	}
+	check := func() {
+		for _, topic := range topics {
+			items, err := db.Get(NewQuery([]byte(topic)).WithLimit(n))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(items) != n {
+				t.Fatalf("topic %s: expected %d messages; got %d", topic, n, len(items))
+			}
+			if string(items[0]) != fmt.Sprintf("msg.%d", n-1) {
+				t.Fatalf("topic %s: expected msg.%d; got %s", topic, n-1, items[0])
+			}
+		}
+	}
+	check()
+
+	// entries after an invalid entry are not put.
+	entries = make(chan *Entry, 3)
+	entries <- NewEntry([]byte("unit.bulk.d"), []byte("msg"))
+	entries <- NewEntry([]byte("unit.bulk.d"), nil)
+	entries <- NewEntry([]byte("unit.bulk.d"), []byte("msg"))
+	close(entries)
+	if err := db.BulkLoad(entries); err != errValueEmpty {
+		t.Fatalf("expected %v; got %v", errValueEmpty, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// loaded messages are written to the DB files without the write ahead log.
+	db, err = Open(dbPath, WithFileSystem(mem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check()
+	if err := db.Put([]byte("unit.bulk.a"), []byte("msg.put")); err != nil {
+		t.Fatal(err)
+	}
+	items, err := db.Get(NewQuery([]byte("unit.bulk.a")).WithLimit(n + 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != n+1 || string(items[0]) != "msg.put" {
+		t.Fatalf("expected %d messages starting with msg.put; got %d", n+1, len(items))
+	}
+}
+
+func TestBulkLoadAfterPut(t *testing.T) {
+	cleanup()
+	mem := fs.NewMem()
+	db, err := Open(dbPath, WithFileSystem(mem))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first messages of the topic are not yet synced when the bulk load starts.
+	topic := []byte("unit.bulk.put")
+	put := func(from, to int) {
+		for i := from; i < to; i++ {
+			if err := db.Put(topic, []byte(fmt.Sprintf("msg.%3d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	put(0, 5)
+	entries := make(chan *Entry, 10)
+	for i := 5; i < 15; i++ {
+		entries <- NewEntry(topic, []byte(fmt.Sprintf("msg.%3d", i)))
+	}
+	close(entries)
+	if err := db.BulkLoad(entries); err != nil {
+		t.Fatal(err)
+	}
+	put(15, 20)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath, WithFileSystem(mem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	items, err := db.Get(NewQuery(topic).WithLimit(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 20 {
+		t.Fatalf("expected 20 messages; got %d", len(items))
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithFileSystem(fs.NewMem()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.usage")
+	for i := 0; i < 100; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.DiskUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Index == 0 || u.Data == 0 || u.Window == 0 || u.Info == 0 {
+		t.Fatalf("expected index, data, window and info files in use; got %+v", u)
+	}
+	size, err := db.FileSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Total != size+u.Log {
+		t.Fatalf("expected total %d; got %+v", size+u.Log, u)
+	}
+	if u.Total != u.Index+u.Data+u.Window+u.Lease+u.Filter+u.Info+u.Log {
+		t.Fatalf("expected total to be the sum of file sizes; got %+v", u)
+	}
+}
+
+func TestWALPath(t *testing.T) {
+	cleanup()
+	mem := fs.NewMem()
+	walPath := "test_wal"
+	db, err := Open(dbPath, WithFileSystem(mem), WithWALPath(walPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit.wal")
+	if err := db.Put(topic, []byte("msg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Stat(walPath + "/data.log"); err != nil {
+		t.Fatalf("expected log in the WAL directory: %v", err)
+	}
+	if _, err := mem.Stat(dbPath + "/data.log"); err == nil {
+		t.Fatal("expected no log in the DB directory")
+	}
+
+	db, err = Open(dbPath, WithFileSystem(mem), WithWALPath(walPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	items, err := db.Get(NewQuery(topic).WithLimit(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || string(items[0]) != "msg" {
+		t.Fatalf("expected msg; got %q", items)
+	}
+}
+
+func TestDiskFull(t *testing.T) {
+	cleanup()
+	fsys := fs.NewFaulty(fs.NewMem())
+	db, err := Open(dbPath, WithFileSystem(fsys))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topic := []byte("unit.full")
+	put := func(from, to int) {
+		for i := from; i < to; i++ {
+			if err := db.Put(topic, []byte(fmt.Sprintf("msg.%3d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	put(0, 10)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the WAL cannot be written.
+	fsys.SetFull(true)
+	put(10, 20)
+	if err := db.Sync(); err == nil {
+		t.Fatal("expected sync to fail writing the WAL on a full disk")
+	}
+
+	// the WAL is written but the DB files cannot be extended.
+	fsys.SetFull(false)
+	if err := db.internal.mem.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	fsys.SetFull(true)
+	if err := db.Sync(); err == nil {
+		t.Fatal("expected sync to fail writing the DB files on a full disk")
+	}
+	if count := db.Count(); count != 10 {
+		t.Fatalf("expected count 10 after failed sync; got %d", count)
+	}
+
+	// the entries are synced once space is freed.
+	fsys.SetFull(false)
+	put(20, 30)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if count := db.Count(); count != 30 {
+		t.Fatalf("expected count 30; got %d", count)
+	}
+
+	bulkTopic := []byte("unit.full.bulk")
+	bulkLoad := func() error {
+		entries := make(chan *Entry, 10)
+		for i := 0; i < 10; i++ {
+			entries <- NewEntry(bulkTopic, []byte(fmt.Sprintf("msg.%3d", i)))
+		}
+		close(entries)
+		return db.BulkLoad(entries)
+	}
+	fsys.SetFull(true)
+	if err := bulkLoad(); err == nil {
+		t.Fatal("expected bulk load to fail on a full disk")
+	}
+	if seq := db.seq(); seq != 30 {
+		t.Fatalf("expected sequence 30 after failed bulk load; got %d", seq)
+	}
+	if err := db.ForEachTopic(func(top []byte, count uint64, first, last uint64) error {
+		if string(top) == string(bulkTopic) {
+			t.Fatal("expected topic of failed bulk load to be removed")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	fsys.SetFull(false)
+	if err := bulkLoad(); err != nil {
+		t.Fatal(err)
+	}
+	if seq := db.seq(); seq != 40 {
+		t.Fatalf("expected sequence 40; got %d", seq)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath, WithFileSystem(fsys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, top := range [][]byte{topic, bulkTopic} {
+		items, err := db.Get(NewQuery(top).WithLimit(100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 30
+		if string(top) == string(bulkTopic) {
+			want = 10
+		}
+		if len(items) != want {
+			t.Fatalf("expected %d messages for %s; got %d", want, top, len(items))
+		}
+	}
+}
+
+func TestIOErrors(t *testing.T) {
+	cleanup()
+	fsys := fs.NewFaulty(fs.NewMem())
+	db, err := Open(dbPath, WithFileSystem(fsys))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topic := []byte("unit.faulty")
+	put := func(from, to int) {
+		for i := from; i < to; i++ {
+			if err := db.Put(topic, []byte(fmt.Sprintf("msg.%3d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	put(0, 10)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys.Match(func(name string) bool { return strings.HasSuffix(name, ".data") })
+	fsys.ShortWrite(1)
+	put(10, 20)
+	if err := db.Sync(); !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("expected %v; got %v", io.ErrShortWrite, err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath, WithFileSystem(fsys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fsys.FailRead(1, nil)
+	if _, err := db.Get(NewQuery(topic).WithLimit(100)); !errors.Is(err, fs.ErrInjected) {
+		t.Fatalf("expected %v; got %v", fs.ErrInjected, err)
+	}
+	items, err := db.Get(NewQuery(topic).WithLimit(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 20 {
+		t.Fatalf("expected 20 messages; got %d", len(items))
+	}
+}
+
+func TestSetSyncInterval(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithFileSystem(fs.NewMem()), WithMaxSyncDuration(time.Hour, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.sync")
+	for i := 0; i < 10; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count := db.Count(); count != 0 {
+		t.Fatalf("expected no messages synced; got %d", count)
+	}
+	db.SetSyncInterval(10 * time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for db.Count() != 10 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected background sync of 10 messages; got %d", db.Count())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPutReader(t *testing.T) {
+	cleanup()
+	mem := fs.NewMem()
+	db, err := Open(dbPath, WithFileSystem(mem), WithChecksum(), WithMaxValueSize(4<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topic := []byte("unit.attachments")
+	if err := db.Put(topic, []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	payload := make([]byte, 3<<20+17)
+	for i := range payload {
+		payload[i] = byte(i % 251)
+	}
+	if err := db.PutReader(NewEntry(topic, nil), bytes.NewReader(payload), int64(len(payload))); err != nil {
+		t.Fatal(err)
+	}
+	seq := db.seq()
+
+	// a reader shorter than the size is not put and does not use up a sequence.
+	if err := db.PutReader(NewEntry(topic, nil), bytes.NewReader(payload[:100]), 200); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected %v; got %v", io.ErrUnexpectedEOF, err)
+	}
+	if s := db.seq(); s != seq {
+		t.Fatalf("expected sequence %d; got %d", seq, s)
+	}
+	if err := db.PutReader(NewEntry(topic, nil).WithEncryption(), bytes.NewReader(payload), int64(len(payload))); err != errStreamEncrypted {
+		t.Fatalf("expected %v; got %v", errStreamEncrypted, err)
+	}
+	if err := db.PutReader(NewEntry(topic, nil), bytes.NewReader(payload), 8<<20); err != errValueTooLarge {
+		t.Fatalf("expected %v; got %v", errValueTooLarge, err)
+	}
+	if err := db.Put(topic, []byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		items, err := db.Get(NewQuery(topic).WithLimit(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 3 {
+			t.Fatalf("expected 3 messages; got %d", len(items))
+		}
+		if string(items[0]) != "after" || !bytes.Equal(items[1], payload) || string(items[2]) != "before" {
+			t.Fatal("messages do not match the payloads put")
+		}
+	}
+	check()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath, WithFileSystem(mem), WithChecksum(), WithMaxValueSize(4<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check()
+}
+
+func TestDBInfo(t *testing.T) {
+	inf := _DBInfo{header: _Header{signature: signature, version: version}, sequence: 10, count: 5}
+	data, err := inf.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got _DBInfo
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if got != inf {
+		t.Fatalf("expected db info %+v; got %+v", inf, got)
+	}
+	inf.encryption = 1
+	data, _ = inf.MarshalBinary()
+	if err := got.UnmarshalBinary(data); err != nil || got.encryption != 1 || got.sequence != 10 {
+		t.Fatalf("expected encryption 1 and sequence 10; got %d and %d", got.encryption, got.sequence)
+	}
+}
+
+func TestBatchError(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	errBatch := errors.New("batch failed")
+	err = db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		if err := b.Put([]byte("unit.batch.error"), []byte("msg")); err != nil {
+			return err
+		}
+		return errBatch
+	})
+	if err != errBatch {
+		t.Fatalf("expected %v; got %v", errBatch, err)
+	}
+}
+
+func TestExpireEntries(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16), WithMutable(), WithBackgroundKeyExpiry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit.expire")
+	if err := db.Put(topic, []byte("msg.live")); err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := uint32(time.Now().Add(-1 * time.Hour).Unix())
+	for i := 0; i < 10; i++ {
+		entry := &Entry{Topic: topic, Payload: []byte(fmt.Sprintf("msg.%2d", i)), ExpiresAt: expiresAt}
+		if err := db.PutEntry(entry.WithID(db.NewID())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// expired entries are added to the expiry window when queried, and are deleted once.
+	for i := 0; i < 2; i++ {
+		if _, err := db.Get(NewQuery(topic)); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.expireEntries(); err != nil {
+			t.Fatal(err)
+		}
+		if count := db.Count(); count != 1 {
+			t.Fatalf("expected count 1 after expiry; got %d", count)
+		}
+	}
+}
+
+func TestDeleteTopicParent(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithFreeBlockSize(1<<16), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// the parent topic is kept when its only child topic is deleted.
+	parent, child := []byte("unit.parent"), []byte("unit.parent.child")
+	for _, topic := range [][]byte{parent, child} {
+		if err := db.Put(topic, []byte("msg")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteTopic(child); err != nil {
+		t.Fatal(err)
+	}
+	if items, err := db.Get(NewQuery(parent)); err != nil || len(items) != 1 {
+		t.Fatalf("expected 1 message of the parent topic; got %d, %v", len(items), err)
+	}
+}
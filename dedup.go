@@ -0,0 +1,123 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/unit-io/unitdb/hash"
+	"github.com/unit-io/unitdb/message"
+)
+
+type (
+	// _DedupEntry is the message put for a dedup key.
+	_DedupEntry struct {
+		id   message.ID
+		seq  uint64
+		seen time.Time
+	}
+
+	// _Dedup remembers dedup keys of messages put within the dedup window. Keys are compared
+	// exactly so a put is never skipped for a different key.
+	_Dedup struct {
+		locks _Mutex // The locks serialize puts having the same dedup key.
+
+		mu        sync.Mutex
+		window    time.Duration
+		keys      map[string]_DedupEntry
+		lastPurge time.Time
+	}
+)
+
+func newDedup(window time.Duration) *_Dedup {
+	return &_Dedup{locks: newMutex(), window: window, keys: make(map[string]_DedupEntry), lastPurge: time.Now()}
+}
+
+// dedupKey returns the dedup key scoped to the contract.
+func dedupKey(contract uint32, key []byte) string {
+	k := make([]byte, 4+len(key))
+	binary.LittleEndian.PutUint32(k[:4], contract)
+	copy(k[4:], key)
+	return string(k)
+}
+
+// getMutex returns the lock of the dedup key.
+func (d *_Dedup) getMutex(key string) *sync.RWMutex {
+	return d.locks.getMutex(uint64(hash.New([]byte(key))))
+}
+
+// get returns the message put for the dedup key within the dedup window.
+func (d *_Dedup) get(key string, now time.Time) (_DedupEntry, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, ok := d.keys[key]
+	if !ok || now.Sub(e.seen) >= d.window {
+		return _DedupEntry{}, false
+	}
+	return e, true
+}
+
+// add remembers the message put for the dedup key. Keys older than the dedup window are
+// purged at most once a window.
+func (d *_Dedup) add(key string, e _DedupEntry) {
+	if d.window <= 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e.seen.Sub(d.lastPurge) >= d.window {
+		for k, v := range d.keys {
+			if e.seen.Sub(v.seen) >= d.window {
+				delete(d.keys, k)
+			}
+		}
+		d.lastPurge = e.seen
+	}
+	d.keys[key] = e
+}
+
+// reset forgets the messages put for all dedup keys.
+func (d *_Dedup) reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.keys = make(map[string]_DedupEntry)
+}
+
+// putDedup puts the entry unless a message is put for the dedup key of the entry within the
+// dedup window, in which case it returns the ID and sequence of that message.
+func (db *DB) putDedup(e *Entry) (message.ID, uint64, error) {
+	contract := e.Contract
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	key := dedupKey(contract, e.dedupKey)
+	mu := db.internal.dedup.getMutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+	if d, ok := db.internal.dedup.get(key, time.Now()); ok {
+		e.reset()
+		return d.id, d.seq, nil
+	}
+	id, seq, err := db.putResult(e)
+	if err != nil {
+		return nil, 0, err
+	}
+	db.internal.dedup.add(key, _DedupEntry{id: id, seq: seq, seen: time.Now()})
+	return id, seq, nil
+}
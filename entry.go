@@ -18,9 +18,14 @@ package unitdb
 
 import (
 	"encoding/binary"
-	"strconv"
+	"io"
+	"math"
+	"math/bits"
+	"sync"
 	"time"
 	"unsafe"
+
+	"github.com/unit-io/unitdb/message"
 )
 
 const (
@@ -34,9 +39,11 @@ type (
 		valueSize uint32
 		expiresAt uint32 // expiresAt for recovery from log and not persisted to index file but persisted to the time window file.
 
-		parsed    bool
-		topicHash uint64 // topicHash for recovery from log and not persisted to the DB.
-		cache     []byte // entry from memdb if it exist.
+		parsed         bool
+		reserved       bool   // reserved is set if the sequence set using WithSeq is reserved until the entry is written.
+		topicHash      uint64 // topicHash for recovery from log and not persisted to the DB.
+		topicExpiresAt uint32 // topicExpiresAt is expiry time from the ttl parameter of the topic.
+		cache          []byte // entry from memdb if it exist.
 	}
 	// Entry entry is a message entry structure.
 	Entry struct {
@@ -47,6 +54,15 @@ type (
 		ExpiresAt  uint32 // The time expiry of the message.
 		Contract   uint32 // The contract is used to as salt to hash topic parts and also used as prefix in the message ID.
 		Encryption bool
+
+		ttl         time.Duration // The time to live of the message set using WithTTL.
+		compression Compression   // The compression of the message set using WithCompression.
+		multiPart   bool          // The multiPart is set if the payload holds parts set using WithPayloads.
+		seq         uint64        // The seq of the message set using WithSeq.
+		dedupKey    []byte        // The dedupKey identifies retries of the message set using WithDedupKey.
+		alias       uint16        // The alias of the topic set using WithAlias.
+		reader      io.Reader     // The reader of the payload of a message put using DB.PutReader.
+		readerSize  int64         // The size of the payload read from the reader.
 	}
 )
 
@@ -58,15 +74,52 @@ func NewEntry(topic, payload []byte) *Entry {
 	}
 }
 
-// WithID sets entry ID.
+// WithID sets entry ID. The sequence of the DB is advanced past the sequence of the ID once the
+// entry is put, so later messages are not assigned the sequence.
 func (e *Entry) WithID(id []byte) *Entry {
 	e.ID = id
 	return e
 }
 
-// WithPayload sets payload to put entry into DB.
+// WithSeq sets sequence of the entry, such as to preserve the sequence of a message replicated from
+// another node. The sequence of the DB is advanced past seq once the entry is put, and a put returns
+// errEntryExist if the DB has a live message with the sequence, or another entry with the sequence is
+// being put, so a replayed message is not written twice. The ID of the entry takes precedence over the
+// sequence.
+func (e *Entry) WithSeq(seq uint64) *Entry {
+	e.seq = seq
+	return e
+}
+
+// WithAlias sets the topic of the entry to the topic registered for the alias using DB.RegisterAlias,
+// so the topic is not parsed on put. The topic of the entry is replaced by the topic of the alias.
+func (e *Entry) WithAlias(alias uint16) *Entry {
+	e.alias = alias
+	return e
+}
+
+// WithDedupKey sets dedup key of the entry, such as a producer message ID, so a put retried after a
+// timeout is not written twice. PutEntry and PutWithResult skip the entry if a message is put for the
+// dedup key and contract within the dedup window set using WithDedupWindow, and PutWithResult returns
+// the ID and sequence of that message. Puts of a batch or PutEntries do not use the dedup key.
+func (e *Entry) WithDedupKey(key []byte) *Entry {
+	e.dedupKey = key
+	return e
+}
+
+// WithPayload sets payload to put entry into DB. It replaces parts set using WithPayloads.
 func (e *Entry) WithPayload(payload []byte) *Entry {
 	e.Payload = payload
+	e.multiPart = false
+	return e
+}
+
+// WithPayloads sets payload of the entry to the parts, such as fragments of a chunked upload,
+// so the parts are put atomically as a single message. Get returns the parts joined in order,
+// and Message.Parts returns the parts of the message.
+func (e *Entry) WithPayloads(parts [][]byte) *Entry {
+	e.Payload = joinParts(parts)
+	e.multiPart = true
 	return e
 }
 
@@ -76,30 +129,156 @@ func (e *Entry) WithContract(contract uint32) *Entry {
 	return e
 }
 
-// WithTTL sets TTL for message expiry for the entry.
-func (e *Entry) WithTTL(ttl []byte) *Entry {
-	val, err := strconv.ParseInt(unsafeToString(ttl), 10, 64)
-	if err == nil {
-		e.ExpiresAt = uint32(time.Now().Add(time.Duration(int(val)) * time.Second).Unix())
-	}
-	var duration time.Duration
-	duration, _ = time.ParseDuration(unsafeToString(ttl))
-	e.ExpiresAt = uint32(time.Now().Add(duration).Unix())
+// WithTTL sets TTL for message expiry for the entry. The expiry time is computed when the
+// entry is put into DB. The entry TTL takes precedence over ExpiresAt of the entry and
+// over the ttl parameter of the topic.
+func (e *Entry) WithTTL(ttl time.Duration) *Entry {
+	e.ttl = ttl
+	return e
+}
+
+// WithCompression sets the codec used to compress payload of the entry. It takes precedence
+// over the compression of the batch and the DB.
+func (e *Entry) WithCompression(c Compression) *Entry {
+	e.compression = c
 	return e
 }
 
+// WithNoCompression stores payload of the entry uncompressed, such as for payloads
+// that are already compressed.
+func (e *Entry) WithNoCompression() *Entry {
+	return e.WithCompression(CompressionNone)
+}
+
 // WithEncryption sets encryption on entry.
 func (e *Entry) WithEncryption() *Entry {
 	e.Encryption = true
 	return e
 }
 
+// expiryTime returns expiry time of the entry. The precedence of the expiry is the entry TTL,
+// then ExpiresAt of the entry and then the ttl parameter of the topic.
+func (e *Entry) expiryTime() (uint32, error) {
+	switch {
+	case e.ttl > 0:
+		expiresAt := time.Now().Add(e.ttl).Unix()
+		if expiresAt > math.MaxUint32 {
+			return 0, errTtlTooLarge
+		}
+		return uint32(expiresAt), nil
+	case e.ExpiresAt != 0:
+		return e.ExpiresAt, nil
+	}
+	return e.entry.topicExpiresAt, nil
+}
+
 func (e *Entry) reset() {
 	e.entry.seq = 0
+	e.entry.reserved = false
 	e.entry.topicSize = 0
+	putCache(e.entry.cache)
 	e.entry.cache = nil
 	e.ID = nil
 	e.Payload = nil
+	e.multiPart = false
+	e.seq = 0
+	e.dedupKey = nil
+	e.reader = nil
+	e.readerSize = 0
+}
+
+// Entries are packed into buffers pooled by size class, from 64 bytes to 64KB in powers of two. The
+// packed entry is copied into the mem DB or the batch before the entry is reset, so the buffer is put
+// back to the pool on reset. Larger entries are not pooled.
+const (
+	minCacheClass = 6
+	maxCacheClass = 16
+)
+
+var cachePools [maxCacheClass - minCacheClass + 1]sync.Pool
+
+// cacheClass returns the size class of the smallest pooled buffer holding the size, or -1 if the
+// size is larger than the largest size class.
+func cacheClass(size int) int {
+	c := bits.Len(uint(size-1)) - minCacheClass
+	switch {
+	case c < 0:
+		return 0
+	case c > maxCacheClass-minCacheClass:
+		return -1
+	}
+	return c
+}
+
+// getCache returns a buffer of the size to pack the entry into. The buffer is not zeroed.
+func getCache(size int) []byte {
+	c := cacheClass(size)
+	if c < 0 {
+		return make([]byte, size)
+	}
+	if buf, ok := cachePools[c].Get().(*[]byte); ok {
+		return (*buf)[:size]
+	}
+	return make([]byte, size, 1<<(c+minCacheClass))
+}
+
+// putCache puts the buffer the entry is packed into back to the pool of its size class.
+func putCache(buf []byte) {
+	c := cacheClass(cap(buf))
+	if c < 0 || cap(buf) != 1<<(c+minCacheClass) {
+		return
+	}
+	buf = buf[:0]
+	cachePools[c].Put(&buf)
+}
+
+// messageID returns the ID of the message packed by setEntry with the sequence of the message.
+func (e *Entry) messageID() message.ID {
+	id := make(message.ID, message.ID(nil).Size())
+	copy(id, e.entry.cache[entrySize:entrySize+8])
+	binary.LittleEndian.PutUint64(id[8:], e.entry.seq)
+	return id
+}
+
+// joinParts frames the parts into a payload. The payload holds the number of parts and length of
+// each part followed by the parts. An empty list of parts is framed into an empty payload.
+func joinParts(parts [][]byte) []byte {
+	if len(parts) == 0 {
+		return nil
+	}
+	size := 4 + 4*len(parts)
+	for _, p := range parts {
+		size += len(p)
+	}
+	data := make([]byte, 4+4*len(parts), size)
+	binary.LittleEndian.PutUint32(data[:4], uint32(len(parts)))
+	for i, p := range parts {
+		binary.LittleEndian.PutUint32(data[4+4*i:], uint32(len(p)))
+		data = append(data, p...)
+	}
+	return data
+}
+
+// splitParts returns the parts framed into the payload by joinParts.
+func splitParts(data []byte) ([][]byte, error) {
+	if len(data) < 4 {
+		return nil, errEntryInvalid
+	}
+	n := int(binary.LittleEndian.Uint32(data[:4]))
+	if n > (len(data)-4)/4 {
+		return nil, errEntryInvalid
+	}
+	off := 4 + 4*n
+	parts := make([][]byte, n)
+	for i := range parts {
+		size := int(binary.LittleEndian.Uint32(data[4+4*i:]))
+		if size > len(data)-off {
+			return nil, errEntryInvalid
+		}
+		parts[i] = data[off : off+size]
+		off += size
+	}
+	return parts, nil
 }
 
 func (e _Entry) ExpiresAt() uint32 {
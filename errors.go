@@ -31,15 +31,28 @@ var (
 	errMsgExpired          = errors.New("Message has expired")
 	errValueEmpty          = errors.New("Payload is empty")
 	errValueTooLarge       = errors.New("value is too large")
+	errStreamEncrypted     = errors.New("payload read from a reader cannot be encrypted")
 	errEntryInvalid        = errors.New("entry is invalid")
 	errEntryExist          = errors.New("entry exist in database")
 	errImmutable           = errors.New("database is immutable")
 	errFull                = errors.New("database is full")
+	errVersionUnsupported  = errors.New("unsupported format version")
 	errCorrupted           = errors.New("database is corrupted")
+	errChecksumUnsupported = errors.New("database was written without checksums")
 	errLocked              = errors.New("database is locked")
 	errClosed              = errors.New("database is closed")
 	errBatchSeqComplete    = errors.New("batch seq is complete")
-	errWriteConflict       = errors.New("batch write conflict")
+	errBatchTruncated      = errors.New("database was truncated since the batch was started")
+	errWriteConflict       = errors.New("write conflict")
 	errBadRequest          = errors.New("The request was invalid or cannot be otherwise served")
+	errRegexInvalid        = errors.New("query regex is invalid")
 	errForbidden           = errors.New("The request is understood, but it has been refused or access is not allowed")
+	errKeyNotFound         = errors.New("encryption key not found for the contract")
+	errShardsInvalid       = errors.New("number of shards must be a power of two")
+	errKeyIDInvalid        = errors.New("key id of the key ring must be between 1 and 13")
+	errReEncryptSize       = errors.New("re-encrypted message size does not match size of the message")
+	errAliasNotFound       = errors.New("topic alias is not registered")
+	errCodecNotFound       = errors.New("compression codec is not registered")
+	errBackupCorrupted     = errors.New("backup is corrupted")
+	errBackupTargetExist   = errors.New("database exist in the restore path")
 )
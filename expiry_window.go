@@ -93,11 +93,16 @@ func (wb *_ExpiryWindowBucket) getExpiredEntries(maxResults int) []timeWindowEnt
 		return expiredEntries
 	}
 
-	for i := 0; i < wb.maxExpDurations; i++ {
-		// get windows shard.
-		ws := wb.expiryWindows.expiry[i]
+	// Entries are added to the shard of their expiry time so all shards are looked up.
+	for _, ws := range wb.expiryWindows.expiry {
+		if len(expiredEntries) > maxResults {
+			break
+		}
 		ws.mu.Lock()
-		defer ws.mu.Unlock()
+		if len(ws.windows) == 0 {
+			ws.mu.Unlock()
+			continue
+		}
 		windowTimes := make([]int64, 0, len(ws.windows))
 		for windowTime := range ws.windows {
 			windowTimes = append(windowTimes, windowTime)
@@ -120,6 +125,7 @@ func (wb *_ExpiryWindowBucket) getExpiredEntries(maxResults int) []timeWindowEnt
 				delete(ws.windows, windowTimes[i])
 			}
 		}
+		ws.mu.Unlock()
 	}
 	atomic.StoreInt64(&wb.earliestExpiryHash, 0)
 	return expiredEntries
@@ -23,6 +23,8 @@ import (
 	"os"
 	"path"
 	"sync"
+
+	"github.com/unit-io/unitdb/fs"
 )
 
 // _FileType represent a file type.
@@ -49,20 +51,9 @@ const (
 type _FileDesc struct {
 	fileType _FileType
 	num      int16
-	fd       uintptr
 }
 
 func filePath(dirName string, fd _FileDesc) string {
-	name := fmt.Sprintf("%#x-%d", fd.fileType, fd.num)
-	if err := ensureDir(path.Join(dirName, indexDir)); err != nil {
-		return name
-	}
-	if err := ensureDir(path.Join(dirName, dataDir)); err != nil {
-		return name
-	}
-	if err := ensureDir(path.Join(dirName, winDir)); err != nil {
-		return name
-	}
 	switch fd.fileType {
 	case typeInfo:
 		suffix := fmt.Sprintf("%s.info", prefix)
@@ -87,14 +78,9 @@ func filePath(dirName string, fd _FileDesc) string {
 	}
 }
 
-// _LockFile represents a lock file.
-type _LockFile interface {
-	unlock() error
-}
-
 type (
 	_File struct {
-		*os.File
+		fs.File
 		fd   _FileDesc
 		size int64
 	}
@@ -104,37 +90,48 @@ type (
 		fileMap map[int16]_File
 		list    []_FileSet
 		*_File
+
+		// fsys and path are the file system and the directory of the DB files.
+		fsys fs.FileSystem
+		path string
 	}
 )
 
 // createLockFile to create lock file.
-func createLockFile(dirName string) (_LockFile, error) {
-	if err := ensureDir(dirName); err != nil {
+func createLockFile(fsys fs.FileSystem, dirName string) (fs.LockFile, error) {
+	if err := fsys.MkdirAll(dirName, 0777); err != nil {
 		return nil, err
 	}
 	suffix := fmt.Sprintf("%s.lock", prefix)
 
-	return newLockFile(path.Join(dirName, suffix))
+	return fsys.Lock(path.Join(dirName, suffix))
 }
 
-func newFile(path string, nFiles int16, fd _FileDesc) (_FileSet, error) {
+// newFile opens the DB files of the file type. Files of a read-only DB are opened for reading
+// and are not created.
+func newFile(fsys fs.FileSystem, path string, nFiles int16, fd _FileDesc, readOnly bool) (_FileSet, error) {
 	if nFiles == 0 {
 		return _FileSet{}, errors.New("no new file")
 	}
-	fileFlag := os.O_CREATE | os.O_RDWR
+	fileFlag := os.O_RDONLY
+	if !readOnly {
+		if err := ensureDirs(fsys, path); err != nil {
+			return _FileSet{}, err
+		}
+		fileFlag = os.O_CREATE | os.O_RDWR
+	}
 	fileMode := os.FileMode(0666)
 	f := _File{}
 	fs := _FileSet{mu: new(sync.RWMutex), fileMap: make(map[int16]_File, nFiles)}
 	for i := int16(0); i < nFiles; i++ {
 		fd.num = i
 		path := filePath(path, fd)
-		fi, err := os.OpenFile(path, fileFlag, fileMode)
+		fi, err := fsys.OpenFile(path, fileFlag, fileMode)
 		if err != nil {
 			return fs, err
 		}
 		f.File = fi
 
-		fd.fd = fi.Fd()
 		f.fd = fd
 		stat, err := fi.Stat()
 		if err != nil {
@@ -227,12 +224,41 @@ func (fs *_FileSet) getFile(fd _FileDesc) (*_File, error) {
 	return &_File{}, errors.New("file not found")
 }
 
+// reopen reopens the file once it is replaced, such as by DB.Compact. The file is reopened in place
+// so readers and writers holding the file read and write the new file.
+func (fs *_FileSet) reopen(fd _FileDesc) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, fileset := range fs.list {
+		if fileset.fd.fileType != fd.fileType || fileset.fd.num != fd.num {
+			continue
+		}
+		fi, err := fs.fsys.OpenFile(filePath(fs.path, fd), os.O_CREATE|os.O_RDWR, os.FileMode(0666))
+		if err != nil {
+			return err
+		}
+		stat, err := fi.Stat()
+		if err != nil {
+			fi.Close()
+			return err
+		}
+		old := fileset._File.File
+		fileset._File.File = fi
+		fileset._File.size = stat.Size()
+		fileset.fileMap[fd.num] = *fileset._File
+		return old.Close()
+	}
+	return errors.New("file not found")
+}
+
 func (fs *_FileSet) sync() error {
 	fs.mu.RLock()
 	defer fs.mu.RUnlock()
-	for _, f := range fs.fileMap {
-		if err := f.Sync(); err != nil {
-			return err
+	for _, files := range fs.list {
+		for _, f := range files.fileMap {
+			if err := f.Sync(); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
@@ -242,12 +268,30 @@ func (fs *_FileSet) size() (int64, error) {
 	fs.mu.RLock()
 	defer fs.mu.RUnlock()
 	size := int64(0)
-	for _, f := range fs.fileMap {
-		size += f.currSize()
+	for _, files := range fs.list {
+		for _, f := range files.fileMap {
+			size += f.currSize()
+		}
 	}
 	return size, nil
 }
 
+// sizeOf returns the total size of the files of the file type.
+func (fs *_FileSet) sizeOf(fileType _FileType) int64 {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	size := int64(0)
+	for _, files := range fs.list {
+		if files.fd.fileType != fileType {
+			continue
+		}
+		for _, f := range files.fileMap {
+			size += f.currSize()
+		}
+	}
+	return size
+}
+
 func (fs *_FileSet) close() error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
@@ -261,11 +305,12 @@ func (fs *_FileSet) close() error {
 	return nil
 }
 
-func ensureDir(dirName string) error {
-	err := os.Mkdir(dirName, 0777)
-	if err == nil || os.IsExist(err) {
-		return nil
-	} else {
-		return err
+// ensureDirs creates the DB directory along with directories of index, data and window files.
+func ensureDirs(fsys fs.FileSystem, dirName string) error {
+	for _, dir := range []string{indexDir, dataDir, winDir} {
+		if err := fsys.MkdirAll(path.Join(dirName, dir), 0777); err != nil {
+			return err
+		}
 	}
+	return nil
 }
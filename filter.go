@@ -53,14 +53,15 @@ func (f *Filter) close() error {
 	return nil
 }
 
-// writeFilterBlock writes the filter block.
+// writeFilterBlock writes the filter block. The filter file is truncated to the filter block so
+// a smaller filter, such as a rebuilt filter, does not leave bytes of the old filter behind.
 func (f *Filter) writeFilterBlock() error {
 	d := f.filterBlock.Finish()
 	if _, err := f.file.WriteAt(d, 0); err != nil {
 		return err
 	}
 
-	return nil
+	return f.file.truncate(int64(len(d)))
 }
 
 func (f *Filter) getFilterBlock(fillCache bool) (*filter.Block, error) {
@@ -1,10 +1,40 @@
 package filter
 
+import (
+	"encoding/binary"
+	"math"
+)
+
 const (
 	bloomHashes uint64 = 7
 	bloomBits   uint64 = 160000
+
+	// sizeMagic marks a filter block having its size in the block header. Blocks of the default
+	// size are written without the header.
+	sizeMagic  uint64 = 0x6d6f6f6c62746e75
+	headerSize        = 24
 )
 
+// Size returns bits and hashes of a filter holding the expected number of keys with the false
+// positive rate. Bits grow linearly with the expected keys, by about 9.6 bits a key for 1% false
+// positives and another 4.8 bits a key for each tenfold lower rate. Bits are rounded up to a
+// multiple of 64.
+func Size(expectedKeys uint64, fpRate float64) (bits, hashes uint64) {
+	if expectedKeys < KMin {
+		expectedKeys = KMin
+	}
+	if fpRate <= 0 || fpRate >= 1 {
+		return bloomBits, bloomHashes
+	}
+	m := math.Ceil(-float64(expectedKeys) * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	bits = (uint64(m) + 63) / 64 * 64
+	hashes = uint64(math.Round(float64(bits) / float64(expectedKeys) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	return bits, hashes
+}
+
 // Generator bloom filter generator.
 type Generator struct {
 	filter *Filter
@@ -15,6 +45,15 @@ func NewFilterGenerator() *Generator {
 	return &Generator{filter: newFilter(bloomBits, bloomHashes)}
 }
 
+// NewSizedFilterGenerator returns a new filter generator of the filter size, see Size. Zero bits
+// or hashes use the default size.
+func NewSizedFilterGenerator(bits, hashes uint64) *Generator {
+	if bits == 0 || hashes == 0 {
+		return NewFilterGenerator()
+	}
+	return &Generator{filter: newFilter(bits, hashes)}
+}
+
 // Append adds a key to the filter block.
 func (b *Generator) Append(h uint64) {
 	b.filter.Add(h)
@@ -22,12 +61,19 @@ func (b *Generator) Append(h uint64) {
 
 // Finish finishes building the filter block and returns a slice to its contents.
 func (b *Generator) Finish() []byte {
-	return b.filter.Bytes()
+	return b.Bytes()
 }
 
 // Bytes returns a slice to filter block contents.
 func (b *Generator) Bytes() []byte {
-	return b.filter.Bytes()
+	if b.filter.m == bloomBits && uint64(len(b.filter.keys)) == bloomHashes {
+		return b.filter.Bytes()
+	}
+	header := make([]byte, headerSize)
+	binary.LittleEndian.PutUint64(header[0:8], sizeMagic)
+	binary.LittleEndian.PutUint64(header[8:16], b.filter.m)
+	binary.LittleEndian.PutUint64(header[16:24], uint64(len(b.filter.keys)))
+	return append(header, b.filter.Bytes()...)
 }
 
 // Block is a filter block
@@ -36,7 +82,13 @@ type Block struct {
 }
 
 // NewFilterBlock returns new filter block, it is used to test key presence in the filter.
+// The size of the filter is read from the block header, or the default size is used.
 func NewFilterBlock(b []byte) *Block {
+	if len(b) >= headerSize && binary.LittleEndian.Uint64(b[0:8]) == sizeMagic {
+		return &Block{
+			filter: newFilterFromBytes(b[headerSize:], binary.LittleEndian.Uint64(b[8:16]), binary.LittleEndian.Uint64(b[16:24])),
+		}
+	}
 	return &Block{
 		filter: newFilterFromBytes(b, bloomBits, bloomHashes),
 	}
@@ -0,0 +1,226 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// directBlockSize is the alignment of offsets, sizes and memory of unbuffered IO.
+const directBlockSize = 4096
+
+// Direct is the FileSystem of the operating system that opens files for unbuffered IO
+// bypassing the page cache, using O_DIRECT on Linux. Reads and writes are done in whole
+// aligned blocks, and a write to part of a block reads the block first. Files are opened
+// for buffered IO where unbuffered IO is not supported, such as on a file system that
+// rejects O_DIRECT or on other operating systems.
+var Direct FileSystem = directFS{}
+
+type directFS struct {
+	osFS
+}
+
+func (directFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if directFlag == 0 {
+		return os.OpenFile(name, flag, perm)
+	}
+	// Partial blocks are read before they are written, and appends are done at the file size.
+	f := &_DirectFile{append: flag&os.O_APPEND != 0}
+	dflag := flag &^ os.O_APPEND
+	if dflag&os.O_WRONLY != 0 {
+		dflag = dflag&^os.O_WRONLY | os.O_RDWR
+	}
+	fi, err := os.OpenFile(name, dflag|directFlag, perm)
+	if errors.Is(err, syscall.EINVAL) {
+		return os.OpenFile(name, flag, perm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.File = fi
+	return f, nil
+}
+
+// _DirectFile is a file opened for unbuffered IO.
+type _DirectFile struct {
+	*os.File
+
+	// mu serializes writes as a partial block is read, modified and written back.
+	mu     sync.Mutex
+	off    int64
+	append bool
+}
+
+// alignedBuf returns a zeroed buffer of size whose memory is aligned to the block size.
+func alignedBuf(size int64) []byte {
+	buf := make([]byte, size+directBlockSize)
+	shift := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) & (directBlockSize - 1)); rem != 0 {
+		shift = directBlockSize - rem
+	}
+	return buf[shift : int64(shift)+size]
+}
+
+func alignDown(off int64) int64 {
+	return off &^ (directBlockSize - 1)
+}
+
+func alignUp(off int64) int64 {
+	return alignDown(off + directBlockSize - 1)
+}
+
+func (f *_DirectFile) size() (int64, error) {
+	stat, err := f.File.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// readBlocks reads aligned blocks into buf leaving the space past the end of file zeroed.
+func (f *_DirectFile) readBlocks(buf []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(buf, off)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *_DirectFile) readAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	start := alignDown(off)
+	buf := alignedBuf(alignUp(off+int64(len(p))) - start)
+	n, err := f.readBlocks(buf, start)
+	if err != nil {
+		return 0, err
+	}
+	if int64(n) <= off-start {
+		return 0, io.EOF
+	}
+	c := copy(p, buf[off-start:n])
+	if c < len(p) {
+		return c, io.EOF
+	}
+	return c, nil
+}
+
+func (f *_DirectFile) writeAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	size, err := f.size()
+	if err != nil {
+		return 0, err
+	}
+	start, end := alignDown(off), alignUp(off+int64(len(p)))
+	buf := alignedBuf(end - start)
+	if off != start && start < size {
+		if _, err := f.readBlocks(buf[:directBlockSize], start); err != nil {
+			return 0, err
+		}
+	}
+	if last := end - directBlockSize; off+int64(len(p)) != end && last < size && (last != start || off == start) {
+		if _, err := f.readBlocks(buf[last-start:], last); err != nil {
+			return 0, err
+		}
+	}
+	copy(buf[off-start:], p)
+	if _, err := f.File.WriteAt(buf, start); err != nil {
+		return 0, err
+	}
+	// Writing whole blocks extends the file past the data written, so truncate it back.
+	if end > size {
+		if newSize := off + int64(len(p)); newSize < end {
+			if size > newSize {
+				newSize = size
+			}
+			if err := f.File.Truncate(newSize); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(p), nil
+}
+
+func (f *_DirectFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.readAt(p, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *_DirectFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, &os.PathError{Op: "readat", Path: f.Name(), Err: os.ErrInvalid}
+	}
+	return f.readAt(p, off)
+}
+
+func (f *_DirectFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.append {
+		size, err := f.size()
+		if err != nil {
+			return 0, err
+		}
+		f.off = size
+	}
+	n, err := f.writeAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *_DirectFile) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, &os.PathError{Op: "writeat", Path: f.Name(), Err: os.ErrInvalid}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writeAt(p, off)
+}
+
+func (f *_DirectFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		size, err := f.size()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.Name(), Err: os.ErrInvalid}
+	}
+	f.off = offset
+	return offset, nil
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirectFile(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "direct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := Direct.OpenFile(filepath.Join(dir, "f"), os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// Write unaligned ranges within, across and past blocks and compare to the expected content.
+	var want []byte
+	rnd := rand.New(rand.NewSource(1))
+	for _, w := range []struct{ off, size int }{{0, 10}, {4090, 20}, {100, 5000}, {9000, 1}, {8192, 4096}, {3, 3}, {20000, 100}} {
+		p := make([]byte, w.size)
+		rnd.Read(p)
+		if _, err := f.WriteAt(p, int64(w.off)); err != nil {
+			t.Fatal(err)
+		}
+		if end := w.off + w.size; end > len(want) {
+			want = append(want, make([]byte, end-len(want))...)
+		}
+		copy(want[w.off:], p)
+
+		stat, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Size() != int64(len(want)) {
+			t.Fatalf("expected size %d; got %d", len(want), stat.Size())
+		}
+		got := make([]byte, len(want))
+		if _, err := f.ReadAt(got, 0); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("write %d+%d: content mismatch", w.off, w.size)
+		}
+	}
+	if _, err := f.ReadAt(make([]byte, 10), int64(len(want))-5); err != io.EOF {
+		t.Fatalf("expected %v; got %v", io.EOF, err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("read content mismatch")
+	}
+	if _, err := f.Write([]byte("tail")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(int64(len(want)) + 2); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 6)
+	if _, err := f.ReadAt(buf, int64(len(want))-4); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[4:], []byte("ta")) {
+		t.Fatalf("expected %q; got %q", "ta", buf[4:])
+	}
+}
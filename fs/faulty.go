@@ -0,0 +1,262 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// ErrInjected is the error a Faulty file system returns for a fault set without an error.
+var ErrInjected = errors.New("fs: injected fault")
+
+// Faulty is a FileSystem that wraps another FileSystem and injects errors into reads and
+// writes of its files, such as to test how a DB handles IO errors without real disk faults.
+// Faults apply to files opened before or after they are set, and injected errors are
+// returned wrapped in an *os.PathError.
+type Faulty struct {
+	fsys FileSystem
+
+	mu         sync.Mutex
+	match      func(name string) bool
+	reads      int
+	writes     int
+	readFault  _Fault
+	writeFault _Fault
+	full       bool
+}
+
+// _Fault is an error injected into the operation counted at.
+type _Fault struct {
+	at    int // at is zero if the fault is not set.
+	err   error
+	short bool
+}
+
+type _FaultyFile struct {
+	File
+	fs *Faulty
+}
+
+// NewFaulty returns a Faulty file system over fsys with no faults set.
+func NewFaulty(fsys FileSystem) *Faulty {
+	return &Faulty{fsys: fsys}
+}
+
+// Match limits faults to the files for which fn returns true, such as to fail writes of the
+// data file but not of the write ahead log. A nil fn applies faults to all files.
+func (f *Faulty) Match(fn func(name string) bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.match = fn
+}
+
+// FailRead fails the nth read of a file from now with err, or with ErrInjected if err is nil.
+func (f *Faulty) FailRead(n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.readFault = _Fault{at: nth(f.reads, n), err: err}
+}
+
+// FailWrite fails the nth write of a file from now with err, or with ErrInjected if err is nil.
+func (f *Faulty) FailWrite(n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writeFault = _Fault{at: nth(f.writes, n), err: err}
+}
+
+// ShortWrite makes the nth write of a file from now write half of the data and return
+// io.ErrShortWrite.
+func (f *Faulty) ShortWrite(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writeFault = _Fault{at: nth(f.writes, n), err: io.ErrShortWrite, short: true}
+}
+
+// SetFull sets whether the file system is full. Writes and truncates that grow a file of a
+// full file system fail with syscall.ENOSPC.
+func (f *Faulty) SetFull(full bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.full = full
+}
+
+// Reset clears all faults.
+func (f *Faulty) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.match = nil
+	f.readFault = _Fault{}
+	f.writeFault = _Fault{}
+	f.full = false
+}
+
+// nth returns the count of the nth operation after count operations.
+func nth(count, n int) int {
+	if n < 1 {
+		n = 1
+	}
+	return count + n
+}
+
+// read counts a read of the named file and returns the error injected into it, if any.
+func (f *Faulty) read(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.match != nil && !f.match(name) {
+		return nil
+	}
+	f.reads++
+	if f.readFault.at == 0 || f.readFault.at != f.reads {
+		return nil
+	}
+	err := f.readFault.err
+	f.readFault = _Fault{}
+	if err == nil {
+		err = ErrInjected
+	}
+	return &os.PathError{Op: "read", Path: name, Err: err}
+}
+
+// write counts a write of the named file and returns the error injected into it, if any.
+// A short write is reported if the write is to write part of the data before failing.
+func (f *Faulty) write(name string, grows func() bool) (short bool, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.match != nil && !f.match(name) {
+		return false, nil
+	}
+	f.writes++
+	if f.full && grows() {
+		return false, &os.PathError{Op: "write", Path: name, Err: syscall.ENOSPC}
+	}
+	if f.writeFault.at == 0 || f.writeFault.at != f.writes {
+		return false, nil
+	}
+	fault := f.writeFault
+	f.writeFault = _Fault{}
+	if fault.err == nil {
+		fault.err = ErrInjected
+	}
+	return fault.short, &os.PathError{Op: "write", Path: name, Err: fault.err}
+}
+
+// isFull reports whether growing the named file fails.
+func (f *Faulty) isFull(name string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.full && (f.match == nil || f.match(name))
+}
+
+func (f *Faulty) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := f.fsys.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &_FaultyFile{File: file, fs: f}, nil
+}
+
+func (f *Faulty) Stat(name string) (os.FileInfo, error) {
+	return f.fsys.Stat(name)
+}
+
+func (f *Faulty) MkdirAll(name string, perm os.FileMode) error {
+	return f.fsys.MkdirAll(name, perm)
+}
+
+func (f *Faulty) Rename(oldName, newName string) error {
+	return f.fsys.Rename(oldName, newName)
+}
+
+func (f *Faulty) Remove(name string) error {
+	return f.fsys.Remove(name)
+}
+
+func (f *Faulty) RemoveAll(name string) error {
+	return f.fsys.RemoveAll(name)
+}
+
+func (f *Faulty) TempDir(dir, pattern string) (string, error) {
+	return f.fsys.TempDir(dir, pattern)
+}
+
+func (f *Faulty) Lock(name string) (LockFile, error) {
+	return f.fsys.Lock(name)
+}
+
+// grows reports whether writing up to size grows the file.
+func (f *_FaultyFile) grows(size int64) bool {
+	info, err := f.File.Stat()
+	return err != nil || size > info.Size()
+}
+
+func (f *_FaultyFile) Read(p []byte) (int, error) {
+	if err := f.fs.read(f.Name()); err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+func (f *_FaultyFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.fs.read(f.Name()); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *_FaultyFile) Write(p []byte) (int, error) {
+	short, err := f.fs.write(f.Name(), func() bool {
+		off, err := f.File.Seek(0, io.SeekCurrent)
+		return err != nil || f.grows(off+int64(len(p)))
+	})
+	if err != nil && !short {
+		return 0, err
+	}
+	if short {
+		n, werr := f.File.Write(p[:len(p)/2])
+		if werr != nil {
+			return n, werr
+		}
+		return n, err
+	}
+	return f.File.Write(p)
+}
+
+func (f *_FaultyFile) WriteAt(p []byte, off int64) (int, error) {
+	short, err := f.fs.write(f.Name(), func() bool { return f.grows(off + int64(len(p))) })
+	if err != nil && !short {
+		return 0, err
+	}
+	if short {
+		n, werr := f.File.WriteAt(p[:len(p)/2], off)
+		if werr != nil {
+			return n, werr
+		}
+		return n, err
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func (f *_FaultyFile) Truncate(size int64) error {
+	if f.fs.isFull(f.Name()) && f.grows(size) {
+		return &os.PathError{Op: "truncate", Path: f.Name(), Err: syscall.ENOSPC}
+	}
+	return f.File.Truncate(size)
+}
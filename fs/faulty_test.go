@@ -0,0 +1,97 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestFaulty(t *testing.T) {
+	faulty := NewFaulty(NewMem())
+	if err := faulty.MkdirAll("/db", 0777); err != nil {
+		t.Fatal(err)
+	}
+	f, err := faulty.OpenFile("/db/f", os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	faulty.FailWrite(2, nil)
+	if _, err := f.WriteAt([]byte("h"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("h"), 0); !errors.Is(err, ErrInjected) {
+		t.Fatalf("expected %v; got %v", ErrInjected, err)
+	}
+	if _, err := f.WriteAt([]byte("h"), 0); err != nil {
+		t.Fatalf("expected fault to be injected once; got %v", err)
+	}
+
+	faulty.ShortWrite(1)
+	if n, err := f.WriteAt([]byte("HELL"), 0); n != 2 || !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("expected short write of 2 bytes; got %d, %v", n, err)
+	}
+
+	readErr := errors.New("bad sector")
+	faulty.FailRead(1, readErr)
+	buf := make([]byte, 5)
+	if _, err := f.ReadAt(buf, 0); !errors.Is(err, readErr) {
+		t.Fatalf("expected %v; got %v", readErr, err)
+	}
+	if _, err := f.ReadAt(buf, 0); err != nil || string(buf) != "HEllo" {
+		t.Fatalf("expected HEllo; got %q, %v", buf, err)
+	}
+
+	faulty.SetFull(true)
+	if _, err := f.WriteAt([]byte("h"), 0); err != nil {
+		t.Fatalf("expected write within the file to succeed on a full file system; got %v", err)
+	}
+	if _, err := f.WriteAt([]byte("world"), 5); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("expected %v; got %v", syscall.ENOSPC, err)
+	}
+	if _, err := f.Write([]byte("world")); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("expected %v; got %v", syscall.ENOSPC, err)
+	}
+	if err := f.Truncate(10); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("expected %v; got %v", syscall.ENOSPC, err)
+	}
+
+	// faults apply to matching files only.
+	faulty.Match(func(name string) bool { return name == "/db/g" })
+	if err := f.Truncate(10); err != nil {
+		t.Fatal(err)
+	}
+	faulty.Reset()
+	if _, err := f.WriteAt([]byte("world"), 10); err != nil {
+		t.Fatal(err)
+	}
+	lock, err := faulty.Lock("/db/lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
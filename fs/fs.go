@@ -0,0 +1,116 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package fs abstracts the file system used to store DB files and write ahead logs
+// so a DB can be opened over a file system other than the operating system's.
+//
+// Files are read and written at offsets and are not memory mapped, so opening a DB
+// does not reserve address space for its files. A file grows by the size written
+// or allocated past its end, such as a block of the data file or a log of the write
+// ahead log, and there is no growth step to configure.
+package fs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// File is an open file of a FileSystem.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// LockFile is an exclusive lock held on a file.
+type LockFile interface {
+	// Unlock releases the lock and removes the lock file.
+	Unlock() error
+}
+
+// FileSystem is the set of file operations used by the DB.
+type FileSystem interface {
+	// OpenFile opens the named file using the os.O_* flags.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+
+	// Stat returns file info of the named file or directory.
+	Stat(name string) (os.FileInfo, error)
+
+	// MkdirAll creates a directory along with any parents.
+	MkdirAll(name string, perm os.FileMode) error
+
+	// Rename renames a file replacing the target file if it exists.
+	Rename(oldName, newName string) error
+
+	// Remove removes a file or an empty directory.
+	Remove(name string) error
+
+	// RemoveAll removes a path and any children it contains.
+	RemoveAll(name string) error
+
+	// TempDir creates a new temporary directory in dir and returns its path.
+	TempDir(dir, pattern string) (string, error)
+
+	// Lock creates the named lock file and acquires an exclusive lock on it.
+	// It returns os.ErrExist if the lock is held.
+	Lock(name string) (LockFile, error)
+}
+
+// OS is the FileSystem of the operating system.
+var OS FileSystem = osFS{}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) MkdirAll(name string, perm os.FileMode) error {
+	return os.MkdirAll(name, perm)
+}
+
+func (osFS) Rename(oldName, newName string) error {
+	return os.Rename(oldName, newName)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) RemoveAll(name string) error {
+	return os.RemoveAll(name)
+}
+
+func (osFS) TempDir(dir, pattern string) (string, error) {
+	return ioutil.TempDir(dir, pattern)
+}
+
+func (osFS) Lock(name string) (LockFile, error) {
+	return newLockFile(name)
+}
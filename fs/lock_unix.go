@@ -1,3 +1,4 @@
+//go:build !windows
 // +build !windows
 
 /*
@@ -16,7 +17,7 @@
  * limitations under the License.
  */
 
-package unitdb
+package fs
 
 import (
 	"os"
@@ -29,7 +30,7 @@ type _UnixFileLock struct {
 }
 
 // Unlock removes the lock from file.
-func (fl *_UnixFileLock) unlock() error {
+func (fl *_UnixFileLock) Unlock() error {
 	if err := os.Remove(fl.name); err != nil {
 		return err
 	}
@@ -46,7 +47,7 @@ func lockFile(f *os.File) error {
 	return nil
 }
 
-func newLockFile(name string) (_LockFile, error) {
+func newLockFile(name string) (LockFile, error) {
 	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
 		return nil, err
@@ -1,3 +1,4 @@
+//go:build windows
 // +build windows
 
 /*
@@ -16,7 +17,7 @@
  * limitations under the License.
  */
 
-package unitdb
+package fs
 
 import (
 	"os"
@@ -39,8 +40,8 @@ type _WindowsFileLock struct {
 	name string
 }
 
-// unlock removes the lock from file.
-func (fl *_WindowsFileLock) unlock() error {
+// Unlock removes the lock from file.
+func (fl *_WindowsFileLock) Unlock() error {
 	if err := os.Remove(fl.name); err != nil {
 		return err
 	}
@@ -55,7 +56,7 @@ func lockFile(h syscall.Handle, flags, reserved, locklow, lockhigh uint32, ol *s
 	return nil
 }
 
-func newLockFile(name string) (_LockFile, error) {
+func newLockFile(name string) (LockFile, error) {
 	path, err := syscall.UTF16PtrFromString(name)
 	if err != nil {
 		return nil, err
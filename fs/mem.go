@@ -0,0 +1,456 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mem is a FileSystem that keeps all files in memory. It is meant for tests
+// that open a DB without touching disk. Files persist across opening and closing
+// of the DB for the lifetime of the Mem value, so a DB can be reopened over it.
+type Mem struct {
+	mu      sync.Mutex
+	files   map[string]*_MemData
+	dirs    map[string]bool
+	locks   map[string]bool
+	tempSeq int
+}
+
+// NewMem returns an empty in-memory FileSystem.
+func NewMem() *Mem {
+	return &Mem{
+		files: make(map[string]*_MemData),
+		dirs:  map[string]bool{string(filepath.Separator): true},
+		locks: make(map[string]bool),
+	}
+}
+
+type (
+	// _MemData is the content of a file shared by all of its open handles.
+	_MemData struct {
+		mu      sync.RWMutex
+		buf     []byte
+		modTime time.Time
+	}
+	_MemFile struct {
+		mu     sync.Mutex
+		mem    *Mem
+		data   *_MemData
+		name   string
+		flag   int
+		off    int64
+		closed bool
+	}
+	_MemFileInfo struct {
+		name    string
+		size    int64
+		dir     bool
+		modTime time.Time
+	}
+	_MemLock struct {
+		mem  *Mem
+		name string
+	}
+)
+
+func (m *Mem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.dirs[name] {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrInvalid}
+	}
+	data, ok := m.files[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !ok:
+		if !m.dirs[filepath.Dir(name)] {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		data = &_MemData{modTime: time.Now()}
+		m.files[name] = data
+	}
+	if flag&os.O_TRUNC != 0 {
+		data.mu.Lock()
+		data.buf = data.buf[:0]
+		data.modTime = time.Now()
+		data.mu.Unlock()
+	}
+	return &_MemFile{mem: m, data: data, name: name, flag: flag}, nil
+}
+
+func (m *Mem) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.dirs[name] {
+		return &_MemFileInfo{name: filepath.Base(name), dir: true}, nil
+	}
+	data, ok := m.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return data.stat(name), nil
+}
+
+func (m *Mem) MkdirAll(name string, perm os.FileMode) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for dir := name; !m.dirs[dir]; dir = filepath.Dir(dir) {
+		if _, ok := m.files[dir]; ok {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: os.ErrExist}
+		}
+		m.dirs[dir] = true
+		if dir == "." {
+			break
+		}
+	}
+	return nil
+}
+
+func (m *Mem) Rename(oldName, newName string) error {
+	oldName, newName = filepath.Clean(oldName), filepath.Clean(newName)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[oldName]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrNotExist}
+	}
+	if m.dirs[newName] || !m.dirs[filepath.Dir(newName)] {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrInvalid}
+	}
+	delete(m.files, oldName)
+	m.files[newName] = data
+	return nil
+}
+
+func (m *Mem) Remove(name string) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if !m.dirs[name] {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	for _, path := range m.paths() {
+		if isChild(name, path) {
+			return &os.PathError{Op: "remove", Path: name, Err: os.ErrExist}
+		}
+	}
+	delete(m.dirs, name)
+	return nil
+}
+
+func (m *Mem) RemoveAll(name string) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, path := range m.paths() {
+		if path == name || isChild(name, path) {
+			delete(m.files, path)
+			delete(m.dirs, path)
+		}
+	}
+	return nil
+}
+
+func (m *Mem) TempDir(dir, pattern string) (string, error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	if err := m.MkdirAll(dir, 0777); err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for {
+		m.tempSeq++
+		name := filepath.Join(dir, fmt.Sprintf("%s%d", pattern, m.tempSeq))
+		if _, ok := m.files[name]; ok || m.dirs[name] {
+			continue
+		}
+		m.dirs[name] = true
+		return name, nil
+	}
+}
+
+func (m *Mem) Lock(name string) (LockFile, error) {
+	name = filepath.Clean(name)
+	f, err := m.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.locks[name] {
+		return nil, os.ErrExist
+	}
+	m.locks[name] = true
+	return &_MemLock{mem: m, name: name}, nil
+}
+
+// paths returns sorted names of all files and directories. The caller must hold m.mu.
+func (m *Mem) paths() []string {
+	paths := make([]string, 0, len(m.files)+len(m.dirs))
+	for name := range m.files {
+		paths = append(paths, name)
+	}
+	for name := range m.dirs {
+		paths = append(paths, name)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func isChild(dir, path string) bool {
+	return strings.HasPrefix(path, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// Unlock releases the lock and removes the lock file.
+func (l *_MemLock) Unlock() error {
+	l.mem.mu.Lock()
+	delete(l.mem.locks, l.name)
+	l.mem.mu.Unlock()
+	return l.mem.Remove(l.name)
+}
+
+func (d *_MemData) stat(name string) *_MemFileInfo {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return &_MemFileInfo{name: filepath.Base(name), size: int64(len(d.buf)), modTime: d.modTime}
+}
+
+func (f *_MemFile) check(write bool) error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	if write && f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+	return nil
+}
+
+func (f *_MemFile) Name() string {
+	return f.name
+}
+
+func (f *_MemFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check(false); err != nil {
+		return 0, err
+	}
+	n, err := f.data.readAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *_MemFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check(false); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "readat", Path: f.name, Err: os.ErrInvalid}
+	}
+	n, err := f.data.readAt(p, off)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *_MemFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check(true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.off = f.data.size()
+	}
+	n := f.data.writeAt(p, f.off)
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *_MemFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check(true); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "writeat", Path: f.name, Err: os.ErrInvalid}
+	}
+	return f.data.writeAt(p, off), nil
+}
+
+func (f *_MemFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check(false); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.data.size()
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *_MemFile) Stat() (os.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check(false); err != nil {
+		return nil, err
+	}
+	return f.data.stat(f.name), nil
+}
+
+func (f *_MemFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.check(false)
+}
+
+func (f *_MemFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check(true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.data.truncate(size)
+	return nil
+}
+
+func (f *_MemFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+func (d *_MemData) size() int64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return int64(len(d.buf))
+}
+
+func (d *_MemData) readAt(p []byte, off int64) (int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if off >= int64(len(d.buf)) {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	return copy(p, d.buf[off:]), nil
+}
+
+func (d *_MemData) writeAt(p []byte, off int64) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if end := off + int64(len(p)); end > int64(len(d.buf)) {
+		d.grow(end)
+	}
+	d.modTime = time.Now()
+	return copy(d.buf[off:], p)
+}
+
+func (d *_MemData) truncate(size int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if size > int64(len(d.buf)) {
+		d.grow(size)
+	} else {
+		d.buf = d.buf[:size]
+	}
+	d.modTime = time.Now()
+}
+
+// grow extends the buffer to size filling the new space with zeros. The caller must hold d.mu.
+func (d *_MemData) grow(size int64) {
+	if size <= int64(cap(d.buf)) {
+		n := len(d.buf)
+		d.buf = d.buf[:size]
+		for i := n; i < len(d.buf); i++ {
+			d.buf[i] = 0
+		}
+		return
+	}
+	buf := make([]byte, size, size+size/4)
+	copy(buf, d.buf)
+	d.buf = buf
+}
+
+func (fi *_MemFileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *_MemFileInfo) Size() int64 {
+	return fi.size
+}
+
+func (fi *_MemFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0777
+	}
+	return 0666
+}
+
+func (fi *_MemFileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+func (fi *_MemFileInfo) IsDir() bool {
+	return fi.dir
+}
+
+func (fi *_MemFileInfo) Sys() interface{} {
+	return nil
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestMemFile(t *testing.T) {
+	mem := NewMem()
+	if _, err := mem.OpenFile("/db/f", os.O_RDWR|os.O_CREATE, 0666); !os.IsNotExist(err) {
+		t.Fatalf("expected file not to be created without its directory; got %v", err)
+	}
+	if err := mem.MkdirAll("/db", 0777); err != nil {
+		t.Fatal(err)
+	}
+	f, err := mem.OpenFile("/db/f", os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("world"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 11)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte("hello\x00world"); !bytes.Equal(buf, want) {
+		t.Fatalf("expected %q; got %q", want, buf)
+	}
+	if _, err := f.ReadAt(buf, 6); err != io.EOF {
+		t.Fatalf("expected %v; got %v", io.EOF, err)
+	}
+	if err := f.Truncate(5); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello")); err != os.ErrClosed {
+		t.Fatalf("expected %v; got %v", os.ErrClosed, err)
+	}
+
+	if err := mem.Rename("/db/f", "/db/g"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Stat("/db/f"); !os.IsNotExist(err) {
+		t.Fatalf("expected renamed file not to exist; got %v", err)
+	}
+	fi, err := mem.Stat("/db/g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 5 {
+		t.Fatalf("expected size 5; got %d", fi.Size())
+	}
+	if err := mem.Remove("/db"); err == nil {
+		t.Fatal("expected removing a non empty directory to fail")
+	}
+	if err := mem.RemoveAll("/db"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Stat("/db/g"); !os.IsNotExist(err) {
+		t.Fatalf("expected removed file not to exist; got %v", err)
+	}
+}
+
+func TestMemLock(t *testing.T) {
+	mem := NewMem()
+	l, err := mem.Lock("/db.lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Lock("/db.lock"); err != os.ErrExist {
+		t.Fatalf("expected %v; got %v", os.ErrExist, err)
+	}
+	if err := l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Stat("/db.lock"); !os.IsNotExist(err) {
+		t.Fatalf("expected lock file to be removed; got %v", err)
+	}
+	if _, err := mem.Lock("/db.lock"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fs
+
+import "os"
+
+// ReadOnly returns a FileSystem that opens files of fsys for reading only, such as to open
+// a DB shipped on a read-only medium using the WithReadOnly option. Opening a file for writing
+// and changes to the file system return an error wrapping os.ErrPermission.
+func ReadOnly(fsys FileSystem) FileSystem {
+	return readOnlyFS{fsys: fsys}
+}
+
+type readOnlyFS struct {
+	fsys FileSystem
+}
+
+func (r readOnlyFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+	}
+	return r.fsys.OpenFile(name, flag, perm)
+}
+
+func (r readOnlyFS) Stat(name string) (os.FileInfo, error) {
+	return r.fsys.Stat(name)
+}
+
+func (readOnlyFS) MkdirAll(name string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrPermission}
+}
+
+func (readOnlyFS) Rename(oldName, newName string) error {
+	return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrPermission}
+}
+
+func (readOnlyFS) Remove(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+}
+
+func (readOnlyFS) RemoveAll(name string) error {
+	return &os.PathError{Op: "removeall", Path: name, Err: os.ErrPermission}
+}
+
+func (readOnlyFS) TempDir(dir, pattern string) (string, error) {
+	return "", &os.PathError{Op: "mkdirtemp", Path: dir, Err: os.ErrPermission}
+}
+
+func (readOnlyFS) Lock(name string) (LockFile, error) {
+	return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fs
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestReadOnly(t *testing.T) {
+	mem := NewMem()
+	if err := mem.MkdirAll("/db", 0777); err != nil {
+		t.Fatal(err)
+	}
+	f, err := mem.OpenFile("/db/f", os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ro := ReadOnly(mem)
+	if _, err := ro.OpenFile("/db/f", os.O_RDWR, 0666); !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("expected %v; got %v", os.ErrPermission, err)
+	}
+	if _, err := ro.OpenFile("/db/g", os.O_RDONLY|os.O_CREATE, 0666); !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("expected %v; got %v", os.ErrPermission, err)
+	}
+	f, err = ro.OpenFile("/db/f", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 5)
+	if _, err := f.ReadAt(buf, 0); err != nil || string(buf) != "hello" {
+		t.Fatalf("expected hello; got %q, %v", buf, err)
+	}
+	if _, err := f.Write([]byte("world")); err == nil {
+		t.Fatal("expected write to a file opened for reading to fail")
+	}
+	if _, err := ro.Stat("/db/f"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ro.MkdirAll("/db/dir", 0777); !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("expected %v; got %v", os.ErrPermission, err)
+	}
+	if err := ro.Remove("/db/f"); !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("expected %v; got %v", os.ErrPermission, err)
+	}
+	if _, err := ro.Lock("/db/lock"); !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("expected %v; got %v", os.ErrPermission, err)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+// ItemIterator iterates live messages of all topics of the DB in sequence order.
+// Messages are looked up when the iterator is created, and messages deleted or
+// expired before these are read are skipped.
+type ItemIterator struct {
+	db      *DB
+	entries []_Query
+	item    Message
+	valid   bool
+	err     error
+}
+
+// newItemIterator looks up window entries of all topics of the DB.
+func (db *DB) newItemIterator() *ItemIterator {
+	it := &ItemIterator{db: db}
+	if it.err = db.ok(); it.err != nil {
+		return it
+	}
+	for _, topic := range db.internal.trie.topics() {
+		// The topic prefix is not known here, but Compact, ReEncrypt and Truncate lock all query
+		// mutexes so a read lock of any of these holds them off as it does for Get.
+		mu := db.internal.mutex.getMutex(topic.hash)
+		mu.RLock()
+		for _, we := range db.internal.timeWindow.lookup(db.fs, topic.hash, topic.offset, 0, 0, math.MaxInt32) {
+			it.entries = append(it.entries, _Query{topicHash: topic.hash, seq: we.seq(), expiresAt: we.expiryTime()})
+		}
+		mu.RUnlock()
+	}
+	sort.Slice(it.entries, func(i, j int) bool {
+		return it.entries[i].seq < it.entries[j].seq
+	})
+	return it
+}
+
+// Next advances the iterator to the next message. It returns false once all messages
+// are read or on an error, use Err to get the error.
+func (it *ItemIterator) Next() bool {
+	it.valid = false
+	for it.err == nil && len(it.entries) > 0 {
+		query := it.entries[0]
+		it.entries = it.entries[1:]
+		if newWinEntry(query.seq, query.expiresAt).isExpired() {
+			continue
+		}
+		m, err := it.read(query)
+		if err == errMsgIDDeleted {
+			continue
+		}
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.item = m
+		it.valid = true
+		return true
+	}
+	return false
+}
+
+// read reads the message of the entry using the contract stored with the message ID.
+func (it *ItemIterator) read(query _Query) (Message, error) {
+	db := it.db
+	if err := db.ok(); err != nil {
+		return Message{}, err
+	}
+	mu := db.internal.mutex.getMutex(query.topicHash)
+	mu.RLock()
+	s, err := db.readEntry(query)
+	if err != nil {
+		mu.RUnlock()
+		return Message{}, err
+	}
+	buf := db.getDecodeBuffer()
+	id, val, err := db.internal.reader.readMessage(s, buf)
+	mu.RUnlock()
+	if err != nil {
+		db.putDecodeBuffer(buf)
+		return Message{}, err
+	}
+	return db.decodeMessage(query, s, id, val, binary.LittleEndian.Uint32(id[4:8]), buf)
+}
+
+// Item returns the message the iterator is at.
+func (it *ItemIterator) Item() Message {
+	return it.item
+}
+
+// Valid reports whether the iterator is at a message, i.e. the last call to Next returned true.
+func (it *ItemIterator) Valid() bool {
+	return it.valid
+}
+
+// Key returns the ID of the message the iterator is at.
+func (it *ItemIterator) Key() []byte {
+	return it.item.ID
+}
+
+// Value returns the payload of the message the iterator is at.
+func (it *ItemIterator) Value() []byte {
+	return it.item.Payload
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *ItemIterator) Err() error {
+	return it.err
+}
@@ -21,10 +21,21 @@ import (
 	"io"
 	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/unit-io/unitdb/hash"
 )
 
+// LeaseStats provides free block fragmentation of the lease file reported by DB.DefragLease.
+type LeaseStats struct {
+	// FragmentsBefore is the number of free blocks before adjacent blocks are coalesced.
+	FragmentsBefore int
+	// FragmentsAfter is the number of free blocks after adjacent blocks are coalesced.
+	FragmentsAfter int
+	// FreeBytes is the total size of free blocks available for reuse.
+	FreeBytes int64
+}
+
 type _Leases struct {
 	ls           map[int64]map[uint64]struct{} // map[timeID]map[seq]
 	sync.RWMutex                               // Read Write mutex, guards access to internal collection.
@@ -36,8 +47,10 @@ type _Lease struct {
 	file                  _FileSet
 	leases                []*_Leases
 	blocks                []*_FreeBlocks
-	size                  int64 // Total size of free blocks.
+	size                  int64 // Total size of free blocks, updated atomically as shards are locked separately.
 	minimumFreeBlocksSize int64 // Minimum free blocks size before free blocks are reused for new allocation.
+	reused                int64 // Number of allocations served from free blocks.
+	missed                int64 // Number of allocations appended to the data file.
 	consistent            *hash.Consistent
 }
 
@@ -53,20 +66,20 @@ type _FreeBlocks struct {
 }
 
 // newLeaswing creates a new concurrent freeblocks.
-func newLease(fs _FileSet, minimumSize int64) *_Lease {
+func newLease(fs _FileSet, minimumSize int64, shards int) *_Lease {
 	l := &_Lease{
 		file:                  fs,
-		leases:                make([]*_Leases, nShards),
-		blocks:                make([]*_FreeBlocks, nShards),
+		leases:                make([]*_Leases, shards),
+		blocks:                make([]*_FreeBlocks, shards),
 		minimumFreeBlocksSize: minimumSize,
-		consistent:            hash.InitConsistent(int(nShards), int(nShards)),
+		consistent:            hash.InitConsistent(shards, shards),
 	}
 
-	for i := 0; i < nShards; i++ {
+	for i := 0; i < shards; i++ {
 		l.leases[i] = &_Leases{ls: make(map[int64]map[uint64]struct{})}
 	}
 
-	for i := 0; i < nShards; i++ {
+	for i := 0; i < shards; i++ {
 		l.blocks[i] = &_FreeBlocks{cache: make(map[int64]bool)}
 	}
 
@@ -122,39 +135,49 @@ func (b *_FreeBlocks) len() int {
 	return len(b.fb)
 }
 
-func (b *_FreeBlocks) defrag() {
-	l := len(b.fb)
-	if l <= 1 {
-		return
+// defrag coalesces adjacent free blocks across all shards. Merged blocks are placed under the
+// shard of their offset. It returns the number of free blocks before and after the merge.
+func (l *_Lease) defrag() (before, after int) {
+	for i := range l.blocks {
+		l.blocks[i].Lock()
+		defer l.blocks[i].Unlock()
 	}
-	sort.Slice(b.fb[:l], func(i, j int) bool {
-		return b.fb[i].offset < b.fb[j].offset
+	var fb []_FreeBlock
+	for i := range l.blocks {
+		fb = append(fb, l.blocks[i].fb...)
+	}
+	before = len(fb)
+	if before <= 1 {
+		return before, before
+	}
+	sort.Slice(fb, func(i, j int) bool {
+		return fb[i].offset < fb[j].offset
 	})
-	var merged []_FreeBlock
-	curOff := b.fb[0].offset
-	curSize := b.fb[0].size
-	for i := 1; i < l; i++ {
-		if curOff+int64(curSize) == b.fb[i].offset {
-			curSize += b.fb[i].size
-			delete(b.cache, b.fb[i].offset)
-		} else {
-			merged = append(merged, _FreeBlock{size: curSize, offset: curOff})
-			curOff = b.fb[i].offset
-			curSize = b.fb[i].size
+	merged := fb[:1]
+	for _, b := range fb[1:] {
+		cur := &merged[len(merged)-1]
+		if cur.offset+int64(cur.size) == b.offset && uint64(cur.size)+uint64(b.size) <= uint64(^uint32(0)) {
+			cur.size += b.size
+			continue
 		}
+		merged = append(merged, b)
 	}
-	merged = append(merged, _FreeBlock{offset: curOff, size: curSize})
-	sort.Slice(merged, func(i, j int) bool {
-		return merged[i].size < merged[j].size
-	})
-	copy(b.fb[:l], merged)
-}
-
-func (l *_Lease) defrag() {
-	for i := 0; i < nShards; i++ {
+	for i := range l.blocks {
+		l.blocks[i].fb = nil
+		l.blocks[i].cache = make(map[int64]bool)
+	}
+	for _, b := range merged {
+		fbs := l.freeBlocks(uint64(b.offset))
+		fbs.fb = append(fbs.fb, b)
+		fbs.cache[b.offset] = true
+	}
+	for i := range l.blocks {
 		fbs := l.blocks[i]
-		fbs.defrag()
+		sort.Slice(fbs.fb, func(i, j int) bool {
+			return fbs.fb[i].size < fbs.fb[j].size
+		})
 	}
+	return before, len(merged)
 }
 
 func (l *_Lease) freeBlock(off int64, size uint32) {
@@ -167,7 +190,7 @@ func (l *_Lease) freeBlock(off int64, size uint32) {
 	}
 	fbs.fb = append(fbs.fb, _FreeBlock{offset: off, size: size})
 	fbs.cache[off] = true
-	l.size += int64(size)
+	atomic.AddInt64(&l.size, int64(size))
 }
 
 func (l *_Lease) free(seq uint64, off int64, size uint32) {
@@ -181,7 +204,8 @@ func (l *_Lease) allocate(size uint32) int64 {
 	if size == 0 {
 		panic("unable to allocate zero bytes")
 	}
-	if l.size < l.minimumFreeBlocksSize {
+	if atomic.LoadInt64(&l.size) < l.minimumFreeBlocksSize {
+		atomic.AddInt64(&l.missed, 1)
 		return -1
 	}
 	fbs := l.freeBlocks(uint64(size))
@@ -189,8 +213,10 @@ func (l *_Lease) allocate(size uint32) int64 {
 	defer fbs.Unlock()
 	i := fbs.search(size)
 	if i >= len(fbs.fb) {
+		atomic.AddInt64(&l.missed, 1)
 		return -1
 	}
+	atomic.AddInt64(&l.reused, 1)
 	off := fbs.fb[i].offset
 	if fbs.fb[i].size == size {
 		copy(fbs.fb[i:], fbs.fb[i+1:])
@@ -201,10 +227,49 @@ func (l *_Lease) allocate(size uint32) int64 {
 		fbs.fb[i].offset += int64(size)
 	}
 	delete(fbs.cache, off)
-	l.size -= int64(size)
+	atomic.AddInt64(&l.size, -int64(size))
 	return off
 }
 
+// fragments returns the number of free blocks and the size of the largest region of adjacent free
+// blocks.
+func (l *_Lease) fragments() (n int, largest int64) {
+	var fb []_FreeBlock
+	for i := range l.blocks {
+		fbs := l.blocks[i]
+		fbs.RLock()
+		fb = append(fb, fbs.fb...)
+		fbs.RUnlock()
+	}
+	sort.Slice(fb, func(i, j int) bool {
+		return fb[i].offset < fb[j].offset
+	})
+	var end, region int64
+	for _, b := range fb {
+		if b.offset != end {
+			region = 0
+		}
+		region += int64(b.size)
+		end = b.offset + int64(b.size)
+		if region > largest {
+			largest = region
+		}
+	}
+	return len(fb), largest
+}
+
+// reset drops all free blocks.
+func (l *_Lease) reset() {
+	for i := range l.blocks {
+		fbs := l.blocks[i]
+		fbs.Lock()
+		fbs.fb = nil
+		fbs.cache = make(map[int64]bool)
+		fbs.Unlock()
+	}
+	atomic.StoreInt64(&l.size, 0)
+}
+
 func (l *_Lease) read() error {
 	off := int64(0)
 	blocks := &_FreeBlocks{cache: make(map[int64]bool)}
@@ -239,7 +304,7 @@ func (l *_Lease) write() error {
 	}
 	var off int64
 	blocks := &_FreeBlocks{cache: make(map[int64]bool)}
-	for i := 0; i < nShards; i++ {
+	for i := range l.blocks {
 		fbs := l.blocks[i]
 		if fbs.len() == 0 {
 			continue
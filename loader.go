@@ -0,0 +1,98 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+// Loader loads payload of a message that is neither in the mem cache nor in the DB files, such as
+// a message tiered to an external storage. It returns nil payload if the message does not exist.
+type Loader func(topicHash, seq uint64) ([]byte, error)
+
+// _Loaded keeps payloads loaded using the loader and sequences being loaded.
+type _Loaded struct {
+	sync.Mutex
+	loading map[uint64]struct{}
+	cache   map[uint64][]byte
+	order   []uint64 // order is the sequences in cache in the order they were loaded.
+}
+
+func newLoaded() *_Loaded {
+	return &_Loaded{
+		loading: make(map[uint64]struct{}),
+		cache:   make(map[uint64][]byte),
+	}
+}
+
+// reset drops the loaded messages kept in memory.
+func (l *_Loaded) reset() {
+	l.Lock()
+	defer l.Unlock()
+	l.cache = make(map[uint64][]byte)
+	l.order = nil
+}
+
+// load loads payload of the message using the loader. The message is not loaded again if the loader
+// reads the message from the DB while it is loading the message.
+func (db *DB) load(q *Query, query _Query) (Message, error) {
+	l := db.internal.loaded
+	l.Lock()
+	payload, ok := l.cache[query.seq]
+	if !ok {
+		if _, ok := l.loading[query.seq]; ok {
+			l.Unlock()
+			return Message{}, errMsgIDDeleted
+		}
+		l.loading[query.seq] = struct{}{}
+	}
+	l.Unlock()
+
+	if !ok {
+		var err error
+		payload, err = db.opts.loader(query.topicHash, query.seq)
+		l.Lock()
+		delete(l.loading, query.seq)
+		if err == nil && payload != nil && db.opts.loaderCacheSize > 0 {
+			if len(l.order) == db.opts.loaderCacheSize {
+				delete(l.cache, l.order[0])
+				l.order = l.order[1:]
+			}
+			l.cache[query.seq] = payload
+			l.order = append(l.order, query.seq)
+		}
+		l.Unlock()
+		if err != nil {
+			logger.Error().Err(err).Str("context", "db.loader")
+			return Message{}, err
+		}
+	}
+	if payload == nil {
+		return Message{}, errMsgIDDeleted
+	}
+	db.internal.meter.OutBytes.Inc(int64(len(payload)))
+
+	id := message.NewID(query.seq)
+	id.SetContract(q.Contract)
+	mID := make([]byte, id.Size())
+	copy(mID, id.Prefix())
+	binary.LittleEndian.PutUint64(mID[8:], query.seq)
+	return Message{ID: mID, Seq: query.seq, Topic: db.topicName(query.topicHash), Payload: payload, ExpiresAt: expiryTime(query.expiresAt)}, nil
+}
@@ -17,9 +17,9 @@
 package memdb
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
-	"os"
 	"sort"
 	"sync"
 	"time"
@@ -46,6 +46,13 @@ type DB struct {
 
 // Open initializes database.
 func Open(opts ...Options) (*DB, error) {
+	return OpenContext(context.Background(), opts...)
+}
+
+// OpenContext initializes database the same as Open, and stops the log recovery if ctx is
+// canceled while the log is read. The log is reset once it is read, so entries read from the log
+// are put to the DB even if ctx is canceled afterwards. The DB is closed if the recovery is stopped.
+func OpenContext(ctx context.Context, opts ...Options) (*DB, error) {
 	options := &_Options{}
 	WithDefaultOptions().set(options)
 	for _, opt := range opts {
@@ -55,7 +62,7 @@ func Open(opts ...Options) (*DB, error) {
 	}
 
 	// Make sure we have a directory.
-	if err := os.MkdirAll(options.logFilePath, 0777); err != nil {
+	if err := options.fileSystem.MkdirAll(options.logFilePath, 0777); err != nil {
 		return nil, errors.New("DB.Open, Unable to create db dir")
 	}
 
@@ -73,7 +80,7 @@ func Open(opts ...Options) (*DB, error) {
 		closeC: make(chan struct{}),
 	}
 	internal.tinyBatch = &_TinyBatch{ID: int64(internal.timeMark.newTimeID()), doneChan: make(chan struct{})}
-	logOpts := wal.Options{Path: options.logFilePath + "/" + logFileName, TargetSize: options.logSize, BufferSize: options.bufferSize, Reset: options.logResetFlag}
+	logOpts := wal.Options{Path: options.logFilePath + "/" + logFileName, TargetSize: options.logSize, BufferSize: options.bufferSize, Reset: options.logResetFlag, SectorAlign: options.sectorAlign, Lenient: options.lenientRecovery, FileSystem: options.fileSystem, GroupCommitInterval: options.groupCommitInterval, GroupCommitCount: options.groupCommitCount}
 	wal, needLogRecovery, err := wal.New(logOpts)
 	if err != nil {
 		wal.Close()
@@ -86,23 +93,27 @@ func Open(opts ...Options) (*DB, error) {
 	db := &DB{
 		opts:       options,
 		internal:   internal,
-		consistent: hash.InitConsistent(nBlocks, nBlocks),
+		consistent: hash.InitConsistent(options.shards, options.shards),
 		blockCache: make(map[_TimeID]*_Block),
 		timeBlocks: make(map[_BlockKey]*_TimeBlock),
 	}
 
-	for i := 0; i < nBlocks; i++ {
-		db.timeBlocks[_BlockKey(i)] = &_TimeBlock{timeRecords: make(map[_TimeID]*filter.Block), filter: filter.NewFilterGenerator()}
+	for i := 0; i < options.shards; i++ {
+		db.timeBlocks[_BlockKey(i)] = &_TimeBlock{timeRecords: make(map[_TimeID]*filter.Block), filter: db.newFilter()}
 	}
 
 	// Query plan
 	db.internal.queryPlan = db.newQueryPlan()
 	db.internal.batchPool = db.newBatchPool(nPoolSize)
 
-	go db.tinyBatchLoop(db.opts.timeRecordInterval)
+	if !options.noTinyBatchLoop {
+		db.internal.closeW.Add(1)
+		go db.tinyBatchLoop(db.opts.timeRecordInterval)
+	}
 
 	if needLogRecovery || !options.logResetFlag {
-		if err := db.startRecovery(); err != nil {
+		if err := db.startRecovery(ctx); err != nil {
+			db.close()
 			return nil, err
 		}
 	}
@@ -265,7 +276,7 @@ func (db *DB) Get(key uint64) ([]byte, error) {
 	}
 
 	// reset timeBlock and start over
-	db.internal.queryPlan.timeBlocks[blockKey] = &_TimeBlock{timeRecords: make(map[_TimeID]*filter.Block), filter: filter.NewFilterGenerator()}
+	db.internal.queryPlan.timeBlocks[blockKey] = &_TimeBlock{timeRecords: make(map[_TimeID]*filter.Block), filter: db.newFilter()}
 
 	return db.Get(key)
 }
@@ -310,7 +321,8 @@ func (db *DB) ForEachBlock(f func(timeID int64, keys []uint64) (bool, error)) (e
 	return nil
 }
 
-// Delete deletes entry from DB.
+// Delete deletes entry from DB. A tombstone for the key is written to the WAL so the
+// deleted entry is not recovered, subsequent Get for the key returns an error.
 func (db *DB) Delete(key uint64) error {
 	if err := db.ok(); err != nil {
 		return err
@@ -353,11 +365,18 @@ func (db *DB) Delete(key uint64) error {
 			}
 			block.Lock()
 			ikey := iKey(false, key)
+			if _, ok := block.records[ikey]; !ok {
+				// Key is deleted concurrently.
+				block.Unlock()
+				return errEntryDoesNotExist
+			}
 			delete(block.records, ikey)
 			block.count--
 			count := block.count
-			db.delete(key)
 			block.Unlock()
+			if err := db.delete(timeID, key); err != nil {
+				return err
+			}
 			db.internal.meter.Dels.Inc(1)
 
 			if count == 0 {
@@ -392,17 +411,26 @@ func (db *DB) Put(key uint64, data []byte) (int64, error) {
 	db.mu.Unlock()
 
 	block.Lock()
-	defer block.Unlock()
 	ikey := iKey(false, key)
 	if err := block.put(ikey, data); err != nil {
+		block.Unlock()
 		return int64(timeID), err
 	}
+	size := block.data.Size()
+	block.Unlock()
 
 	db.addTimeBlock(timeID, key)
 
 	db.internal.tinyBatch.incount()
 	db.internal.meter.Puts.Inc(1)
 
+	// Write the tiny batch to the log without waiting for the tiny batch interval once it
+	// reaches the tiny batch size. The put blocks while the batch pool is busy.
+	if db.opts.tinyBatchSize > 0 && size >= db.opts.tinyBatchSize && !db.opts.noTinyBatchLoop {
+		db.internal.batchPool.write(db.internal.tinyBatch)
+		db.internal.tinyBatch = db.newTinyBatch()
+	}
+
 	return int64(timeID), nil
 }
 
@@ -433,11 +461,97 @@ func (db *DB) Batch(fn func(*Batch, <-chan struct{}) error) error {
 	return b.Commit()
 }
 
+// Flush writes the current tiny batch to the WAL and waits for the write to complete, along
+// with the writes of tiny batches written before it.
+// It returns an error if tiny batches that failed to write to the WAL still cannot be written,
+// or if the last eviction of old time blocks failed.
+func (db *DB) Flush() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+
+	db.internal.writeLockC <- struct{}{}
+	defer func() {
+		<-db.internal.writeLockC
+	}()
+
+	if db.internal.tinyBatch.len() != 0 {
+		db.internal.batchPool.write(db.internal.tinyBatch)
+		db.internal.tinyBatch = db.newTinyBatch()
+	}
+	db.internal.batchPool.waitQueued()
+
+	if err := db.writeUnlogged(); err != nil {
+		return err
+	}
+	return db.lastEvictErr()
+}
+
+// Truncate drops all entries from DB and resets the WAL. Entries put before Truncate is
+// called are written to the WAL before the WAL is reset.
+func (db *DB) Truncate() error {
+	if err := db.Flush(); err != nil {
+		return err
+	}
+
+	db.internal.writeLockC <- struct{}{}
+	defer func() {
+		<-db.internal.writeLockC
+	}()
+
+	db.mu.Lock()
+	for _, block := range db.blockCache {
+		block.Lock()
+		db.internal.bufPool.Put(block.data)
+		block.Unlock()
+	}
+	db.blockCache = make(map[_TimeID]*_Block)
+	db.mu.Unlock()
+	for _, tb := range db.timeBlocks {
+		tb.Lock()
+		tb.timeRecords = make(map[_TimeID]*filter.Block)
+		tb.filter = db.newFilter()
+		tb.Unlock()
+	}
+
+	return db.internal.wal.Truncate()
+}
+
 // Free frees time block from DB for a provided time ID and releases block from WAL.
 func (db *DB) Free(timeID int64) error {
 	return db.releaseLog(_TimeID(timeID))
 }
 
+// LogSize returns the size of the write ahead log.
+func (db *DB) LogSize() int64 {
+	return db.internal.wal.Size()
+}
+
+// WaitLogApplied blocks until the size of logs written to the WAL and not yet released is below
+// size. It returns false if the timeout passes or DB is closed first. A zero timeout waits until
+// logs are released.
+func (db *DB) WaitLogApplied(size int64, timeout time.Duration) bool {
+	return db.internal.wal.WaitPending(size, timeout)
+}
+
+// RecoveryErrors returns logs skipped during recovery if DB is opened with WithLenientRecovery option.
+func (db *DB) RecoveryErrors() []wal.RecoveryError {
+	return db.internal.wal.RecoveryErrors()
+}
+
+// MemSize returns the size of time blocks held in DB.
+func (db *DB) MemSize() int64 {
+	size := int64(0)
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, block := range db.blockCache {
+		size += block.data.Size()
+	}
+
+	return size
+}
+
 // Size returns the total number of entries in DB.
 func (db *DB) Size() int64 {
 	size := int64(0)
@@ -17,6 +17,7 @@
 package memdb
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"io"
@@ -99,6 +100,14 @@ type _DB struct {
 	tinyBatch  *_TinyBatch
 	batchPool  *_BatchPool
 
+	// time IDs of tiny batches that failed to write to the WAL.
+	unloggedMu sync.Mutex
+	unlogged   []_TimeID
+
+	// error of the last eviction that failed, returned by Flush.
+	evictMu  sync.Mutex
+	evictErr error
+
 	// buffer pool
 	bufPool *bpool.BufferPool
 
@@ -216,13 +225,18 @@ func (db *DB) batch() *Batch {
 
 func (db *DB) newQueryPlan() *_LogicalPlan {
 	queryPlan := &_LogicalPlan{blockCache: make(map[_TimeID]*_Block), timeBlocks: make(map[_BlockKey]*_TimeBlock)}
-	for i := 0; i < nBlocks; i++ {
-		queryPlan.timeBlocks[_BlockKey(i)] = &_TimeBlock{timeRecords: make(map[_TimeID]*filter.Block), filter: filter.NewFilterGenerator()}
+	for i := 0; i < db.opts.shards; i++ {
+		queryPlan.timeBlocks[_BlockKey(i)] = &_TimeBlock{timeRecords: make(map[_TimeID]*filter.Block), filter: db.newFilter()}
 	}
 
 	return queryPlan
 }
 
+// newFilter returns a filter generator of the filter size of a time block.
+func (db *DB) newFilter() *filter.Generator {
+	return filter.NewSizedFilterGenerator(db.opts.filterBits, db.opts.filterHashes)
+}
+
 // seek finds timeRecords and blockCache for the provided key and cutoff duration and caches those for query.
 func (db *DB) seek(key uint64, cutoff int64) error {
 	if err := db.ok(); err != nil {
@@ -323,7 +337,11 @@ func (b *_Block) put(ikey _Key, data []byte) error {
 	return nil
 }
 
-func (db *DB) delete(key uint64) error {
+// delete puts a tombstone for the key deleted from the block of the given time ID.
+// The tombstone is added to the current block and the time ID of the deleted entry is
+// kept with it, so the tombstone is moved to a new block if its block is released
+// before the block of the deleted entry.
+func (db *DB) delete(delTimeID _TimeID, key uint64) error {
 	db.internal.writeLockC <- struct{}{}
 	defer func() {
 		<-db.internal.writeLockC
@@ -339,15 +357,15 @@ func (db *DB) delete(key uint64) error {
 	}
 	db.mu.Unlock()
 
+	block.Lock()
+	defer block.Unlock()
 	// set key is deleted to persist key with timeID to the log.
 	ikey := iKey(true, key)
-	if _, ok := block.delRecords[timeID]; ok {
-		block.delRecords[timeID] = append(block.delRecords[timeID], ikey)
-	} else {
-		block.delRecords[timeID] = []_Key{ikey}
-	}
+	block.delRecords[delTimeID] = append(block.delRecords[delTimeID], ikey)
 
-	block.put(ikey, nil)
+	if err := block.put(ikey, nil); err != nil {
+		return err
+	}
 	db.internal.tinyBatch.incount()
 
 	return nil
@@ -356,18 +374,31 @@ func (db *DB) delete(key uint64) error {
 // move moves deleted records to new block cache before releasing the block from the WAL.
 func (db *DB) move(timeID _TimeID) error {
 	db.mu.RLock()
-	block := db.blockCache[timeID]
+	block, ok := db.blockCache[timeID]
 	db.mu.RUnlock()
-	block.Lock()
-	defer block.Unlock()
+	if !ok {
+		return nil
+	}
+	block.RLock()
+	delRecords := make(map[_TimeID][]_Key, len(block.delRecords))
+	for delTimeID, dkeys := range block.delRecords {
+		delRecords[delTimeID] = dkeys
+	}
+	block.RUnlock()
 
-	for timeID, dkeys := range block.delRecords {
+	for delTimeID, dkeys := range delRecords {
+		if delTimeID == timeID {
+			// Deleted entries are released along with the tombstones.
+			continue
+		}
 		db.mu.RLock()
-		_, ok := db.blockCache[timeID]
+		_, ok := db.blockCache[delTimeID]
 		db.mu.RUnlock()
 		if ok {
 			for _, ik := range dkeys {
-				db.delete(ik.key)
+				if err := db.delete(delTimeID, ik.key); err != nil {
+					return err
+				}
 			}
 		}
 	}
@@ -375,15 +406,15 @@ func (db *DB) move(timeID _TimeID) error {
 	return nil
 }
 
-// tinyWrite writes tiny batch to the WAL.
-func (db *DB) tinyWrite(tinyBatch *_TinyBatch) error {
+// tinyWrite writes entries of the time block to the WAL.
+func (db *DB) tinyWrite(timeID _TimeID) error {
 	logWriter, err := db.internal.wal.NewWriter()
 	if err != nil {
 		return err
 	}
 
 	db.mu.RLock()
-	block, ok := db.blockCache[tinyBatch.timeID()]
+	block, ok := db.blockCache[timeID]
 	db.mu.RUnlock()
 	if !ok {
 		return nil
@@ -404,7 +435,7 @@ func (db *DB) tinyWrite(tinyBatch *_TinyBatch) error {
 		}
 	}
 
-	if err := <-logWriter.SignalInitWrite(int64(tinyBatch.timeID())); err != nil {
+	if err := <-logWriter.SignalInitWrite(int64(timeID)); err != nil {
 		return err
 	}
 
@@ -415,17 +446,20 @@ func (db *DB) tinyWrite(tinyBatch *_TinyBatch) error {
 
 // tinyCommit commits tiny batch to DB.
 func (db *DB) tinyCommit(tinyBatch *_TinyBatch) error {
-	db.internal.closeW.Add(1)
-	defer func() {
-		tinyBatch.abort()
-		db.internal.closeW.Done()
-	}()
+	defer tinyBatch.abort()
 
 	if tinyBatch.len() == 0 {
 		return nil
 	}
 
-	if err := db.tinyWrite(tinyBatch); err != nil {
+	if err := db.tinyWrite(tinyBatch.timeID()); err != nil {
+		// The time block is not released so its entries are not synced to the DB
+		// until these are written to the WAL.
+		if !tinyBatch.managed {
+			db.internal.unloggedMu.Lock()
+			db.internal.unlogged = append(db.internal.unlogged, tinyBatch.timeID())
+			db.internal.unloggedMu.Unlock()
+		}
 		return err
 	}
 
@@ -436,8 +470,26 @@ func (db *DB) tinyCommit(tinyBatch *_TinyBatch) error {
 	return nil
 }
 
-// startRecovery recovers pending entries from the WAL.
-func (db *DB) startRecovery() error {
+// writeUnlogged writes tiny batches that failed to write to the WAL again, such as once
+// space is freed on a full disk, and releases their time blocks.
+func (db *DB) writeUnlogged() error {
+	db.internal.unloggedMu.Lock()
+	defer db.internal.unloggedMu.Unlock()
+	for len(db.internal.unlogged) > 0 {
+		timeID := db.internal.unlogged[0]
+		if err := db.tinyWrite(timeID); err != nil {
+			return err
+		}
+		db.internal.timeMark.release(timeID)
+		db.internal.unlogged = db.internal.unlogged[1:]
+	}
+
+	return nil
+}
+
+// startRecovery recovers pending entries from the WAL. It returns the error of ctx if ctx is
+// canceled before the WAL is reset.
+func (db *DB) startRecovery(ctx context.Context) error {
 	// start log recovery
 	r, err := db.internal.wal.NewReader()
 	if err != nil {
@@ -445,7 +497,12 @@ func (db *DB) startRecovery() error {
 	}
 
 	log := make(map[uint64][]byte)
+	var done int
+	total := int(r.Total())
 	err = r.Read(func(timeID int64) (ok bool, err error) {
+		if err := ctx.Err(); err != nil {
+			return true, err
+		}
 		l := r.Count()
 		for i := uint32(0); i < l; i++ {
 			logData, ok, err := r.Next()
@@ -457,7 +514,8 @@ func (db *DB) startRecovery() error {
 			}
 			dBit := logData[0]
 			key := binary.LittleEndian.Uint64(logData[1:9])
-			val := logData[9:]
+			// The log data is copied as the reader buffer is reused once the log is read.
+			val := append([]byte(nil), logData[9:]...)
 			if dBit == 1 {
 				if _, exists := log[key]; exists {
 					delete(log, key)
@@ -466,8 +524,15 @@ func (db *DB) startRecovery() error {
 			}
 			log[key] = val
 		}
+		done += int(l)
+		if fn := db.opts.onRecoverProgress; fn != nil {
+			fn(done, total)
+		}
 		return false, nil
 	})
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	if err := db.internal.wal.Reset(); err != nil {
 		return err
@@ -485,16 +550,18 @@ func (db *DB) startRecovery() error {
 
 func (db *DB) releaseLog(timeID _TimeID) error {
 	// move moves deleted keys before releasing log.
-	db.move(timeID)
+	if err := db.move(timeID); err != nil {
+		return err
+	}
 
 	db.mu.RLock()
 	block, ok := db.blockCache[timeID]
 	db.mu.RUnlock()
-	block.Lock()
-	defer block.Unlock()
 	if !ok {
 		return errEntryDoesNotExist
 	}
+	block.Lock()
+	defer block.Unlock()
 
 	db.internal.bufPool.Put(block.data)
 	db.mu.Lock()
@@ -504,15 +571,63 @@ func (db *DB) releaseLog(timeID _TimeID) error {
 	return db.internal.wal.SignalLogApplied(int64(timeID))
 }
 
+// evict releases the oldest time blocks once the size of DB reaches the eviction threshold.
+func (db *DB) evict() error {
+	if db.opts.evictionThreshold <= 0 {
+		return nil
+	}
+	highWater := int64(float64(db.opts.memdbSize) * db.opts.evictionThreshold)
+	size := db.MemSize()
+	if size < highWater {
+		return nil
+	}
+
+	db.internal.writeLockC <- struct{}{}
+	currTimeID := db.internal.tinyBatch.timeID()
+	<-db.internal.writeLockC
+
+	var timeIDs []_TimeID
+	db.mu.RLock()
+	for timeID := range db.blockCache {
+		if timeID != currTimeID {
+			timeIDs = append(timeIDs, timeID)
+		}
+	}
+	db.mu.RUnlock()
+	sort.Slice(timeIDs[:], func(i, j int) bool {
+		return timeIDs[i] < timeIDs[j]
+	})
+
+	for _, timeID := range timeIDs {
+		if size < highWater {
+			break
+		}
+		db.mu.RLock()
+		block, ok := db.blockCache[timeID]
+		db.mu.RUnlock()
+		if !ok {
+			continue
+		}
+		blockSize := block.data.Size()
+		if err := db.releaseLog(timeID); err != nil {
+			return err
+		}
+		size -= blockSize
+		db.internal.meter.Evictions.Inc(1)
+	}
+
+	return nil
+}
+
 // tinyBatchLoop handles writing tiny batches to the log.
+// The caller must add the loop to the close wait group.
 func (db *DB) tinyBatchLoop(interval time.Duration) {
-	db.internal.closeW.Add(1)
 	defer db.internal.closeW.Done()
 	tinyBatchTicker := time.NewTicker(interval)
+	defer tinyBatchTicker.Stop()
 	for {
 		select {
 		case <-db.internal.closeC:
-			tinyBatchTicker.Stop()
 			return
 		case <-tinyBatchTicker.C:
 			db.internal.writeLockC <- struct{}{}
@@ -521,10 +636,22 @@ func (db *DB) tinyBatchLoop(interval time.Duration) {
 			}
 			db.internal.tinyBatch = db.newTinyBatch()
 			<-db.internal.writeLockC
+			// A failed eviction is retried on the next tick, so the loop keeps writing tiny batches.
+			err := db.evict()
+			db.internal.evictMu.Lock()
+			db.internal.evictErr = err
+			db.internal.evictMu.Unlock()
 		}
 	}
 }
 
+// lastEvictErr returns the error of the last eviction if it failed.
+func (db *DB) lastEvictErr() error {
+	db.internal.evictMu.Lock()
+	defer db.internal.evictMu.Unlock()
+	return db.internal.evictErr
+}
+
 // setClosed flag; return true if DB is not already closed.
 func (db *DB) setClosed() bool {
 	return atomic.CompareAndSwapUint32(&db.internal.closed, 0, 1)
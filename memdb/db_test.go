@@ -17,8 +17,12 @@
 package memdb
 
 import (
+	"fmt"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/unit-io/unitdb/fs"
 )
 
 func TestSimple(t *testing.T) {
@@ -206,3 +210,232 @@ func TestLogRelease(t *testing.T) {
 	}
 	verifyAndClose()
 }
+
+func TestItems(t *testing.T) {
+	db, err := Open(WithLogFilePath("test"), WithLogReset())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var n uint64 = 10
+	for k := uint64(0); k < n; k++ {
+		if _, err := db.Put(k, []byte("msg.")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Update a key in the next time block and delete a key.
+	if _, err := db.Put(1, []byte("msg.1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(2); err != nil {
+		t.Fatal(err)
+	}
+
+	items := make(map[uint64][]byte)
+	it := db.Items()
+	for it.Next() {
+		if _, ok := items[it.Key()]; ok {
+			t.Fatalf("key %d visited twice", it.Key())
+		}
+		items[it.Key()] = it.Value()
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != int(n-1) {
+		t.Fatalf("expected %d items; got %d", n-1, len(items))
+	}
+	if _, ok := items[2]; ok {
+		t.Fatal("expected deleted key to be skipped")
+	}
+	if !reflect.DeepEqual(items[1], []byte("msg.1")) {
+		t.Fatalf("expected most recent value; got %s", items[1])
+	}
+}
+
+func TestDelete(t *testing.T) {
+	db, err := Open(WithLogFilePath("test"), WithLogReset())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var n uint64 = 10
+	for k := uint64(0); k < n; k++ {
+		if _, err := db.Put(k, []byte("msg.")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(1); err == nil {
+		t.Fatal("expected error for deleted key")
+	}
+	if err := db.Delete(1); err == nil {
+		t.Fatal("expected error deleting a deleted key")
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tombstone is recovered from the WAL along with the entries.
+	db, err = Open(WithLogFilePath("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := db.Size(); size != int64(n-1) {
+		db.Close()
+		t.Fatalf("expected %d records; got %d", n-1, size)
+	}
+	if _, err := db.Get(1); err == nil {
+		db.Close()
+		t.Fatal("expected error for deleted key after recovery")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reset the log so recovered entries are not left for other tests.
+	db, err = Open(WithLogFilePath("test"), WithLogReset())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	memSize := int64(1 << 12)
+	db, err := Open(WithLogFilePath("test"), WithFileSystem(fs.NewMem()), WithMemdbSize(memSize), WithEvictionThreshold(0.5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	val := make([]byte, 100)
+	for k := uint64(0); k < 100; k++ {
+		if _, err := db.Put(k, val); err != nil {
+			t.Fatal(err)
+		}
+		if k%10 == 9 {
+			if err := db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Wait for the tiny batch loop to evict time blocks.
+	time.Sleep(100 * time.Millisecond)
+
+	if size := db.MemSize(); size >= memSize/2 {
+		t.Fatalf("expected size below %d; got %d", memSize/2, size)
+	}
+	if db.internal.meter.Evictions.Count() == 0 {
+		t.Fatal("expected evictions")
+	}
+	if _, err := db.Get(0); err == nil {
+		t.Fatal("expected oldest entry to be evicted")
+	}
+	if _, err := db.Get(99); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTinyBatchSize(t *testing.T) {
+	db, err := Open(WithLogFilePath("test"), WithFileSystem(fs.NewMem()), WithTimeRecordInterval(time.Second), WithTinyBatchSize(1<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	val := make([]byte, 100)
+	for k := uint64(0); k < 100; k++ {
+		if _, err := db.Put(k, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Tiny batches are written to the log before the time record interval.
+	if n := db.internal.tinyBatch.len(); n >= 10 {
+		t.Fatalf("expected tiny batch below 10 entries; got %d", n)
+	}
+	for i := 0; db.LogSize() == 0 && i < 50; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if db.LogSize() == 0 {
+		t.Fatal("expected tiny batches written to the log")
+	}
+}
+
+func TestFlush(t *testing.T) {
+	db, err := Open(WithLogFilePath("test"), WithFileSystem(fs.NewMem()), WithTimeRecordInterval(time.Second), WithTinyBatchSize(1<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	val := make([]byte, 100)
+	for k := uint64(1); k <= 100; k++ {
+		if _, err := db.Put(k, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Flush waits for the tiny batches written before it, so all time blocks are released.
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	if err := db.ForEachBlock(func(timeID int64, keys []uint64) (bool, error) {
+		n += len(keys)
+		return false, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 100 {
+		t.Fatalf("expected 100 keys released; got %d", n)
+	}
+}
+
+func TestTinyBatchRecovery(t *testing.T) {
+	mem := fs.NewMem()
+	db, err := Open(WithLogFilePath("test"), WithFileSystem(mem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := uint64(1); k <= 100; k++ {
+		if _, err := db.Put(k, []byte(fmt.Sprintf("msg.%3d", k))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tiny batches reaching the tiny batch size are written while the log is recovered.
+	db, err = Open(WithLogFilePath("test"), WithFileSystem(mem), WithTinyBatchSize(1<<8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for k := uint64(1); k <= 100; k++ {
+		val, err := db.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("msg.%3d", k); string(val) != want {
+			t.Fatalf("expected %s; got %s", want, val)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package memdb
+
+import "sort"
+
+// Iterator iterates over live keys and values in DB. Keys are visited in the order
+// of time blocks starting from the most recent block, and for a key put more than
+// once only the most recent value is returned.
+type Iterator struct {
+	db    *DB
+	items []_Item
+	item  _Item
+	value []byte
+	err   error
+}
+
+type _Item struct {
+	timeID _TimeID
+	key    uint64
+}
+
+// Items returns an iterator over live keys and values in DB. Keys put or deleted
+// after the iterator is created are not visited.
+func (db *DB) Items() *Iterator {
+	it := &Iterator{db: db}
+	if err := db.ok(); err != nil {
+		it.err = err
+		return it
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var timeIDs []_TimeID
+	for timeID := range db.blockCache {
+		timeIDs = append(timeIDs, timeID)
+	}
+	sort.Slice(timeIDs[:], func(i, j int) bool {
+		return timeIDs[i] > timeIDs[j]
+	})
+	seen := make(map[uint64]struct{})
+	for _, timeID := range timeIDs {
+		block := db.blockCache[timeID]
+		block.RLock()
+		var keys []uint64
+		for ik := range block.records {
+			if _, ok := seen[ik.key]; ok {
+				continue
+			}
+			if ik.delFlag == 0 {
+				keys = append(keys, ik.key)
+			}
+		}
+		for ik := range block.records {
+			seen[ik.key] = struct{}{}
+		}
+		block.RUnlock()
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i] < keys[j]
+		})
+		for _, key := range keys {
+			it.items = append(it.items, _Item{timeID: timeID, key: key})
+		}
+	}
+
+	return it
+}
+
+// Next advances the iterator to the next item. It returns false when iteration is
+// done or an error occurred.
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	for len(it.items) > 0 {
+		it.item = it.items[0]
+		it.items = it.items[1:]
+
+		it.db.mu.RLock()
+		block, ok := it.db.blockCache[it.item.timeID]
+		it.db.mu.RUnlock()
+		if !ok {
+			// Block is released after the iterator is created.
+			continue
+		}
+		block.RLock()
+		off, ok := block.records[iKey(false, it.item.key)]
+		if !ok {
+			// Key is deleted after the iterator is created.
+			block.RUnlock()
+			continue
+		}
+		value, err := block.get(off)
+		if err == nil {
+			// Copy value as block data is reused once the block is released.
+			it.value = append([]byte(nil), value...)
+		}
+		block.RUnlock()
+		if err != nil {
+			it.err = err
+			return false
+		}
+		return true
+	}
+
+	return false
+}
+
+// Key returns the key of the current item.
+func (it *Iterator) Key() uint64 {
+	return it.item.key
+}
+
+// Value returns the value of the current item.
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+// Err returns the error occurred during iteration.
+func (it *Iterator) Err() error {
+	return it.err
+}
@@ -34,6 +34,7 @@ type Meter struct {
 	Syncs      metrics.Counter
 	Recovers   metrics.Counter
 	Dels       metrics.Counter
+	Evictions  metrics.Counter
 }
 
 // NewMeter provide meter to capture statistics.
@@ -47,6 +48,7 @@ func NewMeter() *Meter {
 		Syncs:      metrics.NewCounter(),
 		Recovers:   metrics.NewCounter(),
 		Dels:       metrics.NewCounter(),
+		Evictions:  metrics.NewCounter(),
 	}
 
 	c.TimeSeries.Time(func() {})
@@ -55,6 +57,7 @@ func NewMeter() *Meter {
 	Metrics.GetOrRegister("Syncs", c.Syncs)
 	Metrics.GetOrRegister("Recovers", c.Recovers)
 	Metrics.GetOrRegister("Dels", c.Dels)
+	Metrics.GetOrRegister("Evictions", c.Evictions)
 
 	return c
 }
@@ -66,26 +69,27 @@ func (m *Meter) UnregisterAll() {
 
 // Varz outputs memdb stats on the monitoring port at /varz.
 type Varz struct {
-	Start    time.Time `json:"start"`
-	Now      time.Time `json:"now"`
-	Uptime   string    `json:"uptime"`
-	Count    int64     `json:"count"`
-	Gets     int64     `json:"gets"`
-	Puts     int64     `json:"puts"`
-	Syncs    int64     `json:"syncs"`
-	Recovers int64     `json:"recovers"`
-	Dels     int64     `json:"Dels"`
-	HMean    float64   `json:"hmean"` // Event duration harmonic mean.
-	P50      float64   `json:"p50"`   // Event duration nth percentiles.
-	P75      float64   `json:"p75"`
-	P95      float64   `json:"p95"`
-	P99      float64   `json:"p99"`
-	P999     float64   `json:"p999"`
-	Long5p   float64   `json:"long_5p"`  // Average of the longest 5% event durations.
-	Short5p  float64   `json:"short_5p"` // Average of the shortest 5% event durations.
-	Max      float64   `json:"max"`      // Highest event duration.
-	Min      float64   `json:"min"`      // Lowest event duration.
-	StdDev   float64   `json:"stddev"`   // Standard deviation.
+	Start     time.Time `json:"start"`
+	Now       time.Time `json:"now"`
+	Uptime    string    `json:"uptime"`
+	Count     int64     `json:"count"`
+	Gets      int64     `json:"gets"`
+	Puts      int64     `json:"puts"`
+	Syncs     int64     `json:"syncs"`
+	Recovers  int64     `json:"recovers"`
+	Dels      int64     `json:"Dels"`
+	Evictions int64     `json:"evictions"`
+	HMean     float64   `json:"hmean"` // Event duration harmonic mean.
+	P50       float64   `json:"p50"`   // Event duration nth percentiles.
+	P75       float64   `json:"p75"`
+	P95       float64   `json:"p95"`
+	P99       float64   `json:"p99"`
+	P999      float64   `json:"p999"`
+	Long5p    float64   `json:"long_5p"`  // Average of the longest 5% event durations.
+	Short5p   float64   `json:"short_5p"` // Average of the shortest 5% event durations.
+	Max       float64   `json:"max"`      // Highest event duration.
+	Min       float64   `json:"min"`      // Lowest event duration.
+	StdDev    float64   `json:"stddev"`   // Standard deviation.
 }
 
 func uptime(d time.Duration) string {
@@ -122,6 +126,7 @@ func (db *DB) Varz() (*Varz, error) {
 	v.Syncs = db.internal.meter.Syncs.Count()
 	v.Recovers = db.internal.meter.Recovers.Count()
 	v.Dels = db.internal.meter.Dels.Count()
+	v.Evictions = db.internal.meter.Evictions.Count()
 	ts := db.internal.meter.TimeSeries.Snapshot()
 	v.HMean = float64(ts.HMean())
 	v.P50 = float64(ts.P50())
@@ -18,6 +18,8 @@ package memdb
 
 import (
 	"time"
+
+	"github.com/unit-io/unitdb/fs"
 )
 
 type _Options struct {
@@ -35,6 +37,38 @@ type _Options struct {
 	// logResetFlag flag to skips log recovery on DB open and reset WAL.
 	logResetFlag bool
 
+	// sectorAlign flag to align logs to sector boundary in the WAL.
+	sectorAlign bool
+
+	// lenientRecovery flag to skip corrupt logs on recovery instead of stopping the recovery.
+	lenientRecovery bool
+
+	// onRecoverProgress is called with the number of log entries read on recovery.
+	onRecoverProgress func(done, total int)
+
+	// fileSystem sets the file system of the log file.
+	fileSystem fs.FileSystem
+
+	// groupCommitInterval and groupCommitCount set group commit of logs written to the WAL.
+	groupCommitInterval time.Duration
+	groupCommitCount    int
+
+	// noTinyBatchLoop flag to not start the loop that writes tiny batches to the log.
+	noTinyBatchLoop bool
+
+	// tinyBatchSize sets size of a tiny batch at which it is written to the log before the tiny batch interval.
+	tinyBatchSize int64
+
+	// evictionThreshold sets fraction of memdbSize at which oldest time blocks are evicted.
+	evictionThreshold float64
+
+	// shards sets number of time blocks the block cache is divided into.
+	shards int
+
+	// filterBits and filterHashes set size of the filter of a time block. Zero uses the default size.
+	filterBits   uint64
+	filterHashes uint64
+
 	timeRecordInterval time.Duration
 
 	timeMarkExpiryDuration time.Duration
@@ -64,6 +98,9 @@ func newFuncOption(f func(*_Options)) *fOption {
 // WithDefaultOptions will open DB with some default values.
 func WithDefaultOptions() Options {
 	return newFuncOption(func(o *_Options) {
+		if o.fileSystem == nil {
+			o.fileSystem = fs.OS
+		}
 		if o.logFilePath == "" {
 			o.logFilePath = "/tmp/unitdb"
 		}
@@ -76,6 +113,9 @@ func WithDefaultOptions() Options {
 		if o.logSize == 0 {
 			o.logSize = defaultLogSize
 		}
+		if o.shards == 0 {
+			o.shards = nBlocks
+		}
 		if o.timeRecordInterval == 0 {
 			o.timeRecordInterval = 15 * time.Millisecond
 		}
@@ -120,9 +160,99 @@ func WithLogReset() Options {
 	})
 }
 
+// WithSectorAlign pads each log to the sector size so a torn write is detected and skipped on recovery.
+func WithSectorAlign() Options {
+	return newFuncOption(func(o *_Options) {
+		o.sectorAlign = true
+	})
+}
+
+// WithLenientRecovery skips corrupt or truncated logs on recovery so the logs written
+// after them are still recovered. Skipped logs are reported by DB.RecoveryErrors.
+func WithLenientRecovery() Options {
+	return newFuncOption(func(o *_Options) {
+		o.lenientRecovery = true
+	})
+}
+
+// WithRecoverProgress sets the callback called after each log is read on recovery with the
+// number of log entries read and the number of entries of all logs to recover.
+func WithRecoverProgress(fn func(done, total int)) Options {
+	return newFuncOption(func(o *_Options) {
+		o.onRecoverProgress = fn
+	})
+}
+
+// WithFileSystem sets the file system to store the log file, such as fs.NewMem() to
+// keep the log in memory.
+func WithFileSystem(fsys fs.FileSystem) Options {
+	return newFuncOption(func(o *_Options) {
+		if fsys == nil {
+			fsys = fs.OS
+		}
+		o.fileSystem = fsys
+	})
+}
+
+// WithGroupCommit syncs logs written to the WAL together, once the interval has passed since
+// the first log of the group was written or once count logs are waiting. A zero count leaves
+// the group unbounded.
+func WithGroupCommit(interval time.Duration, count int) Options {
+	return newFuncOption(func(o *_Options) {
+		o.groupCommitInterval = interval
+		o.groupCommitCount = count
+	})
+}
+
+// WithoutTinyBatchLoop opens DB without the loop that writes tiny batches to the log,
+// such as for a DB that is not written to.
+func WithoutTinyBatchLoop() Options {
+	return newFuncOption(func(o *_Options) {
+		o.noTinyBatchLoop = true
+	})
+}
+
+// WithTinyBatchSize writes the tiny batch to the log once its entries reach the given size
+// in bytes, without waiting for the time record interval. Puts wait while earlier tiny
+// batches are written, which bounds memory used by a burst of puts. Zero disables the limit.
+func WithTinyBatchSize(size int64) Options {
+	return newFuncOption(func(o *_Options) {
+		o.tinyBatchSize = size
+	})
+}
+
+// WithEvictionThreshold evicts the oldest time blocks once the size of DB reaches the
+// given fraction of the memdb size, so DB can be used as a bounded buffer. Evicted
+// entries are released from the WAL and are no longer available. Eviction is
+// disabled by default.
+func WithEvictionThreshold(threshold float64) Options {
+	return newFuncOption(func(o *_Options) {
+		o.evictionThreshold = threshold
+	})
+}
+
 // WithTimeBlockInterval sets interval for a time block. Block is pushed to the queue to write it to the log file.
 func WithTimeRecordInterval(dur time.Duration) Options {
 	return newFuncOption(func(o *_Options) {
 		o.timeRecordInterval = dur
 	})
 }
+
+// WithFilterSize sets bits and hashes of the filter of each time block, see filter.Size.
+func WithFilterSize(bits, hashes uint64) Options {
+	return newFuncOption(func(o *_Options) {
+		o.filterBits = bits
+		o.filterHashes = hashes
+	})
+}
+
+// WithShards sets number of time blocks the block cache is divided into. Keys are
+// spread over the time blocks so writers to different time blocks do not contend.
+func WithShards(n int) Options {
+	return newFuncOption(func(o *_Options) {
+		if n <= 0 {
+			n = nBlocks
+		}
+		o.shards = n
+	})
+}
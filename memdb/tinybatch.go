@@ -80,6 +80,11 @@ type _BatchPool struct {
 	stopped      int32
 	waiting      int32
 	wait         bool
+
+	// queued holds batches written to the pool that may not be executed yet, so a flush
+	// waits for the batches written before it.
+	queuedMu sync.Mutex
+	queued   []*_TinyBatch
 }
 
 // size returns maximum number of concurrent batches.
@@ -118,20 +123,43 @@ func (p *_BatchPool) waitQueueSize() int {
 	return int(atomic.LoadInt32(&p.waiting))
 }
 
-// write enqueues a batch to write.
+// write enqueues a batch to write. Batches are not enqueued once the pool is stopped.
 func (p *_BatchPool) write(tinyBatch *_TinyBatch) {
-	if tinyBatch != nil {
+	if tinyBatch != nil && !p.isStopped() {
+		p.addQueued(tinyBatch)
 		p.writeQueue <- tinyBatch
 	}
 }
 
-// writeWait enqueues the given batch and waits for it to be executed.
-func (p *_BatchPool) writeWait(tinyBatch *_TinyBatch) {
-	if tinyBatch == nil {
-		return
+// addQueued adds the batch to the batches queued and drops the batches already executed.
+func (p *_BatchPool) addQueued(tinyBatch *_TinyBatch) {
+	p.queuedMu.Lock()
+	defer p.queuedMu.Unlock()
+	n := 0
+	for _, b := range p.queued {
+		select {
+		case <-b.doneChan:
+		default:
+			p.queued[n] = b
+			n++
+		}
+	}
+	for i := n; i < len(p.queued); i++ {
+		p.queued[i] = nil
+	}
+	p.queued = append(p.queued[:n], tinyBatch)
+}
+
+// waitQueued waits for the batches queued so far to be executed. Batches are executed
+// concurrently, so a batch may complete before the batches enqueued before it.
+func (p *_BatchPool) waitQueued() {
+	p.queuedMu.Lock()
+	queued := p.queued
+	p.queued = nil
+	p.queuedMu.Unlock()
+	for _, b := range queued {
+		<-b.doneChan
 	}
-	p.writeQueue <- tinyBatch
-	<-tinyBatch.doneChan
 }
 
 // dispatch handles tiny batch commit for the batches in queue.
@@ -160,6 +188,7 @@ Loop:
 			case p.batchQueue <- tinyBatch:
 			default:
 				if batchCount < nPoolSize {
+					p.db.internal.closeW.Add(1)
 					go p.commit(tinyBatch, p.batchQueue)
 					batchCount++
 				} else {
@@ -193,13 +222,15 @@ Loop:
 	timeout.Stop()
 }
 
-// commit run initial tiny batch commit, then start tiny batch waiting for more.
+// commit run initial tiny batch commit, then waits for more tiny batches. The caller
+// must add the batch to the close wait group.
 func (p *_BatchPool) commit(tinyBatch *_TinyBatch, batchQueue chan *_TinyBatch) {
+	defer p.db.internal.closeW.Done()
 	if err := p.db.tinyCommit(tinyBatch); err != nil {
 		// p.db.rollback(tinyBatch)
 	}
 
-	go p.tinyCommit(batchQueue)
+	p.tinyCommit(batchQueue)
 }
 
 // tinyCommit commits batch and stops when it receive a nil batch.
@@ -84,3 +84,9 @@ func (id ID) EvalPrefix(contract uint32, cutoff int64) bool {
 	}
 	return binary.LittleEndian.Uint32(id[4:8]) == contract
 }
+
+// EvalTime matches the message ID time with the time range. A zero bound leaves the range open on that side.
+func (id ID) EvalTime(start, end int64) bool {
+	t := uid.Time(id[0:4])
+	return (start <= 0 || t >= start) && (end <= 0 || t <= end)
+}
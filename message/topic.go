@@ -40,6 +40,18 @@ const (
 
 	// Wildcard wildcard is hash for wildcard topic such as '*' or '...'
 	Wildcard = uint32(857445537)
+
+	// topicNameFlag is set on the depth byte of a marshaled topic if the topic string follows the parts.
+	topicNameFlag = 0x80
+	// topicPolicyFlag is set on the parts count byte of a marshaled topic if the encryption policy follows it.
+	topicPolicyFlag = 0x80
+)
+
+// Encryption policies of a topic.
+const (
+	EncryptionDefault uint8 = iota // messages are encrypted as per encryption of the DB or the entry.
+	EncryptionOn                   // messages are always encrypted.
+	EncryptionOff                  // messages are never encrypted.
 )
 
 // TopicOption represents a key/value pair option.
@@ -62,6 +74,7 @@ type Topic struct {
 	Depth        uint8
 	Options      []TopicOption // Gets or sets the options.
 	TopicType    uint8
+	Encryption   uint8 // Gets or sets the encryption policy.
 }
 
 // AddContract adds contract to the parts of a topic.
@@ -108,7 +121,7 @@ func (_SplitFunc) splitOpsKeyValue(c rune) bool {
 func (t *Topic) TTL() (uint32, bool) {
 	ttl, sec, ok := t.getOption("ttl")
 	if sec > 0 {
-		return uint32(time.Duration(sec) * time.Second), ok
+		return uint32(time.Now().Add(time.Duration(sec) * time.Second).Unix()), ok
 	}
 	var duration time.Duration
 	duration, _ = time.ParseDuration(ttl)
@@ -306,19 +319,29 @@ func parseWildcardTopic(contract uint32, topic *Topic) (ok bool) {
 	return true
 }
 
-// Marshal serializes topic to binary.
+// Marshal serializes topic to binary. The topic string is appended to the parts
+// so the topic can be listed on reading the marshaled topic.
 func (t *Topic) Marshal() []byte {
+	name := t.Topic
+	if len(t.Parts) > 0 && t.Parts[len(t.Parts)-1].Hash == Wildcard {
+		name = append(append([]byte{}, name...), TopicGenericSymbol...)
+	}
 	// preallocate buffer of appropriate size
 	var size int
-	//Depth size
-	size++
+	//Depth, parts count and encryption policy size
+	size += 3
 	for range t.Parts {
 		size += 5
 	}
+	size += len(name)
 	buf := make([]byte, size)
 
 	var n int
-	buf[n] = byte(t.Depth)
+	buf[n] = byte(t.Depth) | topicNameFlag
+	n++
+	buf[n] = byte(len(t.Parts)) | topicPolicyFlag
+	n++
+	buf[n] = t.Encryption
 	n++
 	for _, part := range t.Parts {
 		buf[n] = byte(part.Wildchars)
@@ -326,16 +349,30 @@ func (t *Topic) Marshal() []byte {
 		binary.LittleEndian.PutUint32(buf[n:], part.Hash)
 		n += 4
 	}
+	copy(buf[n:], name)
 	return buf
 }
 
-// Unmarshal de-serializes topic from binary data.
+// Unmarshal de-serializes topic from binary data. Topics marshaled without the topic string
+// are unmarshaled with an empty topic string, and topics marshaled without the encryption policy
+// are unmarshaled with the default policy.
 func (t *Topic) Unmarshal(data []byte) error {
 	buf := bytes.NewBuffer(data)
 
 	var parts []Part
 	depth := uint8(buf.Next(1)[0])
-	for i := 0; i <= int(depth); i++ {
+	count := int(depth) + 1
+	named := depth&topicNameFlag != 0
+	if named {
+		depth &^= topicNameFlag
+		count = int(buf.Next(1)[0])
+	}
+	t.Encryption = EncryptionDefault
+	if named && count&topicPolicyFlag != 0 {
+		count &^= topicPolicyFlag
+		t.Encryption = uint8(buf.Next(1)[0])
+	}
+	for i := 0; i < count; i++ {
 		if buf.Len() == 0 {
 			break
 		}
@@ -348,6 +385,10 @@ func (t *Topic) Unmarshal(data []byte) error {
 	}
 	t.Depth = depth
 	t.Parts = parts
+	t.Topic = nil
+	if named {
+		t.Topic = buf.Bytes()
+	}
 	return nil
 }
 
@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/unit-io/unitdb/metrics"
@@ -115,6 +116,84 @@ type Varz struct {
 	// Rate 			float64 `json:"rate"`
 }
 
+// Stats is a snapshot of the DB internal counters.
+type Stats struct {
+	Sequence  uint64 // Sequence of the last entry put to DB.
+	Count     uint64 // Count of entries synced to DB.
+	BlockIdx  int32  // Index of the last block in the index file.
+	WindowIdx int32  // Index of the last block in the window file.
+	WALSize   int64  // Size of the write ahead log.
+	MemdbSize int64  // Number of entries in memdb not yet released.
+	Gets      int64
+	Puts      int64
+	Leases    int64
+	Syncs     int64
+	Recovers  int64
+	Aborts    int64
+	Dels      int64
+	InMsgs    int64
+	OutMsgs   int64
+	InBytes   int64
+	OutBytes  int64
+	// FilterRebuilt is the number of entries added to the filter if it is rebuilt on open.
+	FilterRebuilt int64
+	// FreeBlocks is the number of free blocks in the lease file.
+	FreeBlocks int64
+	// FreeBytes is the total size of free blocks.
+	FreeBytes int64
+	// LargestFreeRegion is the size of the largest region of adjacent free blocks.
+	LargestFreeRegion int64
+	// LeaseReused is the number of entries written to free blocks.
+	LeaseReused int64
+	// LeaseMissed is the number of entries appended to the data file as no free block was reused.
+	LeaseMissed int64
+	// LeaseHitRate is the ratio of entries written to free blocks to all entries written to the data file.
+	LeaseHitRate float64
+}
+
+// Stats returns a snapshot of the DB internal counters and meter values.
+func (db *DB) Stats() Stats {
+	s := Stats{
+		Sequence:  db.seq(),
+		Count:     db.Count(),
+		BlockIdx:  -1,
+		WindowIdx: -1,
+		WALSize:   db.internal.mem.LogSize(),
+		MemdbSize: db.internal.mem.Size(),
+		Gets:      db.internal.meter.Gets.Count(),
+		Puts:      db.internal.meter.Puts.Count(),
+		Leases:    db.internal.meter.Leases.Count(),
+		Syncs:     db.internal.meter.Syncs.Count(),
+		Recovers:  db.internal.meter.Recovers.Count(),
+		Aborts:    db.internal.meter.Aborts.Count(),
+		Dels:      db.internal.meter.Dels.Count(),
+		InMsgs:    db.internal.meter.InMsgs.Count(),
+		OutMsgs:   db.internal.meter.OutMsgs.Count(),
+		InBytes:   db.internal.meter.InBytes.Count(),
+		OutBytes:  db.internal.meter.OutBytes.Count(),
+
+		FilterRebuilt: db.internal.filterRebuilt,
+	}
+	lease := db.internal.freeList
+	n, largest := lease.fragments()
+	s.FreeBlocks = int64(n)
+	s.FreeBytes = atomic.LoadInt64(&lease.size)
+	s.LargestFreeRegion = largest
+	s.LeaseReused = atomic.LoadInt64(&lease.reused)
+	s.LeaseMissed = atomic.LoadInt64(&lease.missed)
+	if total := s.LeaseReused + s.LeaseMissed; total > 0 {
+		s.LeaseHitRate = float64(s.LeaseReused) / float64(total)
+	}
+	if f, err := db.fs.getFile(_FileDesc{fileType: typeIndex}); err == nil {
+		s.BlockIdx = int32((f.currSize()+int64(blockSize)-1)/int64(blockSize)) - 1
+	}
+	if f, err := db.fs.getFile(_FileDesc{fileType: typeTimeWindow}); err == nil {
+		s.WindowIdx = int32((f.currSize()+int64(blockSize)-1)/int64(blockSize)) - 1
+	}
+
+	return s
+}
+
 func uptime(d time.Duration) string {
 	// Just use total seconds for uptime, and display days / years.
 	tsecs := d / time.Second
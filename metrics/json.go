@@ -0,0 +1,71 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import "encoding/json"
+
+// MarshalJSON encodes the timeseries snapshot with all durations in nanoseconds.
+func (t TimeSeriesSnapshot) MarshalJSON() ([]byte, error) {
+	var v struct {
+		Cumulative int64 `json:"cumulative"`
+		HMean      int64 `json:"hmean"`
+		Avg        int64 `json:"avg"`
+		P50        int64 `json:"p50"`
+		P75        int64 `json:"p75"`
+		P95        int64 `json:"p95"`
+		P99        int64 `json:"p99"`
+		P999       int64 `json:"p999"`
+		Min        int64 `json:"min"`
+		Max        int64 `json:"max"`
+		StdDev     int64 `json:"stddev"`
+	}
+	// Accessors of an empty sample panic, so encode zeros instead.
+	if t.histogram != nil && t.histogram.sample.timeSlice.Len() > 0 {
+		v.Cumulative = int64(t.Cumulative())
+		v.HMean = int64(t.HMean())
+		v.Avg = int64(t.Avg())
+		v.P50 = int64(t.P50())
+		v.P75 = int64(t.P75())
+		v.P95 = int64(t.P95())
+		v.P99 = int64(t.P99())
+		v.P999 = int64(t.P999())
+		v.Min = int64(t.Min())
+		v.Max = int64(t.Max())
+		v.StdDev = int64(t.StdDev())
+	}
+	return json.Marshal(v)
+}
+
+// SnapshotJSON encodes a snapshot of all metrics in the registry as a JSON
+// object keyed by metric name. Counters and gauges are encoded as numbers and
+// timeseries are encoded using TimeSeriesSnapshot.MarshalJSON.
+func SnapshotJSON(r Metrics) ([]byte, error) {
+	snap := make(map[string]interface{})
+	r.Each(func(name string, i interface{}) {
+		switch m := i.(type) {
+		case Counter:
+			snap[name] = m.Count()
+		case Gauge:
+			snap[name] = m.Value()
+		case TimeSeries:
+			snap[name] = m.Snapshot()
+		case Histogram:
+			snap[name] = TimeSeriesSnapshot{histogram: m.Snapshot().(*HistogramSnapshot)}
+		}
+	})
+	return json.Marshal(snap)
+}
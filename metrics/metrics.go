@@ -50,6 +50,9 @@ type Metrics interface {
 
 	// Unregister all metrics.  (Mostly for testing.)
 	UnregisterAll()
+
+	// Each calls the given function for each registered metric.
+	Each(func(string, interface{}))
 }
 
 // StandardMetrics the standard implementation of a Registry is a mutex-protected map
@@ -108,12 +111,26 @@ func (m *StandardMetrics) UnregisterAll() {
 	}
 }
 
+// Each calls the given function for each registered metric. The function is
+// called on a copy of the registry so it may safely use the registry.
+func (m *StandardMetrics) Each(f func(string, interface{})) {
+	m.mutex.RLock()
+	metrics := make(map[string]interface{}, len(m.metrics))
+	for name, i := range m.metrics {
+		metrics[name] = i
+	}
+	m.mutex.RUnlock()
+	for name, i := range metrics {
+		f(name, i)
+	}
+}
+
 func (m *StandardMetrics) register(name string, i interface{}) error {
 	if _, ok := m.metrics[name]; ok {
 		return DuplicateMetric(name)
 	}
 	switch i.(type) {
-	case Counter, Gauge:
+	case Counter, Gauge, TimeSeries, Histogram:
 		m.metrics[name] = i
 	}
 	return nil
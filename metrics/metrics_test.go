@@ -0,0 +1,116 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	r := NewMetrics()
+	GetOrRegisterCounter("Puts", r).Inc(3)
+	GetOrRegisterGauge("in.bytes", r).Update(42)
+	ts := GetOrRegisterTimeSeries("timeseries_ns", r)
+	for i := 1; i <= 10; i++ {
+		ts.AddTime(time.Duration(i) * time.Millisecond)
+	}
+	GetOrRegisterTimeSeries("empty", r)
+
+	var buf bytes.Buffer
+	if err := WritePrometheus(&buf, r); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE Puts counter\n",
+		"Puts 3\n",
+		"# TYPE in_bytes gauge\n",
+		"in_bytes 42\n",
+		"# HELP timeseries_ns timeseries_ns summary.\n",
+		"# TYPE timeseries_ns summary\n",
+		"timeseries_ns{quantile=\"0.5\"} 0.006\n",
+		"timeseries_ns{quantile=\"0.99\"} 0.01\n",
+		"timeseries_ns_sum 0.055\n",
+		"timeseries_ns_count 10\n",
+		"empty_count 0\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Fatalf("missing %q in output:\n%s", line, out)
+		}
+	}
+}
+
+func TestSnapshotJSON(t *testing.T) {
+	r := NewMetrics()
+	GetOrRegisterCounter("puts", r).Inc(2)
+	ts := GetOrRegisterTimeSeries("timeseries_ns", r)
+	for i := 1; i <= 4; i++ {
+		ts.AddTime(time.Duration(i) * time.Microsecond)
+	}
+	GetOrRegisterTimeSeries("empty", r)
+
+	data, err := SnapshotJSON(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snap map[string]json.RawMessage
+	if err := json.Unmarshal(data, &snap); err != nil {
+		t.Fatal(err)
+	}
+	if string(snap["puts"]) != "2" {
+		t.Fatalf("expected puts 2, got %s", snap["puts"])
+	}
+	var v map[string]int64
+	if err := json.Unmarshal(snap["timeseries_ns"], &v); err != nil {
+		t.Fatal(err)
+	}
+	if v["cumulative"] != 10000 || v["min"] != 1000 || v["max"] != 4000 || v["p50"] != 3000 {
+		t.Fatalf("unexpected timeseries snapshot %s", snap["timeseries_ns"])
+	}
+	if err := json.Unmarshal(snap["empty"], &v); err != nil {
+		t.Fatal(err)
+	}
+	if v["cumulative"] != 0 {
+		t.Fatalf("unexpected empty snapshot %s", snap["empty"])
+	}
+}
+
+func TestTimeSeriesWithSize(t *testing.T) {
+	r := NewMetrics()
+	ts := GetOrRegisterTimeSeriesWithConfig("timeseries_ns", &Config{Size: 1000}, r)
+	for i := 1; i <= 1000; i++ {
+		ts.AddTime(time.Duration(i))
+	}
+	if min := ts.Snapshot().Min(); min != 1 {
+		t.Fatalf("expected all samples to be retained, min %d", min)
+	}
+	if ts != GetOrRegisterTimeSeries("timeseries_ns", r) {
+		t.Fatal("expected registered timeseries")
+	}
+
+	ts = NewTimeSeries()
+	for i := 1; i <= 1000; i++ {
+		ts.AddTime(time.Duration(i))
+	}
+	if min := ts.Snapshot().Min(); min == 1 {
+		t.Fatal("expected default reservoir to drop old samples")
+	}
+}
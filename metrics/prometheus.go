@@ -0,0 +1,99 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// WritePrometheus writes all metrics in the registry to w using the Prometheus
+// text exposition format. Counters and gauges are written as is, timeseries and
+// histograms are written as summaries with durations in seconds.
+func WritePrometheus(w io.Writer, r Metrics) error {
+	var names []string
+	metrics := make(map[string]interface{})
+	r.Each(func(name string, i interface{}) {
+		names = append(names, name)
+		metrics[name] = i
+	})
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		pname := promName(name)
+		switch m := metrics[name].(type) {
+		case Counter:
+			writePromHeader(bw, pname, name, "counter")
+			fmt.Fprintf(bw, "%s %d\n", pname, m.Count())
+		case Gauge:
+			writePromHeader(bw, pname, name, "gauge")
+			fmt.Fprintf(bw, "%s %d\n", pname, m.Value())
+		case TimeSeries:
+			snap := m.Snapshot().(*TimeSeriesSnapshot)
+			writePromSummary(bw, pname, name, snap.histogram)
+		case Histogram:
+			snap := m.Snapshot().(*HistogramSnapshot)
+			writePromSummary(bw, pname, name, snap)
+		}
+	}
+	return bw.Flush()
+}
+
+func writePromHeader(w io.Writer, pname, name, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s %s.\n", pname, name, typ)
+	fmt.Fprintf(w, "# TYPE %s %s\n", pname, typ)
+}
+
+func writePromSummary(w io.Writer, pname, name string, h *HistogramSnapshot) {
+	writePromHeader(w, pname, name, "summary")
+	if h.sample.timeSlice.Len() > 0 {
+		quantiles := []struct {
+			q string
+			d time.Duration
+		}{
+			{"0.5", h.P50()},
+			{"0.75", h.P75()},
+			{"0.95", h.P95()},
+			{"0.99", h.P99()},
+			{"0.999", h.P999()},
+		}
+		for _, q := range quantiles {
+			fmt.Fprintf(w, "%s{quantile=\"%s\"} %g\n", pname, q.q, q.d.Seconds())
+		}
+	}
+	fmt.Fprintf(w, "%s_sum %g\n", pname, h.Cumulative().Seconds())
+	fmt.Fprintf(w, "%s_count %d\n", pname, h.sample.count)
+}
+
+// promName converts a metric name to a valid Prometheus metric name.
+func promName(name string) string {
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == ':':
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -55,6 +55,9 @@ func (ts _TimeSlice) Len() int           { return len(ts) }
 func (ts _TimeSlice) Less(i, j int) bool { return int64(ts[i]) < int64(ts[j]) }
 func (ts _TimeSlice) Swap(i, j int)      { ts[i], ts[j] = ts[j], ts[i] }
 
+// defaultSampleSize is the reservoir size used by NewTimeSeries.
+const defaultSampleSize = 50
+
 // Config sample config
 type Config struct {
 	Size int
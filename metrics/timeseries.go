@@ -51,12 +51,29 @@ func GetOrRegisterTimeSeries(name string, r Metrics) TimeSeries {
 	return r.GetOrRegister(name, NewTimeSeries).(TimeSeries)
 }
 
+// GetOrRegisterTimeSeriesWithConfig returns an existing timeseries or constructs
+// and registers a new StandardTimeSeries using the sample size from the config.
+func GetOrRegisterTimeSeriesWithConfig(name string, cfg *Config, r Metrics) TimeSeries {
+	return r.GetOrRegister(name, func() TimeSeries { return NewTimeSeriesWithSize(cfg.Size) }).(TimeSeries)
+}
+
 // NewTimeSeries constructs a new StandardTimeSeries using an exponentially-decaying
 // sample with the same reservoir size and alpha as UNIX load averages.
 // Be sure to call Stop() once the timer is of no use to allow for garbage collection.
 func NewTimeSeries() TimeSeries {
+	return NewTimeSeriesWithSize(defaultSampleSize)
+}
+
+// NewTimeSeriesWithSize constructs a new StandardTimeSeries with a sample
+// reservoir of the given size. A larger reservoir gives steadier percentiles
+// for high-throughput events, but each sample holds size durations (8 bytes
+// each) and every snapshot copies and sorts them.
+func NewTimeSeriesWithSize(size int) TimeSeries {
+	if size <= 0 {
+		size = defaultSampleSize
+	}
 	return &_TimeSeries{
-		histogram: NewHistogram(NewSample(&Config{Size: 50})),
+		histogram: NewHistogram(NewSample(&Config{Size: size})),
 	}
 }
 
@@ -19,6 +19,8 @@ package unitdb
 import (
 	"time"
 
+	fltr "github.com/unit-io/unitdb/filter"
+	"github.com/unit-io/unitdb/fs"
 	"github.com/unit-io/unitdb/message"
 )
 
@@ -32,13 +34,31 @@ type _Flags struct {
 
 	// backgroundKeyExpiry sets flag to run key expirer.
 	backgroundKeyExpiry bool
+
+	// readOnly flag opens DB to read files written by another DB.
+	readOnly bool
+
+	// sectorAlign flag pads write ahead logs to the sector size.
+	sectorAlign bool
+
+	// lenientRecovery flag skips corrupt write ahead logs on recovery.
+	lenientRecovery bool
+
+	// rebuildFilter flag recomputes the filter from the index file on open.
+	rebuildFilter bool
+
+	// checksum flag stores a checksum with each message and verifies it on read.
+	checksum bool
 }
 
 // _BatchOptions is used to set options when using batch operation.
 type _BatchOptions struct {
 	contract      uint32
 	encryption    bool
+	compression   Compression
 	writeInterval time.Duration
+	// sync flag syncs batch entries to disk on batch commit.
+	sync bool
 }
 
 // _QueryOptions is used to set options for DB query.
@@ -68,10 +88,50 @@ type _Options struct {
 	// encryptionKey is used for message encryption.
 	encryptionKey []byte
 
+	// contractKeys are used for message encryption of specific contracts.
+	contractKeys map[uint32][]byte
+
+	// keyRing holds encryption keys by key id to rotate the encryption key. Messages are encrypted
+	// using key with currentKeyID and decrypted using key they were encrypted with.
+	keyRing      map[uint8][]byte
+	currentKeyID uint8
+
+	// cipher is used for message encryption instead of the cipher created from encryptionKey.
+	cipher Cipher
+
+	// compression is the codec used to compress message payloads.
+	compression Compression
+
+	// groupCommitInterval and groupCommitCount set group commit of logs written to the write ahead log.
+	groupCommitInterval time.Duration
+	groupCommitCount    int
+
+	// maxPendingLogSize and pendingLogTimeout set size of logs in the write ahead log not yet applied
+	// to the DB files at which puts wait, and how long puts wait before returning errFull.
+	maxPendingLogSize int64
+	pendingLogTimeout time.Duration
+
 	// tinyBatchWriteInterval interval to group tiny batches and write into db on tiny batch interval.
 	// Setting the value to 0 immediately writes entries into db.
 	tinyBatchWriteInterval time.Duration
 
+	// tinyBatchSize sets size of a tiny batch at which it is written to the write ahead log before the tiny batch interval.
+	tinyBatchSize int64
+
+	// loader loads messages missing from the mem cache and DB files, and loaderCacheSize is the
+	// number of loaded messages to keep in memory.
+	loader          Loader
+	loaderCacheSize int
+
+	// onExpire is called for entries deleted by the background key expiry.
+	onExpire func(topicHash, seq uint64)
+
+	// onRecoverProgress is called with the progress of the recovery on open.
+	onRecoverProgress func(done, total int)
+
+	// maxValueSize is the maximum size of a message payload in bytes.
+	maxValueSize int64
+
 	// bufferSize sets Size of buffer to use for pooling.
 	bufferSize int64
 
@@ -81,8 +141,25 @@ type _Options struct {
 	// logSize sets Size of write ahead log.
 	logSize int64
 
+	// walPath sets directory of write ahead log if it is not stored in the DB directory.
+	walPath string
+
 	// freeBlockSize minimum freeblocks size before free blocks are allocated and reused.
 	freeBlockSize int64
+
+	// fileSystem is used to store DB files and the write ahead log.
+	fileSystem fs.FileSystem
+
+	// filterMessages and filterFPRate size the filter of the DB. Zero uses the default size.
+	filterMessages uint64
+	filterFPRate   float64
+
+	// dedupWindow is the time dedup keys of messages put are remembered.
+	dedupWindow time.Duration
+
+	// shards sets number of shards of the mem store block cache, the time window blocks and the
+	// lease of free blocks. Zero uses nShards.
+	shards int
 }
 
 // Options it contains configurable options and flags for DB.
@@ -132,6 +209,54 @@ func WithEncryption() Options {
 	})
 }
 
+// WithReadOnly opens DB in read-only mode. The DB files are not locked, so a DB
+// opened read-only can follow a DB written by another handle using DB.Refresh.
+func WithReadOnly() Options {
+	return newFuncOption(func(o *_Options) {
+		o.flags.readOnly = true
+	})
+}
+
+// WithSectorAlign pads each write ahead log to a multiple of the 4KB sector size and writes
+// it at the sector boundary along with a checksum. A log torn by a crash during write is
+// detected and skipped on recovery. Each log uses up to 4KB of additional space.
+func WithSectorAlign() Options {
+	return newFuncOption(func(o *_Options) {
+		o.flags.sectorAlign = true
+	})
+}
+
+// WithLenientRecovery skips corrupt or truncated write ahead logs on recovery instead of
+// stopping at the first bad log, so the DB opens with all the good data. Skipped logs are
+// reported to the error log.
+func WithLenientRecovery() Options {
+	return newFuncOption(func(o *_Options) {
+		o.flags.lenientRecovery = true
+	})
+}
+
+// WithRebuildFilter recomputes the filter from live entries of the index file on open instead
+// of trusting the filter file, such as when the filter has lost entries and deletes of these entries
+// have no effect. The number of entries added to the filter is reported in Stats. The filter is not
+// rebuilt if the DB is opened read only.
+func WithRebuildFilter() Options {
+	return newFuncOption(func(o *_Options) {
+		o.flags.rebuildFilter = true
+	})
+}
+
+// WithChecksum stores a checksum of the message ID, topic and value with each message of a new DB
+// and verifies it when the message is read, so a message corrupted on disk is reported as
+// errCorrupted instead of being returned. Checksums are stored only if the DB is created with
+// WithChecksum, opening a DB written without checksums using WithChecksum returns an error.
+// A DB created with checksums keeps storing them if it is opened without WithChecksum, but
+// these are not verified on read.
+func WithChecksum() Options {
+	return newFuncOption(func(o *_Options) {
+		o.flags.checksum = true
+	})
+}
+
 // WithBackgroundKeyExpiry sets background key expiry for DB.
 func WithBackgroundKeyExpiry() Options {
 	return newFuncOption(func(o *_Options) {
@@ -139,6 +264,54 @@ func WithBackgroundKeyExpiry() Options {
 	})
 }
 
+// Cipher encrypts and decrypts message payloads.
+type Cipher interface {
+	Encrypt(dst, src []byte) []byte
+	Decrypt(dst, src []byte) ([]byte, error)
+}
+
+// WithCipher sets the cipher used for message encryption, such as AES-GCM using keys from a KMS.
+// The encryption key is ignored if cipher is set.
+func WithCipher(c Cipher) Options {
+	return newFuncOption(func(o *_Options) {
+		o.cipher = c
+	})
+}
+
+// WithContractKey sets encryption key for a contract. Messages for the contract are
+// always encrypted using the contract key instead of the DB encryption key.
+func WithContractKey(contract uint32, key []byte) Options {
+	return newFuncOption(func(o *_Options) {
+		if o.contractKeys == nil {
+			o.contractKeys = make(map[uint32][]byte)
+		}
+		o.contractKeys[contract] = key
+	})
+}
+
+// WithKeyRing sets encryption keys by key id to rotate the encryption key. New messages are encrypted using the
+// key with current key id and messages are decrypted using the key they were encrypted with. Keep old keys in the
+// key ring until DB.ReEncrypt has rewritten messages encrypted with them. Key ids range from 1 to 13.
+func WithKeyRing(current uint8, keys map[uint8][]byte) Options {
+	return newFuncOption(func(o *_Options) {
+		o.currentKeyID = current
+		o.keyRing = keys
+	})
+}
+
+// WithCompression sets the codec used to compress message payloads. Messages are read
+// using the codec they were written with, so the compression of a DB can be changed.
+func WithCompression(c Compression) Options {
+	return newFuncOption(func(o *_Options) {
+		o.compression = c
+	})
+}
+
+// WithNoCompression stores message payloads uncompressed. It is same as WithCompression(CompressionNone).
+func WithNoCompression() Options {
+	return WithCompression(CompressionNone)
+}
+
 // WithDefaultBatchOptions will set some default values for Batch operation.
 //   contract: MasterContract
 //   encryption: False
@@ -163,6 +336,13 @@ func WithBatchEncryption() Options {
 	})
 }
 
+// WithBatchCompression sets the codec used to compress message payloads of the batch.
+func WithBatchCompression(c Compression) Options {
+	return newFuncOption(func(o *_Options) {
+		o.batchOptions.compression = c
+	})
+}
+
 // WithBatchWriteInterval sets batch write interval to partial write large batch.
 func WithBatchWriteInterval(dur time.Duration) Options {
 	return newFuncOption(func(o *_Options) {
@@ -170,6 +350,36 @@ func WithBatchWriteInterval(dur time.Duration) Options {
 	})
 }
 
+// WithGroupCommit shares a single sync of the write ahead log among batches committed concurrently.
+// Logs are synced once the interval has passed since the first log of the group was written or once
+// count logs are waiting, whichever comes first, and a zero count leaves the group unbounded. Writing
+// a log waits for its group to be synced, so log writes may wait up to the interval in exchange for
+// fewer syncs under heavy write load.
+func WithGroupCommit(interval time.Duration, count int) Options {
+	return newFuncOption(func(o *_Options) {
+		o.groupCommitInterval = interval
+		o.groupCommitCount = count
+	})
+}
+
+// WithMaxPendingLogSize bounds the size of logs written to the write ahead log and not yet applied
+// to the DB files. Once it is reached, puts and batch writes wait until a sync applies the logs. If
+// they are not applied within the timeout the put returns an error; a zero timeout waits until the
+// logs are applied or the DB is closed.
+func WithMaxPendingLogSize(size int64, timeout time.Duration) Options {
+	return newFuncOption(func(o *_Options) {
+		o.maxPendingLogSize = size
+		o.pendingLogTimeout = timeout
+	})
+}
+
+// WithBatchSync syncs batch entries to DB files on disk before batch commit returns.
+func WithBatchSync() Options {
+	return newFuncOption(func(o *_Options) {
+		o.batchOptions.sync = true
+	})
+}
+
 // WithDefaultOptions will open DB with some default values.
 func WithDefaultOptions() Options {
 	return newFuncOption(func(o *_Options) {
@@ -191,6 +401,9 @@ func WithDefaultOptions() Options {
 		if o.bufferSize == 0 {
 			o.bufferSize = 1 << 30 // maximum size of a buffer to use in bufferpool (1GB).
 		}
+		if o.maxValueSize == 0 {
+			o.maxValueSize = maxValueLength
+		}
 		if o.memdbSize == 0 {
 			o.memdbSize = 1 << 32 // maximum size of blockcache (4GB).
 		}
@@ -203,6 +416,12 @@ func WithDefaultOptions() Options {
 		if o.encryptionKey == nil {
 			o.encryptionKey = []byte("4BWm1vZletvrCDGWsF6mex8oBSd59m6I")
 		}
+		if o.fileSystem == nil {
+			o.fileSystem = fs.OS
+		}
+		if o.dedupWindow == 0 {
+			o.dedupWindow = 10 * time.Minute
+		}
 	})
 }
 
@@ -221,6 +440,87 @@ func TinyBatchWriteInterval(dur time.Duration) Options {
 	})
 }
 
+// WithTinyBatchSize sets size in bytes at which the tiny batch of puts is written to the write
+// ahead log without waiting for the tiny batch interval. Puts wait while earlier tiny batches
+// are written so a burst of puts does not grow the tiny batch unbounded. Zero disables the limit.
+func WithTinyBatchSize(size int64) Options {
+	return newFuncOption(func(o *_Options) {
+		o.tinyBatchSize = size
+	})
+}
+
+// WithMaxValueSize sets maximum size of a message payload in bytes. Puts of larger payloads
+// return an error before the entry is buffered. The size cannot exceed the 1GB limit of a payload.
+func WithMaxValueSize(size int64) Options {
+	return newFuncOption(func(o *_Options) {
+		if size <= 0 || size > maxValueLength {
+			size = maxValueLength
+		}
+		o.maxValueSize = size
+	})
+}
+
+// WithLoader sets the loader to read messages missing from the DB, such as messages tiered to an object storage.
+// Up to cacheSize loaded messages are kept in memory. The loader must check the payload is of the message
+// contract as loaded messages are not validated.
+func WithLoader(loader Loader, cacheSize int) Options {
+	return newFuncOption(func(o *_Options) {
+		o.loader = loader
+		o.loaderCacheSize = cacheSize
+	})
+}
+
+// WithOnExpire sets the callback called for each entry deleted by the background key expiry. The callback is
+// called from the expirer goroutine after all entries expired in a run are deleted, so it does not block writes.
+// Entries of a run are notified in the order of their expiry window, and runs are notified one after another.
+// There is no ordering of entries of different topics expiring in the same expiry window.
+func WithOnExpire(fn func(topicHash, seq uint64)) Options {
+	return newFuncOption(func(o *_Options) {
+		o.onExpire = fn
+	})
+}
+
+// WithRecoverProgress sets the callback called with the progress of opening the DB, such as to log the
+// percentage done while a large write ahead log is recovered. The total is the number of entries of the
+// write ahead log to recover, counted once read from the log and once synced into the DB files, and the
+// number of blocks of the window file to load topics from, and done counts up to total. The callback is
+// called about once for each percent done and once done reaches total.
+func WithRecoverProgress(fn func(done, total int)) Options {
+	return newFuncOption(func(o *_Options) {
+		o.onRecoverProgress = fn
+	})
+}
+
+// WithFilterSize sizes the filter used to test if a message exists before reading the index file, for
+// the expected number of messages of the DB with the false positive rate. Filter bits grow linearly
+// with the expected messages, by about 9.6 bits a message for 1% false positives and 4.8 more bits a
+// message for each tenfold lower rate, i.e. 10 million messages at 1% take 12MB. Filters of the time
+// blocks of the mem store are sized for their share of the expected messages. The default filter has
+// 160000 bits and 7 hashes, which holds about 16000 messages at 1% false positives.
+func WithFilterSize(expectedMessages uint64, fpRate float64) Options {
+	return newFuncOption(func(o *_Options) {
+		o.filterMessages = expectedMessages
+		o.filterFPRate = fpRate
+	})
+}
+
+// filterSize returns bits and hashes of the filter of the DB, or zero for the default size.
+func (o *_Options) filterSize() (bits, hashes uint64) {
+	if o.filterMessages == 0 {
+		return 0, 0
+	}
+	return fltr.Size(o.filterMessages, o.filterFPRate)
+}
+
+// WithDedupWindow sets the time dedup keys set using Entry.WithDedupKey are remembered, so puts
+// retried within the window are skipped. Keys are kept in memory and are forgotten once the DB is
+// closed. A zero or negative window disables deduplication. The default window is 10 minutes.
+func WithDedupWindow(window time.Duration) Options {
+	return newFuncOption(func(o *_Options) {
+		o.dedupWindow = window
+	})
+}
+
 // WithDefaultQueryLimit limits maximum number of records to fetch
 // if the DB Get or DB Iterator method does not specify a limit.
 func WithDefaultQueryLimit(limit int) Options {
@@ -259,6 +559,15 @@ func WithLogSize(size int64) Options {
 	})
 }
 
+// WithWALPath sets the directory the write ahead log is stored in instead of the DB directory,
+// such as to keep the log on faster storage than the index, data and window files. The directory
+// is not locked by the DB, so each DB needs its own WAL directory.
+func WithWALPath(path string) Options {
+	return newFuncOption(func(o *_Options) {
+		o.walPath = path
+	})
+}
+
 // WithMinimumFreeBlocksSize sets minimum freeblocks size
 // before free blocks are allocated and reused.
 func WithFreeBlockSize(size int64) Options {
@@ -267,6 +576,28 @@ func WithFreeBlockSize(size int64) Options {
 	})
 }
 
+// WithFileSystem sets the file system to store DB files and the write ahead log.
+// Use fs.NewMem() to open a DB in memory, such as in tests. The DB files are kept
+// by the Mem value, so a DB reopened over the same Mem finds its earlier data.
+func WithFileSystem(fsys fs.FileSystem) Options {
+	return newFuncOption(func(o *_Options) {
+		if fsys == nil {
+			fsys = fs.OS
+		}
+		o.fileSystem = fsys
+	})
+}
+
+// WithShards sets number of shards the mem store block cache, the time window blocks and the free blocks
+// lease are divided into to reduce lock contention, such as to scale shards with the number of cores under
+// heavy concurrent writes.
+// The number of shards must be a power of two, otherwise Open returns an error. Zero uses the default of 32 shards.
+func WithShards(n int) Options {
+	return newFuncOption(func(o *_Options) {
+		o.shards = n
+	})
+}
+
 // WithEncryptionKey sets encryption key to use for data encryption.
 func WithEncryptionKey(key []byte) Options {
 	return newFuncOption(func(o *_Options) {
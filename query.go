@@ -17,21 +17,91 @@
 package unitdb
 
 import (
+	"context"
+	"math"
+	"regexp"
+	"time"
+
 	"github.com/unit-io/unitdb/message"
 )
 
+// Message represents a message read from the DB.
+type Message struct {
+	ID        []byte    // The ID of the message.
+	Seq       uint64    // The sequence of the message.
+	Topic     []byte    // The topic the message is put to, it is nil if the topic string is not stored in the DB.
+	Payload   []byte    // The payload of the message.
+	Parts     [][]byte  // The Parts are parts of the payload if the message is put using Entry.WithPayloads.
+	ExpiresAt time.Time // The ExpiresAt is expiry time of the message, it is zero if the message does not expire.
+	FromCache bool      // The FromCache is set if the message is read from the mem cache instead of the DB files.
+
+	sub *_Subscriber // The sub is the subscription tracking acknowledgement of the message.
+}
+
+// Ack acknowledges the message delivered by a subscription using Query.WithAckTimeout so it is
+// not redelivered. It has no effect on other messages.
+func (m Message) Ack() {
+	if m.sub != nil {
+		m.sub.ack(m.Seq)
+	}
+}
+
+// Nack rejects the message delivered by a subscription using Query.WithAckTimeout so it is
+// redelivered without waiting for the ack timeout. It has no effect on other messages.
+func (m Message) Nack() {
+	if m.sub != nil {
+		m.sub.nack(m.Seq)
+	}
+}
+
+// Order represents the order in which query results are returned.
+type Order uint8
+
+const (
+	// Descending returns most recent messages first. It is the default order.
+	Descending Order = iota
+	// Ascending returns oldest messages first.
+	Ascending
+)
+
 // Query represents a topic to query and optional contract information.
 type (
 	_Query struct {
 		topicHash uint64
 		seq       uint64
+		expiresAt uint32
+	}
+	// _Exclusion is a topic excluded from the query results.
+	_Exclusion struct {
+		hash  uint64
+		parts []message.Part
+		depth uint8
 	}
 	_InternalQuery struct {
 		parts      []message.Part // The parts represents a topic which contains a contract and a list of hashes for various parts of the topic.
 		depth      uint8
 		topicType  uint8
-		prefix     uint64 // The prefix is generated from contract and first of the topic.
-		cutoff     int64  // The cutoff is time limit check on message IDs.
+		prefix     uint64         // The prefix is generated from contract and first of the topic.
+		cutoff     int64          // The cutoff is time limit check on message IDs.
+		start      int64          // The start is lower bound of the time range set on the query.
+		end        int64          // The end is upper bound of the time range set on the query.
+		order      Order          // The order is sort order of the query results.
+		cursor     uint64         // The cursor is sequence of the last seen message to resume the query from.
+		seqRange   bool           // The seqRange is set by DB.Range to select messages by sequence.
+		fromSeq    uint64         // The fromSeq is lower bound of the sequence range.
+		toSeq      uint64         // The toSeq is upper bound of the sequence range.
+		next       uint64         // The next is sequence of the last message returned by the query.
+		pattern    string         // The pattern is regular expression set on the query to match topics.
+		regex      *regexp.Regexp // The regex is the compiled pattern matched with the full topic.
+		without    [][]byte       // The without are topics excluded from the query results.
+		exclusions []_Exclusion
+		ctx        context.Context // The ctx cancels the query, it is set by DB.GetContext.
+		countOnly  bool            // The countOnly counts matching messages without reading payloads.
+		count      int             // The count is number of messages matched by the query.
+		source     bool            // The source records if messages returned are read from the mem cache.
+		ackTimeout time.Duration   // The ackTimeout is time after which a message not acknowledged is redelivered by DB.Subscribe.
+		limitBytes int64           // The limitBytes is the maximum size of payloads of the messages returned.
+		sources    []bool
 		winEntries []_Query
 
 		opts *_QueryOptions
@@ -51,7 +121,9 @@ func NewQuery(topic []byte) *Query {
 	}
 }
 
-// WithContract sets contract on query.
+// WithContract sets contract on query. Topics of the contract are queried the same way entries
+// are written using Entry.WithContract, so the contract is not embedded in the topic. Queries
+// using a revoked contract return errForbidden.
 func (q *Query) WithContract(contract uint32) *Query {
 	q.Contract = contract
 	return q
@@ -63,6 +135,131 @@ func (q *Query) WithLimit(limit int) *Query {
 	return q
 }
 
+// WithLimitBytes sets query to stop reading messages once the size of their decoded payloads would
+// exceed limit bytes, such as to bound the response size when a few topics contain large messages.
+// The first message is always returned so reading resumed from Query.Cursor does not stall on a message
+// larger than the limit. The query limit still applies and the query stops at whichever limit is hit first.
+func (q *Query) WithLimitBytes(limit int64) *Query {
+	q.internal.limitBytes = limit
+	return q
+}
+
+// WithOrder sets order of query results. The query limit is applied relative to the order,
+// i.e. Ascending returns oldest messages up to the limit.
+func (q *Query) WithOrder(order Order) *Query {
+	q.internal.order = order
+	return q
+}
+
+// WithCursor sets cursor on query to resume reading messages strictly after the last seen message
+// in query order. Use Query.Cursor to get the cursor after DB.Get returns.
+func (q *Query) WithCursor(cursor uint64) *Query {
+	q.internal.cursor = cursor
+	return q
+}
+
+// WithTimeRange sets query to return messages put between start and end inclusive, in seconds resolution.
+// A zero start or end leaves the range open on that side. If the topic also specifies last duration
+// the later of the two lower bounds is used.
+func (q *Query) WithTimeRange(start, end time.Time) *Query {
+	q.internal.start, q.internal.end = 0, 0
+	if !start.IsZero() {
+		q.internal.start = start.Unix()
+	}
+	if !end.IsZero() {
+		q.internal.end = end.Unix()
+	}
+	return q
+}
+
+// WithRegex sets a regular expression to match topics. The query topic is then used as a prefix,
+// the topics under it are looked up in the trie and only the topics whose full topic string matches
+// the pattern are queried. The pattern is matched against the whole topic, i.e. `sensor\.\d+\.temp`
+// matches "sensor.1234.temp" but not "sensor.1234.temperature". Topics added without the topic string
+// are not matched.
+func (q *Query) WithRegex(pattern string) *Query {
+	q.internal.pattern = pattern
+	return q
+}
+
+// Without excludes topics from the query results. A topic to exclude can be a wildcard topic,
+// i.e. "teams.alpha.secret..." excludes the topic and all topics under it. Topics are excluded
+// from the topics looked up for the query before its messages are read.
+func (q *Query) Without(topics ...[]byte) *Query {
+	q.internal.without = append(q.internal.without, topics...)
+	return q
+}
+
+// CountOnly sets query to count matching messages without reading their payloads. DB.Get then returns
+// no messages and Query.Count returns the number of matches. Deleted and expired messages are not counted.
+// A count only query is not limited, so setting a limit on the query or the topic returns errBadRequest.
+// Setting a limit of payload bytes using Query.WithLimitBytes also returns errBadRequest.
+func (q *Query) CountOnly() *Query {
+	q.internal.countOnly = true
+	return q
+}
+
+// Count returns the number of messages matched by DB.Get for the query.
+func (q *Query) Count() int {
+	return q.internal.count
+}
+
+// WithSource sets query to record for each message returned by DB.Get if it is read from the mem cache
+// or from the DB files. Use Query.Sources to get the sources after DB.Get returns.
+func (q *Query) WithSource() *Query {
+	q.internal.source = true
+	return q
+}
+
+// WithAckTimeout sets the subscription of the query to redeliver messages not acknowledged within
+// the timeout using Message.Ack, so a consumer gets messages at least once while the subscription is
+// open. It is used by DB.Subscribe. Acknowledgements are not persisted: messages in flight are tracked
+// in memory only and are dropped once the subscription is canceled or the DB is closed, so a consumer
+// resuming after a restart must track the last message it processed, such as using Message.Seq.
+func (q *Query) WithAckTimeout(timeout time.Duration) *Query {
+	q.internal.ackTimeout = timeout
+	return q
+}
+
+// Sources returns for each message returned by DB.Get for the query if it is read from the mem cache,
+// in the order of the messages. It returns nil unless the query is set WithSource.
+func (q *Query) Sources() []bool {
+	return q.internal.sources
+}
+
+// Cursor returns cursor of the last message returned by DB.Get for the query.
+// It returns the cursor set on the query if no messages were returned.
+func (q *Query) Cursor() uint64 {
+	if q.internal.next == 0 {
+		return q.internal.cursor
+	}
+	return q.internal.next
+}
+
+// canceled returns the error of the query context once it is done.
+func (q *_InternalQuery) canceled() error {
+	if q.ctx == nil {
+		return nil
+	}
+	select {
+	case <-q.ctx.Done():
+		return q.ctx.Err()
+	default:
+		return nil
+	}
+}
+
+// lookupKey returns a key identifying the trie traversal of the query.
+func (q *_InternalQuery) lookupKey() string {
+	key := make([]byte, 2, 2+len(q.parts)*5)
+	key[0] = q.depth
+	key[1] = q.topicType
+	for _, part := range q.parts {
+		key = append(key, byte(part.Hash>>24), byte(part.Hash>>16), byte(part.Hash>>8), byte(part.Hash), part.Wildchars)
+	}
+	return string(key)
+}
+
 func (q *Query) parse() error {
 	if q.Contract == 0 {
 		q.Contract = message.MasterContract
@@ -80,9 +277,53 @@ func (q *Query) parse() error {
 	q.internal.depth = topic.Depth
 	q.internal.topicType = topic.TopicType
 	q.internal.prefix = message.Prefix(q.internal.parts)
+	q.internal.exclusions = q.internal.exclusions[:0]
+	for _, without := range q.internal.without {
+		t := new(message.Topic)
+		t.ParseKey(without)
+		t.Parse(q.Contract, true)
+		if t.TopicType == message.TopicInvalid {
+			return errBadRequest
+		}
+		t.AddContract(q.Contract)
+		q.internal.exclusions = append(q.internal.exclusions, _Exclusion{hash: t.GetHash(q.Contract), parts: t.Parts, depth: t.Depth})
+	}
+	q.internal.regex = nil
+	if q.internal.pattern != "" {
+		regex, err := regexp.Compile("^(?:" + q.internal.pattern + ")$")
+		if err != nil {
+			return errRegexInvalid
+		}
+		q.internal.regex = regex
+	}
+	q.internal.cutoff = q.internal.start
+	if q.internal.limitBytes < 0 {
+		return errBadRequest
+	}
+	if q.internal.seqRange {
+		// the sequence range selects messages so last duration and limit of the topic are not used.
+		q.Limit = math.MaxInt32
+		return nil
+	}
+	if q.internal.countOnly {
+		if q.Limit != 0 || q.internal.limitBytes != 0 {
+			return errBadRequest
+		}
+		if from, limit, ok := topic.Last(); ok {
+			if limit != 0 {
+				return errBadRequest
+			}
+			if from.Unix() > q.internal.cutoff {
+				q.internal.cutoff = from.Unix()
+			}
+		}
+		return nil
+	}
 	// In case of last, include it to the query.
 	if from, limit, ok := topic.Last(); ok {
-		q.internal.cutoff = from.Unix()
+		if from.Unix() > q.internal.cutoff {
+			q.internal.cutoff = from.Unix()
+		}
 		switch {
 		case (q.Limit == 0 && limit == 0):
 			q.Limit = q.internal.opts.defaultQueryLimit
@@ -17,10 +17,13 @@
 package unitdb
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sort"
+	"sync/atomic"
 
+	fltr "github.com/unit-io/unitdb/filter"
 	"github.com/unit-io/unitdb/message"
 	// _ "net/http/pprof"
 )
@@ -42,7 +45,59 @@ func (db *_SyncHandle) recoverWindowBlocks(windowEntries map[uint64]_WindowEntri
 	return nil
 }
 
-func (db *_SyncHandle) startRecovery() error {
+// _Progress reports progress of opening the DB to the callback set using WithRecoverProgress.
+// Entries of the log are read first, the window blocks are loaded next and the entries read
+// are synced into the DB files last, so done of each phase is counted from the phases before.
+type _Progress struct {
+	fn        func(done, total int)
+	logs      int // logs is the number of log entries to recover.
+	winBlocks int // winBlocks is the number of blocks of the window file.
+	synced    int // synced is the number of log entries synced into the DB files so far.
+	last      int
+}
+
+// total returns the number of log entries read and synced and the number of window blocks loaded.
+func (p *_Progress) total() int {
+	return 2*p.logs + p.winBlocks
+}
+
+// sync reports n more log entries synced into the DB files.
+func (p *_Progress) sync(n int) {
+	if p == nil {
+		return
+	}
+	// entries put after the log is recovered are not counted in logs.
+	if p.synced += n; p.synced > p.logs {
+		p.synced = p.logs
+	}
+	p.report(p.logs + p.winBlocks + p.synced)
+}
+
+// complete reports the recovery done, such as if entries of the log were synced before.
+func (p *_Progress) complete() {
+	if p == nil {
+		return
+	}
+	p.report(p.total())
+}
+
+// report calls the progress callback if done has advanced by a percent of total since the last call.
+func (p *_Progress) report(done int) {
+	if p == nil {
+		return
+	}
+	total := p.total()
+	if p.fn == nil || done <= p.last || (done < total && done-p.last < total/100) {
+		return
+	}
+	p.last = done
+	p.fn(done, total)
+}
+
+// startRecovery syncs entries recovered from the log into the DB files and reports the entries
+// synced to progress. If ctx is canceled, the remaining time blocks are left in the mem DB and the
+// error of ctx is returned once the window entries of the time blocks synced are written.
+func (db *_SyncHandle) startRecovery(ctx context.Context, progress *_Progress) error {
 	// p := profile.Start(profile.MemProfile, profile.ProfilePath("."), profile.NoShutdownHook)
 	// defer p.Stop()
 	db.internal.closeW.Add(1)
@@ -50,6 +105,11 @@ func (db *_SyncHandle) startRecovery() error {
 		db.internal.closeW.Done()
 	}()
 	fmt.Println("db.recoverLog: start recovery")
+	// Entries recovered from the log are put to the tiny batch of the mem DB, so the tiny batch is
+	// written first for time blocks of the entries to be synced here rather than by the syncer.
+	if err := db.internal.mem.Flush(); err != nil {
+		return err
+	}
 	if ok := db.startSync(); !ok {
 		return nil
 	}
@@ -57,10 +117,13 @@ func (db *_SyncHandle) startRecovery() error {
 		db.finish()
 	}()
 
-	var err1 error
+	var err1, canceled error
 	pendingEntries := make(map[uint64]_WindowEntries)
 
 	err := db.internal.mem.ForEachBlock(func(timeID int64, seqs []uint64) (bool, error) {
+		if canceled = ctx.Err(); canceled != nil {
+			return true, nil
+		}
 		winEntries := make(map[uint64]_WindowEntries)
 		sort.Slice(seqs[:], func(i, j int) bool {
 			return seqs[i] < seqs[j]
@@ -69,6 +132,7 @@ func (db *_SyncHandle) startRecovery() error {
 			db.syncInfo.upperSeq = seqs[len(seqs)-1]
 		}
 		for _, seq := range seqs {
+			progress.sync(1)
 			memdata, err := db.internal.mem.Lookup(timeID, seq)
 			if err != nil || memdata == nil {
 				db.syncInfo.entriesInvalid++
@@ -102,7 +166,8 @@ func (db *_SyncHandle) startRecovery() error {
 				if err := t.Unmarshal(rawtopic); err != nil {
 					return false, err
 				}
-				db.internal.trie.add(newTopic(m.topicHash, 0), t.Parts, t.Depth)
+				db.internal.trie.initEncryption(m.topicHash, t.Encryption)
+				db.internal.trie.add(newTopic(m.topicHash, 0), t.Parts, t.Depth, t.Topic)
 			}
 			if _, ok := winEntries[m.topicHash]; ok {
 				winEntries[m.topicHash] = append(winEntries[m.topicHash], newWinEntry(e.seq, m.expiresAt))
@@ -128,6 +193,14 @@ func (db *_SyncHandle) startRecovery() error {
 				delete(winEntries, h)
 			}
 		}
+		// Window entries of earlier time blocks are written with the time block the topic is
+		// recovered from, as these are not written by the sync once all time blocks are synced.
+		for h, wEntries := range pendingEntries {
+			if _, ok := db.internal.trie.getOffset(h); ok {
+				winEntries[h] = append(wEntries, winEntries[h]...)
+				delete(pendingEntries, h)
+			}
+		}
 		if err := db.recoverWindowBlocks(winEntries); err != nil {
 			logger.Error().Err(err).Str("context", "db.recoverWindowBlocks")
 			return true, err
@@ -156,10 +229,63 @@ func (db *_SyncHandle) startRecovery() error {
 		return err
 	}
 
-	return db.sync(true)
+	if err := db.sync(true); err != nil {
+		return err
+	}
+	if canceled == nil {
+		progress.complete()
+	}
+	return canceled
+}
+
+// recoverInfo reconciles the sequence and count recorded in the info file with the index file.
+// The info file is written after index blocks are synced, so if sync was interrupted the info file
+// lags the index file and new writes would reuse sequences of existing entries. Index blocks are scanned
+// beyond the recorded sequence to recover entries and advance the sequence and count.
+func (db *DB) recoverInfo() error {
+	indexFile, err := db.fs.getFile(_FileDesc{fileType: typeIndex})
+	if err != nil {
+		return err
+	}
+	nBlocks := int32((indexFile.currSize() + int64(blockSize) - 1) / int64(blockSize))
+	seq := db.seq()
+	bIdx := int32(0)
+	if seq > 0 {
+		bIdx = blockIndex(seq)
+	}
+	upperSeq := seq
+	var count uint64
+	r := _BlockReader{indexFile: indexFile}
+	for ; bIdx < nBlocks; bIdx++ {
+		r.offset = blockOffset(bIdx)
+		b, err := r.readIndexBlock()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < int(b.entryIdx) && i < entriesPerIndexBlock; i++ {
+			e := b.entries[i]
+			if e.seq <= seq {
+				continue
+			}
+			if e.seq > upperSeq {
+				upperSeq = e.seq
+			}
+			if e.msgOffset != -1 {
+				count++
+			}
+		}
+	}
+	if upperSeq == seq {
+		return nil
+	}
+	logger.Info().Str("context", "db.recoverInfo").Uint64("seq", seq).Uint64("recoveredSeq", upperSeq).Msg("info file lags the index file")
+	atomic.StoreUint64(&db.internal.dbInfo.sequence, upperSeq)
+	db.incount(count)
+
+	return db.writeInfo()
 }
 
-func (db *DB) recoverLog() error {
+func (db *DB) recoverLog(ctx context.Context, progress *_Progress) error {
 	// Sync happens synchronously.
 	db.internal.syncLockC <- struct{}{}
 	defer func() {
@@ -167,9 +293,42 @@ func (db *DB) recoverLog() error {
 	}()
 
 	syncHandle := _SyncHandle{DB: db}
-	if err := syncHandle.startRecovery(); err != nil {
+	if err := syncHandle.startRecovery(ctx, progress); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// rebuildFilter recomputes the filter from live entries of the index file and writes the filter
+// file. It returns the number of entries added to the filter.
+func (db *DB) rebuildFilter() (int64, error) {
+	indexFile, err := db.fs.getFile(_FileDesc{fileType: typeIndex})
+	if err != nil {
+		return 0, err
+	}
+	filterBlock := fltr.NewSizedFilterGenerator(db.opts.filterSize())
+	var n int64
+	nBlocks := int32((indexFile.currSize() + int64(blockSize) - 1) / int64(blockSize))
+	r := _BlockReader{indexFile: indexFile}
+	for bIdx := int32(0); bIdx < nBlocks; bIdx++ {
+		r.offset = blockOffset(bIdx)
+		b, err := r.readIndexBlock()
+		if err != nil {
+			return 0, err
+		}
+		for i := 0; i < int(b.entryIdx) && i < entriesPerIndexBlock; i++ {
+			e := b.entries[i]
+			if e.seq == 0 || e.msgOffset == -1 {
+				continue
+			}
+			filterBlock.Append(e.seq)
+			n++
+		}
+	}
+	db.internal.filter.filterBlock = filterBlock
+	if err := db.internal.filter.writeFilterBlock(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+// reEncryptBlocks is the number of index blocks of which messages are rewritten by ReEncrypt
+// while it holds the sync lock, so reads and syncs are held off for a chunk of the data file only.
+const reEncryptBlocks = 8
+
+// reEncrypt rewrites messages of the index blocks from start to start+reEncryptBlocks encrypted
+// using the DB key or other keys of the key ring using the key ring key with the key id. It returns
+// true once messages of the last index block are rewritten. The caller must hold the sync lock.
+func (db *DB) reEncrypt(keyID uint8, start int32) (bool, error) {
+	// Queries read messages without the sync lock so they are held off while messages are rewritten.
+	for _, mu := range db.internal.mutex.internal {
+		mu.Lock()
+		defer mu.Unlock()
+	}
+
+	indexFile, err := db.fs.getFile(_FileDesc{fileType: typeIndex})
+	if err != nil {
+		return false, err
+	}
+	dataFile, err := db.fs.getFile(_FileDesc{fileType: typeData})
+	if err != nil {
+		return false, err
+	}
+	mac := db.internal.keyRing[keyID]
+	newKeyID := keyContract + keyID
+	nBlocks := int32((indexFile.currSize() + int64(blockSize) - 1) / int64(blockSize))
+	end := start + reEncryptBlocks
+	if end > nBlocks {
+		end = nBlocks
+	}
+	br := _BlockReader{indexFile: indexFile}
+	for bIdx := start; bIdx < end; bIdx++ {
+		br.offset = blockOffset(bIdx)
+		b, err := br.readIndexBlock()
+		if err != nil {
+			return false, err
+		}
+		for i := 0; i < int(b.entryIdx) && i < entriesPerIndexBlock; i++ {
+			e := b.entries[i]
+			if e.seq == 0 || e.msgOffset == -1 {
+				continue
+			}
+			data, err := dataFile.slice(e.msgOffset, e.msgOffset+int64(e.mSize()))
+			if err != nil {
+				return false, err
+			}
+			k := data[idSize-1] & 0x0f
+			if k == keyNone || k == keyContract || k == newKeyID {
+				continue
+			}
+			oldMac, err := db.cipher(k, 0)
+			if err != nil {
+				return false, err
+			}
+			valOffset := idSize + uint32(e.topicSize)
+			valEnd := uint32(len(data))
+			if db.internal.dbInfo.checksum == 1 {
+				valEnd -= checksumSize
+			}
+			val, err := oldMac.Decrypt(nil, data[valOffset:valEnd])
+			if err != nil {
+				return false, err
+			}
+			val = mac.Encrypt(nil, val)
+			if len(val) != int(valEnd-valOffset) {
+				return false, errReEncryptSize
+			}
+			msg := make([]byte, 0, e.mSize())
+			msg = append(msg, data[:valOffset]...)
+			msg = append(msg, val...)
+			msg[idSize-1] = data[idSize-1]&0xf0 | newKeyID
+			if db.internal.dbInfo.checksum == 1 {
+				msg = msg[:e.mSize()]
+				putChecksum(msg)
+			}
+			if _, err := dataFile.WriteAt(msg, e.msgOffset); err != nil {
+				return false, err
+			}
+		}
+	}
+	if err := db.fs.sync(); err != nil {
+		return false, err
+	}
+	return end >= nBlocks, nil
+}
@@ -0,0 +1,404 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+const (
+	// retentionSize is the size of a topic hash and its retention cap in the info file.
+	retentionSize = 12
+	// byteLimitSize is the size of a topic hash and its byte limit in the info file.
+	byteLimitSize = 16
+)
+
+type (
+	// _Retained is the sequence and the value size of a live entry of a capped topic.
+	_Retained struct {
+		seq  uint64
+		size uint32
+	}
+
+	// _Retention is the retention cap set using DB.SetTopicRetention and the byte limit set using
+	// DB.SetTopicByteLimit by topic. The caps are stored in the info file following the contracts,
+	// and byte limits follow the caps. The caps are keyed by the topic hash under the master contract
+	// so they apply to the topic under any contract. The live entries of a capped topic are kept in
+	// memory once the topic is put to, so the oldest entries beyond the caps are evicted.
+	_Retention struct {
+		sync.RWMutex
+		caps     map[uint64]int         // caps is the maximum number of messages by retention key.
+		limits   map[uint64]int64       // limits is the maximum bytes of values by retention key.
+		keys     map[uint64]uint64      // keys are the retention keys of retained topics by topic hash.
+		retained map[uint64][]_Retained // retained are the live entries of a capped topic in put order.
+		bytes    map[uint64]int64       // bytes is the size of values of the retained entries by topic hash.
+		evicted  []_Query               // evicted are the entries to delete on the next sync.
+	}
+)
+
+func newRetention() *_Retention {
+	return &_Retention{
+		caps:     make(map[uint64]int),
+		limits:   make(map[uint64]int64),
+		keys:     make(map[uint64]uint64),
+		retained: make(map[uint64][]_Retained),
+		bytes:    make(map[uint64]int64),
+	}
+}
+
+// reset drops the retained entries of capped topics. The caps and byte limits are kept.
+func (r *_Retention) reset() {
+	r.Lock()
+	defer r.Unlock()
+	r.keys = make(map[uint64]uint64)
+	r.retained = make(map[uint64][]_Retained)
+	r.bytes = make(map[uint64]int64)
+	r.evicted = nil
+}
+
+// MarshalBinary serializes retention caps and byte limits into binary data.
+func (r *_Retention) MarshalBinary() ([]byte, error) {
+	r.RLock()
+	defer r.RUnlock()
+	caps := make([]uint64, 0, len(r.caps))
+	for topicHash := range r.caps {
+		caps = append(caps, topicHash)
+	}
+	sort.Slice(caps, func(i, j int) bool { return caps[i] < caps[j] })
+	limits := make([]uint64, 0, len(r.limits))
+	for topicHash := range r.limits {
+		limits = append(limits, topicHash)
+	}
+	sort.Slice(limits, func(i, j int) bool { return limits[i] < limits[j] })
+
+	buf := make([]byte, 4+retentionSize*len(caps)+4+byteLimitSize*len(limits))
+	binary.LittleEndian.PutUint32(buf[:4], uint32(len(caps)))
+	off := 4
+	for _, topicHash := range caps {
+		binary.LittleEndian.PutUint64(buf[off:off+8], topicHash)
+		binary.LittleEndian.PutUint32(buf[off+8:off+12], uint32(r.caps[topicHash]))
+		off += retentionSize
+	}
+	binary.LittleEndian.PutUint32(buf[off:off+4], uint32(len(limits)))
+	off += 4
+	for _, topicHash := range limits {
+		binary.LittleEndian.PutUint64(buf[off:off+8], topicHash)
+		binary.LittleEndian.PutUint64(buf[off+8:off+16], uint64(r.limits[topicHash]))
+		off += byteLimitSize
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary de-serializes retention caps and byte limits from binary data. DB files written
+// before byte limits were stored have nothing following the caps.
+func (r *_Retention) UnmarshalBinary(data []byte) error {
+	if len(data) < 4 {
+		return errCorrupted
+	}
+	n := int(binary.LittleEndian.Uint32(data[:4]))
+	if len(data) < 4+retentionSize*n {
+		return errCorrupted
+	}
+	r.Lock()
+	defer r.Unlock()
+	off := 4
+	for i := 0; i < n; i++ {
+		r.caps[binary.LittleEndian.Uint64(data[off:off+8])] = int(binary.LittleEndian.Uint32(data[off+8 : off+12]))
+		off += retentionSize
+	}
+	if len(data) < off+4 {
+		return nil
+	}
+	n = int(binary.LittleEndian.Uint32(data[off : off+4]))
+	off += 4
+	if len(data) < off+byteLimitSize*n {
+		return errCorrupted
+	}
+	for i := 0; i < n; i++ {
+		r.limits[binary.LittleEndian.Uint64(data[off:off+8])] = int64(binary.LittleEndian.Uint64(data[off+8 : off+16]))
+		off += byteLimitSize
+	}
+	return nil
+}
+
+// retentionKey returns the hash of the topic under the master contract given its hash under the
+// contract, so that caps set on the topic apply to the topic under any contract. Topic parts are
+// hashed using the contract, so the topic is parsed again from the topic name.
+func (db *DB) retentionKey(topicHash uint64, contract uint32) uint64 {
+	if contract == message.MasterContract {
+		return topicHash
+	}
+	name := db.internal.trie.name(topicHash)
+	if name == nil {
+		return topicHash
+	}
+	t, _, err := db.parseTopic(message.MasterContract, name)
+	if err != nil {
+		return topicHash
+	}
+	t.AddContract(message.MasterContract)
+	return t.GetHash(message.MasterContract)
+}
+
+// capped reports whether the retention key has a retention cap or a byte limit. The caller must
+// hold the retention lock.
+func (r *_Retention) capped(key uint64) bool {
+	_, ok := r.caps[key]
+	if !ok {
+		_, ok = r.limits[key]
+	}
+	return ok
+}
+
+// exceeds reports whether the retained entries of the topic exceed its caps. The newest entry
+// is kept even if its value alone exceeds the byte limit. The caller must hold the retention lock.
+func (r *_Retention) exceeds(topicHash uint64) bool {
+	key := topicHash
+	if k, ok := r.keys[topicHash]; ok {
+		key = k
+	}
+	n := len(r.retained[topicHash])
+	if max, ok := r.caps[key]; ok && n > max {
+		return true
+	}
+	if limit, ok := r.limits[key]; ok && n > 1 && r.bytes[topicHash] > limit {
+		return true
+	}
+	return false
+}
+
+// evict trims the retained entries of the topic to its caps and queues the entries trimmed for
+// deletion. The caller must hold the retention lock.
+func (r *_Retention) evict(topicHash uint64) {
+	for r.exceeds(topicHash) {
+		e := r.retained[topicHash][0]
+		r.evicted = append(r.evicted, _Query{topicHash: topicHash, seq: e.seq})
+		r.retained[topicHash] = r.retained[topicHash][1:]
+		r.bytes[topicHash] -= int64(e.size)
+	}
+}
+
+// track starts tracking the live entries of the topic and evicts the entries beyond the caps.
+// The caller must hold the retention lock.
+func (db *DB) track(topicHash uint64) error {
+	retained, err := db.topicEntries(topicHash)
+	if err != nil {
+		return err
+	}
+	r := db.internal.retention
+	r.retained[topicHash] = retained
+	r.bytes[topicHash] = 0
+	for _, e := range retained {
+		r.bytes[topicHash] += int64(e.size)
+	}
+	r.evict(topicHash)
+	return nil
+}
+
+// retrack evicts the entries beyond the caps of the retention key from the topics tracked under
+// other contracts, or stops tracking these if the key has no caps left. The caller must hold the
+// retention lock.
+func (r *_Retention) retrack(key uint64) {
+	for topicHash, k := range r.keys {
+		if k != key {
+			continue
+		}
+		if r.capped(key) {
+			r.evict(topicHash)
+			continue
+		}
+		delete(r.keys, topicHash)
+		delete(r.retained, topicHash)
+		delete(r.bytes, topicHash)
+	}
+}
+
+// forget stops tracking the live entries of the topics of the retention key and drops entries of
+// these queued for deletion since the evicted queue held n entries. The caller must hold the
+// retention lock.
+func (r *_Retention) forget(key uint64, n int) {
+	evicted := r.evicted[:n]
+	for _, q := range r.evicted[n:] {
+		if q.topicHash == key {
+			continue
+		}
+		if k, ok := r.keys[q.topicHash]; ok && k == key {
+			continue
+		}
+		evicted = append(evicted, q)
+	}
+	r.evicted = evicted
+	for topicHash, k := range r.keys {
+		if k == key {
+			delete(r.keys, topicHash)
+			delete(r.retained, topicHash)
+			delete(r.bytes, topicHash)
+		}
+	}
+	delete(r.retained, key)
+	delete(r.bytes, key)
+}
+
+// untrack stops tracking the live entries of the topic if it has no caps left. The caller must
+// hold the retention lock.
+func (r *_Retention) untrack(topicHash uint64) {
+	if r.capped(topicHash) {
+		return
+	}
+	delete(r.retained, topicHash)
+	delete(r.bytes, topicHash)
+}
+
+// retain adds the entry put to the topic under the contract if the topic has a retention cap or
+// a byte limit, and queues the oldest entries beyond the caps for deletion.
+func (db *DB) retain(topicHash uint64, contract uint32, seq uint64, size uint32) {
+	r := db.internal.retention
+	r.RLock()
+	key, ok := r.keys[topicHash]
+	capped := len(r.caps) != 0 || len(r.limits) != 0
+	r.RUnlock()
+	if !capped {
+		return
+	}
+	if !ok {
+		key = db.retentionKey(topicHash, contract)
+	}
+	r.RLock()
+	capped = r.capped(key)
+	r.RUnlock()
+	if !capped {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.retained[topicHash]; !ok {
+		if key != topicHash {
+			r.keys[topicHash] = key
+		}
+		// The entries of the topic are looked up on the first put after the DB is opened,
+		// and these include the entry just put.
+		if err := db.track(topicHash); err != nil {
+			logger.Error().Err(err).Str("context", "db.retain")
+		}
+		return
+	}
+	retained := r.retained[topicHash]
+	i := sort.Search(len(retained), func(i int) bool { return retained[i].seq >= seq })
+	if i < len(retained) && retained[i].seq == seq {
+		return
+	}
+	// An entry put using Entry.WithSeq can precede entries put earlier.
+	retained = append(retained, _Retained{})
+	copy(retained[i+1:], retained[i:])
+	retained[i] = _Retained{seq: seq, size: size}
+	r.retained[topicHash] = retained
+	r.bytes[topicHash] += int64(size)
+	r.evict(topicHash)
+}
+
+// topicEntries returns the live entries of the topic in sequence order.
+func (db *DB) topicEntries(topicHash uint64) ([]_Retained, error) {
+	var wEntries _WindowEntries
+	if off, ok := db.internal.trie.getOffset(topicHash); ok {
+		wEntries = db.internal.timeWindow.lookup(db.fs, topicHash, off, 0, 0, math.MaxInt32)
+	} else {
+		wEntries = db.internal.timeWindow.ilookup(topicHash, 0, math.MaxInt32)
+	}
+	uniq := make(map[uint64]struct{}, len(wEntries))
+	for _, we := range wEntries {
+		uniq[we.seq()] = struct{}{}
+	}
+	retained := make([]_Retained, 0, len(uniq))
+	for seq := range uniq {
+		e, err := db.readEntry(_Query{seq: seq})
+		if err == errMsgIDDeleted {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		retained = append(retained, _Retained{seq: seq, size: e.valueSize})
+	}
+	sort.Slice(retained, func(i, j int) bool { return retained[i].seq < retained[j].seq })
+	return retained, nil
+}
+
+// deleteEvicted deletes entries evicted by retention caps and frees their blocks the same as
+// expiry does. The topic is stored along with the first entry put to it, so the topic is kept in
+// the info file before that entry is deleted. The caller must hold the sync lock.
+func (db *DB) deleteEvicted() error {
+	r := db.internal.retention
+	r.Lock()
+	evicted := r.evicted
+	r.evicted = nil
+	r.Unlock()
+	if len(evicted) == 0 || db.opts.flags.immutable {
+		return nil
+	}
+	w, err := newBlockWriter(db.fs, db.internal.freeList, nil)
+	if err != nil {
+		return err
+	}
+	for _, q := range evicted {
+		e, err := db.readEntry(q)
+		switch {
+		case err == errMsgIDDeleted:
+			continue
+		case err != nil:
+			return err
+		}
+		if e.topicSize != 0 {
+			rawTopic, err := db.internal.reader.readTopic(e)
+			if err != nil {
+				return err
+			}
+			if err := db.storeTopic(q.topicHash, rawTopic); err != nil {
+				return err
+			}
+		}
+		db.internal.meter.Dels.Inc(1)
+		db.internal.mem.Delete(q.seq)
+		if !db.internal.filter.Test(q.seq) {
+			continue
+		}
+		if e, err = w.del(q.seq); err != nil {
+			return err
+		}
+		if e.seq == 0 {
+			continue
+		}
+		db.internal.freeList.free(e.seq, e.msgOffset, e.mSize())
+		db.decount(1)
+	}
+	return nil
+}
+
+// readRetention reads retention caps and byte limits stored in the info file following the
+// contracts. DB files written before retention caps were stored have nothing following the contracts.
+func (db *DB) readRetention(off int64) error {
+	size := db.internal.info.currSize() - off
+	if size <= 0 {
+		return nil
+	}
+	return db.internal.info.readUnmarshalableAt(db.internal.retention, uint32(size), off)
+}
@@ -0,0 +1,258 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxPendingMessages is the number of messages queued for a subscriber reading its channel slower
+// than messages are put. The subscription is canceled once more messages are queued so a stalled
+// subscriber does not hold memory without bound.
+var maxPendingMessages = 1 << 16
+
+type (
+	// _Subscriber delivers messages put to topics matching the query of a subscription.
+	_Subscriber struct {
+		q  *Query
+		ch chan Message
+
+		mu      sync.Mutex
+		matches map[uint64]bool // The matches caches if a topic hash matches the query.
+		pending []_Query        // The pending are window entries put since the last delivery.
+
+		ackTimeout time.Duration
+		inFlight   map[uint64]_InFlight // The inFlight are messages delivered but not acknowledged.
+
+		notifyC chan struct{}
+		doneC   chan struct{}
+		once    sync.Once
+	}
+
+	// _InFlight is a message delivered to the subscriber and the time it is redelivered at unless acknowledged.
+	_InFlight struct {
+		msg      Message
+		deadline time.Time
+	}
+
+	_Subscribers struct {
+		sync.RWMutex
+		subs map[*_Subscriber]struct{}
+	}
+)
+
+// subscribe registers the subscriber so it is notified of entries put to the DB.
+func (s *_Subscribers) subscribe(sub *_Subscriber) {
+	s.Lock()
+	defer s.Unlock()
+	if s.subs == nil {
+		s.subs = make(map[*_Subscriber]struct{})
+	}
+	s.subs[sub] = struct{}{}
+}
+
+// unsubscribe unregisters the subscriber and stops its delivery.
+func (s *_Subscribers) unsubscribe(sub *_Subscriber) {
+	s.Lock()
+	delete(s.subs, sub)
+	s.Unlock()
+	sub.once.Do(func() {
+		close(sub.doneC)
+	})
+}
+
+// ack stops tracking the message so it is not redelivered.
+func (sub *_Subscriber) ack(seq uint64) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	delete(sub.inFlight, seq)
+}
+
+// nack marks the message for redelivery and wakes the subscriber.
+func (sub *_Subscriber) nack(seq uint64) {
+	sub.mu.Lock()
+	f, ok := sub.inFlight[seq]
+	if ok {
+		f.deadline = time.Time{}
+		sub.inFlight[seq] = f
+	}
+	sub.mu.Unlock()
+	if ok {
+		sub.wake()
+	}
+}
+
+// wake signals the subscriber without blocking if it is already signaled.
+func (sub *_Subscriber) wake() {
+	select {
+	case sub.notifyC <- struct{}{}:
+	default:
+	}
+}
+
+// expired returns messages in flight past their deadline in sequence order.
+func (sub *_Subscriber) expired(now time.Time) []Message {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	var msgs []Message
+	for _, f := range sub.inFlight {
+		if !f.deadline.After(now) {
+			msgs = append(msgs, f.msg)
+		}
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Seq < msgs[j].Seq
+	})
+	return msgs
+}
+
+// notify queues the window entry of a message put to the topic for subscribers matching the topic.
+// It does not block on subscribers reading their channel, and it cancels subscriptions having
+// maxPendingMessages messages queued.
+func (db *DB) notify(topicHash, seq uint64, expiresAt uint32) {
+	s := &db.internal.subscribers
+	s.RLock()
+	defer s.RUnlock()
+	for sub := range s.subs {
+		sub.mu.Lock()
+		ok, cached := sub.matches[topicHash]
+		if !cached {
+			ok = db.matchTopic(sub.q, topicHash)
+			sub.matches[topicHash] = ok
+		}
+		if ok && len(sub.pending) >= maxPendingMessages {
+			// the subscriber is removed once its delivery stops.
+			sub.once.Do(func() {
+				close(sub.doneC)
+			})
+			ok = false
+		}
+		if ok {
+			sub.pending = append(sub.pending, _Query{topicHash: topicHash, seq: seq, expiresAt: expiresAt})
+		}
+		sub.mu.Unlock()
+		if ok {
+			sub.wake()
+		}
+	}
+}
+
+// matchTopic reports whether the topic of the topic hash matches the parsed query.
+// The topic must be added to the trie before it is matched.
+func (db *DB) matchTopic(q *Query, topicHash uint64) bool {
+	var topics _Topics
+	if q.internal.regex != nil {
+		topics = db.internal.trie.regex(q.internal.parts, q.internal.regex)
+	} else {
+		topics = db.internal.trie.lookup(q.internal.parts, q.internal.depth, q.internal.topicType)
+	}
+	if len(q.internal.exclusions) != 0 {
+		topics = db.internal.trie.exclude(topics, q.internal.exclusions)
+	}
+	for _, topic := range topics {
+		if topic.hash == topicHash {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver streams messages of the prepared query and then messages put since the subscription
+// until the subscription is canceled or the DB is closed.
+func (db *DB) deliver(sub *_Subscriber) {
+	defer db.internal.closeW.Done()
+	defer close(sub.ch)
+	defer db.internal.subscribers.unsubscribe(sub)
+
+	// messages put while existing messages are read are notified as well so these are not sent twice.
+	sent := make(map[uint64]struct{})
+	if err := db.readQuery(sub.q, func(m Message) error {
+		sent[m.Seq] = struct{}{}
+		return db.send(sub, m)
+	}); err != nil {
+		return
+	}
+	mu := db.internal.mutex.getMutex(sub.q.internal.prefix)
+	var redeliverC <-chan time.Time
+	if sub.ackTimeout > 0 {
+		ticker := time.NewTicker(sub.ackTimeout)
+		defer ticker.Stop()
+		redeliverC = ticker.C
+	}
+	for {
+		select {
+		case <-sub.notifyC:
+		case <-redeliverC:
+		case <-sub.doneC:
+			return
+		case <-db.internal.closeC:
+			return
+		}
+		sub.mu.Lock()
+		pending := sub.pending
+		sub.pending = nil
+		sub.mu.Unlock()
+		for _, query := range pending {
+			if _, ok := sent[query.seq]; ok {
+				delete(sent, query.seq)
+				continue
+			}
+			mu.RLock()
+			m, err := db.readMessage(sub.q, query)
+			mu.RUnlock()
+			if err == errMsgIDDeleted || err == errMsgIDPrefixMismatch {
+				continue
+			}
+			if err != nil {
+				logger.Error().Err(err).Str("context", "db.deliver")
+				return
+			}
+			if err := db.send(sub, m); err != nil {
+				return
+			}
+		}
+		if sub.ackTimeout == 0 {
+			continue
+		}
+		for _, m := range sub.expired(time.Now()) {
+			if err := db.send(sub, m); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// send sends the message to the subscriber channel unless the subscription is canceled or the DB is closed.
+// If the subscription tracks acknowledgements the message is in flight until it is acknowledged.
+func (db *DB) send(sub *_Subscriber, m Message) error {
+	if sub.ackTimeout > 0 {
+		m.sub = sub
+		sub.mu.Lock()
+		sub.inFlight[m.Seq] = _InFlight{msg: m, deadline: time.Now().Add(sub.ackTimeout)}
+		sub.mu.Unlock()
+	}
+	select {
+	case sub.ch <- m:
+		return nil
+	case <-sub.doneC:
+		return errClosed
+	case <-db.internal.closeC:
+		return errClosed
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/unit-io/unitdb/hash"
@@ -30,6 +31,11 @@ type (
 		sequence  uint64
 		expiresAt uint32
 	}
+	// _ExpiryEntry is the window entry of a topic added to the expiry window.
+	_ExpiryEntry struct {
+		_WinEntry
+		topicHash uint64
+	}
 	_WinBlock struct {
 		topicHash uint64
 		entries   [entriesPerWindowBlock]_WinEntry
@@ -110,6 +116,7 @@ type (
 		expDurationType     time.Duration
 		maxExpDurations     int
 		backgroundKeyExpiry bool
+		shards              int
 	}
 	_TimeWindowBucket struct {
 		sync.RWMutex
@@ -139,13 +146,13 @@ type _WindowBlocks struct {
 }
 
 // newWindowBlocks creates a new concurrent windows.
-func newWindowBlocks() *_WindowBlocks {
+func newWindowBlocks(shards int) *_WindowBlocks {
 	wb := &_WindowBlocks{
-		window:     make([]*_TimeWindow, nShards),
-		consistent: hash.InitConsistent(nShards, nShards),
+		window:     make([]*_TimeWindow, shards),
+		consistent: hash.InitConsistent(shards, shards),
 	}
 
-	for i := 0; i < nShards; i++ {
+	for i := 0; i < shards; i++ {
 		wb.window[i] = &_TimeWindow{entries: make(map[_Key]_WindowEntries)}
 	}
 
@@ -161,11 +168,29 @@ func (w *_WindowBlocks) getWindowBlock(blockID uint64) *_TimeWindow {
 
 func newTimeWindowBucket(opts *_TimeOptions) *_TimeWindowBucket {
 	l := &_TimeWindowBucket{timeIDs: make(map[int64]struct{})}
-	l.windowBlocks = newWindowBlocks()
+	l.windowBlocks = newWindowBlocks(opts.shards)
 	l.expiryWindowBucket = newExpiryWindowBucket(opts.backgroundKeyExpiry, opts.expDurationType, opts.maxExpDurations)
 	return l
 }
 
+// reset drops window entries not yet written to the window file and entries waiting to expire.
+func (tw *_TimeWindowBucket) reset() {
+	tw.Lock()
+	defer tw.Unlock()
+	tw.timeIDs = make(map[int64]struct{})
+	for _, w := range tw.windowBlocks.window {
+		w.mu.Lock()
+		w.entries = make(map[_Key]_WindowEntries)
+		w.mu.Unlock()
+	}
+	for _, ew := range tw.expiryWindowBucket.expiryWindows.expiry {
+		ew.mu.Lock()
+		ew.windows = make(map[int64]_ExpiryWindowEntries)
+		ew.mu.Unlock()
+	}
+	atomic.StoreInt64(&tw.expiryWindowBucket.earliestExpiryHash, 0)
+}
+
 func (tw *_TimeWindowBucket) add(timeID int64, topicHash uint64, e _WinEntry) (ok bool) {
 	// get windowBlock shard.
 	tw.RLock()
@@ -189,7 +214,7 @@ func (tw *_TimeWindowBucket) add(timeID int64, topicHash uint64, e _WinEntry) (o
 }
 func (tw *_TimeWindowBucket) release() func(timeID int64) error {
 	releasedKeys := make(map[int64][]_Key)
-	for i := 0; i < nShards; i++ {
+	for i := range tw.windowBlocks.window {
 		wb := tw.windowBlocks.window[i]
 		wb.mu.RLock()
 		for k := range wb.entries {
@@ -203,10 +228,9 @@ func (tw *_TimeWindowBucket) release() func(timeID int64) error {
 	}
 
 	return func(timeID int64) error {
-		keys, ok := releasedKeys[timeID]
-		if !ok {
-			return errBadRequest
-		}
+		// A block with no window entries in the snapshot, such as a block of entries
+		// recovered from the log, has nothing to release.
+		keys := releasedKeys[timeID]
 		for _, k := range keys {
 			b := tw.windowBlocks.getWindowBlock(k.topicHash)
 			b.mu.Lock()
@@ -219,46 +243,43 @@ func (tw *_TimeWindowBucket) release() func(timeID int64) error {
 }
 
 // ilookup lookups window entries from timeWindowBucket and not yet sync to DB.
-func (tw *_TimeWindowBucket) ilookup(topicHash uint64, limit int) (winEntries _WindowEntries) {
+// Entries with sequence greater than or equal to the before bound are skipped if before is non zero.
+func (tw *_TimeWindowBucket) ilookup(topicHash uint64, before uint64, limit int) (winEntries _WindowEntries) {
 	winEntries = make([]_WinEntry, 0)
 	// get windowBlock shard.
 	b := tw.windowBlocks.getWindowBlock(topicHash)
 	b.mu.RLock()
 	defer b.mu.RUnlock()
-	var l int
-	var expiryCount int
 
 	for key := range b.entries {
 		if key.topicHash != topicHash {
 			continue
 		}
 		wEntries := b.entries[key]
-		if len(wEntries) > 0 {
-			l = limit + expiryCount - l
-			if len(wEntries) < l {
-				l = len(wEntries)
+		var l int
+		for i := len(wEntries) - 1; i >= 0 && l < limit; i-- {
+			we := wEntries[i]
+			if before != 0 && we.seq() >= before {
+				continue
 			}
-			for i := len(wEntries) - 1; i >= len(wEntries)-l; i-- {
-				we := wEntries[i]
-				if we.isExpired() {
-					if err := tw.expiryWindowBucket.addExpiry(we); err != nil {
-						expiryCount++
-						logger.Error().Err(err).Str("context", "timeWindow.addExpiry")
-					}
-					// if id is expired it does not return an error but continue the iteration.
-					continue
+			if we.isExpired() {
+				if err := tw.expiryWindowBucket.addExpiry(_ExpiryEntry{_WinEntry: we, topicHash: topicHash}); err != nil {
+					logger.Error().Err(err).Str("context", "timeWindow.addExpiry")
 				}
-				winEntries = append(winEntries, we)
+				// if id is expired it does not return an error but continue the iteration.
+				continue
 			}
+			winEntries = append(winEntries, we)
+			l++
 		}
 	}
 	return winEntries
 }
 
 // lookup lookups window entries from window file.
-func (tw *_TimeWindowBucket) lookup(fs *_FileSet, topicHash uint64, off, cutoff int64, limit int) (winEntries _WindowEntries) {
+func (tw *_TimeWindowBucket) lookup(fs *_FileSet, topicHash uint64, off, cutoff int64, before uint64, limit int) (winEntries _WindowEntries) {
 	winEntries = make([]_WinEntry, 0)
-	winEntries = tw.ilookup(topicHash, limit)
+	winEntries = tw.ilookup(topicHash, before, limit)
 	if len(winEntries) >= limit {
 		return winEntries
 	}
@@ -277,47 +298,40 @@ func (tw *_TimeWindowBucket) lookup(fs *_FileSet, topicHash uint64, off, cutoff
 				return err
 			}
 			if b.next == 0 {
-				return nil
+				// A block chained to the first block of the window file has zero next offset, the
+				// same as the last block of a topic, so the first block is read if it is of the topic.
+				if blockOff == 0 {
+					return nil
+				}
+				r := _WindowReader{winFile: winFile, offset: 0}
+				if first, err := r.readWindowBlock(); err != nil || first.topicHash != topicHash {
+					return nil
+				}
 			}
 			blockOff = b.next
 		}
 	}
-	expiryCount := 0
 	err = next(off, func(curb _WinBlock) (bool, error) {
 		b := &curb
 		if b.topicHash != topicHash {
 			return true, nil
 		}
-		if len(winEntries) > limit-int(b.entryIdx) {
-			limit = limit - len(winEntries)
-			for i := len(b.entries[:b.entryIdx]) - 1; i >= len(b.entries[:b.entryIdx])-limit; i-- {
-				we := b.entries[i]
-				if we.isExpired() {
-					if err := tw.expiryWindowBucket.addExpiry(we); err != nil {
-						expiryCount++
-						logger.Error().Err(err).Str("context", "timeWindow.addExpiry")
-					}
-					// if id is expired it does not return an error but continue the iteration.
-					continue
-				}
-				winEntries = append(winEntries, we)
-			}
-			if len(winEntries) >= limit {
-				return true, nil
-			}
-		}
 		for i := len(b.entries[:b.entryIdx]) - 1; i >= 0; i-- {
 			we := b.entries[i]
+			if before != 0 && we.seq() >= before {
+				continue
+			}
 			if we.isExpired() {
-				if err := tw.expiryWindowBucket.addExpiry(we); err != nil {
-					expiryCount++
+				if err := tw.expiryWindowBucket.addExpiry(_ExpiryEntry{_WinEntry: we, topicHash: topicHash}); err != nil {
 					logger.Error().Err(err).Str("context", "timeWindow.addExpiry")
 				}
 				// if id is expired it does not return an error but continue the iteration.
 				continue
 			}
 			winEntries = append(winEntries, we)
-
+			if len(winEntries) >= limit {
+				return true, nil
+			}
 		}
 		if b.cutoff(cutoff) {
 			return true, nil
@@ -53,7 +53,15 @@ func (r *_WindowReader) readWindowBlock() (_WinBlock, error) {
 }
 
 // foreachWindowBlock iterates winBlocks on DB init to store topic hash and last offset of topic into trie.
+// Blocks of a topic are appended to the window file in order, so topics are reported in the order of their
+// first block along with the offset of their last block.
 func (r *_WindowReader) foreachWindowBlock(f func(startSeq, topicHash uint64, off int64) (bool, error)) (err error) {
+	type _TopicBlock struct {
+		startSeq, topicHash uint64
+		off                 int64
+	}
+	var topics []_TopicBlock
+	idx := make(map[uint64]int) // map[topicHash]index of topic
 	windowIdx := int32(0)
 	nBlocks := r.windowIdx
 	for windowIdx <= nBlocks {
@@ -61,16 +69,27 @@ func (r *_WindowReader) foreachWindowBlock(f func(startSeq, topicHash uint64, of
 		b, err := r.readWindowBlock()
 		if err != nil {
 			if err == io.EOF {
-				return nil
+				break
 			}
 			return err
 		}
 		windowIdx++
-		if b.entryIdx == 0 || b.next != 0 {
+		if b.entryIdx == 0 {
+			continue
+		}
+		if i, ok := idx[b.topicHash]; ok {
+			topics[i].off = r.offset
 			continue
 		}
-		// fmt.Println("timeWindow.foreachTimeBlock: topicHash, seq ", b.topicHash, b.entries[0].sequence)
-		if stop, err := f(b.entries[0].sequence, b.topicHash, r.offset); stop || err != nil {
+		if b.next != 0 {
+			continue
+		}
+		idx[b.topicHash] = len(topics)
+		topics = append(topics, _TopicBlock{startSeq: b.entries[0].sequence, topicHash: b.topicHash, off: r.offset})
+	}
+	for _, t := range topics {
+		// fmt.Println("timeWindow.foreachTimeBlock: topicHash, seq ", t.topicHash, t.startSeq)
+		if stop, err := f(t.startSeq, t.topicHash, t.off); stop || err != nil {
 			return err
 		}
 	}
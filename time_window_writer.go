@@ -49,34 +49,18 @@ func newWindowWriter(fs *_FileSet, buf *bpool.Buffer) (*_WindowWriter, error) {
 	return w, nil
 }
 
-func (w *_WindowWriter) del(seq uint64, winIdx int32) error {
-	r := _WindowReader{winFile: w.winFile, offset: winBlockOffset(winIdx)}
-	b, err := r.readWindowBlock()
-	if err != nil {
-		return err
-	}
-	entryIdx := -1
-	for i := 0; i < int(b.entryIdx); i++ {
-		e := b.entries[i]
-		if e.sequence == seq { //record exist in db.
-			entryIdx = i
-			break
-		}
+// isFirstBlock reports whether the first window block belongs to the topic. The first block is at
+// offset zero, the same as the offset of a topic not yet written to the window file.
+func (w *_WindowWriter) isFirstBlock(topicHash uint64) bool {
+	if b, ok := w.winBlocks[0]; ok {
+		return b.topicHash == topicHash
 	}
-	if entryIdx == -1 {
-		return nil // no entry in db to delete.
+	if w.offset == 0 {
+		return false
 	}
-	b.dirty = true
-	b.entryIdx--
-
-	i := entryIdx
-	for ; i < entriesPerIndexBlock-1; i++ {
-		b.entries[i] = b.entries[i+1]
-	}
-	b.entries[i] = _WinEntry{}
-
-	w.winBlocks[winIdx] = b
-	return nil
+	r := _WindowReader{winFile: w.winFile, offset: 0}
+	b, err := r.readWindowBlock()
+	return err == nil && b.topicHash == topicHash
 }
 
 // append appends window entries to buffer.
@@ -84,14 +68,15 @@ func (w *_WindowWriter) append(topicHash uint64, off int64, wEntries _WindowEntr
 	var b _WinBlock
 	var ok bool
 	var wIdx int32
-	if off == 0 {
+	written := off > 0 || w.isFirstBlock(topicHash)
+	if !written {
 		w.windowIdx++
 		wIdx = w.windowIdx
 	} else {
 		wIdx = int32(off / int64(blockSize))
 	}
 	b, ok = w.winBlocks[wIdx]
-	if !ok && off > 0 {
+	if !ok && written {
 		if wIdx <= w.windowIdx {
 			r := _WindowReader{winFile: w.winFile, offset: off}
 			b, err = r.readWindowBlock()
@@ -193,19 +178,41 @@ func (w *_WindowWriter) write() error {
 	return nil
 }
 
+// rollback removes the entries appended to the window blocks written before.
 func (w *_WindowWriter) rollback() error {
 	for bIdx, seqs := range w.winLeases {
+		r := _WindowReader{winFile: w.winFile, offset: winBlockOffset(bIdx)}
+		b, err := r.readWindowBlock()
+		if err != nil {
+			return err
+		}
+		leased := make(map[uint64]struct{}, len(seqs))
 		for _, seq := range seqs {
-			if err := w.del(seq, bIdx); err != nil {
-				return err
+			leased[seq] = struct{}{}
+		}
+		n := 0
+		for i := 0; i < int(b.entryIdx); i++ {
+			if _, ok := leased[b.entries[i].sequence]; ok {
+				continue
 			}
+			b.entries[n] = b.entries[i]
+			n++
+		}
+		for i := n; i < int(b.entryIdx); i++ {
+			b.entries[i] = _WinEntry{}
+		}
+		b.entryIdx = uint16(n)
+		if _, err := w.winFile.WriteAt(b.marshalBinary(), winBlockOffset(bIdx)); err != nil {
+			return err
 		}
+		delete(w.winBlocks, bIdx)
 	}
 	return nil
 }
 
 func (w *_WindowWriter) reset() error {
 	w.buffer.Reset()
+	w.winLeases = make(map[int32][]uint64)
 	w.offset = w.winFile.currSize()
 
 	return nil
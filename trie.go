@@ -17,6 +17,9 @@
 package unitdb
 
 import (
+	"bytes"
+	"regexp"
+	"sort"
 	"sync"
 
 	"github.com/unit-io/unitdb/message"
@@ -58,6 +61,7 @@ type _Part struct {
 type _Node struct {
 	part     _Part
 	depth    uint8
+	name     []byte // name is the topic string of the node if a topic was added to the node.
 	parent   *_Node
 	children map[_Part]*_Node
 	topics   _Topics
@@ -69,7 +73,7 @@ func (n *_Node) orphan() {
 	}
 
 	delete(n.parent.children, n.part)
-	if len(n.parent.children) == 0 {
+	if len(n.parent.children) == 0 && len(n.parent.topics) == 0 {
 		n.parent.orphan()
 	}
 }
@@ -95,17 +99,27 @@ type _Trie struct {
 	sync.RWMutex
 	mutex     _Mutex
 	topicTrie *_TopicTrie
+	// encryption is the encryption policy by topic hash. A policy can be set before the topic is added.
+	encryption map[uint64]uint8
 }
 
 // newTrie new trie creates a Trie with an initialized Trie.
 // Mutex is used to lock concurent read/write on a contract, and it does not lock entire trie.
 func newTrie() *_Trie {
 	return &_Trie{
-		mutex:     newMutex(),
-		topicTrie: newTopicTrie(),
+		mutex:      newMutex(),
+		topicTrie:  newTopicTrie(),
+		encryption: make(map[uint64]uint8),
 	}
 }
 
+// reset drops all topics from the Trie. Encryption policies are kept.
+func (t *_Trie) reset() {
+	t.Lock()
+	defer t.Unlock()
+	t.topicTrie = newTopicTrie()
+}
+
 // Count returns the number of topics in the Trie.
 func (t *_Trie) Count() int {
 	t.RLock()
@@ -114,7 +128,7 @@ func (t *_Trie) Count() int {
 }
 
 // add adds a topic to trie.
-func (t *_Trie) add(topic _Topic, parts []message.Part, depth uint8) (added bool) {
+func (t *_Trie) add(topic _Topic, parts []message.Part, depth uint8, name []byte) (added bool) {
 	// Get mutex
 	mu := t.mutex.getMutex(topic.hash)
 	mu.Lock()
@@ -145,6 +159,9 @@ func (t *_Trie) add(topic _Topic, parts []message.Part, depth uint8) (added bool
 	}
 	t.Lock()
 	curr.topics.addUnique(topic)
+	if curr.name == nil && len(name) > 0 {
+		curr.name = append([]byte{}, name...)
+	}
 	t.topicTrie.summary[topic.hash] = curr
 	t.Unlock()
 	added = true
@@ -152,6 +169,30 @@ func (t *_Trie) add(topic _Topic, parts []message.Part, depth uint8) (added bool
 	return
 }
 
+// remove removes a topic from trie and removes the node if it has no topics and children.
+func (t *_Trie) remove(topicHash uint64) (removed bool) {
+	mu := t.mutex.getMutex(topicHash)
+	mu.Lock()
+	defer mu.Unlock()
+	t.Lock()
+	defer t.Unlock()
+	curr, ok := t.topicTrie.summary[topicHash]
+	if !ok {
+		return false
+	}
+	for i, topic := range curr.topics {
+		if topic.hash == topicHash {
+			curr.topics = append(curr.topics[:i], curr.topics[i+1:]...)
+			break
+		}
+	}
+	delete(t.topicTrie.summary, topicHash)
+	if len(curr.topics) == 0 && len(curr.children) == 0 {
+		curr.orphan()
+	}
+	return true
+}
+
 // lookup returns window entry set for given topic.
 func (t *_Trie) lookup(query []message.Part, depth, topicType uint8) (tops _Topics) {
 	t.RLock()
@@ -160,6 +201,29 @@ func (t *_Trie) lookup(query []message.Part, depth, topicType uint8) (tops _Topi
 	return
 }
 
+// lookupBatch returns topics for each of the given queries in a single read lock of the trie.
+// Queries with identical parts, depth and topic type share the result of one traversal.
+func (t *_Trie) lookupBatch(qs []*Query) []_Topics {
+	results := make([]_Topics, len(qs))
+	seen := make(map[string]int, len(qs))
+	t.RLock()
+	defer t.RUnlock()
+	for i, q := range qs {
+		if q.internal.regex != nil {
+			t.iregex(q.internal.parts, q.internal.regex, &results[i])
+			continue
+		}
+		key := q.internal.lookupKey()
+		if j, ok := seen[key]; ok {
+			results[i] = results[j]
+			continue
+		}
+		t.ilookup(q.internal.parts, q.internal.depth, q.internal.topicType, &results[i], t.topicTrie.root)
+		seen[key] = i
+	}
+	return results
+}
+
 func (t *_Trie) ilookup(query []message.Part, depth, topicType uint8, tops *_Topics, currNode *_Node) {
 	// Add topics from the current branch.
 	if currNode.depth == depth || (topicType == message.TopicStatic && currNode.part.hash == message.Wildcard) {
@@ -187,6 +251,201 @@ func (t *_Trie) ilookup(query []message.Part, depth, topicType uint8, tops *_Top
 	}
 }
 
+// match returns topics in the trie matching the wildcard topic. Unlike lookup, it matches
+// the wildcard parts of the query with the static topics stored in the trie.
+func (t *_Trie) match(query []message.Part, depth uint8) (tops _Topics) {
+	t.RLock()
+	defer t.RUnlock()
+	t.imatch(query, depth, &tops, t.topicTrie.root)
+	return
+}
+
+func (t *_Trie) imatch(query []message.Part, depth uint8, tops *_Topics, currNode *_Node) {
+	if len(query) == 0 {
+		if currNode.depth == depth {
+			for _, topic := range currNode.topics {
+				tops.addUnique(topic)
+			}
+		}
+		return
+	}
+
+	q := query[0]
+	// Multi level wildcard matches all topics under the current branch.
+	if q.Hash == message.Wildcard {
+		t.isubtree(tops, currNode)
+		return
+	}
+	for part, n := range currNode.children {
+		if part.hash == q.Hash && part.wildchars == 0 {
+			t.iskip(query[1:], depth, q.Wildchars, tops, n)
+		}
+	}
+}
+
+// iskip skips the levels of single level wildcards and matches remaining query.
+func (t *_Trie) iskip(query []message.Part, depth, wildchars uint8, tops *_Topics, currNode *_Node) {
+	if wildchars == 0 {
+		t.imatch(query, depth, tops, currNode)
+		return
+	}
+	for part, n := range currNode.children {
+		if part.wildchars == 0 {
+			t.iskip(query, depth, wildchars-1, tops, n)
+		}
+	}
+}
+
+func (t *_Trie) isubtree(tops *_Topics, currNode *_Node) {
+	for _, topic := range currNode.topics {
+		tops.addUnique(topic)
+	}
+	for _, n := range currNode.children {
+		t.isubtree(tops, n)
+	}
+}
+
+// regex returns topics under the query prefix whose topic string matches the regular expression.
+func (t *_Trie) regex(query []message.Part, regex *regexp.Regexp) (tops _Topics) {
+	t.RLock()
+	defer t.RUnlock()
+	t.iregex(query, regex, &tops)
+	return
+}
+
+func (t *_Trie) iregex(query []message.Part, regex *regexp.Regexp, tops *_Topics) {
+	if n := len(query); n == 0 || query[n-1].Hash != message.Wildcard {
+		query = append(query[:n:n], message.Part{Hash: message.Wildcard})
+	}
+	var candidates _Topics
+	t.imatch(query, message.TopicMaxDepth, &candidates, t.topicTrie.root)
+	for _, topic := range candidates {
+		if curr, ok := t.topicTrie.summary[topic.hash]; ok && curr.name != nil && regex.Match(curr.name) {
+			tops.addUnique(topic)
+		}
+	}
+}
+
+// exclude returns the topics without the excluded topics and topics matching the excluded wildcard topics.
+func (t *_Trie) exclude(tops _Topics, exclusions []_Exclusion) _Topics {
+	t.RLock()
+	defer t.RUnlock()
+	excluded := make(map[uint64]struct{})
+	for _, ex := range exclusions {
+		excluded[ex.hash] = struct{}{}
+		var matched _Topics
+		t.imatch(ex.parts, ex.depth, &matched, t.topicTrie.root)
+		for _, topic := range matched {
+			excluded[topic.hash] = struct{}{}
+		}
+	}
+	kept := make(_Topics, 0, len(tops))
+	for _, topic := range tops {
+		if _, ok := excluded[topic.hash]; !ok {
+			kept = append(kept, topic)
+		}
+	}
+	return kept
+}
+
+// names returns topic strings of topics matching the query in sorted order. Topics added without
+// the topic string are not returned.
+func (t *_Trie) names(query []message.Part, depth uint8) [][]byte {
+	t.RLock()
+	defer t.RUnlock()
+	var tops _Topics
+	t.imatch(query, depth, &tops, t.topicTrie.root)
+	seen := make(map[*_Node]struct{}, len(tops))
+	var names [][]byte
+	for _, topic := range tops {
+		curr, ok := t.topicTrie.summary[topic.hash]
+		if !ok || curr.name == nil {
+			continue
+		}
+		if _, ok := seen[curr]; ok {
+			continue
+		}
+		seen[curr] = struct{}{}
+		names = append(names, append([]byte{}, curr.name...))
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return bytes.Compare(names[i], names[j]) < 0
+	})
+	return names
+}
+
+// name returns topic string of the topic, or nil if the topic was added without the topic string.
+func (t *_Trie) name(topicHash uint64) []byte {
+	t.RLock()
+	defer t.RUnlock()
+	if curr, ok := t.topicTrie.summary[topicHash]; ok {
+		return curr.name
+	}
+	return nil
+}
+
+// topics returns all topics in the trie.
+func (t *_Trie) topics() _Topics {
+	t.RLock()
+	defer t.RUnlock()
+	tops := make(_Topics, 0, len(t.topicTrie.summary))
+	for hash, curr := range t.topicTrie.summary {
+		for _, topic := range curr.topics {
+			if topic.hash == hash {
+				tops = append(tops, topic)
+			}
+		}
+	}
+	return tops
+}
+
+// getEncryption returns encryption policy of the topic.
+func (t *_Trie) getEncryption(topicHash uint64) uint8 {
+	t.RLock()
+	defer t.RUnlock()
+	return t.encryption[topicHash]
+}
+
+// hasEncryption reports whether an encryption policy is set on any topic.
+func (t *_Trie) hasEncryption() bool {
+	t.RLock()
+	defer t.RUnlock()
+	return len(t.encryption) != 0
+}
+
+// setEncryption sets encryption policy of the topic.
+func (t *_Trie) setEncryption(topicHash uint64, policy uint8) {
+	t.Lock()
+	defer t.Unlock()
+	if policy == message.EncryptionDefault {
+		delete(t.encryption, topicHash)
+		return
+	}
+	t.encryption[topicHash] = policy
+}
+
+// initEncryption sets encryption policy of the topic loaded from the stored topic unless a policy is
+// already set. Policies read from the info file take precedence over policies stored with topics.
+func (t *_Trie) initEncryption(topicHash uint64, policy uint8) {
+	t.Lock()
+	defer t.Unlock()
+	if _, ok := t.encryption[topicHash]; ok || policy == message.EncryptionDefault {
+		return
+	}
+	t.encryption[topicHash] = policy
+}
+
+// encryptionPolicies returns a copy of encryption policies by topic hash.
+func (t *_Trie) encryptionPolicies() _Policies {
+	t.RLock()
+	defer t.RUnlock()
+	policies := make(_Policies, len(t.encryption))
+	for topicHash, policy := range t.encryption {
+		policies[topicHash] = policy
+	}
+	return policies
+}
+
 func (t *_Trie) getOffset(topicHash uint64) (off int64, ok bool) {
 	t.RLock()
 	defer t.RUnlock()
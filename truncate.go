@@ -0,0 +1,72 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"sync/atomic"
+
+	fltr "github.com/unit-io/unitdb/filter"
+)
+
+// truncate drops all messages, topics and the entries in the mem cache, and resets the sequence.
+// Contracts, retention caps and encryption policies are kept. The caller must hold the sync lock.
+func (db *DB) truncate() error {
+	// Writers and queries are held off while the DB files are reset.
+	db.internal.truncate.Lock()
+	defer db.internal.truncate.Unlock()
+	defer atomic.AddUint64(&db.internal.truncates, 1)
+	for _, mu := range db.internal.writeMutex.internal {
+		mu.Lock()
+		defer mu.Unlock()
+	}
+	for _, mu := range db.internal.mutex.internal {
+		mu.Lock()
+		defer mu.Unlock()
+	}
+
+	if err := db.internal.mem.Truncate(); err != nil {
+		return err
+	}
+	for _, fileType := range []_FileType{typeTimeWindow, typeIndex, typeData, typeFilter} {
+		f, err := db.fs.getFile(_FileDesc{fileType: fileType})
+		if err != nil {
+			return err
+		}
+		if err := f.truncate(0); err != nil {
+			return err
+		}
+	}
+	db.internal.freeList.reset()
+	if err := db.internal.freeList.write(); err != nil {
+		return err
+	}
+	db.internal.filter.filterBlock = fltr.NewSizedFilterGenerator(db.opts.filterSize())
+
+	db.internal.trie.reset()
+	db.internal.timeWindow.reset()
+	db.internal.retention.reset()
+	db.internal.dedup.reset()
+	db.internal.loaded.reset()
+	db.internal.syncHandle.syncInfo = _SyncInfo{}
+
+	atomic.StoreUint64(&db.internal.dbInfo.sequence, 0)
+	atomic.StoreUint64(&db.internal.dbInfo.count, 0)
+	if err := db.writeInfo(); err != nil {
+		return err
+	}
+	return db.fs.sync()
+}
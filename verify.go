@@ -0,0 +1,132 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import "sort"
+
+// InconsistencyKind is the kind of inconsistency found by DB.Verify.
+type InconsistencyKind uint8
+
+const (
+	// OrphanedSlot is an index slot of a message that no window entry refers to.
+	OrphanedSlot InconsistencyKind = iota + 1
+	// DanglingWindowEntry is a window entry of a message without an index slot.
+	DanglingWindowEntry
+	// DataOutOfRange is an index slot pointing outside of the data file.
+	DataOutOfRange
+	// FilterMismatch is an index slot of a message missing from the filter.
+	FilterMismatch
+	// ChecksumMismatch is a message of a DB created with checksums that does not match its checksum.
+	ChecksumMismatch
+)
+
+// Inconsistency is an inconsistency between the index, window, data and filter files found by DB.Verify.
+type Inconsistency struct {
+	Kind InconsistencyKind
+	// Seq is the sequence of the message.
+	Seq uint64
+	// TopicHash is the topic hash of the window entry, it is zero for inconsistencies found on index slots.
+	TopicHash uint64
+}
+
+// verify cross-checks window entries with index slots, and index slots with the data file and
+// the filter, and returns inconsistencies in the order of sequences. It reads the DB files without
+// changing them. The caller must hold the sync lock.
+func (db *DB) verify() ([]Inconsistency, error) {
+	winFile, err := db.fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		return nil, err
+	}
+	indexFile, err := db.fs.getFile(_FileDesc{fileType: typeIndex})
+	if err != nil {
+		return nil, err
+	}
+	dataFile, err := db.fs.getFile(_FileDesc{fileType: typeData})
+	if err != nil {
+		return nil, err
+	}
+	dataSize := dataFile.currSize()
+
+	// Read sequences of window entries of all topics.
+	windowed := make(map[uint64]uint64) // map[seq]topicHash
+	wr := _WindowReader{winFile: winFile}
+	for wIdx := int32(0); wIdx < int32(winFile.currSize()/int64(blockSize)); wIdx++ {
+		wr.offset = winBlockOffset(wIdx)
+		b, err := wr.readWindowBlock()
+		if err != nil {
+			return nil, err
+		}
+		for _, we := range b.entries[:b.entryIdx] {
+			if we.sequence != 0 {
+				windowed[we.sequence] = b.topicHash
+			}
+		}
+	}
+
+	// Check index slots and collect sequences of all slots including deleted ones.
+	var found []Inconsistency
+	slotted := make(map[uint64]struct{})
+	nBlocks := int32((indexFile.currSize() + int64(blockSize) - 1) / int64(blockSize))
+	br := _BlockReader{indexFile: indexFile}
+	for bIdx := int32(0); bIdx < nBlocks; bIdx++ {
+		br.offset = blockOffset(bIdx)
+		b, err := br.readIndexBlock()
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < int(b.entryIdx) && i < entriesPerIndexBlock; i++ {
+			e := b.entries[i]
+			if e.seq == 0 {
+				continue
+			}
+			slotted[e.seq] = struct{}{}
+			if e.msgOffset == -1 {
+				continue
+			}
+			if _, ok := windowed[e.seq]; !ok {
+				found = append(found, Inconsistency{Kind: OrphanedSlot, Seq: e.seq})
+			}
+			if e.msgOffset < 0 || e.msgOffset+int64(e.mSize()) > dataSize {
+				found = append(found, Inconsistency{Kind: DataOutOfRange, Seq: e.seq})
+			} else if db.internal.dbInfo.checksum == 1 {
+				data, err := dataFile.slice(e.msgOffset, e.msgOffset+int64(e.mSize()))
+				if err != nil {
+					return nil, err
+				}
+				if !validChecksum(data) {
+					found = append(found, Inconsistency{Kind: ChecksumMismatch, Seq: e.seq})
+				}
+			}
+			if !db.internal.filter.Test(e.seq) {
+				found = append(found, Inconsistency{Kind: FilterMismatch, Seq: e.seq})
+			}
+		}
+	}
+
+	for seq, topicHash := range windowed {
+		if _, ok := slotted[seq]; !ok {
+			found = append(found, Inconsistency{Kind: DanglingWindowEntry, Seq: seq, TopicHash: topicHash})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Seq == found[j].Seq {
+			return found[i].Kind < found[j].Kind
+		}
+		return found[i].Seq < found[j].Seq
+	})
+	return found, nil
+}
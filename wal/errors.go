@@ -0,0 +1,26 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrChecksum is returned by Reader.Read when log data does not match the checksum in the log header.
+	ErrChecksum = errors.New("wal: log checksum mismatch")
+	// ErrTruncated is returned by Reader.Read when log extends beyond the end of the log file.
+	ErrTruncated = errors.New("wal: log is truncated")
+	// ErrCorrupted is returned when a log header is invalid.
+	ErrCorrupted = errors.New("WAL is corrupted")
+)
+
+// RecoveryError reports a log skipped during recovery if the WAL is opened with Lenient option.
+type RecoveryError struct {
+	TimeID int64
+	Offset int64
+	Err    error
+}
+
+func (e RecoveryError) Error() string {
+	return fmt.Sprintf("wal: log at offset %d skipped: %v", e.Offset, e.Err)
+}
@@ -21,6 +21,9 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"time"
+
+	"github.com/unit-io/unitdb/fs"
 )
 
 type (
@@ -29,21 +32,25 @@ type (
 		size   uint32
 	}
 	_File struct {
-		*os.File
+		fs.File
+		fs         fs.FileSystem
 		segments   _Segments
 		size       int64
 		targetSize int64
 	}
 )
 
-type _Segments [3]_Segment
+// _Segments holds free segments of the log file. The first segment accumulates
+// space freed by released logs, the second segment is used for allocation and the
+// remaining segments hold free space left over from earlier allocation segments.
+type _Segments []_Segment
 
-func openFile(name string, targetSize int64) (_File, error) {
+func openFile(fsys fs.FileSystem, name string, targetSize int64) (_File, error) {
 	fileFlag := os.O_CREATE | os.O_RDWR
 	fileMode := os.FileMode(0666)
 
-	f := _File{}
-	fi, err := os.OpenFile(name, fileFlag, fileMode)
+	f := _File{fs: fsys}
+	fi, err := fsys.OpenFile(name, fileFlag, fileMode)
 	if err != nil {
 		return f, err
 	}
@@ -59,72 +66,101 @@ func openFile(name string, targetSize int64) (_File, error) {
 	return f, err
 }
 
-func newSegments() _Segments {
-	segments := _Segments{}
-	segments[0] = _Segment{offset: int64(headerSize), size: 0}
-	segments[1] = _Segment{offset: int64(headerSize), size: 0}
+func newSegments(count int, offset int64) _Segments {
+	segments := make(_Segments, count)
+	for i := range segments {
+		segments[i] = _Segment{offset: offset, size: 0}
+	}
 	return segments
 }
 
-func (sg *_Segments) currSize() uint32 {
-	return sg[1].size
+// alignSize rounds size up to a multiple of the sector size.
+func alignSize(size uint32) uint32 {
+	return (size + sectorSize - 1) &^ (sectorSize - 1)
 }
 
-func (sg *_Segments) recoveryOffset(offset int64) int64 {
-	if offset == sg[0].offset {
-		offset += int64(sg[0].size)
-	}
-	if offset == sg[1].offset {
-		offset += int64(sg[1].size)
+// currSize returns the size of largest segment available for allocation.
+func (sg _Segments) currSize() uint32 {
+	var size uint32
+	for i := 1; i < len(sg); i++ {
+		if sg[i].size > size {
+			size = sg[i].size
+		}
 	}
-	if offset == sg[2].offset {
-		offset += int64(sg[2].size)
+	return size
+}
+
+func (sg _Segments) recoveryOffset(offset int64) int64 {
+	for skipped := true; skipped; {
+		skipped = false
+		for i := range sg {
+			if sg[i].size != 0 && offset == sg[i].offset {
+				offset += int64(sg[i].size)
+				skipped = true
+			}
+		}
 	}
 	return offset
 }
 
-func (sg *_Segments) freeSize(offset int64) uint32 {
-	if offset == sg[0].offset {
-		return sg[0].size
-	}
-	if offset == sg[1].offset {
-		return sg[1].size
-	}
-	if offset == sg[2].offset {
-		return sg[2].size
+func (sg _Segments) freeSize(offset int64) uint32 {
+	for i := range sg {
+		if sg[i].size != 0 && offset == sg[i].offset {
+			return sg[i].size
+		}
 	}
 	return 0
 }
 
-func (sg *_Segments) allocate(size uint32) int64 {
-	off := sg[1].offset
-	sg[1].size -= size
-	sg[1].offset += int64(size)
-	return off
+// allocate allocates size from the allocation segment if it has enough space,
+// otherwise from the first earlier segment that fits.
+func (sg _Segments) allocate(size uint32) int64 {
+	for i := 1; i < len(sg); i++ {
+		if sg[i].size < size {
+			continue
+		}
+		off := sg[i].offset
+		sg[i].size -= size
+		sg[i].offset += int64(size)
+		return off
+	}
+	return -1
 }
 
-func (sg *_Segments) free(offset int64, size uint32) (ok bool) {
-	if sg[0].offset+int64(sg[0].size) == offset {
-		sg[0].size += size
-		return true
-	}
-	if sg[1].offset+int64(sg[1].size) == offset {
-		sg[1].size += size
-		return true
+func (sg _Segments) free(offset int64, size uint32) (ok bool) {
+	for i := range sg {
+		if sg[i].offset+int64(sg[i].size) == offset {
+			sg[i].size += size
+			return true
+		}
 	}
 	return false
 }
 
-func (sg *_Segments) swap(targetSize int64) error {
-	if sg[1].size != 0 && sg[1].offset+int64(sg[1].size) == sg[2].offset {
-		sg[1].size += sg[2].size
-		sg[2].size = 0
+func (sg _Segments) swap(targetSize int64) error {
+	// Merge earlier segments adjacent to the end of the allocation segment.
+	for merged := sg[1].size != 0; merged; {
+		merged = false
+		for i := 2; i < len(sg); i++ {
+			if sg[i].size != 0 && sg[1].offset+int64(sg[1].size) == sg[i].offset {
+				sg[1].size += sg[i].size
+				sg[i].size = 0
+				merged = true
+			}
+		}
 	}
 	if targetSize < int64(sg[0].size) {
-		sg[2].offset = sg[1].offset
-		sg[2].size = sg[1].size
-		sg[1].offset = sg[0].offset
-		sg[1].size = sg[0].size
+		// Keep the allocation segment in the first empty slot, or drop the oldest segment if all slots are used.
+		last := len(sg) - 1
+		for i := 2; i < len(sg); i++ {
+			if sg[i].size == 0 {
+				last = i
+				break
+			}
+		}
+		copy(sg[3:last+1], sg[2:last])
+		sg[2] = sg[1]
+		sg[1] = sg[0]
 		sg[0].size = 0
 		fmt.Println("wal.Swap: segments ", sg)
 	}
@@ -148,8 +184,8 @@ func (f *_File) copy(bufferSize int64) (int64, error) {
 	if err != nil || stat.Size() == int64(0) {
 		return 0, err
 	}
-	newName := fmt.Sprintf("%s.%d", f.File.Name(), f.File.Fd())
-	newFile, err := os.OpenFile(newName, os.O_CREATE|os.O_RDWR, os.FileMode(0666))
+	newName := fmt.Sprintf("%s.%d", f.File.Name(), time.Now().UnixNano())
+	newFile, err := f.fs.OpenFile(newName, os.O_CREATE|os.O_RDWR, os.FileMode(0666))
 	if err != nil {
 		return 0, err
 	}
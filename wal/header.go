@@ -61,23 +61,52 @@ func (l *_LogInfo) UnmarshalBinary(data []byte) error {
 }
 
 type _Header struct {
-	signature [7]byte
-	version   uint32
-	segments  _Segments
-	_         [2]byte
+	signature   [7]byte
+	version     uint32
+	sectorAlign bool
+	segments    _Segments
+	_           [2]byte
 }
 
-// MarshalBinary serialized header into binary data.
+// segmentsHeaderSize returns the size of the header of the file version with the given number
+// of segments. Headers from flagsVersion carry a flags byte ahead of the segments.
+func segmentsHeaderSize(version uint32, count int) uint32 {
+	if version < flagsVersion {
+		return uint32(13 + 12*count)
+	}
+	return uint32(14 + 12*count)
+}
+
+// MarshalBinary serialized header into binary data. Headers prior to
+// segmentsVersion hold exactly three segments without a segment count.
 func (h _Header) MarshalBinary() ([]byte, error) {
-	buf := make([]byte, headerSize)
+	if h.version < segmentsVersion {
+		buf := make([]byte, headerSize)
+		copy(buf[:7], h.signature[:])
+		binary.LittleEndian.PutUint32(buf[7:11], h.version)
+		for i := 0; i < 3; i++ {
+			off := 11 + 12*i
+			binary.LittleEndian.PutUint32(buf[off:off+4], h.segments[i].size)
+			binary.LittleEndian.PutUint64(buf[off+4:off+12], uint64(h.segments[i].offset))
+		}
+		return buf, nil
+	}
+	buf := make([]byte, segmentsHeaderSize(h.version, len(h.segments)))
 	copy(buf[:7], h.signature[:])
 	binary.LittleEndian.PutUint32(buf[7:11], h.version)
-	binary.LittleEndian.PutUint32(buf[11:15], h.segments[0].size)
-	binary.LittleEndian.PutUint64(buf[15:23], uint64(h.segments[0].offset))
-	binary.LittleEndian.PutUint32(buf[23:27], h.segments[1].size)
-	binary.LittleEndian.PutUint64(buf[27:35], uint64(h.segments[1].offset))
-	binary.LittleEndian.PutUint32(buf[35:39], h.segments[2].size)
-	binary.LittleEndian.PutUint64(buf[39:47], uint64(h.segments[2].offset))
+	binary.LittleEndian.PutUint16(buf[11:13], uint16(len(h.segments)))
+	start := 13
+	if h.version >= flagsVersion {
+		if h.sectorAlign {
+			buf[13] |= flagSectorAlign
+		}
+		start = 14
+	}
+	for i := range h.segments {
+		off := start + 12*i
+		binary.LittleEndian.PutUint32(buf[off:off+4], h.segments[i].size)
+		binary.LittleEndian.PutUint64(buf[off+4:off+12], uint64(h.segments[i].offset))
+	}
 	return buf, nil
 }
 
@@ -85,11 +114,29 @@ func (h _Header) MarshalBinary() ([]byte, error) {
 func (h *_Header) UnmarshalBinary(data []byte) error {
 	copy(h.signature[:], data[:7])
 	h.version = binary.LittleEndian.Uint32(data[7:11])
-	h.segments[0].size = binary.LittleEndian.Uint32(data[11:15])
-	h.segments[0].offset = int64(binary.LittleEndian.Uint64(data[15:23]))
-	h.segments[1].size = binary.LittleEndian.Uint32(data[23:27])
-	h.segments[1].offset = int64(binary.LittleEndian.Uint64(data[27:35]))
-	h.segments[2].size = binary.LittleEndian.Uint32(data[35:39])
-	h.segments[2].offset = int64(binary.LittleEndian.Uint64(data[39:47]))
+	if h.version < segmentsVersion {
+		h.segments = make(_Segments, 3)
+		for i := range h.segments {
+			off := 11 + 12*i
+			h.segments[i].size = binary.LittleEndian.Uint32(data[off : off+4])
+			h.segments[i].offset = int64(binary.LittleEndian.Uint64(data[off+4 : off+12]))
+		}
+		return nil
+	}
+	count := int(binary.LittleEndian.Uint16(data[11:13]))
+	if uint32(len(data)) < segmentsHeaderSize(h.version, count) {
+		return ErrCorrupted
+	}
+	start := 13
+	if h.version >= flagsVersion {
+		h.sectorAlign = data[13]&flagSectorAlign != 0
+		start = 14
+	}
+	h.segments = make(_Segments, count)
+	for i := range h.segments {
+		off := start + 12*i
+		h.segments[i].size = binary.LittleEndian.Uint32(data[off : off+4])
+		h.segments[i].offset = int64(binary.LittleEndian.Uint64(data[off+4 : off+12]))
+	}
 	return nil
 }
@@ -19,6 +19,7 @@ package wal
 import (
 	"encoding/binary"
 	"errors"
+	"hash/crc32"
 
 	"github.com/unit-io/bpool"
 	"github.com/unit-io/unitdb/uid"
@@ -33,6 +34,9 @@ type Reader struct {
 
 	entryCount uint32
 
+	// pred filters records before they are returned by Next.
+	pred func([]byte) bool
+
 	buffer *bpool.Buffer
 
 	wal *WAL
@@ -99,6 +103,14 @@ func (r *Reader) Read(f func(timeID int64) (bool, error)) (err error) {
 				idx++
 				continue
 			}
+			if ul.offset+int64(ul.size) > r.wal.logFile.Size() {
+				if err := r.skip(i, ErrTruncated); err != nil {
+					return err
+				}
+				offset += int64(ul.size)
+				idx++
+				continue
+			}
 			if size < int64(ul.size) {
 				size = int64(ul.size)
 				break
@@ -112,6 +124,26 @@ func (r *Reader) Read(f func(timeID int64) (bool, error)) (err error) {
 			if err != nil {
 				return err
 			}
+			if r.wal.sectorAlign && !validChecksum(data) {
+				// Skip the torn log.
+				r.wal.recoveredLogs[i].status = logStatusReleased
+				if err := r.wal.logFile.writeMarshalableAt(r.wal.recoveredLogs[i], r.wal.recoveredLogs[i].offset); err != nil {
+					return err
+				}
+				offset += int64(ul.size)
+				offset += int64(r.wal.logFile.segments.freeSize(ul.offset + int64(ul.size)))
+				idx++
+				continue
+			}
+			if ul.version >= checksumVersion && !validChecksum(data) {
+				if err := r.skip(i, ErrChecksum); err != nil {
+					return err
+				}
+				offset += int64(ul.size)
+				offset += int64(r.wal.logFile.segments.freeSize(ul.offset + int64(ul.size)))
+				idx++
+				continue
+			}
 			r.entryCount = ul.entryCount
 			r.logData = data
 			r.offset = 0
@@ -136,6 +168,52 @@ func (r *Reader) Read(f func(timeID int64) (bool, error)) (err error) {
 	return nil
 }
 
+// skip skips the recovered log at the given index if WAL is opened with Lenient
+// option, otherwise it returns the error.
+func (r *Reader) skip(i int, err error) error {
+	if !r.wal.opts.Lenient {
+		return err
+	}
+	ul := r.wal.recoveredLogs[i]
+	r.wal.recoveryErrors = append(r.wal.recoveryErrors, RecoveryError{TimeID: ul.timeID, Offset: ul.offset, Err: err})
+	r.wal.recoveredLogs[i].status = logStatusReleased
+	if ul.offset+int64(ul.size) > r.wal.logFile.Size() {
+		// Truncated log header is not updated.
+		return nil
+	}
+	return r.wal.logFile.writeMarshalableAt(r.wal.recoveredLogs[i], ul.offset)
+}
+
+// ReadFiltered reads logs same as Read but Next skips records for which pred
+// returns false, so those records are never surfaced to the caller.
+func (r *Reader) ReadFiltered(pred func([]byte) bool, f func(timeID int64) (bool, error)) error {
+	r.pred = pred
+	defer func() { r.pred = nil }()
+	return r.Read(f)
+}
+
+// validChecksum verifies checksum written at the end of the log data.
+func validChecksum(data []byte) bool {
+	if len(data) < checksumSize {
+		return false
+	}
+	n := len(data) - checksumSize
+	return binary.LittleEndian.Uint32(data[n:]) == crc32.ChecksumIEEE(data[:n])
+}
+
+// Total returns the number of entries of the logs to read.
+func (r *Reader) Total() uint32 {
+	r.wal.mu.RLock()
+	defer r.wal.mu.RUnlock()
+	var n uint32
+	for _, l := range r.wal.recoveredLogs {
+		if l.status == logStatusWritten {
+			n += l.entryCount
+		}
+	}
+	return n
+}
+
 // Count returns entry count in the current reader.
 func (r *Reader) Count() uint32 {
 	return r.entryCount
@@ -143,15 +221,18 @@ func (r *Reader) Count() uint32 {
 
 // Next returns next record from the log data iterator or false if iteration is done.
 func (r *Reader) Next() ([]byte, bool, error) {
-	if r.entryCount == 0 {
-		return nil, false, nil
-	}
-	r.entryCount--
-	logData := r.logData[r.offset:]
-	dataLen := binary.LittleEndian.Uint32(logData[0:4])
-	if uint32(len(logData)) < dataLen {
-		return nil, false, errors.New("logData error")
+	for r.entryCount > 0 {
+		r.entryCount--
+		logData := r.logData[r.offset:]
+		dataLen := binary.LittleEndian.Uint32(logData[0:4])
+		if uint32(len(logData)) < dataLen {
+			return nil, false, errors.New("logData error")
+		}
+		r.offset += int64(dataLen)
+		if r.pred != nil && !r.pred(logData[4:dataLen]) {
+			continue
+		}
+		return logData[4:dataLen], true, nil
 	}
-	r.offset += int64(dataLen)
-	return logData[4:dataLen], true, nil
+	return nil, false, nil
 }
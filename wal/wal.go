@@ -18,6 +18,7 @@ package wal
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"io"
 	"sort"
@@ -26,6 +27,7 @@ import (
 	"time"
 
 	"github.com/unit-io/bpool"
+	"github.com/unit-io/unitdb/fs"
 )
 
 // LogStatus represents the state of log, written to applied.
@@ -49,7 +51,25 @@ const (
 
 	defaultLogReleaseInterval = 15 * time.Second
 	defaultBufferSize         = 1 << 27
-	version                   = 1 // file format version
+	version                   = 4 // file format version
+
+	// checksumVersion is the log version from which the log data ends with a checksum, as a sector aligned log does.
+	checksumVersion = 2
+	// segmentsVersion is the file version from which the header carries a variable number of segments.
+	segmentsVersion = 3
+	// flagsVersion is the file version from which the header records whether logs are sector aligned.
+	flagsVersion = 4
+
+	// flagSectorAlign is set in the header flags if logs of the file are sector aligned.
+	flagSectorAlign = 1 << 0
+
+	// defaultSegmentCount is the minimum and default number of free segments.
+	defaultSegmentCount = 3
+
+	// sectorSize is the size logs are aligned to if SectorAlign option is set.
+	sectorSize = 4096
+	// checksumSize is the size of checksum written at the end of a log.
+	checksumSize = 4
 )
 
 type (
@@ -61,6 +81,16 @@ type (
 		entriesWritten  int64
 		entriesApplied  int64
 	}
+	// WALStats provides WAL size and log counts by status.
+	WALStats struct {
+		Size          int64 // Size of the log file.
+		Used          int64 // Bytes used by the header and logs.
+		Free          int64 // Bytes in free segments available for reuse.
+		RecoveredLogs int   // Logs recovered on open and not yet read.
+		WrittenLogs   int   // Logs written but not yet applied.
+		AppliedLogs   int   // Logs applied but not yet merged with free segments.
+		ReleasedLogs  int   // Recovered logs released but not yet removed.
+	}
 	// WAL write ahead logs to recover db commit failure dues to db crash or other unexpected errors.
 	WAL struct {
 		// wg is a WaitGroup that allows us to wait for the syncThread to finish to
@@ -74,11 +104,21 @@ type (
 		recoveredLogs []_LogInfo // recoveredLogs is used only for log recovery.
 		releasedLogs  _Logs      // releaseLogs are logs applied but not yet merged.
 
-		bufPool *bpool.BufferPool
-		logFile _File
+		recoveryErrors []RecoveryError // recoveryErrors are logs skipped during recovery.
+
+		bufPool     *bpool.BufferPool
+		logFile     _File
+		fileVersion uint32 // fileVersion is the format version of the log file header.
+		sectorAlign bool   // sectorAlign is set if logs of the log file are sector aligned.
 
 		opts Options
 
+		// group holds logs waiting on the group commit.
+		group _GroupCommit
+
+		// appliedC is closed and replaced each time logs are applied to wake writers waiting on pending logs.
+		appliedC chan struct{}
+
 		// close
 		closed uint32
 		closeC chan struct{}
@@ -91,6 +131,32 @@ type (
 		TargetSize int64
 		BufferSize int64
 		Reset      bool
+		// SectorAlign pads each log to a multiple of the sector size and writes it
+		// at sector aligned offset along with a checksum, so a torn write is detected
+		// on recovery and the log is skipped. It applies to new log files only, the
+		// alignment is recorded in the header and an existing log file keeps the
+		// alignment it was created with. Log files written before the alignment was
+		// recorded must be opened with the same SectorAlign option these were created with.
+		SectorAlign bool
+		// Lenient skips corrupt or truncated logs on recovery and reports them
+		// using RecoveryErrors instead of failing the recovery.
+		Lenient bool
+		// SegmentCount sets the number of free segments tracked in the log file to
+		// reuse space of released logs, the default and minimum is 3. More segments
+		// reduce log file growth under heavy churn. It applies to new log files only,
+		// an existing log file keeps the segment count it was created with.
+		SegmentCount int
+		// FileSystem sets the file system of the log file, the default is fs.OS.
+		FileSystem fs.FileSystem
+		// GroupCommitInterval enables group commit. Writers write their logs as usual but
+		// share a single header write and sync of the log file, done once the interval has
+		// passed since the first log of the group was written or once GroupCommitCount logs
+		// are waiting, whichever comes first. SignalInitWrite returns after the sync so a
+		// log is durable when it is signaled written, but it may wait up to the interval.
+		GroupCommitInterval time.Duration
+		// GroupCommitCount is the maximum number of logs to group in a commit. Zero leaves
+		// the number of logs unbounded so the group is committed on the interval only.
+		GroupCommitCount int
 	}
 )
 
@@ -99,16 +165,26 @@ func newWal(opts Options) (wal *WAL, needsRecovery bool, err error) {
 	if opts.BufferSize == 0 {
 		opts.BufferSize = defaultBufferSize
 	}
+	if opts.FileSystem == nil {
+		opts.FileSystem = fs.OS
+	}
+	if opts.SegmentCount < defaultSegmentCount {
+		opts.SegmentCount = defaultSegmentCount
+	}
+	if opts.SectorAlign && segmentsHeaderSize(version, opts.SegmentCount) > sectorSize {
+		opts.SegmentCount = int(sectorSize-segmentsHeaderSize(version, 0)) / 12
+	}
 	wal = &WAL{
 		releaseLockC: make(chan struct{}, 1),
 		logs:         make(map[int64][]_LogInfo),
 		releasedLogs: make(map[int64][]_LogInfo),
 		bufPool:      bpool.NewBufferPool(opts.BufferSize, nil),
 		opts:         opts,
+		appliedC:     make(chan struct{}),
 		// close
 		closeC: make(chan struct{}, 1),
 	}
-	wal.logFile, err = openFile(opts.Path, opts.TargetSize)
+	wal.logFile, err = openFile(opts.FileSystem, opts.Path, opts.TargetSize)
 	if err != nil {
 		return wal, false, err
 	}
@@ -118,11 +194,7 @@ func newWal(opts Options) (wal *WAL, needsRecovery bool, err error) {
 		}
 	}
 	if wal.logFile.size == 0 {
-		if _, err = wal.logFile.allocate(headerSize); err != nil {
-			return nil, false, err
-		}
-		wal.logFile.segments = newSegments()
-		if err := wal.Sync(); err != nil {
+		if err := wal.initFile(); err != nil {
 			return nil, false, err
 		}
 	} else {
@@ -142,29 +214,77 @@ func newWal(opts Options) (wal *WAL, needsRecovery bool, err error) {
 	return wal, len(wal.recoveredLogs) != 0, nil
 }
 
+// initFile reserves the header and initializes the segments of an empty log file.
+func (wal *WAL) initFile() error {
+	wal.fileVersion = version
+	wal.sectorAlign = wal.opts.SectorAlign
+	wal.logFile.segments = newSegments(wal.opts.SegmentCount, 0)
+	if _, err := wal.logFile.allocate(wal.headerSize()); err != nil {
+		return err
+	}
+	wal.logFile.segments = newSegments(wal.opts.SegmentCount, int64(wal.headerSize()))
+	return wal.Sync()
+}
+
+// headerSize returns the size reserved for the header at the start of the log file.
+func (wal *WAL) headerSize() uint32 {
+	if wal.sectorAlign {
+		return sectorSize
+	}
+	if wal.fileVersion < segmentsVersion {
+		return headerSize
+	}
+	return segmentsHeaderSize(wal.fileVersion, len(wal.logFile.segments))
+}
+
+// logSize returns the size of a log with the given data size written to the log file.
+func (wal *WAL) logSize(dataSize uint32) uint32 {
+	size := dataSize + uint32(logHeaderSize+checksumSize)
+	if wal.sectorAlign {
+		size = alignSize(size)
+	}
+	return size
+}
+
 func (wal *WAL) writeHeader() error {
 	h := _Header{
-		signature: signature,
-		version:   version,
-		segments:  wal.logFile.segments,
+		signature:   signature,
+		version:     wal.fileVersion,
+		sectorAlign: wal.sectorAlign,
+		segments:    wal.logFile.segments,
 	}
 	return wal.logFile.writeMarshalableAt(h, 0)
 }
 
 func (wal *WAL) readHeader() error {
+	// Read the header prefix to find the size of the header.
+	prefix := make([]byte, segmentsHeaderSize(segmentsVersion, 0))
+	if _, err := wal.logFile.readAt(prefix, 0); err != nil {
+		return err
+	}
+	size := headerSize
+	if v := binary.LittleEndian.Uint32(prefix[7:11]); v >= segmentsVersion {
+		size = segmentsHeaderSize(v, int(binary.LittleEndian.Uint16(prefix[11:13])))
+	}
 	h := &_Header{}
-	if err := wal.logFile.readUnmarshalableAt(h, headerSize, 0); err != nil {
+	if err := wal.logFile.readUnmarshalableAt(h, size, 0); err != nil {
 		return err
 	}
-	if !bytes.Equal(h.signature[:], signature[:]) {
-		return errors.New("WAL is corrupted")
+	if !bytes.Equal(h.signature[:], signature[:]) || len(h.segments) < defaultSegmentCount {
+		return ErrCorrupted
+	}
+	wal.fileVersion = h.version
+	// The alignment of files written before it was recorded is set by the SectorAlign option.
+	wal.sectorAlign = h.sectorAlign
+	if h.version < flagsVersion {
+		wal.sectorAlign = wal.opts.SectorAlign
 	}
 	wal.logFile.segments = h.segments
 	return nil
 }
 
 func (wal *WAL) recoverLogHeaders() error {
-	offset := int64(headerSize)
+	offset := int64(wal.headerSize())
 	l := _LogInfo{}
 	for {
 		offset = wal.logFile.segments.recoveryOffset(offset)
@@ -176,7 +296,16 @@ func (wal *WAL) recoverLogHeaders() error {
 			return err
 		}
 		if l.offset < 0 || l.status > logStatusReleased {
-			return errors.New("WAL is corrupted")
+			if wal.opts.Lenient {
+				// Logs are not recovered beyond the corrupt log header.
+				wal.recoveryErrors = append(wal.recoveryErrors, RecoveryError{TimeID: l.timeID, Offset: offset, Err: ErrCorrupted})
+				return nil
+			}
+			return ErrCorrupted
+		}
+		if wal.sectorAlign && (l.offset != offset || l.size == 0 || l.size%sectorSize != 0) {
+			// Torn log header, logs are not recovered beyond this offset.
+			return nil
 		}
 		wal.recoveredLogs = append(wal.recoveredLogs, l)
 		offset = l.offset + int64(l.size)
@@ -193,6 +322,13 @@ func (wal *WAL) recoverWal() error {
 	return wal.recoverLogHeaders()
 }
 
+// RecoveryErrors returns logs skipped during recovery if the WAL is opened with Lenient option.
+func (wal *WAL) RecoveryErrors() []RecoveryError {
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+	return append([]RecoveryError(nil), wal.recoveryErrors...)
+}
+
 func (wal *WAL) put(id int64, log _LogInfo) error {
 	log.version = version
 	wal.logCountWritten++
@@ -257,6 +393,8 @@ func (wal *WAL) SignalLogApplied(id int64) error {
 		}
 	}
 	delete(wal.logs, id)
+	close(wal.appliedC)
+	wal.appliedC = make(chan struct{})
 	if err := wal.writeHeader(); err != nil {
 		return err
 	}
@@ -264,6 +402,67 @@ func (wal *WAL) SignalLogApplied(id int64) error {
 	return err1
 }
 
+// Truncate drops all logs and resets the log file. Logs are not copied before the log file is reset.
+func (wal *WAL) Truncate() error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	wal.logs = make(map[int64][]_LogInfo)
+	wal.releasedLogs = make(map[int64][]_LogInfo)
+	wal.recoveredLogs = nil
+	close(wal.appliedC)
+	wal.appliedC = make(chan struct{})
+	if err := wal.logFile.reset(); err != nil {
+		return err
+	}
+	return wal.initFile()
+}
+
+// Pending returns the size of logs written to the log file and not yet applied.
+func (wal *WAL) Pending() int64 {
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+	return wal.pending()
+}
+
+func (wal *WAL) pending() int64 {
+	var size int64
+	for _, logs := range wal.logs {
+		for _, l := range logs {
+			if l.status == logStatusWritten {
+				size += int64(l.size)
+			}
+		}
+	}
+	return size
+}
+
+// WaitPending blocks until the size of logs not yet applied is below size. It returns false
+// if the timeout passes or the WAL is closed first. A zero timeout waits until logs are applied.
+func (wal *WAL) WaitPending(size int64, timeout time.Duration) bool {
+	var timeoutC <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutC = timer.C
+	}
+	for {
+		wal.mu.RLock()
+		pending := wal.pending()
+		appliedC := wal.appliedC
+		wal.mu.RUnlock()
+		if pending < size {
+			return true
+		}
+		select {
+		case <-appliedC:
+		case <-wal.closeC:
+			return false
+		case <-timeoutC:
+			return false
+		}
+	}
+}
+
 // Reset resets log file and log segments.
 func (wal *WAL) Reset() error {
 	wal.logs = make(map[int64][]_LogInfo)
@@ -274,16 +473,235 @@ func (wal *WAL) Reset() error {
 	if err := wal.logFile.reset(); err != nil {
 		return err
 	}
-	if _, err := wal.logFile.allocate(headerSize); err != nil {
+	return wal.initFile()
+}
+
+// Compact rewrites the log file keeping only the logs not yet applied. Live logs are
+// moved to the front of the log file and the free segments are reset. The compacted
+// log file replaces the log file once it is fully written.
+func (wal *WAL) Compact() error {
+	if err := wal.ok(); err != nil {
 		return err
 	}
-	wal.logFile.segments = newSegments()
-	if err := wal.Sync(); err != nil {
+	wal.wg.Add(1)
+	wal.mu.Lock()
+	wal.releaseLockC <- struct{}{}
+	defer func() {
+		wal.mu.Unlock()
+		<-wal.releaseLockC
+		wal.wg.Done()
+	}()
+
+	// Recovered logs are kept ahead of the other logs so Reader reads them in sequence.
+	var recovered, written []*_LogInfo
+	for i := range wal.recoveredLogs {
+		if wal.recoveredLogs[i].status == logStatusWritten {
+			recovered = append(recovered, &wal.recoveredLogs[i])
+		}
+	}
+	for _, logs := range wal.logs {
+		for i := range logs {
+			if logs[i].status == logStatusWritten {
+				written = append(written, &logs[i])
+			}
+		}
+	}
+	sort.Slice(recovered, func(i, j int) bool {
+		return recovered[i].offset < recovered[j].offset
+	})
+	sort.Slice(written, func(i, j int) bool {
+		if written[i].timeID != written[j].timeID {
+			return written[i].timeID < written[j].timeID
+		}
+		return written[i].offset < written[j].offset
+	})
+
+	path := wal.logFile.Name()
+	f, err := openFile(wal.opts.FileSystem, path+".compact", wal.logFile.targetSize)
+	if err != nil {
+		return err
+	}
+	if err := f.reset(); err != nil {
+		f.Close()
+		return err
+	}
+	// The offsets of the live logs are set once the compacted log file replaces the log file.
+	live := append(recovered, written...)
+	offsets := make([]int64, len(live))
+	offset := int64(wal.headerSize())
+	for i, l := range live {
+		buf := make([]byte, l.size)
+		if _, err := wal.logFile.readAt(buf, l.offset); err != nil {
+			f.Close()
+			return err
+		}
+		info := *l
+		info.offset = offset
+		offsets[i] = offset
+		h, err := info.MarshalBinary()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		copy(buf, h)
+		if _, err := f.WriteAt(buf, offset); err != nil {
+			f.Close()
+			return err
+		}
+		offset += int64(l.size)
+	}
+	f.size = offset
+	f.segments = newSegments(len(wal.logFile.segments), offset)
+	h := _Header{
+		signature:   signature,
+		version:     wal.fileVersion,
+		sectorAlign: wal.sectorAlign,
+		segments:    f.segments,
+	}
+	if err := f.writeMarshalableAt(h, 0); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := wal.opts.FileSystem.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	for i, l := range live {
+		l.offset = offsets[i]
+	}
+	if err := wal.logFile.Close(); err != nil {
+		return err
+	}
+	if wal.logFile, err = openFile(wal.opts.FileSystem, path, f.targetSize); err != nil {
 		return err
 	}
+	wal.logFile.segments = f.segments
+
+	// Applied logs are dropped from the compacted log file.
+	logs := make([]_LogInfo, 0, len(recovered))
+	for _, l := range recovered {
+		logs = append(logs, *l)
+	}
+	wal.recoveredLogs = logs
+	wal.releasedLogs = make(map[int64][]_LogInfo)
+
 	return nil
 }
 
+// Size returns the size of the log file.
+func (wal *WAL) Size() int64 {
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+	return wal.logFile.Size()
+}
+
+// Stats returns the WAL size and log counts by status.
+func (wal *WAL) Stats() WALStats {
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+	st := WALStats{
+		Size:          wal.logFile.Size(),
+		RecoveredLogs: len(wal.recoveredLogs),
+	}
+	for _, sg := range wal.logFile.segments {
+		st.Free += int64(sg.size)
+	}
+	st.Used = st.Size - st.Free
+	count := func(l _LogInfo) {
+		switch l.status {
+		case logStatusWritten:
+			st.WrittenLogs++
+		case logStatusApplied:
+			st.AppliedLogs++
+		case logStatusReleased:
+			st.ReleasedLogs++
+		}
+	}
+	for _, l := range wal.recoveredLogs {
+		count(l)
+	}
+	for _, logs := range wal.logs {
+		for _, l := range logs {
+			count(l)
+		}
+	}
+	for _, logs := range wal.releasedLogs {
+		for _, l := range logs {
+			count(l)
+		}
+	}
+	return st
+}
+
+// _GroupCommit holds writers waiting on the log file to be synced.
+type _GroupCommit struct {
+	mu      sync.Mutex
+	waiters []chan error
+	timer   *time.Timer
+}
+
+// commit syncs the log file after a log is written. With group commit the sync
+// is shared by all logs written while the group is waiting.
+func (wal *WAL) commit() error {
+	wal.wg.Add(1)
+	defer wal.wg.Done()
+	if wal.opts.GroupCommitInterval <= 0 {
+		wal.mu.Lock()
+		defer wal.mu.Unlock()
+		return wal.Sync()
+	}
+	done := make(chan error, 1)
+	g := &wal.group
+	g.mu.Lock()
+	g.waiters = append(g.waiters, done)
+	switch {
+	case wal.opts.GroupCommitCount > 0 && len(g.waiters) >= wal.opts.GroupCommitCount:
+		g.mu.Unlock()
+		wal.flushGroup()
+		return <-done
+	case len(g.waiters) == 1:
+		g.timer = time.AfterFunc(wal.opts.GroupCommitInterval, wal.flushGroup)
+	}
+	g.mu.Unlock()
+	return <-done
+}
+
+// flushGroup writes the header and syncs the log file once for all logs waiting
+// on the group commit.
+func (wal *WAL) flushGroup() {
+	g := &wal.group
+	g.mu.Lock()
+	waiters := g.waiters
+	g.waiters = nil
+	if g.timer != nil {
+		g.timer.Stop()
+		g.timer = nil
+	}
+	g.mu.Unlock()
+	if len(waiters) == 0 {
+		return
+	}
+	wal.mu.Lock()
+	err := wal.writeHeader()
+	wal.mu.Unlock()
+	if err == nil {
+		err = wal.logFile.Sync()
+	}
+	for _, done := range waiters {
+		done <- err
+	}
+}
+
 // Sync syncs log entries to disk.
 func (wal *WAL) Sync() error {
 	wal.writeHeader()
@@ -298,6 +716,9 @@ func (wal *WAL) Close() error {
 	}
 	close(wal.closeC)
 
+	// Commit logs waiting on the group commit.
+	wal.flushGroup()
+
 	// acquire Lock.
 	wal.releaseLockC <- struct{}{}
 
@@ -20,7 +20,13 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/unit-io/unitdb/fs"
 )
 
 var (
@@ -174,3 +180,784 @@ func TestSimple(t *testing.T) {
 	}
 
 }
+
+func TestTornWrite(t *testing.T) {
+	os.RemoveAll(dbPath)
+	if err := os.MkdirAll(dbPath, 0777); err != nil {
+		t.Fatal(err)
+	}
+	logOpts := Options{Path: dbPath + "/" + logFileName, TargetSize: 1 << 20, BufferSize: 1 << 16, SectorAlign: true}
+	wal, _, err := New(logOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(id int64, n int) {
+		logWriter, err := wal.NewWriter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			if err := <-logWriter.Append([]byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := <-logWriter.SignalInitWrite(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(1, 10)
+	write(2, 1000)
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tear the second log by zeroing its last sector.
+	f, err := os.OpenFile(logOpts.Path, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size()%sectorSize != 0 {
+		t.Fatalf("expected log file aligned to sector size; got size %d", stat.Size())
+	}
+	if _, err := f.WriteAt(make([]byte, sectorSize), stat.Size()-sectorSize); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	wal, needRecovery, err := New(logOpts)
+	if !needRecovery || err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	r, err := wal.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var timeIDs []int64
+	count := 0
+	err = r.Read(func(timeID int64) (bool, error) {
+		timeIDs = append(timeIDs, timeID)
+		for {
+			_, ok, err := r.Next()
+			if err != nil {
+				return true, err
+			}
+			if !ok {
+				break
+			}
+			count++
+		}
+		return false, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timeIDs) != 1 || timeIDs[0] != 1 || count != 10 {
+		t.Fatalf("expected only log 1 with 10 records; got logs %v with %d records", timeIDs, count)
+	}
+}
+
+func TestReadFiltered(t *testing.T) {
+	wal, _, err := newTestWal(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logWriter, err := wal.NewWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := <-logWriter.Append([]byte(fmt.Sprintf("msg.%d", i%2))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-logWriter.SignalInitWrite(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	wal, needRecovery, err := newTestWal(false)
+	if !needRecovery || err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	r, err := wal.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	err = r.ReadFiltered(func(data []byte) bool {
+		return string(data) == "msg.1"
+	}, func(timeID int64) (bool, error) {
+		for {
+			data, ok, err := r.Next()
+			if err != nil {
+				return true, err
+			}
+			if !ok {
+				break
+			}
+			if string(data) != "msg.1" {
+				t.Fatalf("unexpected record %s", data)
+			}
+			count++
+		}
+		return false, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 50 {
+		t.Fatalf("expected 50 records; got %d", count)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	wal, _, err := newTestWal(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(id int64, n int) {
+		logWriter, err := wal.NewWriter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			if err := <-logWriter.Append([]byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := <-logWriter.SignalInitWrite(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(1, 10)
+	write(2, 10)
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the last record of the second log.
+	f, err := os.OpenFile(dbPath+"/"+logFileName, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{'x'}, stat.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	wal, needRecovery, err := newTestWal(false)
+	if !needRecovery || err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	r, err := wal.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var timeIDs []int64
+	err = r.Read(func(timeID int64) (bool, error) {
+		timeIDs = append(timeIDs, timeID)
+		return false, nil
+	})
+	if err != ErrChecksum {
+		t.Fatalf("expected checksum error; got %v", err)
+	}
+	if len(timeIDs) != 1 || timeIDs[0] != 1 {
+		t.Fatalf("expected only log 1 to be read; got logs %v", timeIDs)
+	}
+}
+
+func TestLenientRecovery(t *testing.T) {
+	os.RemoveAll(dbPath)
+	if err := os.MkdirAll(dbPath, 0777); err != nil {
+		t.Fatal(err)
+	}
+	logOpts := Options{Path: dbPath + "/" + logFileName, TargetSize: 1 << 20, BufferSize: 1 << 16, Lenient: true}
+	wal, _, err := New(logOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for id := int64(1); id <= 3; id++ {
+		logWriter, err := wal.NewWriter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if err := <-logWriter.Append([]byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := <-logWriter.SignalInitWrite(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	off := wal.logs[2][0].offset + int64(logHeaderSize)
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt a record of the second log.
+	f, err := os.OpenFile(logOpts.Path, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{'x'}, off+5); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	wal, needRecovery, err := New(logOpts)
+	if !needRecovery || err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	r, err := wal.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var timeIDs []int64
+	err = r.Read(func(timeID int64) (bool, error) {
+		timeIDs = append(timeIDs, timeID)
+		return false, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timeIDs) != 2 || timeIDs[0] != 1 || timeIDs[1] != 3 {
+		t.Fatalf("expected logs 1 and 3; got logs %v", timeIDs)
+	}
+	errs := wal.RecoveryErrors()
+	if len(errs) != 1 || errs[0].TimeID != 2 || errs[0].Err != ErrChecksum {
+		t.Fatalf("expected checksum error for log 2; got %v", errs)
+	}
+}
+
+func TestSegmentCount(t *testing.T) {
+	os.RemoveAll(dbPath)
+	if err := os.MkdirAll(dbPath, 0777); err != nil {
+		t.Fatal(err)
+	}
+	logOpts := Options{Path: dbPath + "/" + logFileName, TargetSize: 1 << 8, BufferSize: 1 << 16, SegmentCount: 8}
+	wal, _, err := New(logOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for id := int64(1); id <= 50; id++ {
+		logWriter, err := wal.NewWriter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if err := <-logWriter.Append([]byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := <-logWriter.SignalInitWrite(id); err != nil {
+			t.Fatal(err)
+		}
+		if id%2 == 0 {
+			if err := wal.SignalLogApplied(id - 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	segments := append(_Segments(nil), wal.logFile.segments...)
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Segment count of an existing log file is kept.
+	logOpts.SegmentCount = 3
+	wal, needRecovery, err := New(logOpts)
+	if !needRecovery || err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	if len(wal.logFile.segments) != 8 {
+		t.Fatalf("expected 8 segments; got %d", len(wal.logFile.segments))
+	}
+	for i := range segments {
+		if wal.logFile.segments[i] != segments[i] {
+			t.Fatalf("expected segments %v; got %v", segments, wal.logFile.segments)
+		}
+	}
+
+	r, err := wal.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	err = r.Read(func(timeID int64) (bool, error) {
+		if timeID%2 != 0 {
+			t.Fatalf("unexpected applied log %d", timeID)
+		}
+		count++
+		return false, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 25 {
+		t.Fatalf("expected 25 logs; got %d", count)
+	}
+}
+
+func TestHeaderVersion(t *testing.T) {
+	segments := _Segments{{offset: 47, size: 10}, {offset: 100, size: 20}, {offset: 200, size: 30}}
+	for _, v := range []uint32{1, segmentsVersion, flagsVersion} {
+		data, err := _Header{signature: signature, version: v, sectorAlign: true, segments: segments}.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := &_Header{}
+		if err := h.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		if h.version != v || len(h.segments) != 3 || h.segments[2] != segments[2] {
+			t.Fatalf("header version %d: expected segments %v; got %v", v, segments, h.segments)
+		}
+		// the alignment is recorded from flagsVersion only.
+		if h.sectorAlign != (v >= flagsVersion) {
+			t.Fatalf("header version %d: unexpected sector align %v", v, h.sectorAlign)
+		}
+	}
+}
+
+func TestSectorAlignRecorded(t *testing.T) {
+	for _, align := range []bool{false, true} {
+		os.RemoveAll(dbPath)
+		if err := os.MkdirAll(dbPath, 0777); err != nil {
+			t.Fatal(err)
+		}
+		logOpts := Options{Path: dbPath + "/" + logFileName, TargetSize: 1 << 20, BufferSize: 1 << 16, SectorAlign: align}
+		wal, _, err := New(logOpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for id := int64(1); id <= 5; id++ {
+			logWriter, err := wal.NewWriter()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 10; i++ {
+				if err := <-logWriter.Append([]byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := <-logWriter.SignalInitWrite(id); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := wal.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// the log file is opened with the alignment it was created with.
+		logOpts.SectorAlign = !align
+		wal, needRecovery, err := New(logOpts)
+		if !needRecovery || err != nil {
+			t.Fatalf("sector align %v: expected logs to recover; got %v", align, err)
+		}
+		if wal.sectorAlign != align {
+			t.Fatalf("expected sector align %v; got %v", align, wal.sectorAlign)
+		}
+		r, err := wal.NewReader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var count int
+		err = r.Read(func(timeID int64) (bool, error) {
+			for {
+				_, ok, err := r.Next()
+				if err != nil {
+					return true, err
+				}
+				if !ok {
+					break
+				}
+				count++
+			}
+			return false, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 50 {
+			t.Fatalf("sector align %v: expected 50 entries; got %d", align, count)
+		}
+		if errs := wal.RecoveryErrors(); len(errs) != 0 {
+			t.Fatalf("expected no recovery errors; got %v", errs)
+		}
+		wal.Close()
+	}
+}
+
+func TestSegmentsSwap(t *testing.T) {
+	sg := newSegments(5, 100)
+	if !sg.free(100, 300) {
+		t.Fatal("expected free space to be added to first segment")
+	}
+	sg.swap(256)
+	if sg[1] != (_Segment{offset: 100, size: 300}) || sg[0].size != 0 {
+		t.Fatalf("unexpected segments after swap %v", sg)
+	}
+	if off := sg.allocate(100); off != 100 {
+		t.Fatalf("expected allocation at 100; got %d", off)
+	}
+	// Swap again, the remaining space of the allocation segment is kept in an earlier segment.
+	sg[1] = _Segment{offset: 1000, size: 50}
+	sg.free(1050, 300)
+	sg[0] = _Segment{offset: 2000, size: 300}
+	sg.swap(256)
+	if sg[1] != (_Segment{offset: 2000, size: 300}) || sg[2] != (_Segment{offset: 1000, size: 350}) {
+		t.Fatalf("unexpected segments after swap %v", sg)
+	}
+	if off := sg.allocate(320); off != 1000 {
+		t.Fatalf("expected allocation from earlier segment at 1000; got %d", off)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	wal, _, err := newTestWal(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sizes []int64
+	write := func(id int64) {
+		logWriter, err := wal.NewWriter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if err := <-logWriter.Append([]byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := <-logWriter.SignalInitWrite(id); err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, int64(wal.logs[id][0].size))
+	}
+	for id := int64(1); id <= 4; id++ {
+		write(id)
+	}
+	for id := int64(1); id <= 3; id++ {
+		if err := wal.SignalLogApplied(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(5)
+
+	if err := wal.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if size := int64(wal.headerSize()) + sizes[3] + sizes[4]; wal.Size() != size {
+		t.Fatalf("expected compacted log size %d; got %d", size, wal.Size())
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	wal, needRecovery, err := newTestWal(false)
+	if !needRecovery || err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	r, err := wal.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var timeIDs []int64
+	count := 0
+	err = r.Read(func(timeID int64) (bool, error) {
+		timeIDs = append(timeIDs, timeID)
+		for {
+			_, ok, err := r.Next()
+			if err != nil {
+				return true, err
+			}
+			if !ok {
+				break
+			}
+			count++
+		}
+		return false, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timeIDs) != 2 || timeIDs[0] != 4 || timeIDs[1] != 5 || count != 20 {
+		t.Fatalf("expected logs 4 and 5 with 20 records; got logs %v with %d records", timeIDs, count)
+	}
+}
+
+func TestCompactError(t *testing.T) {
+	fsys := fs.NewFaulty(fs.NewMem())
+	if err := fsys.MkdirAll(dbPath, 0777); err != nil {
+		t.Fatal(err)
+	}
+	logOpts := Options{Path: dbPath + "/" + logFileName, TargetSize: 1 << 20, BufferSize: 1 << 16, FileSystem: fsys}
+	wal, _, err := New(logOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := int64(1); id <= 4; id++ {
+		logWriter, err := wal.NewWriter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if err := <-logWriter.Append([]byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := <-logWriter.SignalInitWrite(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wal.SignalLogApplied(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fail the compaction after a live log is written to the compacted log file.
+	fsys.Match(func(name string) bool { return strings.HasSuffix(name, ".compact") })
+	fsys.FailWrite(2, nil)
+	if err := wal.Compact(); !errors.Is(err, fs.ErrInjected) {
+		t.Fatalf("expected %v; got %v", fs.ErrInjected, err)
+	}
+	fsys.Reset()
+
+	// The logs are kept at their offsets in the log file.
+	if err := wal.SignalLogApplied(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	wal, needRecovery, err := New(logOpts)
+	if !needRecovery || err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	r, err := wal.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int64
+	count := 0
+	err = r.Read(func(timeID int64) (bool, error) {
+		ids = append(ids, timeID)
+		for {
+			_, ok, err := r.Next()
+			if err != nil {
+				return true, err
+			}
+			if !ok {
+				break
+			}
+			count++
+		}
+		return false, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 || ids[0] != 3 || ids[1] != 4 || count != 20 {
+		t.Fatalf("expected logs 3 and 4 with 20 records; got logs %v with %d records", ids, count)
+	}
+}
+
+func TestStats(t *testing.T) {
+	wal, _, err := newTestWal(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	for id := int64(1); id <= 3; id++ {
+		logWriter, err := wal.NewWriter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := <-logWriter.Append([]byte(fmt.Sprintf("msg.%2d", id))); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-logWriter.SignalInitWrite(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wal.SignalLogApplied(2); err != nil {
+		t.Fatal(err)
+	}
+
+	st := wal.Stats()
+	if st.WrittenLogs != 2 || st.AppliedLogs != 1 || st.RecoveredLogs != 0 {
+		t.Fatalf("unexpected log counts %+v", st)
+	}
+	if st.Size != wal.Size() || st.Used+st.Free != st.Size {
+		t.Fatalf("unexpected sizes %+v", st)
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	os.RemoveAll(dbPath)
+	if err := os.MkdirAll(dbPath, 0777); err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Path: dbPath + "/" + logFileName, TargetSize: 1 << 8, BufferSize: 1 << 8, GroupCommitInterval: time.Second, GroupCommitCount: 8}
+	wal, _, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The group is committed once GroupCommitCount logs are written, well before the interval.
+	start := time.Now()
+	var wg sync.WaitGroup
+	errs := make(chan error, opts.GroupCommitCount)
+	for i := 0; i < opts.GroupCommitCount; i++ {
+		wg.Add(1)
+		go func(id int64) {
+			defer wg.Done()
+			logWriter, err := wal.NewWriter()
+			if err != nil {
+				errs <- err
+				return
+			}
+			if err := <-logWriter.Append([]byte(fmt.Sprintf("msg.%2d", id))); err != nil {
+				errs <- err
+				return
+			}
+			errs <- <-logWriter.SignalInitWrite(id)
+		}(int64(i + 1))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed >= opts.GroupCommitInterval {
+		t.Fatalf("expected group commit before the interval; took %v", elapsed)
+	}
+
+	// A log waiting on the group commit is committed on close.
+	logWriter, err := wal.NewWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-logWriter.Append([]byte("msg.last")); err != nil {
+		t.Fatal(err)
+	}
+	done := logWriter.SignalInitWrite(int64(opts.GroupCommitCount + 1))
+	time.Sleep(10 * time.Millisecond)
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	wal, needRecovery, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	if !needRecovery {
+		t.Fatal("expected logs to recover")
+	}
+	r, err := wal.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := r.Read(func(timeID int64) (bool, error) {
+		count++
+		return false, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if count != opts.GroupCommitCount+1 {
+		t.Fatalf("expected %d logs; got %d", opts.GroupCommitCount+1, count)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	fsys := fs.NewFaulty(fs.NewMem())
+	if err := fsys.MkdirAll(dbPath, 0777); err != nil {
+		t.Fatal(err)
+	}
+	logOpts := Options{Path: dbPath + "/" + logFileName, TargetSize: 1 << 8, BufferSize: 1 << 8, FileSystem: fsys}
+	wal, _, err := New(logOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(id int64) error {
+		logWriter, err := wal.NewWriter()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 10; i++ {
+			if err := <-logWriter.Append([]byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+				return err
+			}
+		}
+		return <-logWriter.SignalInitWrite(id)
+	}
+
+	fsys.SetFull(true)
+	if err := write(1); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("expected %v; got %v", syscall.ENOSPC, err)
+	}
+	fsys.SetFull(false)
+	if err := write(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	wal, needRecovery, err := New(logOpts)
+	if !needRecovery || err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	r, err := wal.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int64
+	if err := r.Read(func(timeID int64) (bool, error) {
+		ids = append(ids, timeID)
+		return false, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != 2 {
+		t.Fatalf("expected log 2 only; got %v", ids)
+	}
+}
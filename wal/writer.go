@@ -19,6 +19,7 @@ package wal
 import (
 	"encoding/binary"
 	"errors"
+	"hash/crc32"
 
 	"github.com/unit-io/bpool"
 	"github.com/unit-io/unitdb/uid"
@@ -97,24 +98,49 @@ func (w *Writer) Append(data []byte) <-chan error {
 // writeLog writes log by setting correct header and status.
 func (w *Writer) writeLog(id int64) error {
 	w.writeCompleted <- struct{}{}
+	defer func() {
+		<-w.writeCompleted
+	}()
+	written, err := w.write(id)
+	if !written || err != nil {
+		return err
+	}
+	if err := w.wal.commit(); err != nil {
+		return err
+	}
+	w.writeComplete = true
+	return nil
+}
+
+// write writes the log to the log file. It does not sync the log file.
+func (w *Writer) write(id int64) (bool, error) {
 	w.wal.mu.Lock()
 	w.wal.wg.Add(1)
 	defer func() {
 		w.wal.bufPool.Put(w.buffer)
 		w.wal.wg.Done()
 		w.wal.mu.Unlock()
-		<-w.writeCompleted
 	}()
 
 	if w.logSize == 0 {
-		return nil
+		return false, nil
+	}
+	dataLen := w.wal.logSize(w.logSize)
+	// Pad log to the sector boundary if SectorAlign is set and write checksum of the log data in the last bytes.
+	pad := make([]byte, dataLen-w.logSize-uint32(logHeaderSize))
+	if _, err := w.buffer.Write(pad[:len(pad)-checksumSize]); err != nil {
+		return false, err
+	}
+	binary.LittleEndian.PutUint32(pad[len(pad)-checksumSize:], crc32.ChecksumIEEE(w.buffer.Bytes()))
+	if _, err := w.buffer.Write(pad[len(pad)-checksumSize:]); err != nil {
+		return false, err
 	}
-	dataLen := w.logSize + uint32(logHeaderSize)
 	off, err := w.wal.logFile.allocate(uint32(dataLen))
-	if off < int64(headerSize) || err != nil {
-		return err
+	if off < int64(w.wal.headerSize()) || err != nil {
+		return false, err
 	}
 	h := _LogInfo{
+		version:    version,
 		status:     logStatusWritten,
 		timeID:     id,
 		entryCount: w.entryCount,
@@ -122,20 +148,15 @@ func (w *Writer) writeLog(id int64) error {
 		offset:     int64(off),
 	}
 	if err := w.wal.put(id, h); err != nil {
-		return err
+		return false, err
 	}
 	if err := w.wal.logFile.writeMarshalableAt(h, off); err != nil {
-		return err
+		return false, err
 	}
 	if _, err := w.wal.logFile.WriteAt(w.buffer.Bytes(), off+int64(logHeaderSize)); err != nil {
-		return err
-	}
-
-	if err := w.wal.Sync(); err != nil {
-		return err
+		return false, err
 	}
-	w.writeComplete = true
-	return nil
+	return true, nil
 }
 
 // SignalInitWrite will signal to the WAL that log append has